@@ -8,7 +8,7 @@ import (
 
 	"errors"
 	"fmt"
-
+	"time"
 )
 
 // ошибки - это тоже часть API
@@ -39,6 +39,11 @@ type ATM struct {
 	Id int64
 	Name string
 	Address string
+	Latitude *float64
+	Longitude *float64
+	OpensAt string
+	ClosesAt string
+	Status string
 }
 
 type Services struct {
@@ -56,6 +61,8 @@ type Client struct {
 	BalanceNumber uint64
 	PhoneNumber int64
 	PassportSeries int64
+	// сумма действующих срочных вкладов; только для выгрузки, при импорте не используется
+	Deposits uint64
 }
 
 func (receiver *QueryError) Unwrap() error {
@@ -84,7 +91,17 @@ func dbError(err error) *DbError {
 
 // TODO: INIT
 func Init(db *sql.DB) (err error) {
-	ddls := []string{managersDDL, productsDDL, salesDDL, clients, atm, managers, services, cards}
+	ddls := []string{
+		branches, managersDDL, productsDDL, salesDDL, clients, atm, managers,
+		providers, serviceCategories, services, cards, operations, spendingLimits, atmCassettes,
+		atmReplenishments, atmMaintenanceWindows, servicePayments, receipts, scheduledPayments,
+		scheduledPaymentRuns, idempotencyKeys, auditLog, auditLogNoUpdate, auditLogNoDelete,
+		clientRestrictions, outboxEvents, outboxDeliveries, webhookSubscriptions, webhookDeliveries,
+		notificationPreferences, clientDevices, fraudHistory, fraudHolds,
+		interestProducts, savingsAccounts, interestAccruals, loanProducts, loans, loanInstallments, loanPayments,
+		depositProducts, termDeposits, overdrafts,
+		feeSchedules, feeTiers, bankAccounts, feePostings,
+	}
 	for _, ddl := range ddls {
 		_, err = db.Exec(ddl)
 		if err != nil {
@@ -92,7 +109,16 @@ func Init(db *sql.DB) (err error) {
 		}
 	}
 
-	initialData := []string{managersInitialData, productsInitialData}
+	err = migrateBranches(db)
+	if err != nil {
+		return err
+	}
+	err = migrateIdempotencyKeys(db)
+	if err != nil {
+		return err
+	}
+
+	initialData := []string{branchesInitialData, managersInitialData, productsInitialData, serviceCatalogInitialData}
 	for _, datum := range initialData {
 		_, err = db.Exec(datum)
 		if err != nil {
@@ -156,10 +182,22 @@ func GetAllProducts(db *sql.DB) (products []Product, err error) {
 
 // TODO: add manager_id
 func Sale(productId int64, productQty int64, db *sql.DB) (err error) {
+	_, err = SaleWithReceipt(productId, productQty, db)
+	return err
+}
+
+// SaleWithReceipt - продажа с квитанцией для покупателя
+func SaleWithReceipt(productId int64, productQty int64, db *sql.DB) (Receipt, error) {
+	return SaleWithKey("", productId, productQty, db)
+}
+
+// SaleWithKey - продажа с ключом идемпотентности: повтор с тем же ключом
+// возвращает квитанцию первой продажи
+func SaleWithKey(idempotencyKey string, productId int64, productQty int64, db *sql.DB) (receipt Receipt, err error) {
 	// begin + commit|rollback
 	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return Receipt{}, err
 	}
 
 	// если произошла ошибка, пробуем делать rollback
@@ -172,19 +210,31 @@ func Sale(productId int64, productQty int64, db *sql.DB) (err error) {
 		err = tx.Commit()
 	}()
 
+	request := []int64{productId, productQty}
+	err = idempotent(tx, idempotencyKey, 0, idempotentSale, request, &receipt, func() error {
+		receipt, err = sale(tx, productId, productQty)
+		return err
+	})
+	if err != nil {
+		return Receipt{}, err
+	}
+	return receipt, nil
+}
+
+func sale(tx *sql.Tx, productId int64, productQty int64) (Receipt, error) {
 	var currentPrice int64
 	var currentQty int64
 
-	err = tx.QueryRow(
+	err := tx.QueryRow(
 		getProductPriceAndQtyByIdSQL,
 		productId,
 	).Scan(&currentPrice, &currentQty)
 	if err != nil {
-		return err
+		return Receipt{}, err
 	}
 
 	// TODO: желательно ещё проверить, что продаём меньше или равно
-	_, err = tx.Exec(
+	result, err := tx.Exec(
 		insertSaleSQL,
 		sql.Named("manager_id", 1),
 		sql.Named("product_id", productId),
@@ -192,10 +242,51 @@ func Sale(productId int64, productQty int64, db *sql.DB) (err error) {
 		sql.Named("qty", productQty),
 	)
 	if err != nil {
-		return err
+		return Receipt{}, err
+	}
+	saleId, err := result.LastInsertId()
+	if err != nil {
+		return Receipt{}, err
 	}
 
-	return nil
+	var productName string
+	err = tx.QueryRow(getProductNameSQL, productId).Scan(&productName)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	now := timeNow()
+	receipt := Receipt{
+		Number:      receiptNumber("SL", now, saleId),
+		Kind:        ReceiptSale,
+		CreatedAt:   time.Unix(now.Unix(), 0),
+		Payer:       "customer",
+		Payee:       "store",
+		Description: fmt.Sprintf("%s x %d", productName, productQty),
+		Amount:      currentPrice * productQty,
+	}
+	err = insertReceipt(tx, receipt)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	// продажи пока проводятся от имени менеджера 1, см. TODO у Sale
+	err = writeAudit(tx, ManagerActor(1), AuditSale, AuditEntitySale, saleId, nil, receipt)
+	if err != nil {
+		return Receipt{}, err
+	}
+	err = publishEvent(tx, EventSaleCompleted, AuditEntitySale, saleId, SaleCompleted{
+		SaleId:        saleId,
+		ProductId:     productId,
+		Qty:           productQty,
+		Amount:        receipt.Amount,
+		ReceiptNumber: receipt.Number,
+	})
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	return receipt, nil
 }
 func LoginManager(login, password string, db *sql.DB) (bool, error) {
 	var dbLogin, dbPassword string
@@ -239,9 +330,19 @@ func LoginUser(login, password string, db *sql.DB) (int64 ,bool, error) {
 		return -1,false, ErrInvalidPass
 	}
 
+	err = checkClientActive(db, dbId)
+	if err != nil {
+		return -1, false, err
+	}
+
 	return dbId ,true, nil
 }
 func AddAtm( atmName string, atmAddress string, db *sql.DB) (err error) {
+	return AddAtmAs(SystemActor, atmName, atmAddress, db)
+}
+
+// AddAtmAs - AddAtm с записью исполнителя в журнал аудита
+func AddAtmAs(actor Actor, atmName string, atmAddress string, db *sql.DB) (err error) {
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -254,7 +355,7 @@ func AddAtm( atmName string, atmAddress string, db *sql.DB) (err error) {
 		err = tx.Commit()
 	}()
 
-	_, err = tx.Exec(
+	result, err := tx.Exec(
 		insertAtmSQL,
 
 		sql.Named("name", atmName),
@@ -263,12 +364,25 @@ func AddAtm( atmName string, atmAddress string, db *sql.DB) (err error) {
 	if err != nil {
 		return err
 	}
+	atmId, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
 
-	return nil
+	err = writeAudit(tx, actor, AuditCreate, AuditEntityAtm, atmId, nil, ATM{Id: atmId, Name: atmName, Address: atmAddress})
+	if err != nil {
+		return err
+	}
+	return publishEvent(tx, EventAtmAdded, AuditEntityAtm, atmId, AtmAdded{AtmId: atmId, Name: atmName, Address: atmAddress})
 }
 
-func GetAllAtms(db *sql.DB) (atms []ATM, err error) {
-	rows, err := db.Query(listAtmsSQL)
+// GetAllAtms - банкоматы подразделения менеджера, для головного офиса - все
+func GetAllAtms(managerId int64, db *sql.DB) (atms []ATM, err error) {
+	branchId, err := managerBranch(db, managerId)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(listAtmsSQL, sql.Named("branch_id", branchId), sql.Named("now", timeNow().Unix()))
 	if err != nil {
 		return nil, queryError(listAtmsSQL, err)
 	}
@@ -280,7 +394,8 @@ func GetAllAtms(db *sql.DB) (atms []ATM, err error) {
 
 	for rows.Next() {
 		atm := ATM{}
-		err = rows.Scan(&atm.Id, &atm.Name, &atm.Address)
+		err = rows.Scan(&atm.Id, &atm.Name, &atm.Address, &atm.Latitude, &atm.Longitude,
+			&atm.OpensAt, &atm.ClosesAt, &atm.Status)
 		if err != nil {
 			return nil, dbError(err)
 		}
@@ -294,6 +409,10 @@ func GetAllAtms(db *sql.DB) (atms []ATM, err error) {
 }
 
 func AddService( serviceName string, servicePrice int64, db *sql.DB) (err error) {
+	return AddServiceAs(SystemActor, serviceName, servicePrice, db)
+}
+
+func AddServiceAs(actor Actor, serviceName string, servicePrice int64, db *sql.DB) (err error) {
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -306,7 +425,7 @@ func AddService( serviceName string, servicePrice int64, db *sql.DB) (err error)
 		err = tx.Commit()
 	}()
 
-	_, err = tx.Exec(
+	result, err := tx.Exec(
 		insertServiceSQL,
 
 		sql.Named("name", serviceName),
@@ -315,8 +434,18 @@ func AddService( serviceName string, servicePrice int64, db *sql.DB) (err error)
 	if err != nil {
 		return err
 	}
+	serviceId, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
 
-	return nil
+	err = writeAudit(tx, actor, AuditCreate, AuditEntityService, serviceId, nil,
+		Services{Id: serviceId, Name: serviceName, Price: servicePrice})
+	if err != nil {
+		return err
+	}
+	return publishEvent(tx, EventServiceAdded, AuditEntityService, serviceId,
+		ServiceAdded{ServiceId: serviceId, Name: serviceName, Price: servicePrice})
 }
 
 func GetAllServices(db *sql.DB) (services []Services, err error) {
@@ -345,34 +474,11 @@ func GetAllServices(db *sql.DB) (services []Services, err error) {
 	return services, nil
 }
 
-func AddCard( cardName string, cardBalance int64, cardUserId int64, db *sql.DB) (err error) {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-			return
-		}
-		err = tx.Commit()
-	}()
-
-	_, err = tx.Exec(
-		insertCardsSQL,
-
-		sql.Named("name", cardName),
-		sql.Named("balance", cardBalance),
-		sql.Named("user_id", cardUserId),
-	)
-	if err != nil {
-		return err
-	}
-
-	return nil
+func AddUser( userName string, userLogin string, userPassword string, userPassportSeries string, userPhoneNumber int, balance uint64, balanceNumber int64, db *sql.DB) (err error) {
+	return AddUserAs(SystemActor, userName, userLogin, userPassword, userPassportSeries, userPhoneNumber, balance, balanceNumber, db)
 }
 
-func AddUser( userName string, userLogin string, userPassword string, userPassportSeries string, userPhoneNumber int, balance uint64, balanceNumber int64, db *sql.DB) (err error) {
+func AddUserAs(actor Actor, userName string, userLogin string, userPassword string, userPassportSeries string, userPhoneNumber int, balance uint64, balanceNumber int64, db *sql.DB) (err error) {
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -385,7 +491,7 @@ func AddUser( userName string, userLogin string, userPassword string, userPasspo
 		err = tx.Commit()
 	}()
 
-	_, err = tx.Exec(
+	result, err := tx.Exec(
 		insertUserSQL,
 
 		sql.Named("name", userName),
@@ -399,16 +505,58 @@ func AddUser( userName string, userLogin string, userPassword string, userPasspo
 	if err != nil {
 		return err
 	}
+	clientId, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
 
-	return nil
+	err = writeAudit(tx, actor, AuditCreate, AuditEntityClient, clientId, nil, auditClient{
+		Name:          userName,
+		Login:         userLogin,
+		PhoneNumber:   int64(userPhoneNumber),
+		Balance:       balance,
+		BalanceNumber: uint64(balanceNumber),
+	})
+	if err != nil {
+		return err
+	}
+	return publishEvent(tx, EventClientRegistered, AuditEntityClient, clientId, ClientRegistered{
+		ClientId:      clientId,
+		Name:          userName,
+		Login:         userLogin,
+		PhoneNumber:   int64(userPhoneNumber),
+		Balance:       balance,
+		BalanceNumber: uint64(balanceNumber),
+	})
 }
 
 
 
+// UpdateBalanceClient зачисляет balance на счёт клиента; ошибочное зачисление отменяется через ReverseTransaction
 func UpdateBalanceClient(id int64, balance int64,  db *sql.DB) (err error) {
+	return UpdateBalanceClientAs(SystemActor, id, balance, db)
+}
+
+func UpdateBalanceClientAs(actor Actor, id int64, balance int64, db *sql.DB) (err error) {
+	_, err = UpdateBalanceClientWithReceipt(actor, id, balance, db)
+	return err
+}
+
+// UpdateBalanceClientWithReceipt - зачисление с квитанцией для клиента
+func UpdateBalanceClientWithReceipt(actor Actor, id int64, balance int64, db *sql.DB) (Receipt, error) {
+	return UpdateBalanceClientWithKey("", actor, id, balance, db)
+}
+
+// UpdateBalanceClientWithKey - зачисление с ключом идемпотентности: повтор с тем же ключом
+// не зачисляет деньги второй раз и возвращает квитанцию первого зачисления
+func UpdateBalanceClientWithKey(idempotencyKey string, actor Actor, id int64, balance int64, db *sql.DB) (receipt Receipt, err error) {
+	if balance <= 0 {
+		return Receipt{}, ErrInvalidAmount
+	}
+
 	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return Receipt{}, err
 	}
 	defer func() {
 		if err != nil {
@@ -417,72 +565,111 @@ func UpdateBalanceClient(id int64, balance int64,  db *sql.DB) (err error) {
 		}
 		err = tx.Commit()
 	}()
-	_, err = tx.Exec(
-		updateCardBalanceSQL,
-		sql.Named("id", id),
-		sql.Named("balance", balance),
-	)
-	if err != nil {
+
+	request := []int64{id, balance}
+	err = idempotent(tx, idempotencyKey, id, idempotentTopUpClient, request, &receipt, func() error {
+		receipt, err = updateBalanceClient(tx, actor, id, balance)
 		return err
+	})
+	if err != nil {
+		return Receipt{}, err
 	}
-
-	return nil
+	return receipt, nil
 }
 
-
-func UpdateBalanceClientForService(login string, balance int64,  db *sql.DB) (err error) {
-	tx, err := db.Begin()
+func updateBalanceClient(tx *sql.Tx, actor Actor, id int64, balance int64) (Receipt, error) {
+	err := checkActorScope(tx, actor, id)
 	if err != nil {
-		return err
+		return Receipt{}, err
 	}
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-			return
-		}
-		err = tx.Commit()
-	}()
+	before, err := getClientBalance(tx, id)
+	if err != nil {
+		return Receipt{}, err
+	}
+	operationId, err := registerCredit(tx, id, 0, OperationTopUp, balance)
+	if err != nil {
+		return Receipt{}, err
+	}
+
 	_, err = tx.Exec(
-		updateClientBalanceMinusSQL,
-		sql.Named("login", login),
+		updateCardBalanceSQL,
+		sql.Named("id", id),
 		sql.Named("balance", balance),
 	)
 	if err != nil {
-		return err
+		return Receipt{}, err
 	}
 
-	return nil
+	err = publishBalanceChanged(tx, id, balance)
+	if err != nil {
+		return Receipt{}, err
+	}
+	receipt, err := topUpReceipt(tx, id, operationId, "account top-up", balance)
+	if err != nil {
+		return Receipt{}, err
+	}
+	err = publishEvent(tx, EventTopUpCompleted, AuditEntityClient, id, TopUpCompleted{
+		OperationId:   operationId,
+		ClientId:      id,
+		Amount:        balance,
+		ReceiptNumber: receipt.Number,
+	})
+	if err != nil {
+		return Receipt{}, err
+	}
+	err = auditClientBalance(tx, actor, AuditUpdateBalance, id, before)
+	if err != nil {
+		return Receipt{}, err
+	}
+	return receipt, nil
 }
 
-
-
-
-func PayForService(id int64, balance int64,  db *sql.DB) (err error) {
-	tx, err := db.Begin()
+// topUpReceipt - квитанция о зачислении на счёт клиента
+func topUpReceipt(tx *sql.Tx, clientId int64, operationId int64, description string, amount int64) (Receipt, error) {
+	payee, err := getClientName(tx, clientId)
 	if err != nil {
-		return err
+		return Receipt{}, err
 	}
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-			return
-		}
-		err = tx.Commit()
-	}()
+	now := timeNow()
+	return insertAccountReceipt(tx, clientId, Receipt{
+		Number:      receiptNumber("TU", now, operationId),
+		Kind:        ReceiptTopUp,
+		OperationId: operationId,
+		CreatedAt:   time.Unix(now.Unix(), 0),
+		Payer:       "-",
+		Payee:       payee,
+		Description: description,
+		Amount:      amount,
+	})
+}
 
-	_, err = tx.Exec(
-		payForServices,
-		sql.Named("id", id),
-		sql.Named("price", balance),
-	)
+// transferReceipt - квитанция о переводе со счёта клиента
+func transferReceipt(tx *sql.Tx, clientId int64, operationId int64, description string, amount int64, fee int64) (Receipt, error) {
+	payer, err := getClientName(tx, clientId)
 	if err != nil {
-		return err
+		return Receipt{}, err
 	}
-
-	return nil
+	now := timeNow()
+	return insertAccountReceipt(tx, clientId, Receipt{
+		Number:      receiptNumber("TR", now, operationId),
+		Kind:        ReceiptTransfer,
+		OperationId: operationId,
+		CreatedAt:   time.Unix(now.Unix(), 0),
+		Payer:       payer,
+		Payee:       "-",
+		Description: description,
+		Amount:      amount,
+		Fee:         fee,
+	})
 }
 
-func GetBalanceList(db *sql.DB, userId int64) (listBalance []Client, err error) {
+
+// GetBalanceList - счёт клиента; менеджер подразделения видит только своих клиентов
+func GetBalanceList(db *sql.DB, managerId int64, userId int64) (listBalance []Client, err error) {
+	err = checkClientScope(db, managerId, userId)
+	if err != nil {
+		return nil, err
+	}
 	rows, err := db.Query(lisUsers, userId)
 	if err != nil {
 		return nil, queryError(lisUsers, err)
@@ -495,7 +682,7 @@ func GetBalanceList(db *sql.DB, userId int64) (listBalance []Client, err error)
 
 	for rows.Next() {
 		listAccount := Client{}
-		err = rows.Scan(&listAccount.Id, &listAccount.Name, &listAccount.BalanceNumber, &listAccount.Balance )
+		err = rows.Scan(&listAccount.Id, &listAccount.Name, &listAccount.BalanceNumber, &listAccount.Balance, &listAccount.Deposits)
 		if err != nil {
 			return nil, dbError(err)
 		}
@@ -509,9 +696,22 @@ func GetBalanceList(db *sql.DB, userId int64) (listBalance []Client, err error)
 }
 
 func TransactionBalanceNumberMinus(tranzaction Client, db *sql.DB) (err error) {
+	_, err = TransactionBalanceNumberMinusWithReceipt(tranzaction, db)
+	return err
+}
+
+// TransactionBalanceNumberMinusWithReceipt - перевод по номеру счёта с квитанцией
+func TransactionBalanceNumberMinusWithReceipt(tranzaction Client, db *sql.DB) (Receipt, error) {
+	return TransactionBalanceNumberMinusWithKey("", tranzaction, db)
+}
+
+func TransactionBalanceNumberMinusWithKey(idempotencyKey string, tranzaction Client, db *sql.DB) (receipt Receipt, err error) {
+	defer func() {
+		err = holdForReview(err, db)
+	}()
 	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return Receipt{}, err
 	}
 	defer func() {
 		if err != nil {
@@ -520,16 +720,72 @@ func TransactionBalanceNumberMinus(tranzaction Client, db *sql.DB) (err error) {
 		}
 		err = tx.Commit()
 	}()
-	_, err = tx.Exec(
-		updateTransactionWithBalanceNumberMinus,
-		sql.Named("balance_number", tranzaction.BalanceNumber),
-		sql.Named("balance", tranzaction.Balance),
-	)
+
+	clientId, err := getClientId(tx, getClientIdByBalanceNumberSQL, tranzaction.BalanceNumber)
 	if err != nil {
-		return err
+		return Receipt{}, err
 	}
+	request := []uint64{tranzaction.BalanceNumber, tranzaction.Balance}
+	err = idempotent(tx, idempotencyKey, clientId, idempotentTransferBalanceNumber, request, &receipt, func() error {
+		err = screenFraud(tx, fraudRequest{
+			Operation:     idempotentTransferBalanceNumber,
+			ClientId:      clientId,
+			Amount:        int64(tranzaction.Balance),
+			Recipient:     accountRecipient(tranzaction.BalanceNumber),
+			BalanceNumber: tranzaction.BalanceNumber,
+		})
+		if err != nil {
+			return err
+		}
+		before, err := getClientBalance(tx, clientId)
+		if err != nil {
+			return err
+		}
+		operationId, err := registerDebit(tx, clientId, 0, OperationTransfer, int64(tranzaction.Balance))
+		if err != nil {
+			return err
+		}
 
-	return nil
+		_, err = tx.Exec(
+			updateTransactionWithBalanceNumberMinus,
+			sql.Named("balance_number", tranzaction.BalanceNumber),
+			sql.Named("balance", tranzaction.Balance),
+		)
+		if err != nil {
+			return err
+		}
+		err = settleClientCards(tx, clientId)
+		if err != nil {
+			return err
+		}
+		err = publishBalanceChanged(tx, clientId, -int64(tranzaction.Balance))
+		if err != nil {
+			return err
+		}
+		fee, err := applyFee(tx, clientId, 0, OperationTransfer, operationId, int64(tranzaction.Balance), timeNow())
+		if err != nil {
+			return err
+		}
+		receipt, err = transferReceipt(tx, clientId, operationId,
+			fmt.Sprintf("transfer from account %d", tranzaction.BalanceNumber), int64(tranzaction.Balance), fee)
+		if err != nil {
+			return err
+		}
+		err = publishEvent(tx, EventTransferCompleted, AuditEntityClient, clientId, TransferCompleted{
+			OperationId:   operationId,
+			ClientId:      clientId,
+			Amount:        int64(tranzaction.Balance),
+			ReceiptNumber: receipt.Number,
+		})
+		if err != nil {
+			return err
+		}
+		return auditClientBalance(tx, ClientActor(clientId), AuditTransfer, clientId, before)
+	})
+	if err != nil {
+		return Receipt{}, err
+	}
+	return receipt, nil
 }
 
 func CheckByBalanceNumber(balanceNumber uint64, db *sql.DB)(err error)  {
@@ -540,14 +796,26 @@ func CheckByBalanceNumber(balanceNumber uint64, db *sql.DB)(err error)  {
 
 func CheckByPhoneNumber(phoneNumber int64,db *sql.DB) (err error) {
 	var id int
-	err = db.QueryRow("select id from client where phone_number=?", phoneNumber).Scan(&id)
+	err = db.QueryRow("select id from client where phone=?", phoneNumber).Scan(&id)
 	return err
 }
 
 func TransactionPlus(phoneNumber int64,balance uint64, db *sql.DB) (err error) {
+	_, err = TransactionPlusWithReceipt(phoneNumber, balance, db)
+	return err
+}
+
+// TransactionPlusWithReceipt - пополнение по номеру телефона с квитанцией
+func TransactionPlusWithReceipt(phoneNumber int64, balance uint64, db *sql.DB) (Receipt, error) {
+	return TransactionPlusWithKey("", phoneNumber, balance, db)
+}
+
+// TransactionPlusWithKey - пополнение по номеру телефона с ключом идемпотентности:
+// повтор после таймаута с тем же ключом не зачисляет деньги второй раз и возвращает квитанцию первого
+func TransactionPlusWithKey(idempotencyKey string, phoneNumber int64, balance uint64, db *sql.DB) (receipt Receipt, err error) {
 	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return Receipt{}, err
 	}
 	defer func() {
 		if err != nil {
@@ -556,22 +824,72 @@ func TransactionPlus(phoneNumber int64,balance uint64, db *sql.DB) (err error) {
 		}
 		err = tx.Commit()
 	}()
-	_, err = tx.Exec(
-		updateTransactionWithPhoneNumberPlus,
-		sql.Named("phone_number", phoneNumber),
-		sql.Named("balance", balance),
-	)
+
+	clientId, err := getClientId(tx, getClientIdByPhoneSQL, phoneNumber)
 	if err != nil {
-		return err
+		return Receipt{}, err
 	}
+	request := []interface{}{phoneNumber, balance}
+	err = idempotent(tx, idempotencyKey, clientId, idempotentTopUpPhone, request, &receipt, func() error {
+		before, err := getClientBalance(tx, clientId)
+		if err != nil {
+			return err
+		}
+		operationId, err := registerCredit(tx, clientId, 0, OperationTopUp, int64(balance))
+		if err != nil {
+			return err
+		}
 
-	return nil
+		_, err = tx.Exec(
+			updateTransactionWithPhoneNumberPlus,
+			sql.Named("phone_number", phoneNumber),
+			sql.Named("balance", balance),
+		)
+		if err != nil {
+			return err
+		}
+		err = publishBalanceChanged(tx, clientId, int64(balance))
+		if err != nil {
+			return err
+		}
+		receipt, err = topUpReceipt(tx, clientId, operationId, fmt.Sprintf("top-up by phone %d", phoneNumber), int64(balance))
+		if err != nil {
+			return err
+		}
+		err = publishEvent(tx, EventTopUpCompleted, AuditEntityClient, clientId, TopUpCompleted{
+			OperationId:   operationId,
+			ClientId:      clientId,
+			Amount:        int64(balance),
+			ReceiptNumber: receipt.Number,
+		})
+		if err != nil {
+			return err
+		}
+		return auditClientBalance(tx, SystemActor, AuditTopUp, clientId, before)
+	})
+	if err != nil {
+		return Receipt{}, err
+	}
+	return receipt, nil
 }
 
 func TransactionMinus(tranzaction Client, db *sql.DB) (err error) {
+	_, err = TransactionMinusWithReceipt(tranzaction, db)
+	return err
+}
+
+// TransactionMinusWithReceipt - перевод по номеру телефона с квитанцией
+func TransactionMinusWithReceipt(tranzaction Client, db *sql.DB) (Receipt, error) {
+	return TransactionMinusWithKey("", tranzaction, db)
+}
+
+func TransactionMinusWithKey(idempotencyKey string, tranzaction Client, db *sql.DB) (receipt Receipt, err error) {
+	defer func() {
+		err = holdForReview(err, db)
+	}()
 	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return Receipt{}, err
 	}
 	defer func() {
 		if err != nil {
@@ -581,22 +899,87 @@ func TransactionMinus(tranzaction Client, db *sql.DB) (err error) {
 		err = tx.Commit()
 	}()
 
-	_, err = tx.Exec(
-		updateTransactionWithPhoneNumberMinus,
-		sql.Named("phone_number", tranzaction.PhoneNumber),
-		sql.Named("balance", tranzaction.Balance),
-	)
+	clientId, err := getClientId(tx, getClientIdByPhoneSQL, tranzaction.PhoneNumber)
 	if err != nil {
-		return err
+		return Receipt{}, err
 	}
+	request := []interface{}{tranzaction.PhoneNumber, tranzaction.Balance}
+	err = idempotent(tx, idempotencyKey, clientId, idempotentTransferPhone, request, &receipt, func() error {
+		err = screenFraud(tx, fraudRequest{
+			Operation:   idempotentTransferPhone,
+			ClientId:    clientId,
+			Amount:      int64(tranzaction.Balance),
+			Recipient:   phoneRecipient(tranzaction.PhoneNumber),
+			PhoneNumber: tranzaction.PhoneNumber,
+		})
+		if err != nil {
+			return err
+		}
+		before, err := getClientBalance(tx, clientId)
+		if err != nil {
+			return err
+		}
+		operationId, err := registerDebit(tx, clientId, 0, OperationTransfer, int64(tranzaction.Balance))
+		if err != nil {
+			return err
+		}
 
-	return nil
+		_, err = tx.Exec(
+			updateTransactionWithPhoneNumberMinus,
+			sql.Named("phone_number", tranzaction.PhoneNumber),
+			sql.Named("balance", tranzaction.Balance),
+		)
+		if err != nil {
+			return err
+		}
+		err = settleClientCards(tx, clientId)
+		if err != nil {
+			return err
+		}
+		err = publishBalanceChanged(tx, clientId, -int64(tranzaction.Balance))
+		if err != nil {
+			return err
+		}
+		fee, err := applyFee(tx, clientId, 0, OperationTransfer, operationId, int64(tranzaction.Balance), timeNow())
+		if err != nil {
+			return err
+		}
+		receipt, err = transferReceipt(tx, clientId, operationId,
+			fmt.Sprintf("transfer by phone %d", tranzaction.PhoneNumber), int64(tranzaction.Balance), fee)
+		if err != nil {
+			return err
+		}
+		err = publishEvent(tx, EventTransferCompleted, AuditEntityClient, clientId, TransferCompleted{
+			OperationId:   operationId,
+			ClientId:      clientId,
+			Amount:        int64(tranzaction.Balance),
+			ReceiptNumber: receipt.Number,
+		})
+		if err != nil {
+			return err
+		}
+		return auditClientBalance(tx, ClientActor(clientId), AuditTransfer, clientId, before)
+	})
+	if err != nil {
+		return Receipt{}, err
+	}
+	return receipt, nil
 }
 
 func TransactionBalanceNumberPlus(balanceNumber uint64,balance uint64, db *sql.DB) (err error) {
+	_, err = TransactionBalanceNumberPlusWithReceipt(balanceNumber, balance, db)
+	return err
+}
+
+// TransactionBalanceNumberPlusWithReceipt - пополнение по номеру счёта с квитанцией
+func TransactionBalanceNumberPlusWithReceipt(balanceNumber uint64, balance uint64, db *sql.DB) (Receipt, error) {
+	return TransactionBalanceNumberPlusWithKey("", balanceNumber, balance, db)
+}
+
+func TransactionBalanceNumberPlusWithKey(idempotencyKey string, balanceNumber uint64, balance uint64, db *sql.DB) (receipt Receipt, err error) {
 	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return Receipt{}, err
 	}
 	defer func() {
 		if err != nil {
@@ -605,46 +988,93 @@ func TransactionBalanceNumberPlus(balanceNumber uint64,balance uint64, db *sql.D
 		}
 		err = tx.Commit()
 	}()
-	_, err = tx.Exec(
-		updateTransactionWithBalanceNumberPlus,
-		sql.Named("balance_number", balanceNumber),
-		sql.Named("balance", balance),
-	)
+
+	clientId, err := getClientId(tx, getClientIdByBalanceNumberSQL, balanceNumber)
 	if err != nil {
-		return err
+		return Receipt{}, err
 	}
+	request := []uint64{balanceNumber, balance}
+	err = idempotent(tx, idempotencyKey, clientId, idempotentTopUpBalanceNumber, request, &receipt, func() error {
+		before, err := getClientBalance(tx, clientId)
+		if err != nil {
+			return err
+		}
+		operationId, err := registerCredit(tx, clientId, 0, OperationTopUp, int64(balance))
+		if err != nil {
+			return err
+		}
 
-	return nil
+		_, err = tx.Exec(
+			updateTransactionWithBalanceNumberPlus,
+			sql.Named("balance_number", balanceNumber),
+			sql.Named("balance", balance),
+		)
+		if err != nil {
+			return err
+		}
+		err = publishBalanceChanged(tx, clientId, int64(balance))
+		if err != nil {
+			return err
+		}
+		receipt, err = topUpReceipt(tx, clientId, operationId, fmt.Sprintf("top-up to account %d", balanceNumber), int64(balance))
+		if err != nil {
+			return err
+		}
+		err = publishEvent(tx, EventTopUpCompleted, AuditEntityClient, clientId, TopUpCompleted{
+			OperationId:   operationId,
+			ClientId:      clientId,
+			Amount:        int64(balance),
+			ReceiptNumber: receipt.Number,
+		})
+		if err != nil {
+			return err
+		}
+		return auditClientBalance(tx, SystemActor, AuditTopUp, clientId, before)
+	})
+	if err != nil {
+		return Receipt{}, err
+	}
+	return receipt, nil
 }
 
 // export
+// менеджер подразделения выгружает только клиентов и банкоматы своего подразделения
 
-func ExportClientsToJSON(db *sql.DB) error {
-	return ExportToFile(db, getAllClientsDataSQL, "clients.json",
+func ExportClientsToJSON(managerId int64, db *sql.DB) error {
+	return exportBranchToFile(managerId, db, getAllClientsDataSQL, "clients.json",
 		mapRowToClient, json.Marshal, mapInterfaceSliceToClients)
 }
-func ExportAtmsToJSON(db *sql.DB) error {
-	return ExportToFile(db, getAllAtmDataSQL, "atms.json",
+func ExportAtmsToJSON(managerId int64, db *sql.DB) error {
+	return exportBranchToFile(managerId, db, getAllAtmDataSQL, "atms.json",
 		mapRowToAtm, json.Marshal,
 		mapInterfaceSliceToAtms)
 }
 
 //XML
 
-func ExportClientsToXML(db *sql.DB) error {
-	return ExportToFile(db, getAllClientsDataSQL, "clients.xml",
+func ExportClientsToXML(managerId int64, db *sql.DB) error {
+	return exportBranchToFile(managerId, db, getAllClientsDataSQL, "clients.xml",
 		mapRowToClient, xml.Marshal, mapInterfaceSliceToClients)
 }
-func ExportAtmsToXML(db *sql.DB) error {
-	return ExportToFile(db, getAllAtmDataSQL, "atms.xml",
+func ExportAtmsToXML(managerId int64, db *sql.DB) error {
+	return exportBranchToFile(managerId, db, getAllAtmDataSQL, "atms.xml",
 		mapRowToAtm, xml.Marshal,
 		mapInterfaceSliceToAtms)
 }
 
+func exportBranchToFile(managerId int64, db *sql.DB, getDataFromDbSQL string, filename string,
+	mapRow MapperRowTo, marshal Marshaller, mapDataSlice MapperInterfaceSliceTo) error {
+	branchId, err := managerBranch(db, managerId)
+	if err != nil {
+		return err
+	}
+	return ExportToFile(db, getDataFromDbSQL, filename, mapRow, marshal, mapDataSlice, sql.Named("branch_id", branchId))
+}
+
 func mapRowToClient(rows *sql.Rows) (interface{}, error) {
 	client := Client{}
 	err := rows.Scan(&client.Id, &client.Login, &client.Password,
-		&client.Name, &client.PhoneNumber, &client.Balance, &client.BalanceNumber, &client.PassportSeries)
+		&client.Name, &client.PhoneNumber, &client.Balance, &client.BalanceNumber, &client.PassportSeries, &client.Deposits)
 	if err != nil {
 		return nil, err
 	}
@@ -652,7 +1082,8 @@ func mapRowToClient(rows *sql.Rows) (interface{}, error) {
 }
 func mapRowToAtm(rows *sql.Rows) (interface{}, error) {
 	atm := ATM{}
-	err := rows.Scan(&atm.Id,&atm.Name, &atm.Address)
+	err := rows.Scan(&atm.Id,&atm.Name, &atm.Address, &atm.Latitude, &atm.Longitude,
+		&atm.OpensAt, &atm.ClosesAt, &atm.Status)
 	if err != nil {
 		return nil, err
 	}
@@ -678,43 +1109,55 @@ func mapInterfaceSliceToAtms(ifaces []interface{}) interface{} {
 	return atmsExport
 }
 func ImportClientsFromJSON(db *sql.DB) error {
+	return ImportClientsFromJSONAs(SystemActor, db)
+}
+func ImportClientsFromJSONAs(actor Actor, db *sql.DB) error {
 	return ImportFromFile(
 		db,
 		"clients.json",
 		func(data []byte) ([]interface{}, error) {
 			return mapBytesToClients(data, json.Unmarshal)
 		},
-		insertClientToDB,
+		insertClientToDB(actor),
 	)
 }
 func ImportAtmsFromJSON(db *sql.DB) error {
+	return ImportAtmsFromJSONAs(SystemActor, db)
+}
+func ImportAtmsFromJSONAs(actor Actor, db *sql.DB) error {
 	return ImportFromFile(
 		db,
 		"atms.json",
 		func(data []byte) ([]interface{}, error) {
 			return mapBytesToAtms(data, json.Unmarshal)
 		},
-		insertAtmToDB,
+		insertAtmToDB(actor),
 	)
 }
 func ImportClientsFromXML(db *sql.DB) error {
+	return ImportClientsFromXMLAs(SystemActor, db)
+}
+func ImportClientsFromXMLAs(actor Actor, db *sql.DB) error {
 	return ImportFromFile(
 		db,
 		"clients.xml",
 		func(data []byte) ([]interface{}, error) {
 			return mapBytesToClients(data, xml.Unmarshal)
 		},
-		insertClientToDB,
+		insertClientToDB(actor),
 	)
 }
 func ImportAtmsFromXML(db *sql.DB) error {
+	return ImportAtmsFromXMLAs(SystemActor, db)
+}
+func ImportAtmsFromXMLAs(actor Actor, db *sql.DB) error {
 	return ImportFromFile(
 		db,
 		"atms.xml",
 		func(data []byte) ([]interface{}, error) {
 			return mapBytesToAtms(data, xml.Unmarshal)
 		},
-		insertAtmToDB,
+		insertAtmToDB(actor),
 	)
 }
 func mapBytesToClients(data []byte,
@@ -731,22 +1174,63 @@ func mapBytesToClients(data []byte,
 	}
 	return ifaces, nil
 }
-func insertClientToDB(iface interface{}, db *sql.DB) error {
-	client := iface.(Client)
-	_, err := db.Exec(
-		insertClientSQL,
-		sql.Named("id", client.Id),
-		sql.Named("name", client.Name),
-		sql.Named("login", client.Login),
-		sql.Named("password", client.Password),
-		sql.Named("phone", client.PhoneNumber),
-		sql.Named("balance_number", client.BalanceNumber),
-		sql.Named("balance", client.Balance),
-	)
-	if err != nil {
-		return err
+// insertClientToDB возвращает вставку клиента для ImportFromFile; каждый добавленный
+// клиент записывается в журнал аудита от имени actor, пропущенные дубликаты - нет
+func insertClientToDB(actor Actor) func(interface{}, *sql.DB) error {
+	return func(iface interface{}, db *sql.DB) (err error) {
+		client := iface.(Client)
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				_ = tx.Rollback()
+				return
+			}
+			err = tx.Commit()
+		}()
+
+		result, err := tx.Exec(
+			insertClientSQL,
+			sql.Named("id", client.Id),
+			sql.Named("name", client.Name),
+			sql.Named("login", client.Login),
+			sql.Named("password", client.Password),
+			sql.Named("phone", client.PhoneNumber),
+			sql.Named("balance_number", client.BalanceNumber),
+			sql.Named("balance", client.Balance),
+		)
+		if err != nil {
+			return err
+		}
+		inserted, err := result.RowsAffected()
+		if err != nil || inserted == 0 {
+			return err
+		}
+		clientId, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		err = writeAudit(tx, actor, AuditImport, AuditEntityClient, clientId, nil, auditClient{
+			Name:          client.Name,
+			Login:         client.Login,
+			PhoneNumber:   client.PhoneNumber,
+			Balance:       client.Balance,
+			BalanceNumber: client.BalanceNumber,
+		})
+		if err != nil {
+			return err
+		}
+		return publishEvent(tx, EventClientRegistered, AuditEntityClient, clientId, ClientRegistered{
+			ClientId:      clientId,
+			Name:          client.Name,
+			Login:         client.Login,
+			PhoneNumber:   client.PhoneNumber,
+			Balance:       client.Balance,
+			BalanceNumber: client.BalanceNumber,
+		})
 	}
-	return nil
 }
 
 type AtmsExport struct {
@@ -767,18 +1251,48 @@ func mapBytesToAtms(data []byte,
 	}
 	return ifaces, nil
 }
-func insertAtmToDB(iface interface{}, db *sql.DB) error {
-	atm := iface.(ATM)
-	_, err := db.Exec(
-		insertAtmSQL,
-		sql.Named("id", atm.Id),
-		sql.Named("name", atm.Name),
-		sql.Named("address", atm.Address),
-	)
-	if err != nil {
-		return err
+func insertAtmToDB(actor Actor) func(interface{}, *sql.DB) error {
+	return func(iface interface{}, db *sql.DB) (err error) {
+		atm := iface.(ATM)
+		if atm.Status == "" {
+			atm.Status = AtmStatusOnline
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				_ = tx.Rollback()
+				return
+			}
+			err = tx.Commit()
+		}()
+
+		result, err := tx.Exec(
+			insertAtmFullSQL,
+			sql.Named("id", atm.Id),
+			sql.Named("name", atm.Name),
+			sql.Named("address", atm.Address),
+			sql.Named("latitude", atm.Latitude),
+			sql.Named("longitude", atm.Longitude),
+			sql.Named("opens_at", atm.OpensAt),
+			sql.Named("closes_at", atm.ClosesAt),
+			sql.Named("status", atm.Status),
+		)
+		if err != nil {
+			return err
+		}
+		atm.Id, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		err = writeAudit(tx, actor, AuditImport, AuditEntityAtm, atm.Id, nil, atm)
+		if err != nil {
+			return err
+		}
+		return publishEvent(tx, EventAtmAdded, AuditEntityAtm, atm.Id, AtmAdded{AtmId: atm.Id, Name: atm.Name, Address: atm.Address})
 	}
-	return nil
 }
 
 
@@ -792,9 +1306,10 @@ func ExportToFile(
 	filename string,
 	mapRow MapperRowTo,
 	marshal Marshaller,
-	mapDataSlice MapperInterfaceSliceTo) error {
+	mapDataSlice MapperInterfaceSliceTo,
+	args ...interface{}) error {
 
-	rows, err := db.Query(getDataFromDbSQL)
+	rows, err := db.Query(getDataFromDbSQL, args...)
 	if err != nil {
 		return err
 	}
@@ -282,24 +282,10 @@ func TestAddAtm_NoBd(t *testing.T) {
 }
 
 func TestAddAtm_HasBd(t *testing.T) {
-	db, err := sql.Open("sqlite3", ":memory:")
-	if err != nil {
-		t.Errorf("can't open db: %v", err)
-	}
-	defer func() {
-		if err := db.Close(); err != nil {
-			t.Errorf("can't close db: %v", err)
-		}
-	}()
-	_, err = db.Exec(`
-    CREATE TABLE IF NOT EXISTS atm
-  (
-    id      INTEGER PRIMARY KEY AUTOINCREMENT,
-    name    TEXT    NOT NULL UNIQUE,
-    address TEXT NOT NULL
-  );`)
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
 
-	err = AddAtm("T1", "rudaki 65", db)
+	err := AddAtm("T1", "rudaki 65", db)
 	if err != nil {
 		t.Errorf("can't execute add atm: %v", err)
 	}
@@ -316,78 +302,64 @@ func TestGetAllAtms_NoDb(t *testing.T) {
 		}
 	}()
 
-	_, err = GetAllAtms(db)
+	_, err = GetAllAtms(1, db)
 	if err == nil {
 		t.Errorf("can't get all atm: %v", err)
 	}
 }
 
 func TestGetAllAtms_HasDbError(t *testing.T) {
-	db, err := sql.Open("sqlite3", ":memory:")
-	if err != nil {
-		t.Errorf("can't open db: %v", err)
-	}
-	defer func() {
-		if err := db.Close(); err != nil {
-			t.Errorf("can't close db: %v", err)
-		}
-	}()
-
-	_, err = db.Exec(`
-    CREATE TABLE IF NOT EXISTS atm
-  (
-    id      INTEGER PRIMARY KEY AUTOINCREMENT,
-    name    TEXT    NOT NULL UNIQUE,
-    address TEXT NOT NULL
-  );`)
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
 
-	atms, err := GetAllAtms(db)
+	atms, err := GetAllAtms(1, db)
 	if err != nil {
 		t.Errorf("can't get all atm: %v", err)
 	}
 	if atms != nil {
 		t.Errorf("can't get all atm: %v", err)
 	}
+	if _, err := GetAllAtms(100, db); !errors.Is(err, ErrManagerNotFound) {
+		t.Errorf("not ErrManagerNotFound: %v", err)
+	}
 }
 
 func TestGetAllAtms_HasDb(t *testing.T) {
-	db, err := sql.Open("sqlite3", ":memory:")
-	if err != nil {
-		t.Errorf("can't open db: %v", err)
-	}
-	defer func() {
-		if err := db.Close(); err != nil {
-			t.Errorf("can't close db: %v", err)
-		}
-	}()
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
 
-	_, err = db.Exec(`
-    CREATE TABLE IF NOT EXISTS atm
-  (
-    id      INTEGER PRIMARY KEY AUTOINCREMENT,
-    name    TEXT    NOT NULL UNIQUE,
-    address TEXT NOT NULL
-  );`)
+	err := AddAtm("t1", "rudaki 43", db)
 	if err != nil {
-		t.Errorf("can't creat atm to get all atm: %v", err)
+		t.Errorf("can't get all atm, add atm: %v", err)
 	}
-
-	_, err = db.Exec(`INSERT INTO atm(name, address) VALUES ("t1","rudaki 43")`)
+	err = AddAtm("t2", "somoni 77", db)
 	if err != nil {
 		t.Errorf("can't get all atm, add atm: %v", err)
 	}
-
-	_, err = db.Exec(`INSERT INTO atm(name, address) VALUES ("t2","somoni 77")`)
+	err = AssignAtmToBranch(1, 2, 2, db)
 	if err != nil {
-		t.Errorf("can't get all atm, add atm: %v", err)
+		t.Fatalf("can't assign atm: %v", err)
 	}
-	atms, err := GetAllAtms(db)
-	if err == nil {
-		t.Errorf("can't get all atm: %v", err)
+	err = SetAtmLocation(1, 2, 38.5598, 68.7870, db)
+	if err != nil {
+		t.Fatalf("can't set atm location: %v", err)
+	}
+	err = SetAtmStatus(1, 2, AtmStatusOffline, db)
+	if err != nil {
+		t.Fatalf("can't set atm status: %v", err)
 	}
 
-	if atms != nil {
-		t.Errorf("can't get all atm: %v", err)
+	atms, err := GetAllAtms(1, db)
+	if err != nil || len(atms) != 2 || atms[0].Name != "t1" || atms[1].Address != "somoni 77" {
+		t.Fatalf("can't get all atm: %+v %v", atms, err)
+	}
+	if atms[0].Latitude != nil || atms[0].Status != AtmStatusOnline ||
+		atms[1].Latitude == nil || *atms[1].Latitude != 38.5598 || atms[1].Status != AtmStatusOffline {
+		t.Errorf("atm location or status not listed: %+v", atms)
+	}
+	atms, err = GetAllAtms(4, db)
+	if err != nil || len(atms) != 1 || atms[0].Id != 2 {
+		t.Errorf("branch manager sees other atms: %+v %v", atms, err)
 	}
 }
 
@@ -469,7 +441,7 @@ func TestGetAllServices_HasDbError(t *testing.T) {
    balance INTEGER NOT NULL 
 );`)
 
-	atms, err := GetAllAtms(db)
+	atms, err := GetAllAtms(1, db)
 	if err == nil {
 		t.Errorf("can't get all atm: %v", err)
 	}
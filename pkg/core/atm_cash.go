@@ -0,0 +1,528 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// купюры, которые принимает и выдаёт банкомат. Номиналы, как и все суммы
+// банкомата (выдача, взнос, остаток в кассетах), - в дирамах, как балансы: 500 сомони = 50000.
+var atmDenominations = []int64{50000, 20000, 10000, 5000, 2000, 1000, 500, 300, 100}
+
+// MaxAtmWithdrawal - наибольшая сумма одной выдачи наличных, в дирамах
+var MaxAtmWithdrawal int64 = 1000000
+
+var ErrAtmNotFound = errors.New("atm not found")
+var ErrManagerNotFound = errors.New("manager not found")
+var ErrAtmInsufficientCash = errors.New("not enough cash in atm")
+var ErrAtmAmountNotDispensable = errors.New("amount can't be dispensed with available notes")
+var ErrUnsupportedDenomination = errors.New("unsupported denomination")
+var ErrAtmWithdrawalTooLarge = errors.New("atm withdrawal amount too large")
+
+type AtmCassette struct {
+	AtmId        int64
+	Denomination int64
+	Count        int64
+}
+
+// Notes - количество купюр по номиналам
+type Notes map[int64]int64
+
+func (receiver Notes) Total() int64 {
+	var total int64
+	for denomination, count := range receiver {
+		total += denomination * count
+	}
+	return total
+}
+
+func GetAtmCash(atmId int64, db *sql.DB) ([]AtmCassette, error) {
+	return listAtmCassettes(db, atmId)
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func listAtmCassettes(q queryer, atmId int64) (cassettes []AtmCassette, err error) {
+	rows, err := q.Query(listAtmCassettesSQL, atmId)
+	if err != nil {
+		return nil, queryError(listAtmCassettesSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			cassettes, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		cassette := AtmCassette{}
+		err = rows.Scan(&cassette.AtmId, &cassette.Denomination, &cassette.Count)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		cassettes = append(cassettes, cassette)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return cassettes, nil
+}
+
+// ReplenishAtm - инкассация: менеджер загружает купюры в кассеты банкомата
+func ReplenishAtm(managerId int64, atmId int64, notes Notes, db *sql.DB) (err error) {
+	err = validateNotes(notes)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkAtmScope(tx, managerId, atmId)
+	if err != nil {
+		return err
+	}
+	before, err := listAtmCassettes(tx, atmId)
+	if err != nil {
+		return err
+	}
+
+	err = addAtmNotes(tx, atmId, notes)
+	if err != nil {
+		return err
+	}
+
+	now := timeNow()
+	for denomination, count := range notes {
+		_, err = tx.Exec(
+			insertAtmReplenishmentSQL,
+			sql.Named("atm_id", atmId),
+			sql.Named("manager_id", managerId),
+			sql.Named("denomination", denomination),
+			sql.Named("count", count),
+			sql.Named("created_at", now.Unix()),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	after, err := listAtmCassettes(tx, atmId)
+	if err != nil {
+		return err
+	}
+	return writeAudit(tx, ManagerActor(managerId), AuditAtmReplenish, AuditEntityAtm, atmId, before, after)
+}
+
+// CashWithdrawal - выданные банкоматом купюры и квитанция о списании с карты
+type CashWithdrawal struct {
+	Notes   Notes
+	Receipt Receipt
+}
+
+// Withdraw выдаёт наличные с карты, минимизируя количество купюр
+func Withdraw(atmId int64, cardId int64, amount int64, db *sql.DB) (Notes, error) {
+	withdrawal, err := WithdrawWithReceipt(atmId, cardId, amount, db)
+	if err != nil {
+		return nil, err
+	}
+	return withdrawal.Notes, nil
+}
+
+// WithdrawWithReceipt - выдача наличных с квитанцией для печати в банкомате
+func WithdrawWithReceipt(atmId int64, cardId int64, amount int64, db *sql.DB) (CashWithdrawal, error) {
+	return WithdrawWithKey("", atmId, cardId, amount, db)
+}
+
+// WithdrawWithKey - выдача наличных с ключом идемпотентности: повтор с тем же ключом
+// возвращает купюры и квитанцию первой выдачи и повторно не списывает
+func WithdrawWithKey(idempotencyKey string, atmId int64, cardId int64, amount int64, db *sql.DB) (withdrawal CashWithdrawal, err error) {
+	if amount <= 0 {
+		return CashWithdrawal{}, ErrInvalidAmount
+	}
+	if amount > MaxAtmWithdrawal {
+		return CashWithdrawal{}, ErrAtmWithdrawalTooLarge
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	card, err := getCard(tx, cardId)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+	request := []int64{atmId, cardId, amount}
+	err = idempotent(tx, idempotencyKey, card.UserId, idempotentAtmWithdrawal, request, &withdrawal, func() error {
+		withdrawal, err = withdraw(tx, atmId, cardId, amount)
+		return err
+	})
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+	return withdrawal, nil
+}
+
+func withdraw(tx *sql.Tx, atmId int64, cardId int64, amount int64) (CashWithdrawal, error) {
+	now := timeNow()
+	atm, err := getAtm(tx, atmId, now)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+	err = checkAtmAvailable(atm, now, false)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+	card, err := getCard(tx, cardId)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+	err = checkCardActive(card, now)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+	err = checkClientActive(tx, card.UserId)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+	cassettes, err := listAtmCassettes(tx, atmId)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+	notes, err := dispense(cassettes, amount)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+
+	err = checkSpendingLimits(tx, card.UserId, card.Id, OperationAtmWithdrawal, amount, now)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+	before, err := getClientBalance(tx, card.UserId)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+	overdraftFeeId, err := allowCardDebit(tx, card, amount)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+
+	for denomination, count := range notes {
+		_, err = tx.Exec(
+			takeAtmCassetteNotesSQL,
+			sql.Named("atm_id", atmId),
+			sql.Named("denomination", denomination),
+			sql.Named("count", count),
+		)
+		if err != nil {
+			return CashWithdrawal{}, err
+		}
+	}
+
+	err = moveCardBalance(tx, card, -amount)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+
+	var cashLeft int64
+	err = tx.QueryRow(atmCashTotalSQL, atmId).Scan(&cashLeft)
+	if err != nil {
+		return CashWithdrawal{}, queryError(atmCashTotalSQL, err)
+	}
+	if cashLeft == 0 {
+		_, err = tx.Exec(updateAtmStatusSQL, sql.Named("id", atmId), sql.Named("status", AtmStatusOutOfCash))
+		if err != nil {
+			return CashWithdrawal{}, err
+		}
+	}
+
+	operationId, err := insertOperation(tx, Operation{
+		Type:      OperationAtmWithdrawal,
+		ClientId:  card.UserId,
+		CardId:    card.Id,
+		AtmId:     atmId,
+		Amount:    amount,
+		CreatedAt: now,
+	})
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+	err = linkOverdraftFee(tx, overdraftFeeId, OperationAtmWithdrawal, operationId)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+	fee, err := applyFee(tx, card.UserId, card.Id, OperationAtmWithdrawal, operationId, amount, now)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+	payer, err := getClientName(tx, card.UserId)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+	balanceAfter := card.Balance - amount - fee
+	receipt := Receipt{
+		Number:       receiptNumber("CW", now, operationId),
+		Kind:         ReceiptCashWithdrawal,
+		OperationId:  operationId,
+		CreatedAt:    time.Unix(now.Unix(), 0),
+		Payer:        payer + ", " + card.MaskedPAN(),
+		Payee:        "ATM " + atm.Name,
+		Description:  "cash withdrawal at " + atm.Address,
+		Amount:       amount,
+		Fee:          fee,
+		BalanceAfter: &balanceAfter,
+	}
+	err = insertReceipt(tx, receipt)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+	err = auditClientBalance(tx, ClientActor(card.UserId), AuditCashWithdrawal, card.UserId, before)
+	if err != nil {
+		return CashWithdrawal{}, err
+	}
+
+	return CashWithdrawal{Notes: notes, Receipt: receipt}, nil
+}
+
+// Deposit зачисляет на карту внесённые в банкомат купюры
+func Deposit(atmId int64, cardId int64, notes Notes, db *sql.DB) error {
+	return DepositWithKey("", atmId, cardId, notes, db)
+}
+
+func DepositWithKey(idempotencyKey string, atmId int64, cardId int64, notes Notes, db *sql.DB) (err error) {
+	err = validateNotes(notes)
+	if err != nil {
+		return err
+	}
+	amount := notes.Total()
+	if amount <= 0 {
+		return ErrInvalidAmount
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	card, err := getCard(tx, cardId)
+	if err != nil {
+		return err
+	}
+	request := []interface{}{atmId, cardId, notes}
+	return idempotent(tx, idempotencyKey, card.UserId, idempotentAtmDeposit, request, nil, func() error {
+		return deposit(tx, atmId, cardId, notes, amount)
+	})
+}
+
+func deposit(tx *sql.Tx, atmId int64, cardId int64, notes Notes, amount int64) error {
+	now := timeNow()
+	atm, err := getAtm(tx, atmId, now)
+	if err != nil {
+		return err
+	}
+	err = checkAtmAvailable(atm, now, true)
+	if err != nil {
+		return err
+	}
+	card, err := getCard(tx, cardId)
+	if err != nil {
+		return err
+	}
+	err = checkCardActive(card, now)
+	if err != nil {
+		return err
+	}
+	err = checkClientActive(tx, card.UserId)
+	if err != nil {
+		return err
+	}
+	before, err := getClientBalance(tx, card.UserId)
+	if err != nil {
+		return err
+	}
+
+	err = addAtmNotes(tx, atmId, notes)
+	if err != nil {
+		return err
+	}
+	err = moveCardBalance(tx, card, amount)
+	if err != nil {
+		return err
+	}
+
+	_, err = insertOperation(tx, Operation{
+		Type:      OperationAtmDeposit,
+		ClientId:  card.UserId,
+		CardId:    card.Id,
+		AtmId:     atmId,
+		Amount:    amount,
+		CreatedAt: now,
+	})
+	if err != nil {
+		return err
+	}
+	return auditClientBalance(tx, ClientActor(card.UserId), AuditCashDeposit, card.UserId, before)
+}
+
+// addAtmNotes пополняет кассеты; банкомат без наличных снова становится online
+func addAtmNotes(tx *sql.Tx, atmId int64, notes Notes) error {
+	for denomination, count := range notes {
+		_, err := tx.Exec(
+			addAtmCassetteNotesSQL,
+			sql.Named("atm_id", atmId),
+			sql.Named("denomination", denomination),
+			sql.Named("count", count),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(backOnlineAfterCashSQL, atmId)
+	return err
+}
+
+func validateNotes(notes Notes) error {
+	if len(notes) == 0 {
+		return ErrInvalidAmount
+	}
+	for denomination, count := range notes {
+		if count <= 0 {
+			return ErrInvalidAmount
+		}
+		if !isSupportedDenomination(denomination) {
+			return ErrUnsupportedDenomination
+		}
+	}
+	return nil
+}
+
+func isSupportedDenomination(denomination int64) bool {
+	for _, supported := range atmDenominations {
+		if supported == denomination {
+			return true
+		}
+	}
+	return false
+}
+
+// dispense подбирает купюры на сумму amount с минимальным их количеством
+// с учётом остатка в кассетах (ограниченный размен, динамическое программирование).
+// Каждая кассета разбивается на пачки 1, 2, 4, ... купюр, дальше - задача о рюкзаке 0/1.
+// Таблица строится в единицах НОД номиналов кассет, а не в дирамах.
+func dispense(cassettes []AtmCassette, amount int64) (Notes, error) {
+	var cash, unit int64
+	for _, cassette := range cassettes {
+		cash += cassette.Denomination * cassette.Count
+		if cassette.Count > 0 {
+			unit = gcd(unit, cassette.Denomination)
+		}
+	}
+	if cash < amount {
+		return nil, ErrAtmInsufficientCash
+	}
+	if unit == 0 || amount%unit != 0 {
+		return nil, ErrAtmAmountNotDispensable
+	}
+	target := amount / unit
+
+	type pack struct {
+		denomination int64
+		count        int64
+	}
+	var packs []pack
+	for _, cassette := range cassettes {
+		maxUseful := amount / cassette.Denomination
+		left := cassette.Count
+		if left > maxUseful {
+			left = maxUseful
+		}
+		for size := int64(1); left > 0; size *= 2 {
+			if size > left {
+				size = left
+			}
+			packs = append(packs, pack{denomination: cassette.Denomination / unit, count: size})
+			left -= size
+		}
+	}
+
+	const unreachable = int64(-1)
+	best := make([]int64, target+1)
+	for i := range best {
+		best[i] = unreachable
+	}
+	best[0] = 0
+	taken := make([][]bool, len(packs))
+	for i, p := range packs {
+		taken[i] = make([]bool, target+1)
+		value := p.denomination * p.count
+		for sum := target; sum >= value; sum-- {
+			if best[sum-value] == unreachable {
+				continue
+			}
+			candidate := best[sum-value] + p.count
+			if best[sum] == unreachable || candidate < best[sum] {
+				best[sum] = candidate
+				taken[i][sum] = true
+			}
+		}
+	}
+	if best[target] == unreachable {
+		return nil, ErrAtmAmountNotDispensable
+	}
+
+	notes := Notes{}
+	sum := target
+	for i := len(packs) - 1; i >= 0; i-- {
+		if taken[i][sum] {
+			notes[packs[i].denomination*unit] += packs[i].count
+			sum -= packs[i].denomination * packs[i].count
+		}
+	}
+	return notes, nil
+}
+
+func gcd(a int64, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func checkExists(q queryRower, query string, id int64, notFound error) error {
+	var found int64
+	err := q.QueryRow(query, id).Scan(&found)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return notFound
+		}
+		return queryError(query, err)
+	}
+	return nil
+}
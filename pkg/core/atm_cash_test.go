@@ -0,0 +1,141 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func addTestAtm(t *testing.T, db *sql.DB) int64 {
+	err := AddAtm("T1", "rudaki 65", db)
+	if err != nil {
+		t.Fatalf("can't add atm: %v", err)
+	}
+	var id int64
+	err = db.QueryRow(`SELECT max(id) FROM atm`).Scan(&id)
+	if err != nil {
+		t.Fatalf("can't get atm id: %v", err)
+	}
+	return id
+}
+
+func TestDispense(t *testing.T) {
+	cassettes := []AtmCassette{
+		{Denomination: 10000, Count: 2},
+		{Denomination: 5000, Count: 1},
+		{Denomination: 2000, Count: 5},
+	}
+
+	notes, err := dispense(cassettes, 16000)
+	if err != nil {
+		t.Fatalf("can't dispense: %v", err)
+	}
+	// жадный алгоритм взял бы 10000 + 5000 и застрял на 1000
+	if notes[10000] != 1 || notes[2000] != 3 || notes.Total() != 16000 {
+		t.Errorf("unexpected notes: %v", notes)
+	}
+
+	notes, err = dispense(cassettes, 30000)
+	if err != nil || notes[10000] != 2 || notes[2000] != 5 {
+		t.Errorf("unexpected notes: %v, %v", notes, err)
+	}
+
+	if _, err := dispense(cassettes, 100000); !errors.Is(err, ErrAtmInsufficientCash) {
+		t.Errorf("not ErrAtmInsufficientCash: %v", err)
+	}
+	if _, err := dispense(cassettes, 3000); !errors.Is(err, ErrAtmAmountNotDispensable) {
+		t.Errorf("not ErrAtmAmountNotDispensable: %v", err)
+	}
+	if _, err := dispense(cassettes, 16050); !errors.Is(err, ErrAtmAmountNotDispensable) {
+		t.Errorf("not ErrAtmAmountNotDispensable for amount off the notes: %v", err)
+	}
+
+	// таблица строится в единицах НОД номиналов: 50000 * 100000 дирамов - это 100000 ячеек
+	notes, err = dispense([]AtmCassette{{Denomination: 50000, Count: 100000}}, 50000*100000)
+	if err != nil || notes[50000] != 100000 {
+		t.Errorf("unexpected notes: %v, %v", notes, err)
+	}
+}
+
+func TestWithdrawAndDeposit(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	card := issueTestCard(t, db, clientId, 100000)
+	atmId := addTestAtm(t, db)
+
+	if err := ReplenishAtm(100, atmId, Notes{10000: 5}, db); !errors.Is(err, ErrManagerNotFound) {
+		t.Errorf("not ErrManagerNotFound: %v", err)
+	}
+	if err := ReplenishAtm(1, atmId, Notes{100: 5, 700: 5}, db); !errors.Is(err, ErrUnsupportedDenomination) {
+		t.Errorf("not ErrUnsupportedDenomination: %v", err)
+	}
+	if err := ReplenishAtm(1, atmId, Notes{10000: 5, 2000: 5}, db); err != nil {
+		t.Fatalf("can't replenish atm: %v", err)
+	}
+
+	notes, err := Withdraw(atmId, card.Id, 34000, db)
+	if err != nil {
+		t.Fatalf("can't withdraw: %v", err)
+	}
+	if notes[10000] != 3 || notes[2000] != 2 {
+		t.Errorf("unexpected notes: %v", notes)
+	}
+	if _, err := Withdraw(atmId, card.Id, 1000, db); !errors.Is(err, ErrAtmAmountNotDispensable) {
+		t.Errorf("not ErrAtmAmountNotDispensable: %v", err)
+	}
+	if _, err := Withdraw(atmId, card.Id, 60000, db); !errors.Is(err, ErrAtmInsufficientCash) {
+		t.Errorf("not ErrAtmInsufficientCash: %v", err)
+	}
+
+	if err := Deposit(atmId, card.Id, Notes{5000: 2}, db); err != nil {
+		t.Fatalf("can't deposit: %v", err)
+	}
+
+	cash, err := GetAtmCash(atmId, db)
+	if err != nil {
+		t.Fatalf("can't get atm cash: %v", err)
+	}
+	expected := Notes{10000: 2, 5000: 2, 2000: 3}
+	for _, cassette := range cash {
+		if expected[cassette.Denomination] != cassette.Count {
+			t.Errorf("unexpected cassette: %+v", cassette)
+		}
+	}
+
+	current, _ := GetCard(card.Id, db)
+	if current.Balance != 76000 || clientBalance(t, db, clientId) != 76000 {
+		t.Errorf("unexpected balance: %d", current.Balance)
+	}
+}
+
+func TestWithdraw_Limit(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	card := issueTestCard(t, db, clientId, 100000)
+	atmId := addTestAtm(t, db)
+	if err := ReplenishAtm(1, atmId, Notes{10000: 10}, db); err != nil {
+		t.Fatalf("can't replenish atm: %v", err)
+	}
+	err := SetSpendingLimit(1, SpendingLimit{
+		Scope:         LimitScopeCard,
+		SubjectId:     card.Id,
+		OperationType: OperationAtmWithdrawal,
+		Period:        LimitPeriodDaily,
+		Amount:        20000,
+	}, db)
+	if err != nil {
+		t.Fatalf("can't set limit: %v", err)
+	}
+
+	if _, err := Withdraw(atmId, card.Id, MaxAtmWithdrawal+10000, db); !errors.Is(err, ErrAtmWithdrawalTooLarge) {
+		t.Errorf("not ErrAtmWithdrawalTooLarge: %v", err)
+	}
+	if _, err := Withdraw(atmId, card.Id, 30000, db); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("not ErrLimitExceeded: %v", err)
+	}
+	if _, err := Withdraw(atmId, card.Id, 20000, db); err != nil {
+		t.Errorf("can't withdraw within limit: %v", err)
+	}
+}
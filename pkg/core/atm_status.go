@@ -0,0 +1,347 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	AtmStatusOnline      = "online"
+	AtmStatusOffline     = "offline"
+	AtmStatusMaintenance = "maintenance"
+	AtmStatusOutOfCash   = "out_of_cash"
+)
+
+const earthRadiusKm = 6371.0
+
+var ErrInvalidAtmStatus = errors.New("invalid atm status")
+var ErrInvalidCoordinates = errors.New("invalid coordinates")
+var ErrInvalidOperatingHours = errors.New("operating hours must be HH:MM")
+var ErrInvalidMaintenanceWindow = errors.New("maintenance window must end after it starts")
+var ErrAtmUnavailable = errors.New("atm unavailable")
+
+type AtmUnavailableError struct {
+	AtmId  int64
+	Status string
+}
+
+func (receiver *AtmUnavailableError) Error() string {
+	return fmt.Sprintf("atm %d is %s", receiver.AtmId, receiver.Status)
+}
+
+func (receiver *AtmUnavailableError) Is(target error) bool {
+	return target == ErrAtmUnavailable
+}
+
+// AtmFilter - условия поиска банкоматов; пустой Statuses - любой статус
+type AtmFilter struct {
+	Statuses []string
+	OpenNow  bool
+}
+
+type AtmDistance struct {
+	ATM
+	DistanceKm float64
+}
+
+// IsOpenAt проверяет часы работы; пустые или совпадающие OpensAt и ClosesAt
+// (например, 00:00-00:00) - круглосуточно. Интервал может переходить через полночь,
+// например 22:00-06:00.
+func (receiver ATM) IsOpenAt(moment time.Time) bool {
+	if receiver.OpensAt == "" && receiver.ClosesAt == "" {
+		return true
+	}
+	opens, err := parseClock(receiver.OpensAt)
+	if err != nil {
+		return false
+	}
+	closes, err := parseClock(receiver.ClosesAt)
+	if err != nil {
+		return false
+	}
+	if opens == closes {
+		return true
+	}
+	current := moment.Hour()*60 + moment.Minute()
+	if opens < closes {
+		return current >= opens && current < closes
+	}
+	return current >= opens || current < closes
+}
+
+func GetAtm(atmId int64, db *sql.DB) (ATM, error) {
+	return getAtm(db, atmId, timeNow())
+}
+
+// getAtm возвращает банкомат со статусом с учётом текущих регламентных работ
+func getAtm(q queryRower, atmId int64, now time.Time) (atm ATM, err error) {
+	err = q.QueryRow(getAtmByIdSQL, atmId).Scan(&atm.Id, &atm.Name, &atm.Address,
+		&atm.Latitude, &atm.Longitude, &atm.OpensAt, &atm.ClosesAt, &atm.Status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ATM{}, ErrAtmNotFound
+		}
+		return ATM{}, queryError(getAtmByIdSQL, err)
+	}
+
+	var windows int
+	err = q.QueryRow(
+		atmInMaintenanceSQL,
+		sql.Named("atm_id", atmId),
+		sql.Named("now", now.Unix()),
+	).Scan(&windows)
+	if err != nil {
+		return ATM{}, queryError(atmInMaintenanceSQL, err)
+	}
+	if windows > 0 {
+		atm.Status = AtmStatusMaintenance
+	}
+
+	return atm, nil
+}
+
+func SetAtmLocation(managerId int64, atmId int64, latitude float64, longitude float64, db *sql.DB) error {
+	if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+		return ErrInvalidCoordinates
+	}
+	return updateAtm(db, managerId, atmId, updateAtmLocationSQL,
+		sql.Named("latitude", latitude),
+		sql.Named("longitude", longitude),
+	)
+}
+
+// SetAtmOperatingHours задаёт часы работы в формате HH:MM; две пустые строки
+// или одинаковое время открытия и закрытия - круглосуточно
+func SetAtmOperatingHours(managerId int64, atmId int64, opensAt string, closesAt string, db *sql.DB) error {
+	if opensAt != "" || closesAt != "" {
+		if _, err := parseClock(opensAt); err != nil {
+			return err
+		}
+		if _, err := parseClock(closesAt); err != nil {
+			return err
+		}
+	}
+	return updateAtm(db, managerId, atmId, updateAtmHoursSQL,
+		sql.Named("opens_at", opensAt),
+		sql.Named("closes_at", closesAt),
+	)
+}
+
+func SetAtmStatus(managerId int64, atmId int64, status string, db *sql.DB) error {
+	if !isValidAtmStatus(status) {
+		return ErrInvalidAtmStatus
+	}
+	return updateAtm(db, managerId, atmId, updateAtmStatusSQL, sql.Named("status", status))
+}
+
+// AtmMaintenance - окно регламентных работ банкомата
+type AtmMaintenance struct {
+	StartsAt time.Time
+	EndsAt   time.Time
+	Reason   string
+}
+
+// ScheduleAtmMaintenance - на время окна банкомат считается в статусе maintenance
+func ScheduleAtmMaintenance(managerId int64, atmId int64, startsAt time.Time, endsAt time.Time, reason string, db *sql.DB) (err error) {
+	if !endsAt.After(startsAt) {
+		return ErrInvalidMaintenanceWindow
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkAtmScope(tx, managerId, atmId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		insertAtmMaintenanceSQL,
+		sql.Named("atm_id", atmId),
+		sql.Named("starts_at", startsAt.Unix()),
+		sql.Named("ends_at", endsAt.Unix()),
+		sql.Named("reason", reason),
+	)
+	if err != nil {
+		return err
+	}
+	window := AtmMaintenance{StartsAt: startsAt, EndsAt: endsAt, Reason: reason}
+	return writeAudit(tx, ManagerActor(managerId), AuditAtmMaintenance, AuditEntityAtm, atmId, nil, window)
+}
+
+// FindNearestAtms ищет банкоматы в радиусе radiusKm от точки, ближайшие первыми
+func FindNearestAtms(latitude float64, longitude float64, radiusKm float64, limit int, filter AtmFilter, db *sql.DB) (atms []AtmDistance, err error) {
+	if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 || radiusKm < 0 {
+		return nil, ErrInvalidCoordinates
+	}
+
+	// грубый прямоугольник в SQL, точное расстояние - по формуле гаверсинусов.
+	// Круг через полюс захватывает все долготы.
+	latDelta := radiusKm / earthRadiusKm * 180 / math.Pi
+	lonDelta := 180.0
+	if cos := math.Cos(latitude * math.Pi / 180); cos > 1e-9 && math.Abs(latitude)+latDelta < 90 {
+		lonDelta = math.Min(180, latDelta/cos)
+	}
+	minLon, maxLon, wrapMinLon, wrapMaxLon := longitudeRanges(longitude, lonDelta)
+
+	now := timeNow()
+	rows, err := db.Query(
+		listAtmsInBoxSQL,
+		sql.Named("now", now.Unix()),
+		sql.Named("min_lat", latitude-latDelta),
+		sql.Named("max_lat", latitude+latDelta),
+		sql.Named("min_lon", minLon),
+		sql.Named("max_lon", maxLon),
+		sql.Named("wrap_min_lon", wrapMinLon),
+		sql.Named("wrap_max_lon", wrapMaxLon),
+	)
+	if err != nil {
+		return nil, queryError(listAtmsInBoxSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			atms, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		atm := ATM{}
+		err = rows.Scan(&atm.Id, &atm.Name, &atm.Address, &atm.Latitude, &atm.Longitude,
+			&atm.OpensAt, &atm.ClosesAt, &atm.Status)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		if !filter.matches(atm, now) {
+			continue
+		}
+		distance := haversineKm(latitude, longitude, *atm.Latitude, *atm.Longitude)
+		if distance > radiusKm {
+			continue
+		}
+		atms = append(atms, AtmDistance{ATM: atm, DistanceKm: distance})
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	sort.Slice(atms, func(i, j int) bool { return atms[i].DistanceKm < atms[j].DistanceKm })
+	if limit > 0 && len(atms) > limit {
+		atms = atms[:limit]
+	}
+
+	return atms, nil
+}
+
+// longitudeRanges - полоса долгот longitude ± delta. Если она переходит через ±180,
+// хвост переносится на другую сторону вторым отрезком, иначе второй отрезок совпадает с первым.
+func longitudeRanges(longitude float64, delta float64) (minLon, maxLon, wrapMinLon, wrapMaxLon float64) {
+	minLon, maxLon = longitude-delta, longitude+delta
+	switch {
+	case delta >= 180:
+		return -180, 180, -180, 180
+	case minLon < -180:
+		return -180, maxLon, minLon + 360, 180
+	case maxLon > 180:
+		return minLon, 180, -180, maxLon - 360
+	}
+	return minLon, maxLon, minLon, maxLon
+}
+
+func (receiver AtmFilter) matches(atm ATM, now time.Time) bool {
+	if receiver.OpenNow && !atm.IsOpenAt(now) {
+		return false
+	}
+	if len(receiver.Statuses) == 0 {
+		return true
+	}
+	for _, status := range receiver.Statuses {
+		if status == atm.Status {
+			return true
+		}
+	}
+	return false
+}
+
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLon := (lon2 - lon1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// checkAtmAvailable - банкомат должен быть online и работать в текущее время;
+// внесение наличных допускается и при статусе out_of_cash
+func checkAtmAvailable(atm ATM, now time.Time, deposit bool) error {
+	available := atm.Status == AtmStatusOnline || deposit && atm.Status == AtmStatusOutOfCash
+	if !available {
+		return &AtmUnavailableError{AtmId: atm.Id, Status: atm.Status}
+	}
+	if !atm.IsOpenAt(now) {
+		return &AtmUnavailableError{AtmId: atm.Id, Status: "closed"}
+	}
+	return nil
+}
+
+// updateAtm меняет банкомат запросом query и пишет в журнал банкомат до и после изменения;
+// менеджер подразделения меняет только банкоматы своего подразделения
+func updateAtm(db *sql.DB, managerId int64, atmId int64, query string, args ...interface{}) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkAtmScope(tx, managerId, atmId)
+	if err != nil {
+		return err
+	}
+	now := timeNow()
+	before, err := getAtm(tx, atmId, now)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(query, append(args, sql.Named("id", atmId))...)
+	if err != nil {
+		return err
+	}
+	after, err := getAtm(tx, atmId, now)
+	if err != nil {
+		return err
+	}
+	return writeAudit(tx, ManagerActor(managerId), AuditAtmUpdate, AuditEntityAtm, atmId, before, after)
+}
+
+func isValidAtmStatus(status string) bool {
+	switch status {
+	case AtmStatusOnline, AtmStatusOffline, AtmStatusMaintenance, AtmStatusOutOfCash:
+		return true
+	}
+	return false
+}
+
+func parseClock(value string) (int, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, ErrInvalidOperatingHours
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
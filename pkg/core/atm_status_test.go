@@ -0,0 +1,183 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAtm_IsOpenAt(t *testing.T) {
+	day := ATM{OpensAt: "09:00", ClosesAt: "18:00"}
+	night := ATM{OpensAt: "22:00", ClosesAt: "06:00"}
+	always := ATM{}
+	roundTheClock := ATM{OpensAt: "00:00", ClosesAt: "00:00"}
+
+	noon := time.Date(2020, 5, 10, 12, 0, 0, 0, time.UTC)
+	midnight := time.Date(2020, 5, 10, 0, 30, 0, 0, time.UTC)
+
+	if !day.IsOpenAt(noon) || day.IsOpenAt(midnight) {
+		t.Error("day atm hours not respected")
+	}
+	if night.IsOpenAt(noon) || !night.IsOpenAt(midnight) {
+		t.Error("overnight atm hours not respected")
+	}
+	if !always.IsOpenAt(midnight) {
+		t.Error("24/7 atm closed")
+	}
+	if !roundTheClock.IsOpenAt(midnight) || !roundTheClock.IsOpenAt(noon) {
+		t.Error("00:00-00:00 atm closed")
+	}
+}
+
+func TestHaversineKm(t *testing.T) {
+	// Душанбе - Худжанд, около 190 км по прямой
+	distance := haversineKm(38.5598, 68.7870, 40.2828, 69.6221)
+	if distance < 180 || distance > 210 {
+		t.Errorf("unexpected distance: %f", distance)
+	}
+}
+
+func TestFindNearestAtms(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	now := time.Date(2020, 5, 10, 20, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	near := addTestAtm(t, db)
+	far := addTestAtm(t, db)
+	closed := addTestAtm(t, db)
+	broken := addTestAtm(t, db)
+	addTestAtm(t, db) // без координат в поиск не попадает
+
+	locations := map[int64][2]float64{
+		near:   {38.5600, 68.7800},
+		far:    {38.5800, 68.8000},
+		closed: {38.5601, 68.7801},
+		broken: {38.5602, 68.7802},
+	}
+	for id, location := range locations {
+		if err := SetAtmLocation(1, id, location[0], location[1], db); err != nil {
+			t.Fatalf("can't set location: %v", err)
+		}
+	}
+	if err := SetAtmOperatingHours(1, closed, "09:00", "18:00", db); err != nil {
+		t.Fatalf("can't set hours: %v", err)
+	}
+	if err := SetAtmStatus(1, broken, AtmStatusOffline, db); err != nil {
+		t.Fatalf("can't set status: %v", err)
+	}
+
+	atms, err := FindNearestAtms(38.5598, 68.7870, 5, 10, AtmFilter{}, db)
+	if err != nil {
+		t.Fatalf("can't find atms: %v", err)
+	}
+	if len(atms) != 4 || atms[len(atms)-1].Id != far {
+		t.Errorf("unexpected atms: %+v", atms)
+	}
+
+	atms, err = FindNearestAtms(38.5598, 68.7870, 5, 10, AtmFilter{Statuses: []string{AtmStatusOnline}, OpenNow: true}, db)
+	if err != nil {
+		t.Fatalf("can't find atms: %v", err)
+	}
+	if len(atms) != 2 || atms[0].Id != near || atms[1].Id != far {
+		t.Errorf("unexpected atms: %+v", atms)
+	}
+
+	atms, err = FindNearestAtms(38.5598, 68.7870, 1, 1, AtmFilter{}, db)
+	if err != nil || len(atms) != 1 {
+		t.Errorf("unexpected atms: %+v, %v", atms, err)
+	}
+
+	if err := SetAtmOperatingHours(1, near, "9:00am", "", db); !errors.Is(err, ErrInvalidOperatingHours) {
+		t.Errorf("not ErrInvalidOperatingHours: %v", err)
+	}
+	if err := SetAtmLocation(1, near, 91, 0, db); !errors.Is(err, ErrInvalidCoordinates) {
+		t.Errorf("not ErrInvalidCoordinates: %v", err)
+	}
+	if err := SetAtmStatus(1, 100, AtmStatusOnline, db); !errors.Is(err, ErrAtmNotFound) {
+		t.Errorf("not ErrAtmNotFound: %v", err)
+	}
+
+	err = AssignAtmToBranch(1, near, 2, db)
+	if err != nil {
+		t.Fatalf("can't assign atm: %v", err)
+	}
+	if err := SetAtmStatus(2, near, AtmStatusOffline, db); !errors.Is(err, ErrOutsideBranch) {
+		t.Errorf("not ErrOutsideBranch: %v", err)
+	}
+	if err := SetAtmOperatingHours(2, near, "00:00", "00:00", db); !errors.Is(err, ErrOutsideBranch) {
+		t.Errorf("not ErrOutsideBranch: %v", err)
+	}
+	if err := ScheduleAtmMaintenance(2, near, timeNow(), timeNow().Add(time.Hour), "", db); !errors.Is(err, ErrOutsideBranch) {
+		t.Errorf("not ErrOutsideBranch: %v", err)
+	}
+	if err := SetAtmOperatingHours(4, near, "00:00", "00:00", db); err != nil {
+		t.Errorf("can't set hours: %v", err)
+	}
+}
+
+func TestFindNearestAtms_Antimeridian(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	east := addTestAtm(t, db)
+	west := addTestAtm(t, db)
+	if err := SetAtmLocation(1, east, -17.75, 179.95, db); err != nil {
+		t.Fatalf("can't set location: %v", err)
+	}
+	if err := SetAtmLocation(1, west, -17.75, -179.95, db); err != nil {
+		t.Fatalf("can't set location: %v", err)
+	}
+
+	// банкоматы в 5 км друг от друга по разные стороны от 180-го меридиана
+	atms, err := FindNearestAtms(-17.75, 179.98, 10, 10, AtmFilter{}, db)
+	if err != nil || len(atms) != 2 || atms[0].Id != east || atms[1].Id != west {
+		t.Errorf("unexpected atms: %+v, %v", atms, err)
+	}
+	atms, err = FindNearestAtms(-17.75, -179.98, 10, 10, AtmFilter{}, db)
+	if err != nil || len(atms) != 2 || atms[0].Id != west || atms[1].Id != east {
+		t.Errorf("unexpected atms: %+v, %v", atms, err)
+	}
+}
+
+func TestAtmMaintenanceAndCashStatus(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	card := issueTestCard(t, db, clientId, 100000)
+	atmId := addTestAtm(t, db)
+	if err := ReplenishAtm(1, atmId, Notes{10000: 2}, db); err != nil {
+		t.Fatalf("can't replenish atm: %v", err)
+	}
+
+	now := time.Now()
+	err := ScheduleAtmMaintenance(1, atmId, now.Add(-time.Hour), now.Add(time.Hour), "cassette change", db)
+	if err != nil {
+		t.Fatalf("can't schedule maintenance: %v", err)
+	}
+	atm, err := GetAtm(atmId, db)
+	if err != nil || atm.Status != AtmStatusMaintenance {
+		t.Errorf("atm not in maintenance: %+v, %v", atm, err)
+	}
+	if _, err := Withdraw(atmId, card.Id, 10000, db); !errors.Is(err, ErrAtmUnavailable) {
+		t.Errorf("not ErrAtmUnavailable: %v", err)
+	}
+
+	timeNow = func() time.Time { return now.Add(2 * time.Hour) }
+	defer func() { timeNow = time.Now }()
+
+	if _, err := Withdraw(atmId, card.Id, 20000, db); err != nil {
+		t.Fatalf("can't withdraw: %v", err)
+	}
+	atm, _ = GetAtm(atmId, db)
+	if atm.Status != AtmStatusOutOfCash {
+		t.Errorf("empty atm not out of cash: %s", atm.Status)
+	}
+	if err := Deposit(atmId, card.Id, Notes{5000: 1}, db); err != nil {
+		t.Errorf("can't deposit to out of cash atm: %v", err)
+	}
+	atm, _ = GetAtm(atmId, db)
+	if atm.Status != AtmStatusOnline {
+		t.Errorf("atm not back online after cash: %s", atm.Status)
+	}
+}
@@ -0,0 +1,279 @@
+package core
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	ActorSystem  = "system"
+	ActorManager = "manager"
+	ActorClient  = "client"
+)
+
+// действия в журнале аудита
+const (
+	AuditCreate           = "create"
+	AuditImport           = "import"
+	AuditUpdateBalance    = "update_balance"
+	AuditTopUp            = "top_up"
+	AuditTransfer         = "transfer"
+	AuditSale             = "sale"
+	AuditReverse          = "reverse"
+	AuditUpdateProfile    = "update_profile"
+	AuditKycStatus        = "kyc_status"
+	AuditFreeze           = "freeze"
+	AuditUnfreeze         = "unfreeze"
+	AuditBan              = "ban"
+	AuditUnban            = "unban"
+	AuditFraudReview      = "fraud_review"
+	AuditInterest         = "interest"
+	AuditLoanReview       = "loan_review"
+	AuditLoanDisbursement = "loan_disbursement"
+	AuditLoanRepayment    = "loan_repayment"
+	AuditDepositOpen      = "deposit_open"
+	AuditDepositPayout    = "deposit_payout"
+	AuditDepositRollover  = "deposit_rollover"
+	AuditOverdraft        = "overdraft"
+	AuditSegment          = "segment"
+	AuditBranch           = "branch"
+	AuditPinReset         = "pin_reset"
+	AuditPinChange        = "pin_change"
+	AuditCardBlock        = "card_block"
+	AuditCardUnblock      = "card_unblock"
+	AuditCardReissue      = "card_reissue"
+	AuditServicePayment   = "service_payment"
+	AuditCashWithdrawal   = "cash_withdrawal"
+	AuditCashDeposit      = "cash_deposit"
+	AuditAtmReplenish     = "atm_replenish"
+	AuditAtmUpdate        = "atm_update"
+	AuditAtmMaintenance   = "atm_maintenance"
+	AuditSpendingLimit    = "spending_limit"
+	AuditFeeSchedule      = "fee_schedule"
+)
+
+// сущности в журнале аудита
+const (
+	AuditEntityAtm       = "atm"
+	AuditEntityService   = "service"
+	AuditEntityClient    = "client"
+	AuditEntitySale      = "sale"
+	AuditEntityOperation = "operation"
+	AuditEntityFraudHold = "fraud_hold"
+	AuditEntityLoan      = "loan"
+	AuditEntityDeposit   = "deposit"
+	AuditEntityBranch    = "branch"
+	AuditEntityManager   = "manager"
+	AuditEntityCard      = "card"
+	AuditEntityFee       = "fee_schedule"
+)
+
+var ErrAuditLogTampered = errors.New("audit log tampered")
+
+// Actor - кто выполнил действие. Функции без явного исполнителя (фоновые задачи,
+// старые вызовы без As) пишут в журнал SystemActor.
+type Actor struct {
+	Type string
+	Id   int64
+}
+
+var SystemActor = Actor{Type: ActorSystem}
+
+func ManagerActor(managerId int64) Actor {
+	return Actor{Type: ActorManager, Id: managerId}
+}
+
+func ClientActor(clientId int64) Actor {
+	return Actor{Type: ActorClient, Id: clientId}
+}
+
+// AuditEntry - запись журнала аудита. Before и After - JSON состояния сущности
+// до и после действия (пустая строка - состояния нет). Каждая запись содержит хеш
+// предыдущей, поэтому изменение или удаление записи обнаруживается VerifyAuditLog.
+type AuditEntry struct {
+	Id        int64
+	Actor     Actor
+	Action    string
+	Entity    string
+	EntityId  int64
+	Before    string
+	After     string
+	CreatedAt time.Time
+	PrevHash  string
+	Hash      string
+}
+
+// AuditFilter - условия выборки журнала; нулевые поля не ограничивают, To не включается
+type AuditFilter struct {
+	ActorType string
+	ActorId   int64
+	Entity    string
+	EntityId  int64
+	From      time.Time
+	To        time.Time
+}
+
+type AuditTamperedError struct {
+	EntryId int64
+}
+
+func (receiver *AuditTamperedError) Error() string {
+	return fmt.Sprintf("audit log tampered at entry %d", receiver.EntryId)
+}
+
+func (receiver *AuditTamperedError) Is(target error) bool {
+	return target == ErrAuditLogTampered
+}
+
+// writeAudit добавляет запись в журнал в транзакции изменения: не записался журнал - нет и изменения
+func writeAudit(tx *sql.Tx, actor Actor, action string, entity string, entityId int64, before interface{}, after interface{}) error {
+	entry := AuditEntry{
+		Actor:     actor,
+		Action:    action,
+		Entity:    entity,
+		EntityId:  entityId,
+		CreatedAt: time.Unix(timeNow().Unix(), 0),
+	}
+	var err error
+	entry.Before, err = auditValue(before)
+	if err != nil {
+		return err
+	}
+	entry.After, err = auditValue(after)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(getLastAuditHashSQL).Scan(&entry.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return queryError(getLastAuditHashSQL, err)
+	}
+	entry.Hash = auditHash(entry)
+
+	_, err = tx.Exec(
+		insertAuditEntrySQL,
+		sql.Named("actor_type", entry.Actor.Type),
+		sql.Named("actor_id", entry.Actor.Id),
+		sql.Named("action", entry.Action),
+		sql.Named("entity", entry.Entity),
+		sql.Named("entity_id", entry.EntityId),
+		sql.Named("before", entry.Before),
+		sql.Named("after", entry.After),
+		sql.Named("created_at", entry.CreatedAt.Unix()),
+		sql.Named("prev_hash", entry.PrevHash),
+		sql.Named("hash", entry.Hash),
+	)
+	return err
+}
+
+func auditValue(value interface{}) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+func auditHash(entry AuditEntry) string {
+	data := fmt.Sprintf("%s|%d|%q|%d|%q|%q|%d|%q|%q", entry.PrevHash, entry.CreatedAt.Unix(),
+		entry.Actor.Type, entry.Actor.Id, entry.Action, entry.Entity, entry.EntityId, entry.Before, entry.After)
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// auditClient - данные клиента для журнала, без пароля и паспорта
+type auditClient struct {
+	Name          string
+	Login         string
+	PhoneNumber   int64
+	Balance       uint64
+	BalanceNumber uint64
+}
+
+type auditBalance struct {
+	Balance int64
+}
+
+// auditClientBalance пишет в журнал изменение баланса клиента: before - баланс до изменения,
+// текущий баланс берётся как состояние после
+func auditClientBalance(tx *sql.Tx, actor Actor, action string, clientId int64, before int64) error {
+	after, err := getClientBalance(tx, clientId)
+	if err != nil {
+		return err
+	}
+	return writeAudit(tx, actor, action, AuditEntityClient, clientId, auditBalance{before}, auditBalance{after})
+}
+
+func GetAuditLog(filter AuditFilter, db *sql.DB) ([]AuditEntry, error) {
+	return listAuditEntries(
+		db,
+		listAuditEntriesSQL,
+		sql.Named("actor_type", filter.ActorType),
+		sql.Named("actor_id", filter.ActorId),
+		sql.Named("entity", filter.Entity),
+		sql.Named("entity_id", filter.EntityId),
+		sql.Named("from", unixOrZero(filter.From)),
+		sql.Named("to", unixOrZero(filter.To)),
+	)
+}
+
+// VerifyAuditLog пересчитывает цепочку хешей и возвращает AuditTamperedError
+// с первой записью, которая была изменена или перед которой удалены записи
+func VerifyAuditLog(db *sql.DB) error {
+	entries, err := listAuditEntries(db, listAllAuditEntriesSQL)
+	if err != nil {
+		return err
+	}
+	prevHash := ""
+	for _, entry := range entries {
+		if entry.PrevHash != prevHash || auditHash(entry) != entry.Hash {
+			return &AuditTamperedError{EntryId: entry.Id}
+		}
+		prevHash = entry.Hash
+	}
+	return nil
+}
+
+func listAuditEntries(db *sql.DB, query string, args ...interface{}) (entries []AuditEntry, err error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, queryError(query, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			entries, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		entry := AuditEntry{}
+		var createdAt int64
+		err = rows.Scan(&entry.Id, &entry.Actor.Type, &entry.Actor.Id, &entry.Action, &entry.Entity,
+			&entry.EntityId, &entry.Before, &entry.After, &createdAt, &entry.PrevHash, &entry.Hash)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		entry.CreatedAt = time.Unix(createdAt, 0)
+		entries = append(entries, entry)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return entries, nil
+}
+
+func unixOrZero(moment time.Time) int64 {
+	if moment.IsZero() {
+		return 0
+	}
+	return moment.Unix()
+}
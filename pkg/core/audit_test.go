@@ -0,0 +1,165 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAuditLog_RecordsActorsAndValues(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 100, 1001)
+	err := AssignManagerToBranch(1, 3, 0, db)
+	if err != nil {
+		t.Fatalf("can't move manager to head office: %v", err)
+	}
+
+	err = AddAtmAs(ManagerActor(2), "T1", "rudaki 65", db)
+	if err != nil {
+		t.Fatalf("can't add atm: %v", err)
+	}
+	err = UpdateBalanceClientAs(ManagerActor(3), clientId, 50, db)
+	if err != nil {
+		t.Fatalf("can't update balance: %v", err)
+	}
+	err = TransactionMinus(Client{PhoneNumber: 921111111, Balance: 30}, db)
+	if err != nil {
+		t.Fatalf("can't transfer: %v", err)
+	}
+
+	entries, err := GetAuditLog(AuditFilter{ActorType: ActorManager, ActorId: 3}, db)
+	if err != nil {
+		t.Fatalf("can't get audit log: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("unexpected manager entries: %+v", entries)
+	}
+	entry := entries[0]
+	if entry.Action != AuditUpdateBalance || entry.Entity != AuditEntityClient || entry.EntityId != clientId ||
+		entry.Before != `{"Balance":100}` || entry.After != `{"Balance":150}` {
+		t.Errorf("unexpected balance entry: %+v", entry)
+	}
+
+	entries, err = GetAuditLog(AuditFilter{Entity: AuditEntityClient, EntityId: clientId}, db)
+	if err != nil {
+		t.Fatalf("can't get audit log: %v", err)
+	}
+	// создание клиента, зачисление и перевод
+	if len(entries) != 3 || entries[2].Actor != ClientActor(clientId) || entries[2].After != `{"Balance":120}` {
+		t.Errorf("unexpected client entries: %+v", entries)
+	}
+
+	entries, err = GetAuditLog(AuditFilter{Entity: AuditEntityAtm}, db)
+	if err != nil {
+		t.Fatalf("can't get audit log: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Actor != ManagerActor(2) || entries[0].Before != "" {
+		t.Errorf("unexpected atm entries: %+v", entries)
+	}
+
+	entries, err = GetAuditLog(AuditFilter{From: time.Now().Add(time.Hour)}, db)
+	if err != nil {
+		t.Fatalf("can't get audit log: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("time range not applied: %+v", entries)
+	}
+
+	if err := VerifyAuditLog(db); err != nil {
+		t.Errorf("untouched audit log not verified: %v", err)
+	}
+}
+
+func TestAuditLog_TamperingDetected(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 100, 1001)
+	err := UpdateBalanceClient(clientId, 50, db)
+	if err != nil {
+		t.Fatalf("can't update balance: %v", err)
+	}
+
+	_, err = db.Exec(`UPDATE audit_log SET after = '{"Balance":1000}' WHERE id = 2`)
+	if err == nil {
+		t.Fatal("audit log updated")
+	}
+	_, err = db.Exec(`DELETE FROM audit_log WHERE id = 1`)
+	if err == nil {
+		t.Fatal("audit log entry deleted")
+	}
+
+	// в обход триггеров, как это сделал бы злоумышленник с доступом к файлу базы
+	_, err = db.Exec(`DROP TRIGGER audit_log_no_update`)
+	if err != nil {
+		t.Fatalf("can't drop trigger: %v", err)
+	}
+	_, err = db.Exec(`UPDATE audit_log SET after = '{"Balance":1000}' WHERE id = 2`)
+	if err != nil {
+		t.Fatalf("can't tamper audit log: %v", err)
+	}
+
+	err = VerifyAuditLog(db)
+	var tampered *AuditTamperedError
+	if !errors.As(err, &tampered) || tampered.EntryId != 2 || !errors.Is(err, ErrAuditLogTampered) {
+		t.Errorf("tampering not detected: %v", err)
+	}
+}
+
+func TestAuditLog_CardAndAtmOperations(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	aliCard := issueTestCard(t, db, aliId, 100000)
+	valiCard := issueTestCard(t, db, valiId, 0)
+	atmId := addTestAtm(t, db)
+
+	err := ReplenishAtm(1, atmId, Notes{10000: 5}, db)
+	if err != nil {
+		t.Fatalf("can't replenish atm: %v", err)
+	}
+	_, err = Withdraw(atmId, aliCard.Id, 20000, db)
+	if err != nil {
+		t.Fatalf("can't withdraw: %v", err)
+	}
+	err = Deposit(atmId, aliCard.Id, Notes{5000: 1}, db)
+	if err != nil {
+		t.Fatalf("can't deposit: %v", err)
+	}
+	_, err = TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 1000, db)
+	if err != nil {
+		t.Fatalf("can't transfer: %v", err)
+	}
+	err = SetAtmStatus(1, atmId, AtmStatusOffline, db)
+	if err != nil {
+		t.Fatalf("can't set atm status: %v", err)
+	}
+
+	entries, err := GetAuditLog(AuditFilter{ActorType: ActorClient, ActorId: aliId}, db)
+	if err != nil {
+		t.Fatalf("can't get audit log: %v", err)
+	}
+	actions := []string{AuditCashWithdrawal, AuditCashDeposit, AuditTransfer, AuditTransfer}
+	if len(entries) != len(actions) {
+		t.Fatalf("unexpected client entries: %+v", entries)
+	}
+	for index, entry := range entries {
+		if entry.Action != actions[index] {
+			t.Errorf("entry %d: got %s, want %s", index, entry.Action, actions[index])
+		}
+	}
+	if entries[0].Before != `{"Balance":100000}` || entries[0].After != `{"Balance":80000}` ||
+		entries[3].EntityId != valiId || entries[3].After != `{"Balance":1000}` {
+		t.Errorf("unexpected balances: %+v", entries)
+	}
+
+	entries, err = GetAuditLog(AuditFilter{Entity: AuditEntityAtm, EntityId: atmId}, db)
+	if err != nil || len(entries) != 3 || entries[1].Action != AuditAtmReplenish || entries[1].Actor != ManagerActor(1) ||
+		entries[2].Action != AuditAtmUpdate {
+		t.Errorf("atm changes not audited: %+v %v", entries, err)
+	}
+	if err := VerifyAuditLog(db); err != nil {
+		t.Errorf("audit log broken: %v", err)
+	}
+}
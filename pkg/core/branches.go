@@ -0,0 +1,334 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+var ErrBranchNotFound = errors.New("branch not found")
+var ErrInvalidBranch = errors.New("invalid branch")
+var ErrHeadOfficeOnly = errors.New("allowed for head office managers only")
+var ErrOutsideBranch = errors.New("outside manager branch")
+
+// Branch - подразделение банка. Менеджеры, клиенты и банкоматы закрепляются за подразделением;
+// менеджер без подразделения работает в головном офисе и видит данные всех подразделений.
+type Branch struct {
+	Id      int64
+	Name    string
+	Address string
+}
+
+func (receiver Branch) Validate() error {
+	if strings.TrimSpace(receiver.Name) == "" {
+		return ErrInvalidBranch
+	}
+	return nil
+}
+
+// BranchSummary - показатели подразделения; BranchId 0 - всё, что не закреплено за подразделениями
+type BranchSummary struct {
+	BranchId int64
+	Name     string
+	Managers int64
+	Clients  int64
+	Balance  int64
+	Deposits int64
+	Atms     int64
+	AtmCash  int64
+}
+
+// BranchReport - показатели по подразделениям, доступным менеджеру, и их сумма
+type BranchReport struct {
+	Branches []BranchSummary
+	Total    BranchSummary
+}
+
+func AddBranch(managerId int64, branch Branch, db *sql.DB) (branchId int64, err error) {
+	err = branch.Validate()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkHeadOffice(tx, managerId)
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(
+		insertBranchSQL,
+		sql.Named("name", strings.TrimSpace(branch.Name)),
+		sql.Named("address", strings.TrimSpace(branch.Address)),
+	)
+	if err != nil {
+		return 0, err
+	}
+	branchId, err = result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	branch.Id = branchId
+	return branchId, writeAudit(tx, ManagerActor(managerId), AuditCreate, AuditEntityBranch, branchId, nil, branch)
+}
+
+func ListBranches(db *sql.DB) (branches []Branch, err error) {
+	rows, err := db.Query(listBranchesSQL)
+	if err != nil {
+		return nil, queryError(listBranchesSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			branches, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		branch := Branch{}
+		err = rows.Scan(&branch.Id, &branch.Name, &branch.Address)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		branches = append(branches, branch)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return branches, nil
+}
+
+// AssignManagerToBranch переводит менеджера в подразделение; branchId 0 - в головной офис
+func AssignManagerToBranch(headManagerId int64, managerId int64, branchId int64, db *sql.DB) error {
+	return assignBranch(headManagerId, AuditEntityManager, managerId, branchId, getManagerBranchSQL, updateManagerBranchSQL,
+		ErrManagerNotFound, db)
+}
+
+// AssignClientToBranch закрепляет клиента за подразделением; branchId 0 снимает закрепление
+func AssignClientToBranch(headManagerId int64, clientId int64, branchId int64, db *sql.DB) error {
+	return assignBranch(headManagerId, AuditEntityClient, clientId, branchId, getClientBranchSQL, updateClientBranchSQL,
+		ErrClientNotFound, db)
+}
+
+// AssignAtmToBranch закрепляет банкомат за подразделением; branchId 0 снимает закрепление
+func AssignAtmToBranch(headManagerId int64, atmId int64, branchId int64, db *sql.DB) error {
+	return assignBranch(headManagerId, AuditEntityAtm, atmId, branchId, getAtmBranchSQL, updateAtmBranchSQL,
+		ErrAtmNotFound, db)
+}
+
+// assignBranch меняет подразделение сущности; переназначать может только головной офис
+func assignBranch(headManagerId int64, entity string, entityId int64, branchId int64, getSQL string, updateSQL string,
+	notFoundErr error, db *sql.DB) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkHeadOffice(tx, headManagerId)
+	if err != nil {
+		return err
+	}
+	if branchId != 0 {
+		err = checkExists(tx, getBranchIdSQL, branchId, ErrBranchNotFound)
+		if err != nil {
+			return err
+		}
+	}
+	var before int64
+	err = tx.QueryRow(getSQL, entityId).Scan(&before)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return notFoundErr
+		}
+		return queryError(getSQL, err)
+	}
+	_, err = tx.Exec(updateSQL, sql.Named("id", entityId), sql.Named("branch_id", nullableId(branchId)))
+	if err != nil {
+		return err
+	}
+	return writeAudit(tx, ManagerActor(headManagerId), AuditBranch, entity, entityId, before, branchId)
+}
+
+// migrateBranches добавляет branch_id в базы, созданные до подразделений. Подразделения
+// менеджеров создаются из прежних значений managers.unit; клиенты и банкоматы остаются
+// незакреплёнными, их распределяет головной офис.
+func migrateBranches(db *sql.DB) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	migrations := []struct {
+		table string
+		ddl   string
+	}{
+		{table: "managers", ddl: addManagersBranchIdSQL},
+		{table: "client", ddl: addClientBranchIdSQL},
+		{table: "atm", ddl: addAtmBranchIdSQL},
+	}
+	var managersMigrated bool
+	for _, migration := range migrations {
+		exists, err := columnExists(tx, migration.table, "branch_id")
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		_, err = tx.Exec(migration.ddl)
+		if err != nil {
+			return err
+		}
+		managersMigrated = managersMigrated || migration.table == "managers"
+	}
+
+	// переносим unit один раз: позже менеджера могли перевести в головной офис
+	if !managersMigrated {
+		return nil
+	}
+	hasUnit, err := columnExists(tx, "managers", "unit")
+	if err != nil || !hasUnit {
+		return err
+	}
+	for _, backfill := range []string{insertUnitBranchesSQL, backfillManagersBranchSQL} {
+		_, err = tx.Exec(backfill)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func columnExists(q queryRower, table string, column string) (bool, error) {
+	var count int64
+	err := q.QueryRow(columnExistsSQL, table, column).Scan(&count)
+	if err != nil {
+		return false, queryError(columnExistsSQL, err)
+	}
+	return count > 0, nil
+}
+
+// managerBranch - подразделение менеджера, 0 - головной офис
+func managerBranch(q queryRower, managerId int64) (branchId int64, err error) {
+	err = q.QueryRow(getManagerBranchSQL, managerId).Scan(&branchId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrManagerNotFound
+		}
+		return 0, queryError(getManagerBranchSQL, err)
+	}
+	return branchId, nil
+}
+
+func checkHeadOffice(q queryRower, managerId int64) error {
+	branchId, err := managerBranch(q, managerId)
+	if err != nil {
+		return err
+	}
+	if branchId != 0 {
+		return ErrHeadOfficeOnly
+	}
+	return nil
+}
+
+// checkBranchScope проверяет, что менеджер может работать с клиентом или банкоматом:
+// менеджеру подразделения доступны только закреплённые за его подразделением,
+// головному офису - все, включая незакреплённые
+func checkBranchScope(q queryRower, managerId int64, getSQL string, entityId int64, notFoundErr error) error {
+	branchId, err := managerBranch(q, managerId)
+	if err != nil {
+		return err
+	}
+	var entityBranchId int64
+	err = q.QueryRow(getSQL, entityId).Scan(&entityBranchId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return notFoundErr
+		}
+		return queryError(getSQL, err)
+	}
+	if branchId != 0 && entityBranchId != branchId {
+		return ErrOutsideBranch
+	}
+	return nil
+}
+
+func checkClientScope(q queryRower, managerId int64, clientId int64) error {
+	return checkBranchScope(q, managerId, getClientBranchSQL, clientId, ErrClientNotFound)
+}
+
+func checkAtmScope(q queryRower, managerId int64, atmId int64) error {
+	return checkBranchScope(q, managerId, getAtmBranchSQL, atmId, ErrAtmNotFound)
+}
+
+// checkActorScope - checkClientScope для действий от имени Actor; клиент и система
+// подразделением не ограничены
+func checkActorScope(q queryRower, actor Actor, clientId int64) error {
+	if actor.Type != ActorManager {
+		return nil
+	}
+	return checkClientScope(q, actor.Id, clientId)
+}
+
+// GetBranchReport - показатели подразделения менеджера; головной офис получает все
+// подразделения, строку незакреплённых данных и итог по банку
+func GetBranchReport(managerId int64, db *sql.DB) (report BranchReport, err error) {
+	branchId, err := managerBranch(db, managerId)
+	if err != nil {
+		return BranchReport{}, err
+	}
+	rows, err := db.Query(branchReportSQL, sql.Named("branch_id", branchId))
+	if err != nil {
+		return BranchReport{}, queryError(branchReportSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			report, err = BranchReport{}, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		summary := BranchSummary{}
+		err = rows.Scan(&summary.BranchId, &summary.Name, &summary.Managers, &summary.Clients, &summary.Balance,
+			&summary.Deposits, &summary.Atms, &summary.AtmCash)
+		if err != nil {
+			return BranchReport{}, dbError(err)
+		}
+		report.Branches = append(report.Branches, summary)
+		report.Total.Managers += summary.Managers
+		report.Total.Clients += summary.Clients
+		report.Total.Balance += summary.Balance
+		report.Total.Deposits += summary.Deposits
+		report.Total.Atms += summary.Atms
+		report.Total.AtmCash += summary.AtmCash
+	}
+	if rows.Err() != nil {
+		return BranchReport{}, dbError(rows.Err())
+	}
+
+	report.Total.BranchId = branchId
+	return report, nil
+}
@@ -0,0 +1,220 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAddBranch_HeadOfficeOnly(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+
+	if _, err := AddBranch(1, Branch{Name: " "}, db); !errors.Is(err, ErrInvalidBranch) {
+		t.Errorf("not ErrInvalidBranch: %v", err)
+	}
+	if _, err := AddBranch(2, Branch{Name: "Khujand", Address: "Lenin 10"}, db); !errors.Is(err, ErrHeadOfficeOnly) {
+		t.Errorf("branch manager added branch: %v", err)
+	}
+	if _, err := AddBranch(100, Branch{Name: "Khujand"}, db); !errors.Is(err, ErrManagerNotFound) {
+		t.Errorf("not ErrManagerNotFound: %v", err)
+	}
+	branchId, err := AddBranch(1, Branch{Name: "Khujand", Address: "Lenin 10"}, db)
+	if err != nil {
+		t.Fatalf("can't add branch: %v", err)
+	}
+
+	branches, err := ListBranches(db)
+	if err != nil || len(branches) != 3 || branches[2] != (Branch{Id: branchId, Name: "Khujand", Address: "Lenin 10"}) {
+		t.Errorf("unexpected branches: %+v %v", branches, err)
+	}
+
+	if err := AssignManagerToBranch(2, 3, branchId, db); !errors.Is(err, ErrHeadOfficeOnly) {
+		t.Errorf("branch manager reassigned manager: %v", err)
+	}
+	if err := AssignManagerToBranch(1, 3, branchId+1, db); !errors.Is(err, ErrBranchNotFound) {
+		t.Errorf("not ErrBranchNotFound: %v", err)
+	}
+	if err := AssignManagerToBranch(1, 3, branchId, db); err != nil {
+		t.Fatalf("can't assign manager: %v", err)
+	}
+	if branch, _ := managerBranch(db, 3); branch != branchId {
+		t.Errorf("manager not moved: %d", branch)
+	}
+}
+
+func TestBranchScope_ListsAndReport(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 1000, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 2000, 1002)
+	addTestClient(t, db, "sami", 923333333, 4000, 1003)
+	boysAtm := addTestAtm(t, db)
+	girlsAtm := addTestAtm(t, db)
+	err := ReplenishAtm(1, boysAtm, Notes{10000: 5}, db)
+	if err != nil {
+		t.Fatalf("can't replenish atm: %v", err)
+	}
+
+	if err := AssignClientToBranch(1, valiId+10, 1, db); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("not ErrClientNotFound: %v", err)
+	}
+	for _, assign := range []error{
+		AssignClientToBranch(1, aliId, 1, db),
+		AssignClientToBranch(1, valiId, 2, db),
+		AssignAtmToBranch(1, boysAtm, 1, db),
+		AssignAtmToBranch(1, girlsAtm, 2, db),
+	} {
+		if assign != nil {
+			t.Fatalf("can't assign: %v", assign)
+		}
+	}
+
+	page, err := ListClients(2, ClientFilter{BranchId: 2}, db)
+	if err != nil || len(page.Clients) != 1 || page.Clients[0].Id != aliId || page.Clients[0].BranchId != 1 {
+		t.Errorf("branch manager sees other branches: %+v %v", page.Clients, err)
+	}
+	page, err = ListClients(1, ClientFilter{}, db)
+	if err != nil || page.Total != 3 {
+		t.Errorf("head office doesn't see all clients: %+v %v", page, err)
+	}
+	if _, err := GetBalanceList(db, 4, aliId); !errors.Is(err, ErrOutsideBranch) {
+		t.Errorf("not ErrOutsideBranch: %v", err)
+	}
+	if list, err := GetBalanceList(db, 4, valiId); err != nil || len(list) != 1 {
+		t.Errorf("own client rejected: %+v %v", list, err)
+	}
+
+	atms, err := GetAllAtms(4, db)
+	if err != nil || len(atms) != 1 || atms[0].Id != girlsAtm {
+		t.Errorf("unexpected branch atms: %+v %v", atms, err)
+	}
+	atms, err = GetAllAtms(1, db)
+	if err != nil || len(atms) != 2 {
+		t.Errorf("unexpected head office atms: %+v %v", atms, err)
+	}
+
+	report, err := GetBranchReport(2, db)
+	if err != nil {
+		t.Fatalf("can't get report: %v", err)
+	}
+	boys := BranchSummary{BranchId: 1, Name: "boys", Managers: 2, Clients: 1, Balance: 1000, Atms: 1, AtmCash: 50000}
+	if len(report.Branches) != 1 || report.Branches[0] != boys {
+		t.Errorf("unexpected branch report: %+v", report.Branches)
+	}
+
+	report, err = GetBranchReport(1, db)
+	if err != nil {
+		t.Fatalf("can't get report: %v", err)
+	}
+	if len(report.Branches) != 3 || report.Branches[2].BranchId != 0 || report.Branches[2].Clients != 1 ||
+		report.Branches[2].Managers != 1 {
+		t.Errorf("unexpected head office report: %+v", report.Branches)
+	}
+	total := BranchSummary{Managers: 6, Clients: 3, Balance: 7000, Atms: 2, AtmCash: 50000}
+	if report.Total != total {
+		t.Errorf("unexpected total: %+v", report.Total)
+	}
+}
+
+func TestBranchScope_ManagerOperations(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 1000, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 1000, 1002)
+	atmId := addTestAtm(t, db)
+	assignTestBranch(t, db, aliId, 1)
+	transfer, err := TransactionMinusWithReceipt(Client{PhoneNumber: 922222222, Balance: 100}, db)
+	if err != nil {
+		t.Fatalf("can't transfer: %v", err)
+	}
+
+	// vali и банкомат не закреплены - с ними работает только головной офис
+	outside := []error{
+		SetClientSegment(2, valiId, SegmentPremium, db),
+		UpdateBalanceClientAs(ManagerActor(2), valiId, 100, db),
+		ReplenishAtm(2, atmId, Notes{10000: 1}, db),
+		UpdateClientProfile(ManagerActor(2), valiId, testProfile(), db),
+		SetKycStatus(2, valiId, KycRejected, "bad photo", db),
+	}
+	_, err = FreezeClient(ManagerActor(2), valiId, "court order", time.Time{}, db)
+	outside = append(outside, err)
+	_, err = ReverseTransaction(2, transfer.OperationId, "mistake", db)
+	outside = append(outside, err)
+	for index, err := range outside {
+		if !errors.Is(err, ErrOutsideBranch) {
+			t.Errorf("operation %d: not ErrOutsideBranch: %v", index, err)
+		}
+	}
+
+	if err := SetClientSegment(2, aliId, SegmentPremium, db); err != nil {
+		t.Errorf("own client rejected: %v", err)
+	}
+	if _, err := FreezeClient(ManagerActor(2), aliId, "court order", time.Time{}, db); err != nil {
+		t.Errorf("own client rejected: %v", err)
+	}
+	if _, err := ReverseTransaction(1, transfer.OperationId, "mistake", db); err != nil {
+		t.Errorf("head office rejected: %v", err)
+	}
+}
+
+func TestInit_MigratesBranchColumns(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("can't open db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	defer closeTestDb(t, db)
+	// схема и данные до подразделений
+	for _, ddl := range []string{
+		`CREATE TABLE managers(id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL, login TEXT NOT NULL UNIQUE,
+			password TEXT NOT NULL, salary INTEGER NOT NULL, plan INTEGER NOT NULL, unit TEXT, boss_id INTEGER REFERENCES managers);`,
+		`INSERT INTO managers VALUES (1, 'Vasya', 'vasya', 'secret', 100000, 0, NULL, NULL),
+			(2, 'Petya', 'petya', 'secret', 90000, 90000, 'boys', 1),
+			(7, 'Lena', 'lena', 'secret', 50000, 50000, 'khujand', 1);`,
+		`CREATE TABLE atm(id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL, address TEXT NOT NULL,
+			latitude REAL NOT NULL DEFAULT 0, longitude REAL NOT NULL DEFAULT 0, opens_at TEXT NOT NULL DEFAULT '00:00',
+			closes_at TEXT NOT NULL DEFAULT '24:00', status TEXT NOT NULL DEFAULT 'active');`,
+	} {
+		if _, err := db.Exec(ddl); err != nil {
+			t.Fatalf("can't create old schema: %v", err)
+		}
+	}
+
+	if err := Init(db); err != nil {
+		t.Fatalf("can't init old db: %v", err)
+	}
+	for managerId, name := range map[int64]string{2: "boys", 7: "khujand"} {
+		var branch string
+		err = db.QueryRow(`SELECT b.name FROM managers m JOIN branch b ON b.id = m.branch_id WHERE m.id = ?`, managerId).Scan(&branch)
+		if err != nil || branch != name {
+			t.Errorf("manager %d: unit not moved to branch: %q %v", managerId, branch, err)
+		}
+	}
+	if branchId, err := managerBranch(db, 1); err != nil || branchId != 0 {
+		t.Errorf("head office manager got branch: %d %v", branchId, err)
+	}
+	atmId := addTestAtm(t, db)
+	if err := AssignAtmToBranch(1, atmId, 1, db); err != nil {
+		t.Errorf("atm branch column not added: %v", err)
+	}
+
+	// повторный Init не возвращает переведённого в головной офис менеджера в прежний unit
+	if err := AssignManagerToBranch(1, 2, 0, db); err != nil {
+		t.Fatalf("can't move manager: %v", err)
+	}
+	if err := Init(db); err != nil {
+		t.Fatalf("can't init db again: %v", err)
+	}
+	if branchId, _ := managerBranch(db, 2); branchId != 0 {
+		t.Errorf("unit backfilled twice: %d", branchId)
+	}
+}
+
+func assignTestBranch(t *testing.T, db *sql.DB, clientId int64, branchId int64) {
+	err := AssignClientToBranch(1, clientId, branchId, db)
+	if err != nil {
+		t.Fatalf("can't assign client: %v", err)
+	}
+}
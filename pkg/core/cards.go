@@ -0,0 +1,586 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	CardStatusActive  = "active"
+	CardStatusBlocked = "blocked"
+	CardStatusExpired = "expired"
+	CardStatusClosed  = "closed"
+)
+
+// BIN банка: первые 6 цифр каждого выпускаемого номера карты
+const cardBIN = "444488"
+const cardPANLength = 16
+const cardValidityYears = 3
+const minCardSecretPepperLength = 32
+
+// cardSecretPepper - серверный ключ хэшей PIN и CVV, см. SetCardSecretPepper
+var cardSecretPepper []byte
+
+var ErrCardNotFound = errors.New("card not found")
+var ErrInvalidPin = errors.New("invalid pin")
+var ErrInvalidPinFormat = errors.New("pin must be 4 digits")
+var ErrCardPepperNotSet = errors.New("card secret pepper not set")
+var ErrCardPepperTooShort = errors.New("card secret pepper too short")
+
+type CardStatusError struct {
+	CardId int64
+	Status string
+}
+
+func (receiver *CardStatusError) Error() string {
+	return fmt.Sprintf("card %d has status %s", receiver.CardId, receiver.Status)
+}
+
+type Card struct {
+	Id          int64
+	Name        string
+	PAN         string
+	ExpiryMonth int
+	ExpiryYear  int
+	Status      string
+	Balance     int64
+	UserId      int64
+}
+
+// MaskedPAN возвращает номер карты в виде 444488******1234
+func (receiver Card) MaskedPAN() string {
+	if len(receiver.PAN) < 10 {
+		return receiver.PAN
+	}
+	last := len(receiver.PAN) - 4
+	return receiver.PAN[:6] + strings.Repeat("*", last-6) + receiver.PAN[last:]
+}
+
+// ExpiredAt - карта действует до конца месяца срока действия включительно
+func (receiver Card) ExpiredAt(now time.Time) bool {
+	return receiver.ExpiryYear < now.Year() ||
+		receiver.ExpiryYear == now.Year() && receiver.ExpiryMonth < int(now.Month())
+}
+
+// checkCardActive пропускает только активную карту с неистёкшим сроком: истёкшая карта
+// отклоняется и до того, как ExpireCards сменит её статус
+func checkCardActive(card Card, now time.Time) error {
+	if card.Status != CardStatusActive {
+		return &CardStatusError{CardId: card.Id, Status: card.Status}
+	}
+	if card.ExpiredAt(now) {
+		return &CardStatusError{CardId: card.Id, Status: CardStatusExpired}
+	}
+	return nil
+}
+
+// IssuedCard - только что выпущенная карта; CVV показывается один раз и в БД хранится только его хэш
+type IssuedCard struct {
+	Card
+	CVV string
+}
+
+// IssueCard выпускает клиенту новую активную карту. Начальный баланс зачисляется
+// операцией пополнения: она видна в выписке и отменяется через ReverseTransaction.
+func IssueCard(userId int64, cardName string, pin string, balance int64, db *sql.DB) (issued IssuedCard, err error) {
+	if !isValidPin(pin) {
+		return IssuedCard{}, ErrInvalidPinFormat
+	}
+	if balance < 0 {
+		return IssuedCard{}, ErrInvalidAmount
+	}
+	pinHash, err := hashSecret(pin)
+	if err != nil {
+		return IssuedCard{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	issued, err = insertCard(tx, userId, cardName, pinHash, balance)
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	if balance == 0 {
+		return issued, nil
+	}
+
+	before, err := getClientBalance(tx, userId)
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	_, err = registerCredit(tx, userId, issued.Id, OperationTopUp, balance)
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	// баланс клиента - сумма балансов его карт
+	_, err = tx.Exec(
+		updateClientBalancePlusSQL,
+		sql.Named("id", userId),
+		sql.Named("balance", balance),
+	)
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	err = publishBalanceChanged(tx, userId, balance)
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	err = auditClientBalance(tx, SystemActor, AuditTopUp, userId, before)
+	if err != nil {
+		return IssuedCard{}, err
+	}
+
+	return issued, nil
+}
+
+// AddCard выпускает карту со случайным PIN, который нигде не показывается: PIN такой карте
+// назначает менеджер через ResetCardPin.
+// Deprecated: используйте IssueCard.
+func AddCard(cardName string, cardBalance int64, cardUserId int64, db *sql.DB) (err error) {
+	pin, err := randomDigits(4)
+	if err != nil {
+		return err
+	}
+	_, err = IssueCard(cardUserId, cardName, pin, cardBalance, db)
+	return err
+}
+
+func insertCard(tx *sql.Tx, userId int64, cardName string, pinHash string, balance int64) (IssuedCard, error) {
+	pan, err := generatePAN()
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	cvv, err := randomDigits(3)
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	cvvHash, err := hashSecret(cvv)
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	expiry := timeNow().AddDate(cardValidityYears, 0, 0)
+
+	result, err := tx.Exec(
+		insertCardsSQL,
+		sql.Named("name", cardName),
+		sql.Named("pan", pan),
+		sql.Named("expiry_month", int(expiry.Month())),
+		sql.Named("expiry_year", expiry.Year()),
+		sql.Named("cvv_hash", cvvHash),
+		sql.Named("pin_hash", pinHash),
+		sql.Named("balance", balance),
+		sql.Named("user_id", userId),
+	)
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return IssuedCard{}, err
+	}
+
+	return IssuedCard{
+		Card: Card{
+			Id:          id,
+			Name:        cardName,
+			PAN:         pan,
+			ExpiryMonth: int(expiry.Month()),
+			ExpiryYear:  expiry.Year(),
+			Status:      CardStatusActive,
+			Balance:     balance,
+			UserId:      userId,
+		},
+		CVV: cvv,
+	}, nil
+}
+
+func GetCard(cardId int64, db *sql.DB) (Card, error) {
+	return getCard(db, cardId)
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func getCard(q queryRower, cardId int64) (card Card, err error) {
+	err = q.QueryRow(getCardByIdSQL, cardId).Scan(
+		&card.Id, &card.Name, &card.PAN, &card.ExpiryMonth, &card.ExpiryYear,
+		&card.Status, &card.Balance, &card.UserId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Card{}, ErrCardNotFound
+		}
+		return Card{}, queryError(getCardByIdSQL, err)
+	}
+	return card, nil
+}
+
+func ListClientCards(userId int64, db *sql.DB) (cards []Card, err error) {
+	rows, err := db.Query(listClientCardsSQL, userId)
+	if err != nil {
+		return nil, queryError(listClientCardsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			cards, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		card := Card{}
+		err = rows.Scan(&card.Id, &card.Name, &card.PAN, &card.ExpiryMonth, &card.ExpiryYear,
+			&card.Status, &card.Balance, &card.UserId)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		cards = append(cards, card)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return cards, nil
+}
+
+// BlockCard блокирует карту по просьбе клиента или решению менеджера;
+// менеджер подразделения блокирует только карты своих клиентов
+func BlockCard(actor Actor, cardId int64, db *sql.DB) error {
+	return changeCardStatus(actor, AuditCardBlock, cardId, CardStatusActive, CardStatusBlocked, db)
+}
+
+func UnblockCard(actor Actor, cardId int64, db *sql.DB) error {
+	return changeCardStatus(actor, AuditCardUnblock, cardId, CardStatusBlocked, CardStatusActive, db)
+}
+
+func changeCardStatus(actor Actor, action string, cardId int64, from string, to string, db *sql.DB) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	card, err := getCard(tx, cardId)
+	if err != nil {
+		return err
+	}
+	err = checkActorScope(tx, actor, card.UserId)
+	if err != nil {
+		return err
+	}
+	if card.Status != from {
+		return &CardStatusError{CardId: cardId, Status: card.Status}
+	}
+
+	_, err = tx.Exec(
+		updateCardStatusSQL,
+		sql.Named("id", cardId),
+		sql.Named("status", to),
+	)
+	if err != nil {
+		return err
+	}
+
+	return writeAudit(tx, actor, action, AuditEntityCard, cardId, from, to)
+}
+
+// ReissueCard закрывает карту и выпускает вместо неё новую с тем же PIN;
+// остаток переносится на новую карту
+func ReissueCard(actor Actor, cardId int64, db *sql.DB) (issued IssuedCard, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	card, err := getCard(tx, cardId)
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	err = checkActorScope(tx, actor, card.UserId)
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	if card.Status == CardStatusClosed {
+		return IssuedCard{}, &CardStatusError{CardId: cardId, Status: card.Status}
+	}
+
+	var pinHash string
+	err = tx.QueryRow(getCardPinHashSQL, cardId).Scan(&pinHash)
+	if err != nil {
+		return IssuedCard{}, queryError(getCardPinHashSQL, err)
+	}
+
+	_, err = tx.Exec(closeCardForReissueSQL, sql.Named("id", cardId))
+	if err != nil {
+		return IssuedCard{}, err
+	}
+
+	issued, err = insertCard(tx, card.UserId, card.Name, pinHash, card.Balance)
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	return issued, writeAudit(tx, actor, AuditCardReissue, AuditEntityCard, cardId, nil, issued.Id)
+}
+
+func VerifyCardPin(cardId int64, pin string, db *sql.DB) error {
+	var pinHash string
+	err := db.QueryRow(getCardPinHashSQL, cardId).Scan(&pinHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrCardNotFound
+		}
+		return queryError(getCardPinHashSQL, err)
+	}
+	ok, err := checkSecret(pin, pinHash)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidPin
+	}
+	return nil
+}
+
+// ChangeCardPin - смена PIN держателем карты: в журнал пишется от имени владельца
+func ChangeCardPin(cardId int64, oldPin string, newPin string, db *sql.DB) (err error) {
+	if !isValidPin(newPin) {
+		return ErrInvalidPinFormat
+	}
+	err = VerifyCardPin(cardId, oldPin, db)
+	if err != nil {
+		return err
+	}
+	pinHash, err := hashSecret(newPin)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	card, err := getCard(tx, cardId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		updateCardPinHashSQL,
+		sql.Named("id", cardId),
+		sql.Named("pin_hash", pinHash),
+	)
+	if err != nil {
+		return err
+	}
+	return writeAudit(tx, ClientActor(card.UserId), AuditPinChange, AuditEntityCard, cardId, nil, nil)
+}
+
+// ResetCardPin - новый PIN по решению менеджера, без старого: для карт, выпущенных
+// AddCard, и забытых PIN. Менеджер подразделения сбрасывает PIN только своим клиентам.
+func ResetCardPin(managerId int64, cardId int64, newPin string, db *sql.DB) (err error) {
+	if !isValidPin(newPin) {
+		return ErrInvalidPinFormat
+	}
+	pinHash, err := hashSecret(newPin)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	card, err := getCard(tx, cardId)
+	if err != nil {
+		return err
+	}
+	err = checkClientScope(tx, managerId, card.UserId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		updateCardPinHashSQL,
+		sql.Named("id", cardId),
+		sql.Named("pin_hash", pinHash),
+	)
+	if err != nil {
+		return err
+	}
+	return writeAudit(tx, ManagerActor(managerId), AuditPinReset, AuditEntityCard, cardId, nil, nil)
+}
+
+// ExpireCards помечает истёкшими все карты, срок которых закончился до now
+func ExpireCards(now time.Time, db *sql.DB) (int64, error) {
+	result, err := db.Exec(
+		expireCardsSQL,
+		sql.Named("year", now.Year()),
+		sql.Named("month", int(now.Month())),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func generatePAN() (string, error) {
+	body, err := randomDigits(cardPANLength - len(cardBIN) - 1)
+	if err != nil {
+		return "", err
+	}
+	partial := cardBIN + body
+	return partial + string('0'+luhnCheckDigit(partial)), nil
+}
+
+// luhnCheckDigit считает контрольную цифру для номера без неё
+func luhnCheckDigit(number string) byte {
+	sum := 0
+	double := true
+	for i := len(number) - 1; i >= 0; i-- {
+		digit := int(number[i] - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return byte((10 - sum%10) % 10)
+}
+
+func IsValidPAN(pan string) bool {
+	if len(pan) < 2 {
+		return false
+	}
+	for _, r := range pan {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return luhnCheckDigit(pan[:len(pan)-1]) == pan[len(pan)-1]-'0'
+}
+
+func isValidPin(pin string) bool {
+	if len(pin) != 4 {
+		return false
+	}
+	for _, r := range pin {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func randomDigits(n int) (string, error) {
+	digits := make([]byte, n)
+	for i := range digits {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		digits[i] = byte('0' + d.Int64())
+	}
+	return string(digits), nil
+}
+
+// SetCardSecretPepper задаёт серверный ключ, которым подписываются хэши PIN и CVV.
+// Ключ хранится вне БД (конфигурация, KMS): без него перебор 10^4 PIN по украденной
+// таблице card ничего не даёт. Задаётся при старте до работы с картами и не меняется,
+// иначе сохранённые PIN и CVV перестанут проверяться.
+func SetCardSecretPepper(pepper []byte) error {
+	if len(pepper) < minCardSecretPepperLength {
+		return ErrCardPepperTooShort
+	}
+	cardSecretPepper = append([]byte(nil), pepper...)
+	return nil
+}
+
+// hashSecret хэширует PIN/CVV со случайной солью: "соль$hmac-sha256(pepper, соль+секрет)"
+func hashSecret(secret string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	mac, err := secretMAC(salt, secret)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt) + "$" + hex.EncodeToString(mac), nil
+}
+
+func checkSecret(secret string, hashed string) (bool, error) {
+	parts := strings.SplitN(hashed, "$", 2)
+	if len(parts) != 2 {
+		return false, nil
+	}
+	salt, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return false, nil
+	}
+	expected, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false, nil
+	}
+	mac, err := secretMAC(salt, secret)
+	if err != nil {
+		return false, err
+	}
+	return hmac.Equal(mac, expected), nil
+}
+
+func secretMAC(salt []byte, secret string) ([]byte, error) {
+	if len(cardSecretPepper) == 0 {
+		return nil, ErrCardPepperNotSet
+	}
+	mac := hmac.New(sha256.New, cardSecretPepper)
+	mac.Write(salt)
+	mac.Write([]byte(secret))
+	return mac.Sum(nil), nil
+}
@@ -0,0 +1,336 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var testCardPepper = []byte("test-card-pepper-0123456789abcdef")
+
+// openTestDb открывает in-memory БД со всеми таблицами; одно соединение,
+// иначе каждое новое соединение пула видит свою пустую :memory: БД
+func openTestDb(t *testing.T) *sql.DB {
+	if err := SetCardSecretPepper(testCardPepper); err != nil {
+		t.Fatalf("can't set card pepper: %v", err)
+	}
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("can't open db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	if err := Init(db); err != nil {
+		t.Fatalf("can't init db: %v", err)
+	}
+	return db
+}
+
+func closeTestDb(t *testing.T, db *sql.DB) {
+	if err := db.Close(); err != nil {
+		t.Errorf("can't close db: %v", err)
+	}
+}
+
+func addTestClient(t *testing.T, db *sql.DB, login string, phone int, balance uint64, balanceNumber int64) int64 {
+	err := AddUser(login, login, "secret", "A"+login, phone, balance, balanceNumber, db)
+	if err != nil {
+		t.Fatalf("can't add client: %v", err)
+	}
+	var id int64
+	err = db.QueryRow(`SELECT id FROM client WHERE login = ?`, login).Scan(&id)
+	if err != nil {
+		t.Fatalf("can't get client id: %v", err)
+	}
+	return id
+}
+
+func TestLuhn(t *testing.T) {
+	if !IsValidPAN("4539578763621486") {
+		t.Error("valid PAN rejected")
+	}
+	if IsValidPAN("4539578763621487") {
+		t.Error("invalid PAN accepted")
+	}
+	for i := 0; i < 20; i++ {
+		pan, err := generatePAN()
+		if err != nil {
+			t.Fatalf("can't generate pan: %v", err)
+		}
+		if len(pan) != 16 || !IsValidPAN(pan) {
+			t.Errorf("generated invalid pan: %s", pan)
+		}
+	}
+}
+
+func TestIssueCard_Ok(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	userId := addTestClient(t, db, "alif", 921111111, 0, 1001)
+
+	issued, err := IssueCard(userId, "Alif Mobi", "1234", 500, db)
+	if err != nil {
+		t.Fatalf("can't issue card: %v", err)
+	}
+	if issued.Status != CardStatusActive || len(issued.CVV) != 3 {
+		t.Errorf("unexpected issued card: %+v", issued)
+	}
+	if issued.ExpiryYear != time.Now().Year()+cardValidityYears {
+		t.Errorf("unexpected expiry year: %d", issued.ExpiryYear)
+	}
+
+	cards, err := ListClientCards(userId, db)
+	if err != nil {
+		t.Fatalf("can't list cards: %v", err)
+	}
+	if len(cards) != 1 || cards[0].PAN != issued.PAN || cards[0].Balance != 500 {
+		t.Errorf("unexpected cards: %+v", cards)
+	}
+
+	if err := VerifyCardPin(issued.Id, "1234", db); err != nil {
+		t.Errorf("valid pin rejected: %v", err)
+	}
+	if err := VerifyCardPin(issued.Id, "4321", db); !errors.Is(err, ErrInvalidPin) {
+		t.Errorf("not ErrInvalidPin for wrong pin: %v", err)
+	}
+}
+
+func TestIssueCard_InitialBalanceIsTopUp(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	userId := addTestClient(t, db, "alif", 921111111, 100, 1001)
+
+	if _, err := IssueCard(userId, "Alif Mobi", "1234", -1, db); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("not ErrInvalidAmount: %v", err)
+	}
+	issued, err := IssueCard(userId, "Alif Mobi", "1234", 500, db)
+	if err != nil {
+		t.Fatalf("can't issue card: %v", err)
+	}
+
+	entries, err := GetStatement(userId, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), db)
+	if err != nil || len(entries) != 1 || entries[0].Type != OperationTopUp || entries[0].CardId != issued.Id ||
+		entries[0].Change != 500 {
+		t.Fatalf("initial balance not in statement: %+v %v", entries, err)
+	}
+	audit, err := GetAuditLog(AuditFilter{Entity: AuditEntityClient, EntityId: userId}, db)
+	if err != nil || audit[len(audit)-1].Action != AuditTopUp || audit[len(audit)-1].After != `{"Balance":600}` {
+		t.Errorf("initial balance not audited: %+v %v", audit, err)
+	}
+
+	_, err = ReverseTransaction(1, entries[0].Id, "issued by mistake", db)
+	if err != nil {
+		t.Fatalf("can't reverse initial balance: %v", err)
+	}
+	cards, err := ListClientCards(userId, db)
+	if err != nil || cards[0].Balance != 0 || clientBalance(t, db, userId) != 100 {
+		t.Errorf("initial balance not reversed from card: %+v %v", cards, err)
+	}
+}
+
+func TestIssueCard_InvalidPin(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	_, err := IssueCard(1, "Alif Mobi", "12a4", 0, db)
+	if !errors.Is(err, ErrInvalidPinFormat) {
+		t.Errorf("not ErrInvalidPinFormat: %v", err)
+	}
+}
+
+func TestBlockUnblockCard(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	userId := addTestClient(t, db, "alif", 921111111, 0, 1001)
+	issued, err := IssueCard(userId, "Alif Mobi", "1234", 0, db)
+	if err != nil {
+		t.Fatalf("can't issue card: %v", err)
+	}
+
+	if err := UnblockCard(ManagerActor(1), issued.Id, db); err == nil {
+		t.Error("active card unblocked")
+	}
+	if err := BlockCard(ManagerActor(2), issued.Id, db); !errors.Is(err, ErrOutsideBranch) {
+		t.Errorf("not ErrOutsideBranch: %v", err)
+	}
+	if err := BlockCard(ClientActor(userId), issued.Id, db); err != nil {
+		t.Fatalf("can't block card: %v", err)
+	}
+	err = BlockCard(ManagerActor(1), issued.Id, db)
+	var statusErr *CardStatusError
+	if !errors.As(err, &statusErr) || statusErr.Status != CardStatusBlocked {
+		t.Errorf("not CardStatusError for blocked card: %v", err)
+	}
+	if err := UnblockCard(ManagerActor(1), issued.Id, db); err != nil {
+		t.Errorf("can't unblock card: %v", err)
+	}
+	if err := BlockCard(ManagerActor(1), 100, db); !errors.Is(err, ErrCardNotFound) {
+		t.Errorf("not ErrCardNotFound: %v", err)
+	}
+
+	entries, err := GetAuditLog(AuditFilter{Entity: AuditEntityCard, EntityId: issued.Id}, db)
+	if err != nil || len(entries) != 2 || entries[0].Action != AuditCardBlock || entries[0].Actor != ClientActor(userId) ||
+		entries[1].Action != AuditCardUnblock || entries[1].Actor != ManagerActor(1) {
+		t.Errorf("status changes not audited: %+v %v", entries, err)
+	}
+}
+
+func TestResetCardPin(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	userId := addTestClient(t, db, "alif", 921111111, 0, 1001)
+	err := AddCard("Alif Mobi", 0, userId, db)
+	if err != nil {
+		t.Fatalf("can't add card: %v", err)
+	}
+	cards, err := ListClientCards(userId, db)
+	if err != nil || len(cards) != 1 {
+		t.Fatalf("unexpected cards: %+v %v", cards, err)
+	}
+	cardId := cards[0].Id
+
+	if err := ResetCardPin(1, cardId, "12", db); !errors.Is(err, ErrInvalidPinFormat) {
+		t.Errorf("not ErrInvalidPinFormat: %v", err)
+	}
+	if err := ResetCardPin(2, cardId, "4321", db); !errors.Is(err, ErrOutsideBranch) {
+		t.Errorf("not ErrOutsideBranch: %v", err)
+	}
+	if err := ResetCardPin(1, cardId+1, "4321", db); !errors.Is(err, ErrCardNotFound) {
+		t.Errorf("not ErrCardNotFound: %v", err)
+	}
+	if err := ResetCardPin(1, cardId, "4321", db); err != nil {
+		t.Fatalf("can't reset pin: %v", err)
+	}
+	if err := ChangeCardPin(cardId, "4321", "5678", db); err != nil {
+		t.Errorf("can't change reset pin: %v", err)
+	}
+	entries, err := GetAuditLog(AuditFilter{Entity: AuditEntityCard, EntityId: cardId}, db)
+	if err != nil || len(entries) != 2 || entries[0].Action != AuditPinReset || entries[0].Actor != ManagerActor(1) ||
+		entries[1].Action != AuditPinChange || entries[1].Actor != ClientActor(userId) {
+		t.Errorf("pin reset or change not audited: %+v %v", entries, err)
+	}
+}
+
+func TestReissueCard(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	userId := addTestClient(t, db, "alif", 921111111, 0, 1001)
+	old, err := IssueCard(userId, "Alif Mobi", "1234", 700, db)
+	if err != nil {
+		t.Fatalf("can't issue card: %v", err)
+	}
+
+	reissued, err := ReissueCard(ManagerActor(1), old.Id, db)
+	if err != nil {
+		t.Fatalf("can't reissue card: %v", err)
+	}
+	if reissued.PAN == old.PAN || reissued.Balance != 700 {
+		t.Errorf("unexpected reissued card: %+v", reissued)
+	}
+	if err := VerifyCardPin(reissued.Id, "1234", db); err != nil {
+		t.Errorf("pin not kept on reissue: %v", err)
+	}
+
+	closed, err := GetCard(old.Id, db)
+	if err != nil {
+		t.Fatalf("can't get card: %v", err)
+	}
+	if closed.Status != CardStatusClosed || closed.Balance != 0 {
+		t.Errorf("old card not closed: %+v", closed)
+	}
+	if _, err := ReissueCard(ManagerActor(1), old.Id, db); err == nil {
+		t.Error("closed card reissued")
+	}
+}
+
+func TestExpireCards(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	userId := addTestClient(t, db, "alif", 921111111, 0, 1001)
+	issued, err := IssueCard(userId, "Alif Mobi", "1234", 0, db)
+	if err != nil {
+		t.Fatalf("can't issue card: %v", err)
+	}
+
+	count, err := ExpireCards(time.Now(), db)
+	if err != nil || count != 0 {
+		t.Errorf("fresh card expired: %d, %v", count, err)
+	}
+	count, err = ExpireCards(time.Now().AddDate(cardValidityYears, 1, 0), db)
+	if err != nil || count != 1 {
+		t.Errorf("card not expired: %d, %v", count, err)
+	}
+	card, err := GetCard(issued.Id, db)
+	if err != nil || card.Status != CardStatusExpired {
+		t.Errorf("unexpected card: %+v, %v", card, err)
+	}
+}
+
+func TestHashSecret_Pepper(t *testing.T) {
+	defer func() { cardSecretPepper = testCardPepper }()
+
+	cardSecretPepper = nil
+	if _, err := hashSecret("1234"); !errors.Is(err, ErrCardPepperNotSet) {
+		t.Errorf("not ErrCardPepperNotSet: %v", err)
+	}
+	if err := SetCardSecretPepper([]byte("short")); !errors.Is(err, ErrCardPepperTooShort) {
+		t.Errorf("not ErrCardPepperTooShort: %v", err)
+	}
+
+	cardSecretPepper = testCardPepper
+	hashed, err := hashSecret("1234")
+	if err != nil {
+		t.Fatalf("can't hash secret: %v", err)
+	}
+	if ok, err := checkSecret("1234", hashed); !ok || err != nil {
+		t.Errorf("secret not verified: %v", err)
+	}
+	// без серверного ключа соль из таблицы не позволяет подобрать PIN
+	cardSecretPepper = []byte("other-card-pepper-0123456789abcdef")
+	if ok, _ := checkSecret("1234", hashed); ok {
+		t.Error("secret verified with other pepper")
+	}
+}
+
+func TestCard_ExpiredCardRejected(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return time.Date(2020, 5, 10, 12, 0, 0, 0, time.Local) }
+	aliId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	aliCard := issueTestCard(t, db, aliId, 100000)
+	valiCard := issueTestCard(t, db, valiId, 0)
+	atmId := addTestAtm(t, db)
+	if err := ReplenishAtm(1, atmId, Notes{10000: 5}, db); err != nil {
+		t.Fatalf("can't replenish atm: %v", err)
+	}
+	if aliCard.ExpiryYear != 2023 || aliCard.ExpiryMonth != 5 {
+		t.Fatalf("expiry not from current time: %+v", aliCard.Card)
+	}
+
+	timeNow = func() time.Time { return time.Date(2023, 5, 31, 12, 0, 0, 0, time.Local) }
+	if _, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 100, db); err != nil {
+		t.Errorf("card rejected in last month: %v", err)
+	}
+
+	// ExpireCards ещё не запускался, статус карты - active
+	timeNow = func() time.Time { return time.Date(2023, 6, 1, 12, 0, 0, 0, time.Local) }
+	var statusErr *CardStatusError
+	_, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 100, db)
+	if !errors.As(err, &statusErr) || statusErr.Status != CardStatusExpired {
+		t.Errorf("expired card transferred: %v", err)
+	}
+	_, err = Withdraw(atmId, aliCard.Id, 10000, db)
+	if !errors.As(err, &statusErr) || statusErr.Status != CardStatusExpired {
+		t.Errorf("expired card withdrew cash: %v", err)
+	}
+}
+
+func TestCard_MaskedPAN(t *testing.T) {
+	card := Card{PAN: "4444881234561234"}
+	if masked := card.MaskedPAN(); masked != "444488******1234" {
+		t.Errorf("unexpected masked pan: %s", masked)
+	}
+}
@@ -0,0 +1,255 @@
+package core
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	ClientStatusActive = "active"
+	ClientStatusFrozen = "frozen"
+	ClientStatusBanned = "banned"
+)
+
+const defaultClientsPageSize = 50
+const maxClientsPageSize = 500
+
+var ErrInvalidSortColumn = errors.New("invalid sort column")
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// clientSortColumns - колонки, по которым можно сортировать список; true - текстовая
+var clientSortColumns = map[string]bool{
+	"id":             false,
+	"name":           true,
+	"surname":        true,
+	"login":          true,
+	"phone":          true,
+	"balance":        false,
+	"balance_number": false,
+	"branch_id":      false,
+	"deposits":       false,
+	"kyc_status":     true,
+	"status":         true,
+}
+
+// ClientFilter - поиск клиентов для бэк-офиса. Name ищется подстрокой в имени и фамилии,
+// Phone - подстрокой номера; пустые поля, nil и нулевой BranchId не ограничивают выборку.
+// Cursor - NextCursor предыдущей страницы, пустой - первая страница.
+type ClientFilter struct {
+	Name       string
+	Phone      string
+	MinBalance *int64
+	MaxBalance *int64
+	Status     string
+	KycStatus  string
+	BranchId   int64
+	SortBy     string
+	Descending bool
+	Limit      int
+	Cursor     string
+}
+
+type ClientSummary struct {
+	Id            int64
+	Name          string
+	Surname       string
+	Login         string
+	Phone         string
+	Balance       int64
+	BalanceNumber int64
+	// 0 - клиент не закреплён за подразделением
+	BranchId int64
+	// сумма действующих срочных вкладов
+	Deposits  int64
+	KycStatus string
+	Status    string
+}
+
+// ClientPage - страница списка; Total - число всех клиентов под фильтром без учёта страниц,
+// NextCursor пустой на последней странице
+type ClientPage struct {
+	Clients    []ClientSummary
+	Total      int64
+	NextCursor string
+}
+
+// clientCursor - позиция после последней строки страницы: значение колонки сортировки и id.
+// Sort не даёт применить курсор к списку с другой сортировкой.
+type clientCursor struct {
+	Sort string
+	Text string `json:",omitempty"`
+	Int  int64  `json:",omitempty"`
+	Id   int64
+}
+
+// ListClients - постраничный список клиентов. Пагинация по курсору (значение сортировки, id)
+// не пропускает и не повторяет строки, если между запросами добавились клиенты.
+// Менеджер подразделения видит только клиентов своего подразделения: filter.BranchId
+// заменяется его подразделением; головной офис фильтрует по любому или видит всех.
+func ListClients(managerId int64, filter ClientFilter, db *sql.DB) (page ClientPage, err error) {
+	branchId, err := managerBranch(db, managerId)
+	if err != nil {
+		return ClientPage{}, err
+	}
+	if branchId != 0 {
+		filter.BranchId = branchId
+	}
+	if filter.SortBy == "" {
+		filter.SortBy = "id"
+	}
+	textColumn, ok := clientSortColumns[filter.SortBy]
+	if !ok {
+		return ClientPage{}, ErrInvalidSortColumn
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultClientsPageSize
+	}
+	if limit > maxClientsPageSize {
+		limit = maxClientsPageSize
+	}
+
+	args := clientFilterArgs(filter)
+	err = db.QueryRow(countClientsSQL, args...).Scan(&page.Total)
+	if err != nil {
+		return ClientPage{}, queryError(countClientsSQL, err)
+	}
+
+	direction, compare := "ASC", ">"
+	if filter.Descending {
+		direction, compare = "DESC", "<"
+	}
+	query := listClientsSQL
+	if filter.Cursor != "" {
+		cursor, err := decodeClientCursor(filter.Cursor)
+		if err != nil {
+			return ClientPage{}, err
+		}
+		if cursor.Sort != filter.SortBy+" "+direction {
+			return ClientPage{}, ErrInvalidCursor
+		}
+		var value interface{} = cursor.Int
+		if textColumn {
+			value = cursor.Text
+		}
+		query += fmt.Sprintf("\n  AND (%[1]s %[2]s :cursor_value OR %[1]s = :cursor_value AND id %[2]s :cursor_id)",
+			filter.SortBy, compare)
+		args = append(args, sql.Named("cursor_value", value), sql.Named("cursor_id", cursor.Id))
+	}
+	// строка сверх limit показывает, что есть следующая страница
+	query += fmt.Sprintf("\nORDER BY %[1]s %[2]s, id %[2]s LIMIT %[3]d;", filter.SortBy, direction, limit+1)
+
+	page.Clients, err = queryClientSummaries(db, query, args)
+	if err != nil {
+		return ClientPage{}, err
+	}
+	if len(page.Clients) > limit {
+		page.Clients = page.Clients[:limit]
+		page.NextCursor = encodeClientCursor(page.Clients[limit-1], filter.SortBy, direction)
+	}
+	return page, nil
+}
+
+func clientFilterArgs(filter ClientFilter) []interface{} {
+	name := strings.TrimSpace(filter.Name)
+	if name != "" {
+		name = "%" + name + "%"
+	}
+	phone := strings.TrimSpace(filter.Phone)
+	if strings.HasPrefix(phone, "+") {
+		phone = localPhone(phone)
+	}
+	if phone != "" {
+		phone = "%" + phone + "%"
+	}
+	return []interface{}{
+		sql.Named("now", timeNow().Unix()),
+		sql.Named("name", name),
+		sql.Named("phone", phone),
+		sql.Named("min_balance", nullableInt(filter.MinBalance)),
+		sql.Named("max_balance", nullableInt(filter.MaxBalance)),
+		sql.Named("status", filter.Status),
+		sql.Named("kyc_status", filter.KycStatus),
+		sql.Named("branch_id", filter.BranchId),
+	}
+}
+
+func queryClientSummaries(db *sql.DB, query string, args []interface{}) (clients []ClientSummary, err error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, queryError(query, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			clients, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		client := ClientSummary{}
+		err = rows.Scan(&client.Id, &client.Name, &client.Surname, &client.Login, &client.Phone,
+			&client.Balance, &client.BalanceNumber, &client.BranchId, &client.Deposits, &client.KycStatus, &client.Status)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		clients = append(clients, client)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return clients, nil
+}
+
+func encodeClientCursor(last ClientSummary, sortBy string, direction string) string {
+	cursor := clientCursor{Sort: sortBy + " " + direction, Id: last.Id}
+	switch sortBy {
+	case "id":
+		cursor.Int = last.Id
+	case "name":
+		cursor.Text = last.Name
+	case "surname":
+		cursor.Text = last.Surname
+	case "login":
+		cursor.Text = last.Login
+	case "phone":
+		cursor.Text = last.Phone
+	case "balance":
+		cursor.Int = last.Balance
+	case "balance_number":
+		cursor.Int = last.BalanceNumber
+	case "branch_id":
+		cursor.Int = last.BranchId
+	case "deposits":
+		cursor.Int = last.Deposits
+	case "kyc_status":
+		cursor.Text = last.KycStatus
+	case "status":
+		cursor.Text = last.Status
+	}
+	encoded, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeClientCursor(encoded string) (cursor clientCursor, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return clientCursor{}, ErrInvalidCursor
+	}
+	err = json.Unmarshal(data, &cursor)
+	if err != nil {
+		return clientCursor{}, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+func nullableInt(value *int64) sql.NullInt64 {
+	if value == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: *value, Valid: true}
+}
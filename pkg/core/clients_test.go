@@ -0,0 +1,90 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestListClients_FilterSortPaginate(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 500, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 100, 1002)
+	saliId := addTestClient(t, db, "sali", 933333333, 300, 1003)
+	boboId := addTestClient(t, db, "bobo", 934444444, 300, 1004)
+	_, err := FreezeClient(ManagerActor(1), valiId, "check", time.Time{}, db)
+	if err != nil {
+		t.Fatalf("can't freeze client: %v", err)
+	}
+
+	page, err := ListClients(1, ClientFilter{Name: "ALI"}, db)
+	if err != nil {
+		t.Fatalf("can't list clients: %v", err)
+	}
+	if page.Total != 3 || len(page.Clients) != 3 || page.NextCursor != "" {
+		t.Errorf("unexpected name search: %+v", page)
+	}
+
+	page, err = ListClients(1, ClientFilter{Phone: "+92222"}, db)
+	if err != nil {
+		t.Fatalf("can't list clients: %v", err)
+	}
+	if page.Total != 1 || page.Clients[0].Id != valiId || page.Clients[0].Status != ClientStatusFrozen {
+		t.Errorf("unexpected phone search: %+v", page)
+	}
+
+	min, max := int64(200), int64(400)
+	page, err = ListClients(1, ClientFilter{MinBalance: &min, MaxBalance: &max, Status: ClientStatusActive}, db)
+	if err != nil {
+		t.Fatalf("can't list clients: %v", err)
+	}
+	if page.Total != 2 {
+		t.Errorf("unexpected balance range: %+v", page)
+	}
+
+	// по убыванию баланса страницами по 2: у двух клиентов баланс 300, между ними порядок по id тоже убывающий
+	filter := ClientFilter{SortBy: "balance", Descending: true, Limit: 2}
+	var ids []int64
+	for {
+		page, err = ListClients(1, filter, db)
+		if err != nil {
+			t.Fatalf("can't list clients: %v", err)
+		}
+		if page.Total != 4 {
+			t.Errorf("total depends on page: %d", page.Total)
+		}
+		for _, client := range page.Clients {
+			ids = append(ids, client.Id)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+	if len(ids) != 4 || ids[0] != aliId || ids[1] != boboId || ids[2] != saliId || ids[3] != valiId {
+		t.Errorf("unexpected order: %v", ids)
+	}
+
+	if _, err := ListClients(1, ClientFilter{SortBy: "password"}, db); !errors.Is(err, ErrInvalidSortColumn) {
+		t.Errorf("not ErrInvalidSortColumn: %v", err)
+	}
+	if _, err := ListClients(1, ClientFilter{SortBy: "name", Cursor: filter.Cursor}, db); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("cursor of other sort accepted: %v", err)
+	}
+}
+
+func TestGetBalanceList(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 500, 1001)
+	_ = addTestClient(t, db, "vali", 922222222, 100, 1002)
+
+	list, err := GetBalanceList(db, 1, clientId)
+	if err != nil {
+		t.Fatalf("can't get balance list: %v", err)
+	}
+	if len(list) != 1 || list[0].Id != clientId || list[0].Balance != 500 || list[0].BalanceNumber != 1001 {
+		t.Errorf("unexpected balance list: %+v", list)
+	}
+}
@@ -0,0 +1,451 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// статусы срочного вклада
+const (
+	DepositActive    = "active"
+	DepositMatured   = "matured"
+	DepositWithdrawn = "withdrawn"
+)
+
+var ErrInvalidDepositProduct = errors.New("invalid deposit product")
+var ErrDepositProductNotFound = errors.New("deposit product not found")
+var ErrDepositBelowMinimum = errors.New("deposit amount below product minimum")
+var ErrDepositNotFound = errors.New("deposit not found")
+var ErrDepositNotActive = errors.New("deposit is not active")
+
+// DepositProduct - срочный вклад: срок в месяцах, годовая ставка и пониженная ставка
+// при досрочном снятии в базисных пунктах
+type DepositProduct struct {
+	Id          int64
+	Name        string
+	TermMonths  int
+	RateBp      int64
+	EarlyRateBp int64
+	MinAmount   int64
+}
+
+func (receiver DepositProduct) Validate() error {
+	if strings.TrimSpace(receiver.Name) == "" || receiver.TermMonths <= 0 || receiver.MinAmount <= 0 {
+		return ErrInvalidDepositProduct
+	}
+	if receiver.RateBp <= 0 || receiver.EarlyRateBp < 0 || receiver.EarlyRateBp > receiver.RateBp {
+		return ErrInvalidDepositProduct
+	}
+	return nil
+}
+
+// TermDeposit - срочный вклад клиента. Сумма списывается с баланса при открытии и возвращается
+// с процентами (act/365, без капитализации) в срок MaturesOn. При Rollover вклад
+// продлевается на новый срок по текущей ставке продукта с причисленными процентами.
+type TermDeposit struct {
+	Id          int64
+	ClientId    int64
+	ProductId   int64
+	Principal   int64
+	TermMonths  int
+	RateBp      int64
+	EarlyRateBp int64
+	Rollover    bool
+	Status      string
+	OpenedOn    time.Time
+	MaturesOn   time.Time
+	Payout      int64
+	ClosedAt    time.Time
+}
+
+func AddDepositProduct(product DepositProduct, db *sql.DB) (int64, error) {
+	err := product.Validate()
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.Exec(
+		insertDepositProductSQL,
+		sql.Named("name", strings.TrimSpace(product.Name)),
+		sql.Named("term_months", product.TermMonths),
+		sql.Named("rate_bp", product.RateBp),
+		sql.Named("early_rate_bp", product.EarlyRateBp),
+		sql.Named("min_amount", product.MinAmount),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func ListDepositProducts(db *sql.DB) (products []DepositProduct, err error) {
+	rows, err := db.Query(listDepositProductsSQL)
+	if err != nil {
+		return nil, queryError(listDepositProductsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			products, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		product, err := scanDepositProduct(rows)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		products = append(products, product)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return products, nil
+}
+
+func scanDepositProduct(row scanner) (product DepositProduct, err error) {
+	err = row.Scan(&product.Id, &product.Name, &product.TermMonths, &product.RateBp, &product.EarlyRateBp, &product.MinAmount)
+	return product, err
+}
+
+func getDepositProduct(q queryRower, productId int64) (DepositProduct, error) {
+	product, err := scanDepositProduct(q.QueryRow(getDepositProductSQL, productId))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return DepositProduct{}, ErrDepositProductNotFound
+		}
+		return DepositProduct{}, queryError(getDepositProductSQL, err)
+	}
+	return product, nil
+}
+
+// OpenTermDeposit переводит amount с баланса клиента во вклад
+func OpenTermDeposit(clientId int64, productId int64, amount int64, rollover bool, db *sql.DB) (deposit TermDeposit, err error) {
+	if amount <= 0 {
+		return TermDeposit{}, ErrInvalidAmount
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return TermDeposit{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	product, err := getDepositProduct(tx, productId)
+	if err != nil {
+		return TermDeposit{}, err
+	}
+	if amount < product.MinAmount {
+		return TermDeposit{}, ErrDepositBelowMinimum
+	}
+	before, err := getClientBalance(tx, clientId)
+	if err != nil {
+		return TermDeposit{}, err
+	}
+	// вклад открывается только из собственных средств, не из овердрафта
+	if before < amount {
+		return TermDeposit{}, ErrInsufficientFunds
+	}
+	err = checkClientActive(tx, clientId)
+	if err != nil {
+		return TermDeposit{}, err
+	}
+
+	now := timeNow()
+	_, err = insertOperation(tx, Operation{
+		Type:      OperationDepositOpen,
+		ClientId:  clientId,
+		Amount:    amount,
+		CreatedAt: now,
+	})
+	if err != nil {
+		return TermDeposit{}, err
+	}
+	err = changeClientBalance(tx, clientId, -amount)
+	if err != nil {
+		return TermDeposit{}, err
+	}
+
+	deposit = TermDeposit{
+		ClientId:    clientId,
+		ProductId:   productId,
+		Principal:   amount,
+		TermMonths:  product.TermMonths,
+		RateBp:      product.RateBp,
+		EarlyRateBp: product.EarlyRateBp,
+		Rollover:    rollover,
+		Status:      DepositActive,
+		OpenedOn:    time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()),
+	}
+	deposit.MaturesOn = addMonths(deposit.OpenedOn, deposit.TermMonths)
+	result, err := tx.Exec(
+		insertDepositSQL,
+		sql.Named("client_id", deposit.ClientId),
+		sql.Named("product_id", deposit.ProductId),
+		sql.Named("principal", deposit.Principal),
+		sql.Named("term_months", deposit.TermMonths),
+		sql.Named("rate_bp", deposit.RateBp),
+		sql.Named("early_rate_bp", deposit.EarlyRateBp),
+		sql.Named("rollover", deposit.Rollover),
+		sql.Named("opened_on", deposit.OpenedOn.Format(dateLayout)),
+		sql.Named("matures_on", deposit.MaturesOn.Format(dateLayout)),
+	)
+	if err != nil {
+		return TermDeposit{}, err
+	}
+	deposit.Id, err = result.LastInsertId()
+	if err != nil {
+		return TermDeposit{}, err
+	}
+
+	err = auditClientBalance(tx, ClientActor(clientId), AuditDepositOpen, clientId, before)
+	if err != nil {
+		return TermDeposit{}, err
+	}
+	return deposit, nil
+}
+
+// WithdrawTermDeposit закрывает вклад до срока: проценты за фактические дни по пониженной ставке.
+// Вклад, срок которого наступил, но ещё не обработан DepositMaturityJob, выплачивается полностью.
+func WithdrawTermDeposit(clientId int64, depositId int64, db *sql.DB) (deposit TermDeposit, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return TermDeposit{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	deposit, err = getDeposit(tx, depositId, time.Local)
+	if err != nil {
+		return TermDeposit{}, err
+	}
+	if deposit.ClientId != clientId {
+		return TermDeposit{}, ErrDepositNotFound
+	}
+	if deposit.Status != DepositActive {
+		return TermDeposit{}, ErrDepositNotActive
+	}
+
+	now := timeNow()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	status, rate, until := DepositWithdrawn, deposit.EarlyRateBp, today
+	if !today.Before(deposit.MaturesOn) {
+		status, rate, until = DepositMatured, deposit.RateBp, deposit.MaturesOn
+	}
+	interest := depositInterest(deposit.Principal, rate, deposit.OpenedOn, until)
+	err = payOutDeposit(tx, ClientActor(clientId), &deposit, status, interest, now)
+	if err != nil {
+		return TermDeposit{}, err
+	}
+	return deposit, nil
+}
+
+// DepositMaturityJob - ежедневная обработка вкладов, срок которых наступил: выплата
+// на баланс или пролонгация. Пропущенные сроки пролонгации догоняются по очереди.
+type DepositMaturityJob struct {
+	db    *sql.DB
+	clock Clock
+}
+
+func NewDepositMaturityJob(db *sql.DB, clock Clock) *DepositMaturityJob {
+	return &DepositMaturityJob{db: db, clock: clock}
+}
+
+// RunDue возвращает обработанные вклады в новом состоянии
+func (receiver *DepositMaturityJob) RunDue() ([]TermDeposit, error) {
+	now := receiver.clock.Now()
+	deposits, err := listDeposits(receiver.db, listMaturedDepositsSQL, now.Format(dateLayout), now.Location())
+	if err != nil {
+		return nil, err
+	}
+
+	processed := make([]TermDeposit, 0, len(deposits))
+	for _, deposit := range deposits {
+		deposit, err = receiver.mature(deposit, now)
+		if err != nil {
+			return processed, err
+		}
+		processed = append(processed, deposit)
+	}
+	return processed, nil
+}
+
+func (receiver *DepositMaturityJob) mature(deposit TermDeposit, now time.Time) (_ TermDeposit, err error) {
+	tx, err := receiver.db.Begin()
+	if err != nil {
+		return TermDeposit{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for deposit.Rollover && !deposit.MaturesOn.After(today) {
+		product, err := getDepositProduct(tx, deposit.ProductId)
+		if err != nil {
+			return TermDeposit{}, err
+		}
+		before := deposit
+		deposit.Principal += depositInterest(deposit.Principal, deposit.RateBp, deposit.OpenedOn, deposit.MaturesOn)
+		deposit.RateBp, deposit.EarlyRateBp = product.RateBp, product.EarlyRateBp
+		deposit.OpenedOn = deposit.MaturesOn
+		deposit.MaturesOn = addMonths(deposit.OpenedOn, deposit.TermMonths)
+		_, err = tx.Exec(
+			rollOverDepositSQL,
+			sql.Named("id", deposit.Id),
+			sql.Named("principal", deposit.Principal),
+			sql.Named("rate_bp", deposit.RateBp),
+			sql.Named("early_rate_bp", deposit.EarlyRateBp),
+			sql.Named("opened_on", deposit.OpenedOn.Format(dateLayout)),
+			sql.Named("matures_on", deposit.MaturesOn.Format(dateLayout)),
+		)
+		if err != nil {
+			return TermDeposit{}, err
+		}
+		err = writeAudit(tx, SystemActor, AuditDepositRollover, AuditEntityDeposit, deposit.Id, before, deposit)
+		if err != nil {
+			return TermDeposit{}, err
+		}
+	}
+	if deposit.Rollover {
+		return deposit, nil
+	}
+
+	interest := depositInterest(deposit.Principal, deposit.RateBp, deposit.OpenedOn, deposit.MaturesOn)
+	err = payOutDeposit(tx, SystemActor, &deposit, DepositMatured, interest, now)
+	if err != nil {
+		return TermDeposit{}, err
+	}
+	return deposit, nil
+}
+
+// payOutDeposit зачисляет вклад с процентами на баланс и закрывает его со статусом status
+func payOutDeposit(tx *sql.Tx, actor Actor, deposit *TermDeposit, status string, interest int64, now time.Time) error {
+	before, err := getClientBalance(tx, deposit.ClientId)
+	if err != nil {
+		return err
+	}
+	deposit.Payout = deposit.Principal + interest
+	_, err = insertOperation(tx, Operation{
+		Type:      OperationDepositPayout,
+		ClientId:  deposit.ClientId,
+		Amount:    deposit.Payout,
+		CreatedAt: now,
+	})
+	if err != nil {
+		return err
+	}
+	err = changeClientBalance(tx, deposit.ClientId, deposit.Payout)
+	if err != nil {
+		return err
+	}
+
+	deposit.Status = status
+	deposit.ClosedAt = time.Unix(now.Unix(), 0)
+	_, err = tx.Exec(
+		closeDepositSQL,
+		sql.Named("id", deposit.Id),
+		sql.Named("status", deposit.Status),
+		sql.Named("payout", deposit.Payout),
+		sql.Named("closed_at", deposit.ClosedAt.Unix()),
+	)
+	if err != nil {
+		return err
+	}
+	return auditClientBalance(tx, actor, AuditDepositPayout, deposit.ClientId, before)
+}
+
+// depositInterest - простые проценты act/365 за дни с from по to, с округлением вниз до дирама
+func depositInterest(principal int64, rateBp int64, from time.Time, to time.Time) int64 {
+	days := daysBetween(from, to)
+	if days <= 0 {
+		return 0
+	}
+	return principal * rateBp * days / (10000 * 365)
+}
+
+// daysBetween - число календарных дней между датами, независимо от перехода на летнее время
+func daysBetween(from time.Time, to time.Time) int64 {
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	end := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	return int64(end.Sub(start).Hours() / 24)
+}
+
+func GetTermDeposit(depositId int64, db *sql.DB) (TermDeposit, error) {
+	return getDeposit(db, depositId, time.Local)
+}
+
+func getDeposit(q queryRower, depositId int64, location *time.Location) (TermDeposit, error) {
+	deposit, err := scanDeposit(q.QueryRow(getDepositSQL, depositId), location)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return TermDeposit{}, ErrDepositNotFound
+		}
+		return TermDeposit{}, queryError(getDepositSQL, err)
+	}
+	return deposit, nil
+}
+
+func ListClientTermDeposits(clientId int64, db *sql.DB) ([]TermDeposit, error) {
+	return listDeposits(db, listClientDepositsSQL, clientId, time.Local)
+}
+
+func listDeposits(db *sql.DB, query string, arg interface{}, location *time.Location) (deposits []TermDeposit, err error) {
+	rows, err := db.Query(query, arg)
+	if err != nil {
+		return nil, queryError(query, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			deposits, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		deposit, err := scanDeposit(rows, location)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		deposits = append(deposits, deposit)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return deposits, nil
+}
+
+func scanDeposit(row scanner, location *time.Location) (deposit TermDeposit, err error) {
+	var openedOn, maturesOn string
+	var closedAt sql.NullInt64
+	err = row.Scan(&deposit.Id, &deposit.ClientId, &deposit.ProductId, &deposit.Principal, &deposit.TermMonths,
+		&deposit.RateBp, &deposit.EarlyRateBp, &deposit.Rollover, &deposit.Status, &openedOn, &maturesOn,
+		&deposit.Payout, &closedAt)
+	if err != nil {
+		return TermDeposit{}, err
+	}
+	if closedAt.Valid {
+		deposit.ClosedAt = time.Unix(closedAt.Int64, 0)
+	}
+	deposit.OpenedOn, err = time.ParseInLocation(dateLayout, openedOn, location)
+	if err != nil {
+		return TermDeposit{}, err
+	}
+	deposit.MaturesOn, err = time.ParseInLocation(dateLayout, maturesOn, location)
+	return deposit, err
+}
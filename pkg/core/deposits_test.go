@@ -0,0 +1,144 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func addTestDepositProduct(t *testing.T, db *sql.DB, termMonths int) int64 {
+	productId, err := AddDepositProduct(DepositProduct{Name: "Term " + strconv.Itoa(termMonths), TermMonths: termMonths,
+		RateBp: 1000, EarlyRateBp: 100, MinAmount: 1000}, db)
+	if err != nil {
+		t.Fatalf("can't add deposit product: %v", err)
+	}
+	return productId
+}
+
+func TestOpenTermDeposit_ShownInListings(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 15000, 1001)
+
+	if _, err := AddDepositProduct(DepositProduct{Name: "Broken", TermMonths: 3, RateBp: 100, EarlyRateBp: 200, MinAmount: 1}, db); !errors.Is(err, ErrInvalidDepositProduct) {
+		t.Errorf("not ErrInvalidDepositProduct: %v", err)
+	}
+	productId := addTestDepositProduct(t, db, 12)
+	if _, err := OpenTermDeposit(clientId, productId, 500, false, db); !errors.Is(err, ErrDepositBelowMinimum) {
+		t.Errorf("not ErrDepositBelowMinimum: %v", err)
+	}
+	if _, err := OpenTermDeposit(clientId, productId+1, 5000, false, db); !errors.Is(err, ErrDepositProductNotFound) {
+		t.Errorf("not ErrDepositProductNotFound: %v", err)
+	}
+	if _, err := OpenTermDeposit(clientId, productId, 20000, false, db); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("not ErrInsufficientFunds: %v", err)
+	}
+
+	deposit, err := OpenTermDeposit(clientId, productId, 10000, false, db)
+	if err != nil {
+		t.Fatalf("can't open deposit: %v", err)
+	}
+	if deposit.Status != DepositActive || deposit.MaturesOn != addMonths(deposit.OpenedOn, 12) {
+		t.Errorf("unexpected deposit: %+v", deposit)
+	}
+
+	page, err := ListClients(1, ClientFilter{}, db)
+	if err != nil {
+		t.Fatalf("can't list clients: %v", err)
+	}
+	if len(page.Clients) != 1 || page.Clients[0].Balance != 5000 || page.Clients[0].Deposits != 10000 {
+		t.Errorf("deposit not listed: %+v", page.Clients)
+	}
+	balances, err := GetBalanceList(db, 1, clientId)
+	if err != nil {
+		t.Fatalf("can't get balance list: %v", err)
+	}
+	if len(balances) != 1 || balances[0].Balance != 5000 || balances[0].Deposits != 10000 {
+		t.Errorf("deposit not in balance list: %+v", balances)
+	}
+}
+
+func TestDepositMaturityJob_PayoutAndRollover(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return time.Date(2021, 1, 15, 12, 0, 0, 0, time.Local) }
+
+	aliId := addTestClient(t, db, "ali", 921111111, 100000, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 100000, 1002)
+	productId := addTestDepositProduct(t, db, 3)
+	payout, err := OpenTermDeposit(aliId, productId, 100000, false, db)
+	if err != nil {
+		t.Fatalf("can't open deposit: %v", err)
+	}
+	rollover, err := OpenTermDeposit(valiId, productId, 100000, true, db)
+	if err != nil {
+		t.Fatalf("can't open deposit: %v", err)
+	}
+
+	clock := &testClock{now: time.Date(2021, 4, 14, 9, 0, 0, 0, time.Local)}
+	job := NewDepositMaturityJob(db, clock)
+	processed, err := job.RunDue()
+	if err != nil || len(processed) != 0 {
+		t.Fatalf("matured early: %+v %v", processed, err)
+	}
+
+	// 90 дней по 10%: 100000 * 0.1 * 90 / 365 = 2465.75
+	clock.now = time.Date(2021, 4, 15, 9, 0, 0, 0, time.Local)
+	processed, err = job.RunDue()
+	if err != nil || len(processed) != 2 {
+		t.Fatalf("unexpected maturity: %+v %v", processed, err)
+	}
+	payout, _ = GetTermDeposit(payout.Id, db)
+	if payout.Status != DepositMatured || payout.Payout != 102465 || clientBalance(t, db, aliId) != 102465 {
+		t.Errorf("unexpected payout: %+v", payout)
+	}
+
+	// пропущенная пролонгация: второй срок - 91 день на 102465
+	clock.now = time.Date(2021, 7, 16, 9, 0, 0, 0, time.Local)
+	_, err = job.RunDue()
+	if err != nil {
+		t.Fatalf("can't roll over: %v", err)
+	}
+	rollover, _ = GetTermDeposit(rollover.Id, db)
+	if rollover.Status != DepositActive || rollover.Principal != 102465+2554 ||
+		rollover.MaturesOn != time.Date(2021, 10, 15, 0, 0, 0, 0, time.Local) || clientBalance(t, db, valiId) != 0 {
+		t.Errorf("unexpected rollover: %+v", rollover)
+	}
+}
+
+func TestWithdrawTermDeposit_Early(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return time.Date(2021, 1, 15, 12, 0, 0, 0, time.Local) }
+
+	aliId := addTestClient(t, db, "ali", 921111111, 100000, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	deposit, err := OpenTermDeposit(aliId, addTestDepositProduct(t, db, 12), 100000, true, db)
+	if err != nil {
+		t.Fatalf("can't open deposit: %v", err)
+	}
+	if _, err := WithdrawTermDeposit(valiId, deposit.Id, db); !errors.Is(err, ErrDepositNotFound) {
+		t.Errorf("other client withdrew deposit: %v", err)
+	}
+
+	// 30 дней по пониженной ставке 1%: 82.19
+	timeNow = func() time.Time { return time.Date(2021, 2, 14, 12, 0, 0, 0, time.Local) }
+	deposit, err = WithdrawTermDeposit(aliId, deposit.Id, db)
+	if err != nil {
+		t.Fatalf("can't withdraw: %v", err)
+	}
+	if deposit.Status != DepositWithdrawn || deposit.Payout != 100082 || clientBalance(t, db, aliId) != 100082 {
+		t.Errorf("unexpected withdrawal: %+v", deposit)
+	}
+	if _, err := WithdrawTermDeposit(aliId, deposit.Id, db); !errors.Is(err, ErrDepositNotActive) {
+		t.Errorf("not ErrDepositNotActive: %v", err)
+	}
+	deposits, err := ListClientTermDeposits(aliId, db)
+	if err != nil || len(deposits) != 1 || deposits[0].Status != DepositWithdrawn {
+		t.Errorf("unexpected deposits: %+v %v", deposits, err)
+	}
+}
@@ -0,0 +1,342 @@
+package core
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// типы доменных событий
+const (
+	EventClientRegistered  = "client_registered"
+	EventBalanceChanged    = "balance_changed"
+	EventSaleCompleted     = "sale_completed"
+	EventAtmAdded          = "atm_added"
+	EventServiceAdded      = "service_added"
+	EventServicePaid       = "service_paid"
+	EventTransferCompleted = "transfer_completed"
+	EventTopUpCompleted    = "top_up_completed"
+	EventNewDeviceLogin    = "new_device_login"
+)
+
+const defaultEventBatchSize = 100
+const defaultEventRetryBackoff = time.Minute
+const defaultEventMaxBackoff = time.Hour
+
+// Event - доменное событие из outbox. Aggregate и AggregateId - сущность, к которой
+// относится событие: события одной сущности доставляются строго в порядке Id.
+// Payload - JSON одной из структур ClientRegistered, BalanceChanged ..., см. Decode.
+type Event struct {
+	Id          int64
+	Type        string
+	Aggregate   string
+	AggregateId int64
+	Payload     string
+	CreatedAt   time.Time
+	Attempts    int
+	LastError   string
+}
+
+func (receiver Event) Decode(payload interface{}) error {
+	return json.Unmarshal([]byte(receiver.Payload), payload)
+}
+
+type ClientRegistered struct {
+	ClientId      int64
+	Name          string
+	Login         string
+	PhoneNumber   int64
+	Balance       uint64
+	BalanceNumber uint64
+}
+
+type BalanceChanged struct {
+	ClientId int64
+	Before   int64
+	After    int64
+}
+
+type SaleCompleted struct {
+	SaleId        int64
+	ProductId     int64
+	Qty           int64
+	Amount        int64
+	ReceiptNumber string
+}
+
+type ServicePaid struct {
+	PaymentId     int64
+	ClientId      int64
+	ServiceId     int64
+	ProviderId    int64
+	Amount        int64
+	Fee           int64
+	ReceiptNumber string
+}
+
+// TransferCompleted - перевод между клиентами, со счёта клиента или на его счёт;
+// 0 в ClientId или TargetClientId - другая сторона вне банка
+type TransferCompleted struct {
+	OperationId    int64
+	ClientId       int64
+	TargetClientId int64
+	Amount         int64
+	ReceiptNumber  string
+}
+
+// TopUpCompleted - зачисление на счёт клиента извне банка: пополнение по телефону,
+// номеру счёта или менеджером
+type TopUpCompleted struct {
+	OperationId   int64
+	ClientId      int64
+	Amount        int64
+	ReceiptNumber string
+}
+
+type NewDeviceLogin struct {
+	ClientId   int64
+	DeviceId   string
+	LoggedInAt time.Time
+}
+
+type AtmAdded struct {
+	AtmId   int64
+	Name    string
+	Address string
+}
+
+type ServiceAdded struct {
+	ServiceId int64
+	Name      string
+	Price     int64
+}
+
+// publishEvent кладёт событие в outbox в транзакции изменения: событие появляется
+// только вместе с изменением, а доставляет его EventDispatcher после коммита
+func publishEvent(tx *sql.Tx, eventType string, aggregate string, aggregateId int64, payload interface{}) error {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	now := timeNow().Unix()
+	_, err = tx.Exec(
+		insertOutboxEventSQL,
+		sql.Named("type", eventType),
+		sql.Named("aggregate", aggregate),
+		sql.Named("aggregate_id", aggregateId),
+		sql.Named("payload", string(encoded)),
+		sql.Named("created_at", now),
+	)
+	return err
+}
+
+// publishBalanceChanged публикует BalanceChanged после того, как баланс клиента изменился на delta
+func publishBalanceChanged(tx *sql.Tx, clientId int64, delta int64) error {
+	after, err := getClientBalance(tx, clientId)
+	if err != nil {
+		return err
+	}
+	return publishEvent(tx, EventBalanceChanged, AuditEntityClient, clientId, BalanceChanged{
+		ClientId: clientId,
+		Before:   after - delta,
+		After:    after,
+	})
+}
+
+// EventHandler обрабатывает событие; ошибка - событие будет доставлено этому подписчику повторно
+type EventHandler func(event Event) error
+
+type eventSubscriber struct {
+	name    string
+	types   map[string]bool
+	handler EventHandler
+}
+
+func (receiver eventSubscriber) accepts(eventType string) bool {
+	return len(receiver.types) == 0 || receiver.types[eventType]
+}
+
+// EventDispatcher доставляет события из outbox подписчикам "хотя бы один раз": подписчик
+// может получить событие повторно (например, после падения между обработкой и отметкой
+// о доставке) и должен отбрасывать дубли по Event.Id. Пока событие не доставлено всем
+// подписчикам, следующие события той же сущности ждут; при ошибке подписчика событие
+// повторяется через RetryBackoff, 2*RetryBackoff ... но не реже, чем раз в MaxBackoff.
+type EventDispatcher struct {
+	db           *sql.DB
+	clock        Clock
+	subscribers  []eventSubscriber
+	BatchSize    int
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+}
+
+func NewEventDispatcher(db *sql.DB, clock Clock) *EventDispatcher {
+	return &EventDispatcher{
+		db:           db,
+		clock:        clock,
+		BatchSize:    defaultEventBatchSize,
+		RetryBackoff: defaultEventRetryBackoff,
+		MaxBackoff:   defaultEventMaxBackoff,
+	}
+}
+
+// Subscribe регистрирует подписчика на события eventTypes (без типов - на все).
+// По name запоминается, кому событие уже доставлено, поэтому имя не должно меняться между запусками.
+func (receiver *EventDispatcher) Subscribe(name string, handler EventHandler, eventTypes ...string) {
+	types := make(map[string]bool, len(eventTypes))
+	for _, eventType := range eventTypes {
+		types[eventType] = true
+	}
+	receiver.subscribers = append(receiver.subscribers, eventSubscriber{name: name, types: types, handler: handler})
+}
+
+// Dispatch доставляет все события, срок доставки которых наступил, и возвращает
+// число событий, доставленных всем подписчикам
+func (receiver *EventDispatcher) Dispatch() (delivered int, err error) {
+	now := receiver.clock.Now()
+	for {
+		// в выборку попадает только первое недоставленное событие каждой сущности,
+		// поэтому после доставки пачки выбираем снова
+		events, err := listEvents(receiver.db, listDueEventsSQL, sql.Named("now", now.Unix()), sql.Named("limit", receiver.BatchSize))
+		if err != nil {
+			return delivered, err
+		}
+		if len(events) == 0 {
+			return delivered, nil
+		}
+		for _, event := range events {
+			ok, err := receiver.deliver(event, now)
+			if err != nil {
+				return delivered, err
+			}
+			if ok {
+				delivered++
+			}
+		}
+	}
+}
+
+func (receiver *EventDispatcher) deliver(event Event, now time.Time) (bool, error) {
+	done, err := eventDeliveries(receiver.db, event.Id)
+	if err != nil {
+		return false, err
+	}
+
+	var failure error
+	for _, subscriber := range receiver.subscribers {
+		if done[subscriber.name] || !subscriber.accepts(event.Type) {
+			continue
+		}
+		err = subscriber.handler(event)
+		if err != nil {
+			if failure == nil {
+				failure = fmt.Errorf("%s: %w", subscriber.name, err)
+			}
+			continue
+		}
+		_, err = receiver.db.Exec(
+			insertEventDeliverySQL,
+			sql.Named("event_id", event.Id),
+			sql.Named("subscriber", subscriber.name),
+			sql.Named("delivered_at", now.Unix()),
+		)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if failure != nil {
+		attempts := event.Attempts + 1
+		_, err = receiver.db.Exec(
+			retryEventSQL,
+			sql.Named("id", event.Id),
+			sql.Named("attempts", attempts),
+			sql.Named("next_attempt_at", now.Add(receiver.backoff(attempts)).Unix()),
+			sql.Named("last_error", failure.Error()),
+		)
+		return false, err
+	}
+	_, err = receiver.db.Exec(markEventDeliveredSQL, sql.Named("id", event.Id), sql.Named("delivered_at", now.Unix()))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (receiver *EventDispatcher) backoff(attempts int) time.Duration {
+	return exponentialBackoff(receiver.RetryBackoff, receiver.MaxBackoff, attempts)
+}
+
+// exponentialBackoff - пауза перед повтором после attempts неудачных попыток: base, 2*base, 4*base ... не больше max
+func exponentialBackoff(base time.Duration, max time.Duration, attempts int) time.Duration {
+	backoff := base
+	for attempt := 1; attempt < attempts && backoff < max; attempt++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
+
+// ListPendingEvents - ещё не доставленные события в порядке публикации, с числом попыток и последней ошибкой
+func ListPendingEvents(db *sql.DB) ([]Event, error) {
+	return listEvents(db, listPendingEventsSQL)
+}
+
+func listEvents(db *sql.DB, query string, args ...interface{}) (events []Event, err error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, queryError(query, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			events, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		event := Event{}
+		var createdAt int64
+		err = rows.Scan(&event.Id, &event.Type, &event.Aggregate, &event.AggregateId, &event.Payload,
+			&createdAt, &event.Attempts, &event.LastError)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		event.CreatedAt = time.Unix(createdAt, 0)
+		events = append(events, event)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return events, nil
+}
+
+func eventDeliveries(db *sql.DB, eventId int64) (done map[string]bool, err error) {
+	rows, err := db.Query(listEventDeliveriesSQL, eventId)
+	if err != nil {
+		return nil, queryError(listEventDeliveriesSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			done, err = nil, dbError(innerErr)
+		}
+	}()
+
+	done = make(map[string]bool)
+	for rows.Next() {
+		var subscriber string
+		err = rows.Scan(&subscriber)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		done[subscriber] = true
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return done, nil
+}
@@ -0,0 +1,129 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPublishEvent_InChangeTransaction(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 100, 1001)
+
+	err := TransactionPlus(921111111, 50, db)
+	if err != nil {
+		t.Fatalf("can't top up: %v", err)
+	}
+	if err := TransactionPlus(929999999, 50, db); err == nil {
+		t.Fatalf("top up of unknown phone")
+	}
+	err = Sale(1, 2, db)
+	if err != nil {
+		t.Fatalf("can't sale: %v", err)
+	}
+	err = AddAtm("T1", "rudaki 65", db)
+	if err != nil {
+		t.Fatalf("can't add atm: %v", err)
+	}
+
+	events, err := ListPendingEvents(db)
+	if err != nil {
+		t.Fatalf("can't list events: %v", err)
+	}
+	types := []string{EventClientRegistered, EventBalanceChanged, EventTopUpCompleted, EventSaleCompleted, EventAtmAdded}
+	if len(events) != len(types) {
+		t.Fatalf("rolled back change published or event lost: %+v", events)
+	}
+	for index, event := range events {
+		if event.Type != types[index] {
+			t.Errorf("event %d: got %s, want %s", index, event.Type, types[index])
+		}
+	}
+
+	changed := BalanceChanged{}
+	err = events[1].Decode(&changed)
+	if err != nil {
+		t.Fatalf("can't decode payload: %v", err)
+	}
+	if events[1].AggregateId != clientId || changed != (BalanceChanged{ClientId: clientId, Before: 100, After: 150}) {
+		t.Errorf("unexpected balance event: %+v %+v", events[1], changed)
+	}
+}
+
+func TestEventDispatcher_RetriesInAggregateOrder(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 100, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 100, 1002)
+	err := TransactionPlus(921111111, 10, db)
+	if err != nil {
+		t.Fatalf("can't top up: %v", err)
+	}
+
+	clock := &testClock{now: time.Now()}
+	dispatcher := NewEventDispatcher(db, clock)
+	var logged, mailed []int64
+	dispatcher.Subscribe("log", func(event Event) error {
+		logged = append(logged, event.Id)
+		return nil
+	})
+	mailerDown := true
+	dispatcher.Subscribe("mailer", func(event Event) error {
+		if mailerDown && event.AggregateId == aliId {
+			return errors.New("smtp timeout")
+		}
+		mailed = append(mailed, event.AggregateId)
+		return nil
+	}, EventClientRegistered, EventBalanceChanged)
+
+	delivered, err := dispatcher.Dispatch()
+	if err != nil {
+		t.Fatalf("can't dispatch: %v", err)
+	}
+	// у ali первое событие не доставлено mailer, пополнение ждёт; vali доставлен
+	if delivered != 1 || len(mailed) != 1 || mailed[0] != valiId || len(logged) != 2 {
+		t.Errorf("unexpected first dispatch: %d %v %v", delivered, mailed, logged)
+	}
+	pending, err := ListPendingEvents(db)
+	if err != nil {
+		t.Fatalf("can't list events: %v", err)
+	}
+	if len(pending) != 3 || pending[0].Attempts != 1 || pending[0].LastError != "mailer: smtp timeout" {
+		t.Errorf("unexpected pending events: %+v", pending)
+	}
+
+	mailerDown = false
+	delivered, err = dispatcher.Dispatch()
+	if err != nil {
+		t.Fatalf("can't dispatch: %v", err)
+	}
+	if delivered != 0 {
+		t.Errorf("retried before backoff: %d", delivered)
+	}
+
+	clock.now = clock.now.Add(dispatcher.RetryBackoff)
+	delivered, err = dispatcher.Dispatch()
+	if err != nil {
+		t.Fatalf("can't dispatch: %v", err)
+	}
+	if delivered != 3 || len(mailed) != 3 || mailed[1] != aliId || mailed[2] != aliId {
+		t.Errorf("unexpected retry: %d %v", delivered, mailed)
+	}
+	// log уже получил первое событие ali и повторно его не получает
+	if len(logged) != 4 || logged[2] != pending[1].Id || logged[3] != pending[2].Id {
+		t.Errorf("unexpected log deliveries: %v", logged)
+	}
+}
+
+func TestEventDispatcher_Backoff(t *testing.T) {
+	dispatcher := NewEventDispatcher(nil, SystemClock{})
+	dispatcher.RetryBackoff = time.Minute
+	dispatcher.MaxBackoff = 5 * time.Minute
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for index, backoff := range expected {
+		if got := dispatcher.backoff(index + 1); got != backoff {
+			t.Errorf("attempt %d: got %v, want %v", index+1, got, backoff)
+		}
+	}
+}
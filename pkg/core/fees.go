@@ -0,0 +1,539 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// сегменты клиентов для тарифов
+const (
+	SegmentStandard = "standard"
+	SegmentPremium  = "premium"
+	SegmentBusiness = "business"
+)
+
+// BankAccountFeeRevenue - счёт доходов банка, на который зачисляются комиссии
+const BankAccountFeeRevenue = "fee_revenue"
+
+var ErrInvalidFeeSchedule = errors.New("invalid fee schedule")
+var ErrFeeScheduleNotFound = errors.New("fee schedule not found")
+var ErrInvalidSegment = errors.New("invalid client segment")
+
+// feeOperationTypes - операции, за которые можно брать комиссию
+var feeOperationTypes = map[string]bool{
+	OperationTransfer:       true,
+	OperationServicePayment: true,
+	OperationAtmWithdrawal:  true,
+}
+
+var clientSegments = map[string]bool{
+	SegmentStandard: true,
+	SegmentPremium:  true,
+	SegmentBusiness: true,
+}
+
+// FeeTier - ступень тарифа: действует для сумм от FromAmount до следующей ступени
+// и заменяет Fixed и PercentBp тарифа
+type FeeTier struct {
+	FromAmount int64
+	Fixed      int64
+	PercentBp  int64
+}
+
+// FeeSchedule - тариф на тип операции для сегмента клиентов; пустой Segment - для всех
+// сегментов, у которых нет своего тарифа. Комиссия Fixed + PercentBp от суммы (округление вверх)
+// ограничивается MinFee и MaxFee (0 - без верхней границы). Первые FreePerMonth операций
+// клиента этого типа в календарном месяце бесплатны.
+type FeeSchedule struct {
+	Id            int64
+	OperationType string
+	Segment       string
+	Fixed         int64
+	PercentBp     int64
+	MinFee        int64
+	MaxFee        int64
+	FreePerMonth  int
+	Tiers         []FeeTier
+}
+
+func (receiver FeeSchedule) Validate() error {
+	if !feeOperationTypes[receiver.OperationType] {
+		return ErrInvalidFeeSchedule
+	}
+	if receiver.Segment != "" && !clientSegments[receiver.Segment] {
+		return ErrInvalidSegment
+	}
+	if receiver.Fixed < 0 || receiver.PercentBp < 0 || receiver.MinFee < 0 || receiver.MaxFee < 0 || receiver.FreePerMonth < 0 {
+		return ErrInvalidFeeSchedule
+	}
+	if receiver.MaxFee != 0 && receiver.MaxFee < receiver.MinFee {
+		return ErrInvalidFeeSchedule
+	}
+	seen := make(map[int64]bool)
+	for _, tier := range receiver.Tiers {
+		if tier.FromAmount < 0 || tier.Fixed < 0 || tier.PercentBp < 0 || seen[tier.FromAmount] {
+			return ErrInvalidFeeSchedule
+		}
+		seen[tier.FromAmount] = true
+	}
+	return nil
+}
+
+// Fee - комиссия за операцию на amount без учёта бесплатной квоты
+func (receiver FeeSchedule) Fee(amount int64) int64 {
+	fixed, percentBp := receiver.Fixed, receiver.PercentBp
+	var from int64 = -1
+	for _, tier := range receiver.Tiers {
+		if tier.FromAmount <= amount && tier.FromAmount > from {
+			fixed, percentBp, from = tier.Fixed, tier.PercentBp, tier.FromAmount
+		}
+	}
+	fee := fixed + (amount*percentBp+9999)/10000
+	if fee < receiver.MinFee {
+		fee = receiver.MinFee
+	}
+	if receiver.MaxFee != 0 && fee > receiver.MaxFee {
+		fee = receiver.MaxFee
+	}
+	return fee
+}
+
+// FeePosting - зачисление комиссии на счёт доходов банка
+type FeePosting struct {
+	Id             int64
+	Account        string
+	ClientId       int64
+	OperationType  string
+	OperationId    int64
+	FeeOperationId int64
+	Amount         int64
+	CreatedAt      time.Time
+}
+
+// SetFeeSchedule создаёт тариф или заменяет тариф с тем же типом операции и сегментом.
+// Тарифы общие для всего банка и меняются только головным офисом.
+func SetFeeSchedule(managerId int64, schedule FeeSchedule, db *sql.DB) (id int64, err error) {
+	err = schedule.Validate()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkHeadOffice(tx, managerId)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(
+		upsertFeeScheduleSQL,
+		sql.Named("operation_type", schedule.OperationType),
+		sql.Named("segment", schedule.Segment),
+		sql.Named("fixed", schedule.Fixed),
+		sql.Named("percent_bp", schedule.PercentBp),
+		sql.Named("min_fee", schedule.MinFee),
+		sql.Named("max_fee", schedule.MaxFee),
+		sql.Named("free_per_month", schedule.FreePerMonth),
+	)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.QueryRow(getFeeScheduleIdSQL, schedule.OperationType, schedule.Segment).Scan(&id)
+	if err != nil {
+		return 0, queryError(getFeeScheduleIdSQL, err)
+	}
+	_, err = tx.Exec(deleteFeeTiersSQL, id)
+	if err != nil {
+		return 0, err
+	}
+	for _, tier := range schedule.Tiers {
+		_, err = tx.Exec(
+			insertFeeTierSQL,
+			sql.Named("schedule_id", id),
+			sql.Named("from_amount", tier.FromAmount),
+			sql.Named("fixed", tier.Fixed),
+			sql.Named("percent_bp", tier.PercentBp),
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+	schedule.Id = id
+	return id, writeAudit(tx, ManagerActor(managerId), AuditFeeSchedule, AuditEntityFee, id, nil, schedule)
+}
+
+func DeleteFeeSchedule(managerId int64, scheduleId int64, db *sql.DB) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkHeadOffice(tx, managerId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(deleteFeeTiersSQL, scheduleId)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(deleteFeeScheduleSQL, scheduleId)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrFeeScheduleNotFound
+	}
+	return writeAudit(tx, ManagerActor(managerId), AuditFeeSchedule, AuditEntityFee, scheduleId, nil, nil)
+}
+
+func ListFeeSchedules(db *sql.DB) (schedules []FeeSchedule, err error) {
+	rows, err := db.Query(listFeeSchedulesSQL)
+	if err != nil {
+		return nil, queryError(listFeeSchedulesSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			schedules, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		schedule, err := scanFeeSchedule(rows)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		schedules = append(schedules, schedule)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	for index := range schedules {
+		schedules[index].Tiers, err = listFeeTiers(db, schedules[index].Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return schedules, nil
+}
+
+func scanFeeSchedule(row scanner) (schedule FeeSchedule, err error) {
+	err = row.Scan(&schedule.Id, &schedule.OperationType, &schedule.Segment, &schedule.Fixed, &schedule.PercentBp,
+		&schedule.MinFee, &schedule.MaxFee, &schedule.FreePerMonth)
+	return schedule, err
+}
+
+func listFeeTiers(q queryer, scheduleId int64) (tiers []FeeTier, err error) {
+	rows, err := q.Query(listFeeTiersSQL, scheduleId)
+	if err != nil {
+		return nil, queryError(listFeeTiersSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			tiers, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		tier := FeeTier{}
+		err = rows.Scan(&tier.FromAmount, &tier.Fixed, &tier.PercentBp)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		tiers = append(tiers, tier)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return tiers, nil
+}
+
+// SetClientSegment переводит клиента в сегмент, по которому выбираются тарифы
+func SetClientSegment(managerId int64, clientId int64, segment string, db *sql.DB) (err error) {
+	if !clientSegments[segment] {
+		return ErrInvalidSegment
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkClientScope(tx, managerId, clientId)
+	if err != nil {
+		return err
+	}
+	before, err := getClientSegment(tx, clientId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(updateClientSegmentSQL, sql.Named("id", clientId), sql.Named("segment", segment))
+	if err != nil {
+		return err
+	}
+	return writeAudit(tx, ManagerActor(managerId), AuditSegment, AuditEntityClient, clientId, before, segment)
+}
+
+func getClientSegment(q queryRower, clientId int64) (segment string, err error) {
+	err = q.QueryRow(getClientSegmentSQL, clientId).Scan(&segment)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrClientNotFound
+		}
+		return "", queryError(getClientSegmentSQL, err)
+	}
+	return segment, nil
+}
+
+// QuoteFee - комиссия, которую клиент заплатит за следующую операцию на amount
+func QuoteFee(clientId int64, operationType string, amount int64, db *sql.DB) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	return operationFee(tx, clientId, operationType, amount, 1, timeNow())
+}
+
+// operationFee выбирает тариф сегмента клиента (или общий) и считает комиссию;
+// pending - операции, ещё не записанные в историю, now - время операции: по его месяцу
+// считаются бесплатные операции
+func operationFee(tx *sql.Tx, clientId int64, operationType string, amount int64, pending int, now time.Time) (int64, error) {
+	segment, err := getClientSegment(tx, clientId)
+	if err != nil {
+		return 0, err
+	}
+	schedule, err := scanFeeSchedule(tx.QueryRow(
+		getClientFeeScheduleSQL,
+		sql.Named("operation_type", operationType),
+		sql.Named("segment", segment),
+	))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, queryError(getClientFeeScheduleSQL, err)
+	}
+
+	if schedule.FreePerMonth > 0 {
+		monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		var count int
+		err = tx.QueryRow(
+			countMonthOperationsSQL,
+			sql.Named("client_id", clientId),
+			sql.Named("type", operationType),
+			sql.Named("from", monthStart.Unix()),
+			sql.Named("to", monthStart.AddDate(0, 1, 0).Unix()),
+		).Scan(&count)
+		if err != nil {
+			return 0, queryError(countMonthOperationsSQL, err)
+		}
+		if count+pending <= schedule.FreePerMonth {
+			return 0, nil
+		}
+	}
+
+	schedule.Tiers, err = listFeeTiers(tx, schedule.Id)
+	if err != nil {
+		return 0, err
+	}
+	return schedule.Fee(amount), nil
+}
+
+// applyFee списывает комиссию за уже записанную операцию operationId, проведённую в now,
+// в той же транзакции (с карты cardId, если она указана) и зачисляет её на счёт доходов банка
+func applyFee(tx *sql.Tx, clientId int64, cardId int64, operationType string, operationId int64, amount int64, now time.Time) (int64, error) {
+	fee, err := operationFee(tx, clientId, operationType, amount, 0, now)
+	if err != nil || fee == 0 {
+		return 0, err
+	}
+
+	var feeOperationId int64
+	if cardId == 0 {
+		overdraftFeeId, err := allowDebit(tx, clientId, fee)
+		if err != nil {
+			return 0, err
+		}
+		err = linkOverdraftFee(tx, overdraftFeeId, operationType, operationId)
+		if err != nil {
+			return 0, err
+		}
+		feeOperationId, err = chargeClient(tx, clientId, OperationFee, fee)
+	} else {
+		feeOperationId, err = chargeCard(tx, cardId, OperationFee, fee)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	err = postFeeRevenue(tx, clientId, operationType, operationId, feeOperationId, fee)
+	if err != nil {
+		return 0, err
+	}
+	return fee, nil
+}
+
+// postFeeRevenue зачисляет комиссию на счёт доходов банка. feeOperationId - операция, которой
+// комиссия списана с клиента: отдельная операция fee или сама операция, если комиссия входит в её сумму
+func postFeeRevenue(tx *sql.Tx, clientId int64, operationType string, operationId int64, feeOperationId int64, fee int64) error {
+	if fee == 0 {
+		return nil
+	}
+	_, err := tx.Exec(
+		postBankAccountSQL,
+		sql.Named("code", BankAccountFeeRevenue),
+		sql.Named("amount", fee),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		insertFeePostingSQL,
+		sql.Named("account", BankAccountFeeRevenue),
+		sql.Named("client_id", clientId),
+		sql.Named("operation_type", operationType),
+		sql.Named("operation_id", operationId),
+		sql.Named("fee_operation_id", feeOperationId),
+		sql.Named("amount", fee),
+		sql.Named("created_at", timeNow().Unix()),
+	)
+	return err
+}
+
+// refundFeeRevenue списывает со счёта доходов комиссии, которые клиент заплатил операцией
+// feeOperationId: отдельной операцией fee или в составе суммы самой операции.
+// Сами деньги клиенту возвращает compensate.
+func refundFeeRevenue(tx *sql.Tx, feeOperationId int64) error {
+	_, err := tx.Exec(refundFeeRevenueSQL, sql.Named("fee_operation_id", feeOperationId))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		markFeesRefundedSQL,
+		sql.Named("fee_operation_id", feeOperationId),
+		sql.Named("refunded_at", timeNow().Unix()),
+	)
+	return err
+}
+
+// listUnrefundedFeeOperations - отдельные операции fee, которыми взята комиссия за операцию
+func listUnrefundedFeeOperations(tx *sql.Tx, operationId int64) (ids []int64, err error) {
+	rows, err := tx.Query(listUnrefundedFeeOperationsSQL, operationId)
+	if err != nil {
+		return nil, queryError(listUnrefundedFeeOperationsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			ids, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		ids = append(ids, id)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return ids, nil
+}
+
+// chargeCard списывает сбор банка с карты и баланса её владельца в пределах остатка карты и овердрафта
+func chargeCard(tx *sql.Tx, cardId int64, operationType string, amount int64) (int64, error) {
+	card, err := getCard(tx, cardId)
+	if err != nil {
+		return 0, err
+	}
+	overdraftFeeId, err := allowCardDebit(tx, card, amount)
+	if err != nil {
+		return 0, err
+	}
+	operationId, err := insertOperation(tx, Operation{
+		Type:      operationType,
+		ClientId:  card.UserId,
+		CardId:    card.Id,
+		Amount:    amount,
+		CreatedAt: timeNow(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = linkOverdraftFee(tx, overdraftFeeId, operationType, operationId)
+	if err != nil {
+		return 0, err
+	}
+	return operationId, moveCardBalance(tx, card, -amount)
+}
+
+// GetBankAccountBalance - остаток на внутреннем счёте банка
+func GetBankAccountBalance(code string, db *sql.DB) (balance int64, err error) {
+	err = db.QueryRow(getBankAccountBalanceSQL, code).Scan(&balance)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, queryError(getBankAccountBalanceSQL, err)
+	}
+	return balance, nil
+}
+
+// ListFeePostings - комиссии, зачисленные в [from, to)
+func ListFeePostings(from time.Time, to time.Time, db *sql.DB) (postings []FeePosting, err error) {
+	rows, err := db.Query(listFeePostingsSQL, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, queryError(listFeePostingsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			postings, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		posting := FeePosting{}
+		var createdAt int64
+		err = rows.Scan(&posting.Id, &posting.Account, &posting.ClientId, &posting.OperationType, &posting.OperationId,
+			&posting.FeeOperationId, &posting.Amount, &createdAt)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		posting.CreatedAt = time.Unix(createdAt, 0)
+		postings = append(postings, posting)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return postings, nil
+}
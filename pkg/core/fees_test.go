@@ -0,0 +1,184 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFeeSchedule_Fee(t *testing.T) {
+	schedule := FeeSchedule{
+		OperationType: OperationTransfer,
+		Fixed:         10,
+		PercentBp:     100,
+		MinFee:        20,
+		MaxFee:        500,
+		Tiers:         []FeeTier{{FromAmount: 100000, PercentBp: 50}, {FromAmount: 10000, Fixed: 5, PercentBp: 80}},
+	}
+	if err := schedule.Validate(); err != nil {
+		t.Fatalf("valid schedule rejected: %v", err)
+	}
+	tests := []struct {
+		amount int64
+		fee    int64
+	}{
+		{amount: 500, fee: 20},
+		{amount: 5001, fee: 61},
+		{amount: 10000, fee: 85},
+		{amount: 200000, fee: 500},
+	}
+	for _, test := range tests {
+		if fee := schedule.Fee(test.amount); fee != test.fee {
+			t.Errorf("fee for %d: got %d, want %d", test.amount, fee, test.fee)
+		}
+	}
+
+	invalid := []FeeSchedule{
+		{OperationType: OperationTopUp},
+		{OperationType: OperationTransfer, MinFee: 100, MaxFee: 50},
+		{OperationType: OperationTransfer, Tiers: []FeeTier{{FromAmount: 10}, {FromAmount: 10}}},
+	}
+	for _, schedule := range invalid {
+		if err := schedule.Validate(); !errors.Is(err, ErrInvalidFeeSchedule) {
+			t.Errorf("invalid schedule accepted: %+v %v", schedule, err)
+		}
+	}
+	if err := (FeeSchedule{OperationType: OperationTransfer, Segment: "vip"}).Validate(); !errors.Is(err, ErrInvalidSegment) {
+		t.Errorf("not ErrInvalidSegment: %v", err)
+	}
+}
+
+func TestApplyFee_PhoneTransfer(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return time.Date(2021, 3, 10, 12, 0, 0, 0, time.Local) }
+
+	aliId := addTestClient(t, db, "ali", 921111111, 10000, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 10000, 1002)
+	_, err := SetFeeSchedule(2, FeeSchedule{OperationType: OperationTransfer, Fixed: 10}, db)
+	if !errors.Is(err, ErrHeadOfficeOnly) {
+		t.Errorf("not ErrHeadOfficeOnly: %v", err)
+	}
+	_, err = SetFeeSchedule(1, FeeSchedule{OperationType: OperationTransfer, Fixed: 10, PercentBp: 100, FreePerMonth: 1}, db)
+	if err != nil {
+		t.Fatalf("can't set fee schedule: %v", err)
+	}
+	_, err = SetFeeSchedule(1, FeeSchedule{OperationType: OperationTransfer, Segment: SegmentPremium}, db)
+	if err != nil {
+		t.Fatalf("can't set fee schedule: %v", err)
+	}
+	if err := SetClientSegment(1, valiId, "vip", db); !errors.Is(err, ErrInvalidSegment) {
+		t.Errorf("not ErrInvalidSegment: %v", err)
+	}
+	err = SetClientSegment(1, valiId, SegmentPremium, db)
+	if err != nil {
+		t.Fatalf("can't set segment: %v", err)
+	}
+
+	if fee, err := QuoteFee(aliId, OperationTransfer, 1000, db); err != nil || fee != 0 {
+		t.Errorf("free quota not quoted: %d %v", fee, err)
+	}
+	for _, phone := range []int64{921111111, 921111111, 922222222, 922222222} {
+		err = TransactionMinus(Client{PhoneNumber: phone, Balance: 1000}, db)
+		if err != nil {
+			t.Fatalf("can't transfer: %v", err)
+		}
+	}
+	if balance := clientBalance(t, db, aliId); balance != 10000-2000-20 {
+		t.Errorf("unexpected fee charged: %d", balance)
+	}
+	if balance := clientBalance(t, db, valiId); balance != 10000-2000 {
+		t.Errorf("premium schedule ignored: %d", balance)
+	}
+
+	revenue, err := GetBankAccountBalance(BankAccountFeeRevenue, db)
+	if err != nil || revenue != 20 {
+		t.Errorf("fee not posted to revenue: %d %v", revenue, err)
+	}
+	postings, err := ListFeePostings(timeNow().AddDate(0, 0, -1), timeNow().AddDate(0, 0, 1), db)
+	if err != nil || len(postings) != 1 || postings[0].ClientId != aliId || postings[0].Amount != 20 {
+		t.Errorf("unexpected postings: %+v %v", postings, err)
+	}
+
+	// новая квота в следующем месяце
+	timeNow = func() time.Time { return time.Date(2021, 4, 1, 12, 0, 0, 0, time.Local) }
+	if fee, err := QuoteFee(aliId, OperationTransfer, 1000, db); err != nil || fee != 0 {
+		t.Errorf("quota not renewed: %d %v", fee, err)
+	}
+}
+
+func TestApplyFee_CardTransferWithinOverdraft(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	aliCard := issueTestCard(t, db, aliId, 1000)
+	valiCard := issueTestCard(t, db, valiId, 0)
+	_, err := SetFeeSchedule(1, FeeSchedule{OperationType: OperationTransfer, MinFee: 30}, db)
+	if err != nil {
+		t.Fatalf("can't set fee schedule: %v", err)
+	}
+
+	if _, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 1000, db); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("fee beyond balance charged: %v", err)
+	}
+	receipt, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 900, db)
+	if err != nil {
+		t.Fatalf("can't transfer: %v", err)
+	}
+	if receipt.Fee != 30 || *receipt.BalanceAfter != 70 || clientBalance(t, db, aliId) != 70 {
+		t.Errorf("unexpected receipt: %+v", receipt)
+	}
+
+	schedules, err := ListFeeSchedules(db)
+	if err != nil || len(schedules) != 1 {
+		t.Fatalf("unexpected schedules: %+v %v", schedules, err)
+	}
+	if err := DeleteFeeSchedule(1, schedules[0].Id, db); err != nil {
+		t.Errorf("can't delete schedule: %v", err)
+	}
+	if err := DeleteFeeSchedule(1, schedules[0].Id, db); !errors.Is(err, ErrFeeScheduleNotFound) {
+		t.Errorf("not ErrFeeScheduleNotFound: %v", err)
+	}
+}
+
+func TestApplyFee_FreeQuotaByOperationTime(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return time.Date(2021, 4, 1, 12, 0, 0, 0, time.Local) }
+
+	aliId := addTestClient(t, db, "ali", 921111111, 10000, 1001)
+	_, err := SetFeeSchedule(1, FeeSchedule{OperationType: OperationServicePayment, Fixed: 5, FreePerMonth: 1}, db)
+	if err != nil {
+		t.Fatalf("can't set fee schedule: %v", err)
+	}
+	_, err = SetFeeSchedule(1, FeeSchedule{OperationType: OperationTransfer, Fixed: 10, FreePerMonth: 1}, db)
+	if err != nil {
+		t.Fatalf("can't set fee schedule: %v", err)
+	}
+
+	// плановые платежи за март, проведённые уже в апреле, считаются по мартовской квоте
+	march := time.Date(2021, 3, 31, 9, 0, 0, 0, time.Local)
+	first, err := payServiceWithKey("", aliId, 1, "921234567", 10, march, db)
+	if err != nil || first.Fee != 0 {
+		t.Fatalf("free payment charged: %+v %v", first, err)
+	}
+	second, err := payServiceWithKey("", aliId, 1, "921234567", 10, march, db)
+	if err != nil || second.Fee != 5 {
+		t.Errorf("quota of operation month ignored: %+v %v", second, err)
+	}
+
+	// отменённая операция не расходует бесплатную квоту
+	transfer, err := TransactionMinusWithReceipt(Client{PhoneNumber: 921111111, Balance: 100}, db)
+	if err != nil || transfer.Fee != 0 {
+		t.Fatalf("free transfer charged: %+v %v", transfer, err)
+	}
+	if _, err := ReverseTransaction(1, transfer.OperationId, "disputed", db); err != nil {
+		t.Fatalf("can't reverse: %v", err)
+	}
+	if fee, err := QuoteFee(aliId, OperationTransfer, 100, db); err != nil || fee != 0 {
+		t.Errorf("reversed transfer used free quota: %d %v", fee, err)
+	}
+}
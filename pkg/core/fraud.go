@@ -0,0 +1,471 @@
+package core
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FraudAllow  = "allow"
+	FraudReview = "review"
+	FraudBlock  = "block"
+)
+
+// правила антифрода
+const (
+	FraudRuleVelocity      = "velocity"
+	FraudRuleUnusualAmount = "unusual_amount"
+	FraudRuleNewRecipients = "new_recipients"
+	FraudRuleNightAmount   = "night_amount"
+)
+
+const (
+	FraudHoldPending  = "pending"
+	FraudHoldApproved = "approved"
+	FraudHoldRejected = "rejected"
+	FraudHoldExecuted = "executed"
+	FraudHoldBlocked  = "blocked"
+)
+
+var ErrFraudReview = errors.New("operation held for fraud review")
+var ErrFraudBlocked = errors.New("operation blocked by fraud rules")
+var ErrFraudHoldNotFound = errors.New("fraud hold not found")
+var ErrFraudHoldNotPending = errors.New("fraud hold already reviewed")
+var ErrFraudReasonRequired = errors.New("fraud hold rejection reason required")
+
+// FraudSettings - пороги правил антифрода
+type FraudSettings struct {
+	// больше VelocityReview расходных операций за VelocityWindow - проверка, больше VelocityBlock - блокировка
+	VelocityWindow time.Duration
+	VelocityReview int
+	VelocityBlock  int
+	// сумма больше UnusualAmountFactor средних сумм за HistoryPeriod (если операций не меньше MinHistory)
+	HistoryPeriod       time.Duration
+	MinHistory          int
+	UnusualAmountFactor int64
+	// больше NewRecipients получателей, которым клиент раньше не платил, за NewRecipientsWindow
+	NewRecipientsWindow time.Duration
+	NewRecipients       int
+	// сумма от NightAmount с NightFrom до NightTo часов
+	NightFrom   int
+	NightTo     int
+	NightAmount int64
+}
+
+// FraudRules - действующие пороги; операция, отправленная на проверку двумя и более правилами, блокируется
+var FraudRules = FraudSettings{
+	VelocityWindow:      10 * time.Minute,
+	VelocityReview:      5,
+	VelocityBlock:       10,
+	HistoryPeriod:       90 * 24 * time.Hour,
+	MinHistory:          3,
+	UnusualAmountFactor: 5,
+	NewRecipientsWindow: 24 * time.Hour,
+	NewRecipients:       3,
+	NightFrom:           0,
+	NightTo:             6,
+	NightAmount:         100000,
+}
+
+// FraudDecisionError - операция не проведена: отправлена на проверку (Decision = FraudReview,
+// HoldId - удержание для менеджера) или заблокирована. Rules - сработавшие правила.
+type FraudDecisionError struct {
+	HoldId   int64
+	Decision string
+	Rules    []string
+	request  fraudRequest
+}
+
+func (receiver *FraudDecisionError) Error() string {
+	if receiver.Decision == FraudBlock {
+		return fmt.Sprintf("operation blocked by fraud rules: %s", strings.Join(receiver.Rules, ", "))
+	}
+	return fmt.Sprintf("operation held for fraud review (hold %d): %s", receiver.HoldId, strings.Join(receiver.Rules, ", "))
+}
+
+func (receiver *FraudDecisionError) Is(target error) bool {
+	if receiver.Decision == FraudBlock {
+		return target == ErrFraudBlocked
+	}
+	return target == ErrFraudReview
+}
+
+// FraudHold - операция, остановленная правилами. Одобренная менеджером операция
+// проводится заново без проверки правил.
+type FraudHold struct {
+	Id         int64
+	ClientId   int64
+	Operation  string
+	Amount     int64
+	Recipient  string
+	Rules      []string
+	Status     string
+	ManagerId  int64
+	Reason     string
+	CreatedAt  time.Time
+	ReviewedAt time.Time
+	request    fraudRequest
+}
+
+// fraudRequest - проверяемая операция со всеми параметрами, нужными для её повтора после одобрения
+type fraudRequest struct {
+	Operation     string
+	ClientId      int64
+	Amount        int64
+	Recipient     string
+	PhoneNumber   int64  `json:",omitempty"`
+	BalanceNumber uint64 `json:",omitempty"`
+	FromCardId    int64  `json:",omitempty"`
+	ToCardId      int64  `json:",omitempty"`
+	FromPAN       string `json:",omitempty"`
+	ToPAN         string `json:",omitempty"`
+	ServiceId     int64  `json:",omitempty"`
+	PayerAccount  string `json:",omitempty"`
+}
+
+func cardRecipient(card Card) string {
+	return "card:" + strconv.FormatInt(card.Id, 10)
+}
+
+// phoneRecipient и accountRecipient - получатели переводов по номеру телефона и счёта
+func phoneRecipient(phoneNumber int64) string {
+	return "phone:" + strconv.FormatInt(phoneNumber, 10)
+}
+
+func accountRecipient(balanceNumber uint64) string {
+	return "account:" + strconv.FormatUint(balanceNumber, 10)
+}
+
+func serviceRecipient(serviceId int64, payerAccount string) string {
+	return "service:" + strconv.FormatInt(serviceId, 10) + ":" + payerAccount
+}
+
+// screenFraud проверяет расходную операцию правилами в её транзакции. Пропущенная операция
+// попадает в историю для следующих проверок; остановленная возвращает FraudDecisionError,
+// а удержание сохраняет holdForReview после отката транзакции.
+func screenFraud(tx *sql.Tx, request fraudRequest) error {
+	return screenFraudAt(tx, request, timeNow())
+}
+
+// screenFraudAt - screenFraud на момент now
+func screenFraudAt(tx *sql.Tx, request fraudRequest, now time.Time) error {
+	requestHash, err := hashRequest(request)
+	if err != nil {
+		return err
+	}
+
+	var holdId int64
+	err = tx.QueryRow(getApprovedFraudHoldSQL, request.ClientId, requestHash).Scan(&holdId)
+	switch {
+	case err == nil:
+		_, err = tx.Exec(executeFraudHoldSQL, holdId)
+		if err != nil {
+			return err
+		}
+		return recordFraudHistory(tx, request, now)
+	case err != sql.ErrNoRows:
+		return queryError(getApprovedFraudHoldSQL, err)
+	}
+
+	decision, rules, err := evaluateFraudRules(tx, request, FraudRules, now)
+	if err != nil {
+		return err
+	}
+	if decision != FraudAllow {
+		return &FraudDecisionError{Decision: decision, Rules: rules, request: request}
+	}
+	return recordFraudHistory(tx, request, now)
+}
+
+func recordFraudHistory(tx *sql.Tx, request fraudRequest, now time.Time) error {
+	_, err := tx.Exec(
+		insertFraudHistorySQL,
+		sql.Named("client_id", request.ClientId),
+		sql.Named("operation", request.Operation),
+		sql.Named("amount", request.Amount),
+		sql.Named("recipient", request.Recipient),
+		sql.Named("created_at", now.Unix()),
+	)
+	return err
+}
+
+// evaluateFraudRules - решение по операции и сработавшие правила
+func evaluateFraudRules(q queryRower, request fraudRequest, settings FraudSettings, now time.Time) (string, []string, error) {
+	var rules []string
+	decision := FraudAllow
+	flag := func(rule string, ruleDecision string) {
+		rules = append(rules, rule)
+		if ruleDecision == FraudBlock || len(rules) > 1 {
+			decision = FraudBlock
+		} else if decision == FraudAllow {
+			decision = FraudReview
+		}
+	}
+
+	var recent int
+	err := q.QueryRow(countFraudHistorySQL, request.ClientId, now.Add(-settings.VelocityWindow).Unix()).Scan(&recent)
+	if err != nil {
+		return "", nil, queryError(countFraudHistorySQL, err)
+	}
+	if recent+1 > settings.VelocityBlock {
+		flag(FraudRuleVelocity, FraudBlock)
+	} else if recent+1 > settings.VelocityReview {
+		flag(FraudRuleVelocity, FraudReview)
+	}
+
+	var count int
+	var average float64
+	err = q.QueryRow(fraudAverageAmountSQL, request.ClientId, now.Add(-settings.HistoryPeriod).Unix()).Scan(&count, &average)
+	if err != nil {
+		return "", nil, queryError(fraudAverageAmountSQL, err)
+	}
+	if count >= settings.MinHistory && float64(request.Amount) > average*float64(settings.UnusualAmountFactor) {
+		flag(FraudRuleUnusualAmount, FraudReview)
+	}
+
+	if request.Recipient != "" {
+		var known int
+		err = q.QueryRow(countFraudRecipientSQL, request.ClientId, request.Recipient).Scan(&known)
+		if err != nil {
+			return "", nil, queryError(countFraudRecipientSQL, err)
+		}
+		var newRecipients int
+		err = q.QueryRow(countNewFraudRecipientsSQL, request.ClientId, now.Add(-settings.NewRecipientsWindow).Unix()).Scan(&newRecipients)
+		if err != nil {
+			return "", nil, queryError(countNewFraudRecipientsSQL, err)
+		}
+		if known == 0 && newRecipients+1 > settings.NewRecipients {
+			flag(FraudRuleNewRecipients, FraudReview)
+		}
+	}
+
+	hour := now.Hour()
+	if request.Amount >= settings.NightAmount && hour >= settings.NightFrom && hour < settings.NightTo {
+		flag(FraudRuleNightAmount, FraudReview)
+	}
+
+	return decision, rules, nil
+}
+
+// holdForReview вызывается публичными функциями после отката транзакции операции:
+// если правила остановили операцию, сохраняет удержание (или блокировку) и дописывает
+// его id в ошибку. Повтор той же операции до решения менеджера нового удержания не создаёт.
+func holdForReview(err error, db *sql.DB) error {
+	var decision *FraudDecisionError
+	if !errors.As(err, &decision) || decision.HoldId != 0 {
+		return err
+	}
+
+	request := decision.request
+	requestHash, hashErr := hashRequest(request)
+	if hashErr != nil {
+		return hashErr
+	}
+	status := FraudHoldPending
+	if decision.Decision == FraudBlock {
+		status = FraudHoldBlocked
+	}
+	if status == FraudHoldPending {
+		queryErr := db.QueryRow(getPendingFraudHoldSQL, request.ClientId, requestHash).Scan(&decision.HoldId)
+		if queryErr == nil {
+			return decision
+		}
+		if queryErr != sql.ErrNoRows {
+			return queryError(getPendingFraudHoldSQL, queryErr)
+		}
+	}
+
+	encoded, jsonErr := json.Marshal(request)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	result, execErr := db.Exec(
+		insertFraudHoldSQL,
+		sql.Named("client_id", request.ClientId),
+		sql.Named("operation", request.Operation),
+		sql.Named("amount", request.Amount),
+		sql.Named("recipient", request.Recipient),
+		sql.Named("request", string(encoded)),
+		sql.Named("request_hash", requestHash),
+		sql.Named("rules", strings.Join(decision.Rules, ",")),
+		sql.Named("status", status),
+		sql.Named("created_at", timeNow().Unix()),
+	)
+	if execErr != nil {
+		return execErr
+	}
+	decision.HoldId, execErr = result.LastInsertId()
+	if execErr != nil {
+		return execErr
+	}
+	return decision
+}
+
+// ApproveFraudHold одобряет удержанную операцию и сразу проводит её. Если провести не удалось
+// (например, уже не хватает денег), удержание остаётся одобренным: повтор ApproveFraudHold
+// или той же операции клиентом пройдёт без проверки правил.
+func ApproveFraudHold(managerId int64, holdId int64, db *sql.DB) error {
+	hold, err := reviewFraudHold(managerId, holdId, FraudHoldApproved, "", db)
+	if err != nil {
+		return err
+	}
+	return executeFraudHold(hold, db)
+}
+
+func RejectFraudHold(managerId int64, holdId int64, reason string, db *sql.DB) error {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return ErrFraudReasonRequired
+	}
+	_, err := reviewFraudHold(managerId, holdId, FraudHoldRejected, reason, db)
+	return err
+}
+
+func reviewFraudHold(managerId int64, holdId int64, status string, reason string, db *sql.DB) (hold FraudHold, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return FraudHold{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkExists(tx, getManagerIdSQL, managerId, ErrManagerNotFound)
+	if err != nil {
+		return FraudHold{}, err
+	}
+	hold, err = getFraudHold(tx, holdId)
+	if err != nil {
+		return FraudHold{}, err
+	}
+	err = checkClientScope(tx, managerId, hold.ClientId)
+	if err != nil {
+		return FraudHold{}, err
+	}
+	// одобренное, но не проведённое удержание можно одобрить ещё раз, чтобы повторить проведение
+	if hold.Status != FraudHoldPending && !(hold.Status == FraudHoldApproved && status == FraudHoldApproved) {
+		return FraudHold{}, ErrFraudHoldNotPending
+	}
+
+	before := hold
+	hold.Status = status
+	hold.ManagerId = managerId
+	hold.Reason = reason
+	hold.ReviewedAt = time.Unix(timeNow().Unix(), 0)
+	_, err = tx.Exec(
+		reviewFraudHoldSQL,
+		sql.Named("id", holdId),
+		sql.Named("status", hold.Status),
+		sql.Named("manager_id", managerId),
+		sql.Named("reason", reason),
+		sql.Named("reviewed_at", hold.ReviewedAt.Unix()),
+	)
+	if err != nil {
+		return FraudHold{}, err
+	}
+
+	err = writeAudit(tx, ManagerActor(managerId), AuditFraudReview, AuditEntityFraudHold, holdId, before, hold)
+	if err != nil {
+		return FraudHold{}, err
+	}
+	return hold, nil
+}
+
+// executeFraudHold проводит одобренную операцию; ключ идемпотентности не даёт провести её дважды
+func executeFraudHold(hold FraudHold, db *sql.DB) error {
+	key := "fraud-hold-" + strconv.FormatInt(hold.Id, 10)
+	request := hold.request
+	var err error
+	switch request.Operation {
+	case idempotentTransferPhone:
+		_, err = TransactionMinusWithKey(key, Client{PhoneNumber: request.PhoneNumber, Balance: uint64(request.Amount)}, db)
+	case idempotentTransferBalanceNumber:
+		_, err = TransactionBalanceNumberMinusWithKey(key, Client{BalanceNumber: request.BalanceNumber, Balance: uint64(request.Amount)}, db)
+	case idempotentTransferCard:
+		_, err = TransferCardToCardWithKey(key, request.ClientId, request.FromCardId, request.ToCardId, request.Amount, db)
+	case idempotentTransferCardByPAN:
+		_, err = TransferCardToCardByPANWithKey(key, request.ClientId, request.FromPAN, request.ToPAN, request.Amount, db)
+	case idempotentServicePayment:
+		_, err = PayServiceWithKey(key, request.ClientId, request.ServiceId, request.PayerAccount, request.Amount, db)
+	default:
+		err = fmt.Errorf("unknown held operation %s", request.Operation)
+	}
+	return err
+}
+
+func GetFraudHold(holdId int64, db *sql.DB) (FraudHold, error) {
+	return getFraudHold(db, holdId)
+}
+
+func getFraudHold(q queryRower, holdId int64) (FraudHold, error) {
+	hold, err := scanFraudHold(q.QueryRow(getFraudHoldSQL, holdId))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return FraudHold{}, ErrFraudHoldNotFound
+		}
+		return FraudHold{}, queryError(getFraudHoldSQL, err)
+	}
+	return hold, nil
+}
+
+// ListFraudHolds - удержания и блокировки со статусом status (пустой - все), новые первыми;
+// менеджер подразделения видит только удержания своих клиентов
+func ListFraudHolds(managerId int64, status string, db *sql.DB) (holds []FraudHold, err error) {
+	branchId, err := managerBranch(db, managerId)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(listFraudHoldsSQL, sql.Named("status", status), sql.Named("branch_id", branchId))
+	if err != nil {
+		return nil, queryError(listFraudHoldsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			holds, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		hold, err := scanFraudHold(rows)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		holds = append(holds, hold)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return holds, nil
+}
+
+func scanFraudHold(row scanner) (hold FraudHold, err error) {
+	var rules, request string
+	var managerId, reviewedAt sql.NullInt64
+	var createdAt int64
+	err = row.Scan(&hold.Id, &hold.ClientId, &hold.Operation, &hold.Amount, &hold.Recipient, &request,
+		&rules, &hold.Status, &managerId, &hold.Reason, &createdAt, &reviewedAt)
+	if err != nil {
+		return FraudHold{}, err
+	}
+	err = json.Unmarshal([]byte(request), &hold.request)
+	if err != nil {
+		return FraudHold{}, err
+	}
+	hold.Rules = strings.Split(rules, ",")
+	hold.ManagerId = managerId.Int64
+	hold.CreatedAt = time.Unix(createdAt, 0)
+	if reviewedAt.Valid {
+		hold.ReviewedAt = time.Unix(reviewedAt.Int64, 0)
+	}
+	return hold, nil
+}
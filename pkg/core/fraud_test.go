@@ -0,0 +1,213 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func addTestFraudHistory(t *testing.T, db *sql.DB, clientId int64, amount int64, recipient string, createdAt time.Time) {
+	_, err := db.Exec(
+		insertFraudHistorySQL,
+		sql.Named("client_id", clientId),
+		sql.Named("operation", idempotentTransferCard),
+		sql.Named("amount", amount),
+		sql.Named("recipient", recipient),
+		sql.Named("created_at", createdAt.Unix()),
+	)
+	if err != nil {
+		t.Fatalf("can't add fraud history: %v", err)
+	}
+}
+
+func TestEvaluateFraudRules(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	now := time.Date(2020, 5, 10, 14, 0, 0, 0, time.Local)
+	for day := 1; day <= 3; day++ {
+		addTestFraudHistory(t, db, clientId, 1000, "card:1", now.AddDate(0, 0, -day))
+	}
+
+	cases := []struct {
+		name     string
+		request  fraudRequest
+		now      time.Time
+		decision string
+		rules    []string
+	}{
+		{"usual", fraudRequest{ClientId: clientId, Amount: 5000, Recipient: "card:1"}, now, FraudAllow, nil},
+		{"unusual amount", fraudRequest{ClientId: clientId, Amount: 5001, Recipient: "card:1"}, now, FraudReview,
+			[]string{FraudRuleUnusualAmount}},
+		{"night", fraudRequest{ClientId: clientId, Amount: 100000, Recipient: "card:1"}, now.Add(-12 * time.Hour), FraudBlock,
+			[]string{FraudRuleUnusualAmount, FraudRuleNightAmount}},
+	}
+	for _, testCase := range cases {
+		decision, rules, err := evaluateFraudRules(db, testCase.request, FraudRules, testCase.now)
+		if err != nil {
+			t.Fatalf("%s: can't evaluate: %v", testCase.name, err)
+		}
+		if decision != testCase.decision || !reflect.DeepEqual(rules, testCase.rules) {
+			t.Errorf("%s: got %s %v, want %s %v", testCase.name, decision, rules, testCase.decision, testCase.rules)
+		}
+	}
+
+	for minute := 1; minute <= 5; minute++ {
+		addTestFraudHistory(t, db, clientId, 1000, "card:1", now.Add(-time.Duration(minute)*time.Minute))
+	}
+	decision, rules, _ := evaluateFraudRules(db, fraudRequest{ClientId: clientId, Amount: 1000, Recipient: "card:1"}, FraudRules, now)
+	if decision != FraudReview || !reflect.DeepEqual(rules, []string{FraudRuleVelocity}) {
+		t.Errorf("velocity: got %s %v", decision, rules)
+	}
+
+	for index := 2; index <= 4; index++ {
+		addTestFraudHistory(t, db, clientId, 1000, "card:"+strconv.Itoa(index), now.Add(-time.Hour))
+	}
+	decision, rules, _ = evaluateFraudRules(db, fraudRequest{ClientId: clientId, Amount: 1000, Recipient: "card:9"}, FraudRules, now.Add(time.Hour))
+	if decision != FraudReview || !reflect.DeepEqual(rules, []string{FraudRuleNewRecipients}) {
+		t.Errorf("new recipients: got %s %v", decision, rules)
+	}
+}
+
+func TestFraudHold_ApproveExecutes(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	defer func(settings FraudSettings) { FraudRules = settings }(FraudRules)
+	FraudRules.NewRecipients = 1
+
+	aliId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	saliId := addTestClient(t, db, "sali", 933333333, 0, 1003)
+	assignTestBranch(t, db, aliId, 1)
+	aliCard := issueTestCard(t, db, aliId, 1000)
+	valiCard := issueTestCard(t, db, valiId, 0)
+	saliCard := issueTestCard(t, db, saliId, 0)
+
+	_, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 100, db)
+	if err != nil {
+		t.Fatalf("first recipient held: %v", err)
+	}
+	_, err = TransferCardToCard(aliId, aliCard.Id, saliCard.Id, 100, db)
+	var decision *FraudDecisionError
+	if !errors.As(err, &decision) || !errors.Is(err, ErrFraudReview) || decision.HoldId == 0 {
+		t.Fatalf("second new recipient not held: %v", err)
+	}
+	if balance := clientBalance(t, db, saliId); balance != 0 {
+		t.Errorf("held transfer moved money: %d", balance)
+	}
+	_, err = TransferCardToCard(aliId, aliCard.Id, saliCard.Id, 100, db)
+	var repeated *FraudDecisionError
+	if !errors.As(err, &repeated) || repeated.HoldId != decision.HoldId {
+		t.Errorf("repeated request created another hold: %v", err)
+	}
+
+	holds, err := ListFraudHolds(2, FraudHoldPending, db)
+	if err != nil {
+		t.Fatalf("can't list holds: %v", err)
+	}
+	if len(holds) != 1 || holds[0].ClientId != aliId || holds[0].Amount != 100 || holds[0].Rules[0] != FraudRuleNewRecipients {
+		t.Errorf("unexpected holds: %+v", holds)
+	}
+	if holds, err := ListFraudHolds(4, FraudHoldPending, db); err != nil || len(holds) != 0 {
+		t.Errorf("other branch sees holds: %+v %v", holds, err)
+	}
+	if _, err := ListFraudHolds(100, FraudHoldPending, db); !errors.Is(err, ErrManagerNotFound) {
+		t.Errorf("not ErrManagerNotFound: %v", err)
+	}
+
+	err = ApproveFraudHold(2, decision.HoldId, db)
+	if err != nil {
+		t.Fatalf("can't approve hold: %v", err)
+	}
+	if balance := clientBalance(t, db, saliId); balance != 100 {
+		t.Errorf("approved transfer not executed: %d", balance)
+	}
+	hold, err := GetFraudHold(decision.HoldId, db)
+	if err != nil {
+		t.Fatalf("can't get hold: %v", err)
+	}
+	if hold.Status != FraudHoldExecuted || hold.ManagerId != 2 {
+		t.Errorf("unexpected hold: %+v", hold)
+	}
+	if err := ApproveFraudHold(2, decision.HoldId, db); !errors.Is(err, ErrFraudHoldNotPending) {
+		t.Errorf("executed hold approved again: %v", err)
+	}
+}
+
+func TestFraudRuleNewRecipients_PhoneTransfer(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	defer func(settings FraudSettings) { FraudRules = settings }(FraudRules)
+	FraudRules.NewRecipients = 1
+
+	aliId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	aliCard := issueTestCard(t, db, aliId, 1000)
+	valiCard := issueTestCard(t, db, valiId, 0)
+	_, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 100, db)
+	if err != nil {
+		t.Fatalf("first recipient held: %v", err)
+	}
+
+	err = TransactionMinus(Client{PhoneNumber: 921111111, Balance: 100}, db)
+	var decision *FraudDecisionError
+	if !errors.As(err, &decision) || !reflect.DeepEqual(decision.Rules, []string{FraudRuleNewRecipients}) {
+		t.Fatalf("phone transfer to new recipient not held: %v", err)
+	}
+	hold, err := GetFraudHold(decision.HoldId, db)
+	if err != nil || hold.Recipient != "phone:921111111" {
+		t.Errorf("unexpected hold: %+v %v", hold, err)
+	}
+	err = TransactionBalanceNumberMinus(Client{BalanceNumber: 1001, Balance: 100}, db)
+	if !errors.As(err, &decision) || !reflect.DeepEqual(decision.Rules, []string{FraudRuleNewRecipients}) {
+		t.Errorf("account transfer to new recipient not held: %v", err)
+	}
+}
+
+func TestFraudHold_RejectAndBlock(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	defer func(settings FraudSettings) { FraudRules = settings }(FraudRules)
+	FraudRules.VelocityReview = 1
+	_ = addTestClient(t, db, "ali", 921111111, 1000, 1001)
+
+	transfer := Client{PhoneNumber: 921111111, Balance: 10}
+	err := TransactionMinus(transfer, db)
+	if err != nil {
+		t.Fatalf("first transfer held: %v", err)
+	}
+	err = TransactionMinus(transfer, db)
+	var decision *FraudDecisionError
+	if !errors.As(err, &decision) || decision.Decision != FraudReview {
+		t.Fatalf("not held: %v", err)
+	}
+	if err := RejectFraudHold(1, decision.HoldId, " ", db); !errors.Is(err, ErrFraudReasonRequired) {
+		t.Errorf("not ErrFraudReasonRequired: %v", err)
+	}
+	err = RejectFraudHold(1, decision.HoldId, "client confirmed fraud", db)
+	if err != nil {
+		t.Fatalf("can't reject hold: %v", err)
+	}
+	if err := ApproveFraudHold(1, decision.HoldId, db); !errors.Is(err, ErrFraudHoldNotPending) {
+		t.Errorf("rejected hold approved: %v", err)
+	}
+
+	FraudRules.VelocityBlock = 1
+	if err := TransactionMinus(transfer, db); !errors.Is(err, ErrFraudBlocked) {
+		t.Errorf("not ErrFraudBlocked: %v", err)
+	}
+	blocked, err := ListFraudHolds(1, FraudHoldBlocked, db)
+	if err != nil {
+		t.Fatalf("can't list holds: %v", err)
+	}
+	if len(blocked) != 1 || blocked[0].Rules[0] != FraudRuleVelocity {
+		t.Errorf("unexpected blocked list: %+v", blocked)
+	}
+	all, _ := ListFraudHolds(1, "", db)
+	if len(all) != 2 {
+		t.Errorf("unexpected holds: %+v", all)
+	}
+}
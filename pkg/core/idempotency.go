@@ -0,0 +1,130 @@
+package core
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+const (
+	idempotentTransferCard          = "transfer_card"
+	idempotentTransferCardByPAN     = "transfer_card_by_pan"
+	idempotentTransferPhone         = "transfer_phone"
+	idempotentTransferBalanceNumber = "transfer_balance_number"
+	idempotentTopUpPhone            = "top_up_phone"
+	idempotentTopUpBalanceNumber    = "top_up_balance_number"
+	idempotentTopUpClient           = "top_up_client"
+	idempotentServicePayment        = "service_payment"
+	idempotentSale                  = "sale"
+	idempotentAtmWithdrawal         = "atm_withdrawal"
+	idempotentAtmDeposit            = "atm_deposit"
+)
+
+// ErrIdempotencyKeyReused - ключ клиента уже использован для этой операции с другими параметрами
+var ErrIdempotencyKeyReused = errors.New("idempotency key reused with different request")
+
+// idempotent выполняет execute в транзакции tx и сохраняет result под ключом key в той же транзакции.
+// Ключ действует в пределах клиента clientId и операции: одинаковые ключи разных клиентов не мешают
+// друг другу. Если ключ уже есть, в том числе записан параллельным запросом, execute не вызывается:
+// в result загружается сохранённый результат первого вызова. Сохраняются только успешные результаты -
+// после ошибки транзакция откатывается и повтор выполнится заново. Пустой ключ - обычный вызов без идемпотентности.
+func idempotent(tx *sql.Tx, key string, clientId int64, operation string, request interface{}, result interface{}, execute func() error) error {
+	if key == "" {
+		return execute()
+	}
+
+	requestHash, err := hashRequest(request)
+	if err != nil {
+		return err
+	}
+
+	// ключ занимается до выполнения: второй запрос с тем же ключом получает результат первого,
+	// а не ошибку уникальности при сохранении
+	scope := []interface{}{
+		sql.Named("client_id", clientId),
+		sql.Named("operation", operation),
+		sql.Named("key", key),
+	}
+	claimed, err := tx.Exec(claimIdempotencyKeySQL, append(scope,
+		sql.Named("request_hash", requestHash),
+		sql.Named("created_at", timeNow().Unix()),
+	)...)
+	if err != nil {
+		return err
+	}
+	affected, err := claimed.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return replayIdempotent(tx, scope, requestHash, result)
+	}
+
+	err = execute()
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(updateIdempotencyResultSQL, append(scope, sql.Named("result", string(encoded)))...)
+	return err
+}
+
+// replayIdempotent загружает в result сохранённый результат запроса с тем же ключом
+func replayIdempotent(tx *sql.Tx, scope []interface{}, requestHash string, result interface{}) error {
+	var storedHash, storedResult string
+	err := tx.QueryRow(getIdempotencyKeySQL, scope...).Scan(&storedHash, &storedResult)
+	if err != nil {
+		return queryError(getIdempotencyKeySQL, err)
+	}
+	if storedHash != requestHash {
+		return ErrIdempotencyKeyReused
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal([]byte(storedResult), result)
+}
+
+// migrateIdempotencyKeys пересоздаёт таблицу ключей, созданную до разделения ключей по клиентам.
+// Старые ключи не переносятся: клиента по ним не определить, а нужны они только для повторов
+// запросов, отправленных до обновления.
+func migrateIdempotencyKeys(db *sql.DB) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	exists, err := columnExists(tx, "idempotency_key", "client_id")
+	if err != nil || exists {
+		return err
+	}
+	for _, ddl := range []string{dropIdempotencyKeysSQL, idempotencyKeys} {
+		_, err = tx.Exec(ddl)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashRequest(request interface{}) (string, error) {
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
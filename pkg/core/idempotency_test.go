@@ -0,0 +1,209 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestTransactionPlusWithKey_RetryNotCreditedTwice(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 100, 1001)
+
+	for i := 0; i < 3; i++ {
+		_, err := TransactionPlusWithKey("top-up-1", 921111111, 50, db)
+		if err != nil {
+			t.Fatalf("can't top up: %v", err)
+		}
+	}
+	if balance := clientBalance(t, db, clientId); balance != 150 {
+		t.Errorf("top up with same key applied more than once: %d", balance)
+	}
+
+	_, err := TransactionPlusWithKey("top-up-2", 921111111, 50, db)
+	if err != nil {
+		t.Fatalf("can't top up: %v", err)
+	}
+	if balance := clientBalance(t, db, clientId); balance != 200 {
+		t.Errorf("top up with new key not applied: %d", balance)
+	}
+}
+
+func TestUpdateBalanceClientWithKey_RetryNotCreditedTwice(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 100, 1001)
+
+	first, err := UpdateBalanceClientWithKey("credit-1", ManagerActor(1), clientId, 50, db)
+	if err != nil {
+		t.Fatalf("can't update balance: %v", err)
+	}
+	second, err := UpdateBalanceClientWithKey("credit-1", ManagerActor(1), clientId, 50, db)
+	if err != nil || second.Number != first.Number {
+		t.Errorf("repeated call returned other receipt: %+v %+v %v", first, second, err)
+	}
+	if balance := clientBalance(t, db, clientId); balance != 150 {
+		t.Errorf("credit with same key applied more than once: %d", balance)
+	}
+	if _, err := UpdateBalanceClientWithKey("credit-1", ManagerActor(1), clientId, 70, db); !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Errorf("not ErrIdempotencyKeyReused: %v", err)
+	}
+}
+
+func TestTransferCardToCardWithKey_ReturnsOriginalReceipt(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	aliCard := issueTestCard(t, db, aliId, 1000)
+	valiCard := issueTestCard(t, db, valiId, 0)
+
+	first, err := TransferCardToCardWithKey("tr-1", aliId, aliCard.Id, valiCard.Id, 300, db)
+	if err != nil {
+		t.Fatalf("can't transfer: %v", err)
+	}
+	second, err := TransferCardToCardWithKey("tr-1", aliId, aliCard.Id, valiCard.Id, 300, db)
+	if err != nil {
+		t.Fatalf("can't repeat transfer: %v", err)
+	}
+	if first.Number != second.Number || first.OperationId != second.OperationId || !first.CreatedAt.Equal(second.CreatedAt) {
+		t.Errorf("repeated call returned another receipt: %+v, %+v", first, second)
+	}
+	if balance := clientBalance(t, db, aliId); balance != 700 {
+		t.Errorf("transfer with same key applied more than once: %d", balance)
+	}
+
+	_, err = TransferCardToCardWithKey("tr-1", aliId, aliCard.Id, valiCard.Id, 500, db)
+	if !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Errorf("not ErrIdempotencyKeyReused for other amount: %v", err)
+	}
+	// ключ действует в пределах клиента и операции
+	if _, err := PayServiceWithKey("tr-1", aliId, 1, "921234567", 10, db); err != nil {
+		t.Errorf("same key of other operation rejected: %v", err)
+	}
+	if _, err := TransferCardToCardWithKey("tr-1", valiId, valiCard.Id, aliCard.Id, 100, db); err != nil {
+		t.Errorf("same key of other client rejected: %v", err)
+	}
+	if balance := clientBalance(t, db, aliId); balance != 700-10+100 {
+		t.Errorf("operations with other scope not applied: %d", balance)
+	}
+}
+
+func TestPayServiceWithKey_FailedCallNotStored(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 50, 1001)
+
+	_, err := PayServiceWithKey("sp-1", clientId, 1, "921234567", 100, db)
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("not ErrInsufficientFunds: %v", err)
+	}
+	_, err = TransactionPlusWithKey("top-up-1", 921111111, 100, db)
+	if err != nil {
+		t.Fatalf("can't top up: %v", err)
+	}
+
+	first, err := PayServiceWithKey("sp-1", clientId, 1, "921234567", 100, db)
+	if err != nil {
+		t.Fatalf("retry after failure not executed: %v", err)
+	}
+	second, err := PayServiceWithKey("sp-1", clientId, 1, "921234567", 100, db)
+	if err != nil {
+		t.Fatalf("can't repeat payment: %v", err)
+	}
+	if first.Id != second.Id || first.ReceiptNumber != second.ReceiptNumber {
+		t.Errorf("repeated call returned another payment: %+v, %+v", first, second)
+	}
+	if balance := clientBalance(t, db, clientId); balance != 50 {
+		t.Errorf("payment with same key charged more than once: %d", balance)
+	}
+}
+
+func TestWithdrawWithKey_ReturnsOriginalNotes(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	card := issueTestCard(t, db, clientId, 100000)
+	atmId := addTestAtm(t, db)
+	err := ReplenishAtm(1, atmId, Notes{10000: 10, 2000: 10}, db)
+	if err != nil {
+		t.Fatalf("can't replenish atm: %v", err)
+	}
+
+	first, err := WithdrawWithKey("wd-1", atmId, card.Id, 24000, db)
+	if err != nil {
+		t.Fatalf("can't withdraw: %v", err)
+	}
+	second, err := WithdrawWithKey("wd-1", atmId, card.Id, 24000, db)
+	if err != nil {
+		t.Fatalf("can't repeat withdraw: %v", err)
+	}
+	if second.Notes.Total() != 24000 || second.Notes[10000] != first.Notes[10000] || second.Notes[2000] != first.Notes[2000] ||
+		second.Receipt.Number != first.Receipt.Number {
+		t.Errorf("repeated call returned other notes: %v, %v", first, second)
+	}
+	if balance := clientBalance(t, db, clientId); balance != 76000 {
+		t.Errorf("withdraw with same key applied more than once: %d", balance)
+	}
+}
+
+func TestSaleWithKey_ReturnsOriginalReceipt(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+
+	first, err := SaleWithKey("sale-1", 1, 2, db)
+	if err != nil {
+		t.Fatalf("can't sell: %v", err)
+	}
+	second, err := SaleWithKey("sale-1", 1, 2, db)
+	if err != nil {
+		t.Fatalf("can't repeat sale: %v", err)
+	}
+	if first.Number != second.Number {
+		t.Errorf("repeated call returned another receipt: %s, %s", first.Number, second.Number)
+	}
+	var sales int
+	err = db.QueryRow(`SELECT count(*) FROM sales`).Scan(&sales)
+	if err != nil {
+		t.Fatalf("can't count sales: %v", err)
+	}
+	if sales != 1 {
+		t.Errorf("sale with same key applied more than once: %d", sales)
+	}
+}
+
+func TestInit_MigratesIdempotencyKeys(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("can't open db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	defer closeTestDb(t, db)
+	// ключи до разделения по клиентам
+	for _, ddl := range []string{
+		`CREATE TABLE idempotency_key(key TEXT PRIMARY KEY, operation TEXT NOT NULL, request_hash TEXT NOT NULL,
+			result TEXT NOT NULL, created_at INTEGER NOT NULL);`,
+		`INSERT INTO idempotency_key VALUES ('top-up-1', 'top_up_phone', '', '{}', 0);`,
+	} {
+		if _, err := db.Exec(ddl); err != nil {
+			t.Fatalf("can't create old schema: %v", err)
+		}
+	}
+
+	if err := Init(db); err != nil {
+		t.Fatalf("can't init old db: %v", err)
+	}
+	if err := Init(db); err != nil {
+		t.Fatalf("can't init db again: %v", err)
+	}
+	clientId := addTestClient(t, db, "ali", 921111111, 100, 1001)
+	for i := 0; i < 2; i++ {
+		if _, err := TransactionPlusWithKey("top-up-1", 921111111, 50, db); err != nil {
+			t.Fatalf("can't top up: %v", err)
+		}
+	}
+	if balance := clientBalance(t, db, clientId); balance != 150 {
+		t.Errorf("unexpected balance after migration: %d", balance)
+	}
+}
@@ -0,0 +1,432 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// конвенции подсчёта дней
+const (
+	DayCountActual365 = "act/365"
+	DayCountActual360 = "act/360"
+	DayCount30360     = "30/360"
+)
+
+// периоды капитализации
+const (
+	CompoundMonthly   = "monthly"
+	CompoundQuarterly = "quarterly"
+	CompoundYearly    = "yearly"
+)
+
+const (
+	InterestAccrued     = "accrual"
+	InterestCapitalized = "capitalization"
+)
+
+// dateLayout - формат календарных дат (процентов, графиков платежей), хранимых в TEXT
+const dateLayout = "2006-01-02"
+
+var ErrInvalidInterestProduct = errors.New("invalid interest product")
+var ErrInterestProductNotFound = errors.New("interest product not found")
+var ErrSavingsAccountExists = errors.New("savings account already open")
+
+// InterestProduct - сберегательный продукт: годовая ставка в базисных пунктах (1250 = 12.5%),
+// конвенция подсчёта дней и период капитализации
+type InterestProduct struct {
+	Id          int64
+	Name        string
+	RateBp      int64
+	DayCount    string
+	Compounding string
+}
+
+func (receiver InterestProduct) Validate() error {
+	if strings.TrimSpace(receiver.Name) == "" || receiver.RateBp <= 0 || receiver.RateBp > 10000 {
+		return ErrInvalidInterestProduct
+	}
+	switch receiver.DayCount {
+	case DayCountActual365, DayCountActual360, DayCount30360:
+	default:
+		return ErrInvalidInterestProduct
+	}
+	switch receiver.Compounding {
+	case CompoundMonthly, CompoundQuarterly, CompoundYearly:
+	default:
+		return ErrInvalidInterestProduct
+	}
+	return nil
+}
+
+// denominator - знаменатель дневных процентов: проценты за день = баланс * RateBp * дни / denominator
+func (receiver InterestProduct) denominator() int64 {
+	if receiver.DayCount == DayCountActual365 {
+		return 10000 * 365
+	}
+	return 10000 * 360
+}
+
+// days - сколько дней конвенции приходится на календарный день day
+func (receiver InterestProduct) days(day time.Time) int64 {
+	if receiver.DayCount != DayCount30360 {
+		return 1
+	}
+	// 30/360: в каждом месяце 30 дней - 31-е число не считается, последний день февраля добирает до 30
+	if day.Day() == 31 {
+		return 0
+	}
+	if day.Month() == time.February && day.AddDate(0, 0, 1).Month() != time.February {
+		return int64(30 - day.Day() + 1)
+	}
+	return 1
+}
+
+// capitalizesOn - последний ли day день периода капитализации
+func (receiver InterestProduct) capitalizesOn(day time.Time) bool {
+	next := day.AddDate(0, 0, 1)
+	if next.Month() == day.Month() {
+		return false
+	}
+	switch receiver.Compounding {
+	case CompoundQuarterly:
+		return day.Month()%3 == 0
+	case CompoundYearly:
+		return day.Month() == time.December
+	}
+	return true
+}
+
+// InterestAccrual - запись истории процентов: дневное начисление или капитализация.
+// Начисление точное: Numerator / Denominator единиц валюты (дирамов); при капитализации
+// на баланс зачисляется целая часть накопленного (Amount), остаток переходит в следующий период.
+type InterestAccrual struct {
+	Id          int64
+	ClientId    int64
+	ProductId   int64
+	Date        time.Time
+	Kind        string
+	Balance     int64
+	RateBp      int64
+	Days        int64
+	Numerator   int64
+	Denominator int64
+	Amount      int64
+	OperationId int64
+}
+
+func AddInterestProduct(product InterestProduct, db *sql.DB) (int64, error) {
+	err := product.Validate()
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.Exec(
+		insertInterestProductSQL,
+		sql.Named("name", strings.TrimSpace(product.Name)),
+		sql.Named("rate_bp", product.RateBp),
+		sql.Named("day_count", product.DayCount),
+		sql.Named("compounding", product.Compounding),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func ListInterestProducts(db *sql.DB) (products []InterestProduct, err error) {
+	rows, err := db.Query(listInterestProductsSQL)
+	if err != nil {
+		return nil, queryError(listInterestProductsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			products, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		product := InterestProduct{}
+		err = rows.Scan(&product.Id, &product.Name, &product.RateBp, &product.DayCount, &product.Compounding)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		products = append(products, product)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return products, nil
+}
+
+// OpenSavingsAccount начинает начислять проценты по продукту на баланс клиента со следующего дня
+func OpenSavingsAccount(clientId int64, productId int64, db *sql.DB) error {
+	err := checkExists(db, getClientIdSQL, clientId, ErrClientNotFound)
+	if err != nil {
+		return err
+	}
+	err = checkExists(db, getInterestProductIdSQL, productId, ErrInterestProductNotFound)
+	if err != nil {
+		return err
+	}
+	result, err := db.Exec(
+		insertSavingsAccountSQL,
+		sql.Named("client_id", clientId),
+		sql.Named("product_id", productId),
+		sql.Named("today", timeNow().Format(dateLayout)),
+	)
+	if err != nil {
+		return err
+	}
+	opened, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if opened == 0 {
+		return ErrSavingsAccountExists
+	}
+	return nil
+}
+
+// GetInterestHistory - начисления и капитализации клиента по датам
+func GetInterestHistory(clientId int64, db *sql.DB) (history []InterestAccrual, err error) {
+	rows, err := db.Query(listInterestAccrualsSQL, clientId)
+	if err != nil {
+		return nil, queryError(listInterestAccrualsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			history, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		accrual := InterestAccrual{}
+		var date string
+		var operationId sql.NullInt64
+		err = rows.Scan(&accrual.Id, &accrual.ClientId, &accrual.ProductId, &date, &accrual.Kind, &accrual.Balance,
+			&accrual.RateBp, &accrual.Days, &accrual.Numerator, &accrual.Denominator, &accrual.Amount, &operationId)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		accrual.Date, err = time.ParseInLocation(dateLayout, date, time.Local)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		accrual.OperationId = operationId.Int64
+		history = append(history, accrual)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return history, nil
+}
+
+// InterestJob - ежедневное начисление процентов. RunDue начисляет за каждый прошедший
+// и ещё не обработанный день (пропущенные запуски догоняются по текущему балансу)
+// и в последний день периода капитализирует накопленное.
+type InterestJob struct {
+	db    *sql.DB
+	clock Clock
+}
+
+func NewInterestJob(db *sql.DB, clock Clock) *InterestJob {
+	return &InterestJob{db: db, clock: clock}
+}
+
+type savingsAccount struct {
+	clientId       int64
+	product        InterestProduct
+	accruedThrough time.Time
+	numerator      int64
+}
+
+// RunDue возвращает число начисленных клиенто-дней
+func (receiver *InterestJob) RunDue() (int, error) {
+	now := receiver.clock.Now()
+	yesterday := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, now.Location())
+	accounts, err := listSavingsAccounts(receiver.db, yesterday.Format(dateLayout), now.Location())
+	if err != nil {
+		return 0, err
+	}
+
+	accrued := 0
+	for _, account := range accounts {
+		days, err := receiver.accrue(account, yesterday)
+		if err != nil {
+			return accrued, err
+		}
+		accrued += days
+	}
+	return accrued, nil
+}
+
+// accrue начисляет проценты по счёту за дни до through включительно в одной транзакции
+func (receiver *InterestJob) accrue(account savingsAccount, through time.Time) (days int, err error) {
+	tx, err := receiver.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	product := account.product
+	for day := account.accruedThrough.AddDate(0, 0, 1); !day.After(through); day = day.AddDate(0, 0, 1) {
+		balance, err := getClientBalance(tx, account.clientId)
+		if err != nil {
+			return 0, err
+		}
+		accrual := InterestAccrual{
+			ClientId:    account.clientId,
+			ProductId:   product.Id,
+			Date:        day,
+			Kind:        InterestAccrued,
+			Balance:     balance,
+			RateBp:      product.RateBp,
+			Days:        product.days(day),
+			Denominator: product.denominator(),
+		}
+		if balance > 0 {
+			accrual.Numerator = balance * product.RateBp * accrual.Days
+		}
+		if accrual.Numerator != 0 {
+			err = insertInterestAccrual(tx, accrual)
+			if err != nil {
+				return 0, err
+			}
+			account.numerator += accrual.Numerator
+		}
+		days++
+
+		if product.capitalizesOn(day) {
+			account.numerator, err = capitalizeInterest(tx, account, day)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	_, err = tx.Exec(
+		updateSavingsAccountSQL,
+		sql.Named("client_id", account.clientId),
+		sql.Named("accrued_through", through.Format(dateLayout)),
+		sql.Named("numerator", account.numerator),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return days, nil
+}
+
+// capitalizeInterest зачисляет на баланс целую часть накопленных процентов и возвращает остаток
+func capitalizeInterest(tx *sql.Tx, account savingsAccount, day time.Time) (int64, error) {
+	denominator := account.product.denominator()
+	amount := account.numerator / denominator
+	if amount == 0 {
+		return account.numerator, nil
+	}
+
+	before, err := getClientBalance(tx, account.clientId)
+	if err != nil {
+		return 0, err
+	}
+	// проценты зачисляются в конце дня капитализации, а не в момент запуска задания
+	operationId, err := insertOperation(tx, Operation{
+		Type:      OperationInterest,
+		ClientId:  account.clientId,
+		Amount:    amount,
+		CreatedAt: day.AddDate(0, 0, 1).Add(-time.Second),
+	})
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(
+		updateClientBalancePlusSQL,
+		sql.Named("id", account.clientId),
+		sql.Named("balance", amount),
+	)
+	if err != nil {
+		return 0, err
+	}
+	err = insertInterestAccrual(tx, InterestAccrual{
+		ClientId:    account.clientId,
+		ProductId:   account.product.Id,
+		Date:        day,
+		Kind:        InterestCapitalized,
+		Balance:     before,
+		RateBp:      account.product.RateBp,
+		Numerator:   amount * denominator,
+		Denominator: denominator,
+		Amount:      amount,
+		OperationId: operationId,
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = publishBalanceChanged(tx, account.clientId, amount)
+	if err != nil {
+		return 0, err
+	}
+	err = auditClientBalance(tx, SystemActor, AuditInterest, account.clientId, before)
+	if err != nil {
+		return 0, err
+	}
+	return account.numerator % denominator, nil
+}
+
+func insertInterestAccrual(tx *sql.Tx, accrual InterestAccrual) error {
+	_, err := tx.Exec(
+		insertInterestAccrualSQL,
+		sql.Named("client_id", accrual.ClientId),
+		sql.Named("product_id", accrual.ProductId),
+		sql.Named("date", accrual.Date.Format(dateLayout)),
+		sql.Named("kind", accrual.Kind),
+		sql.Named("balance", accrual.Balance),
+		sql.Named("rate_bp", accrual.RateBp),
+		sql.Named("days", accrual.Days),
+		sql.Named("numerator", accrual.Numerator),
+		sql.Named("denominator", accrual.Denominator),
+		sql.Named("amount", accrual.Amount),
+		sql.Named("operation_id", nullableId(accrual.OperationId)),
+	)
+	return err
+}
+
+func listSavingsAccounts(db *sql.DB, through string, location *time.Location) (accounts []savingsAccount, err error) {
+	rows, err := db.Query(listDueSavingsAccountsSQL, through)
+	if err != nil {
+		return nil, queryError(listDueSavingsAccountsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			accounts, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		account := savingsAccount{}
+		var accruedThrough string
+		err = rows.Scan(&account.clientId, &accruedThrough, &account.numerator, &account.product.Id,
+			&account.product.Name, &account.product.RateBp, &account.product.DayCount, &account.product.Compounding)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		account.accruedThrough, err = time.ParseInLocation(dateLayout, accruedThrough, location)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		accounts = append(accounts, account)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return accounts, nil
+}
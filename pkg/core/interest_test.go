@@ -0,0 +1,159 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInterestProduct_Days30360(t *testing.T) {
+	product := InterestProduct{DayCount: DayCount30360}
+	cases := []struct {
+		day  time.Time
+		days int64
+	}{
+		{time.Date(2021, 1, 15, 0, 0, 0, 0, time.Local), 1},
+		{time.Date(2021, 1, 31, 0, 0, 0, 0, time.Local), 0},
+		{time.Date(2021, 2, 28, 0, 0, 0, 0, time.Local), 3},
+		{time.Date(2020, 2, 28, 0, 0, 0, 0, time.Local), 1},
+		{time.Date(2020, 2, 29, 0, 0, 0, 0, time.Local), 2},
+	}
+	for _, testCase := range cases {
+		if days := product.days(testCase.day); days != testCase.days {
+			t.Errorf("%s: got %d, want %d", testCase.day.Format(dateLayout), days, testCase.days)
+		}
+	}
+
+	quarterly := InterestProduct{Compounding: CompoundQuarterly}
+	if quarterly.capitalizesOn(time.Date(2021, 1, 31, 0, 0, 0, 0, time.Local)) ||
+		!quarterly.capitalizesOn(time.Date(2021, 3, 31, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("unexpected quarterly capitalization")
+	}
+}
+
+func TestAddInterestProduct_Validate(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+
+	invalid := []InterestProduct{
+		{Name: " ", RateBp: 1000, DayCount: DayCountActual365, Compounding: CompoundMonthly},
+		{Name: "Savings", RateBp: 0, DayCount: DayCountActual365, Compounding: CompoundMonthly},
+		{Name: "Savings", RateBp: 1000, DayCount: "act/act", Compounding: CompoundMonthly},
+		{Name: "Savings", RateBp: 1000, DayCount: DayCountActual365, Compounding: "daily"},
+	}
+	for _, product := range invalid {
+		if _, err := AddInterestProduct(product, db); !errors.Is(err, ErrInvalidInterestProduct) {
+			t.Errorf("%+v: not ErrInvalidInterestProduct: %v", product, err)
+		}
+	}
+
+	id, err := AddInterestProduct(InterestProduct{Name: "Savings", RateBp: 1000, DayCount: DayCountActual365,
+		Compounding: CompoundMonthly}, db)
+	if err != nil {
+		t.Fatalf("can't add product: %v", err)
+	}
+	products, err := ListInterestProducts(db)
+	if err != nil {
+		t.Fatalf("can't list products: %v", err)
+	}
+	if len(products) != 1 || products[0].Id != id || products[0].RateBp != 1000 {
+		t.Errorf("unexpected products: %+v", products)
+	}
+
+	clientId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	if err := OpenSavingsAccount(clientId, id+1, db); !errors.Is(err, ErrInterestProductNotFound) {
+		t.Errorf("not ErrInterestProductNotFound: %v", err)
+	}
+	if err := OpenSavingsAccount(clientId+1, id, db); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("not ErrClientNotFound: %v", err)
+	}
+	if err := OpenSavingsAccount(clientId, id, db); err != nil {
+		t.Fatalf("can't open savings: %v", err)
+	}
+	if err := OpenSavingsAccount(clientId, id, db); !errors.Is(err, ErrSavingsAccountExists) {
+		t.Errorf("not ErrSavingsAccountExists: %v", err)
+	}
+}
+
+func TestInterestJob_AccrueAndCapitalize(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	defer func() { timeNow = time.Now }()
+	opened := time.Date(2021, 1, 20, 10, 0, 0, 0, time.Local)
+	timeNow = func() time.Time { return opened }
+
+	productId, err := AddInterestProduct(InterestProduct{Name: "Savings", RateBp: 1000, DayCount: DayCountActual365,
+		Compounding: CompoundMonthly}, db)
+	if err != nil {
+		t.Fatalf("can't add product: %v", err)
+	}
+	clientId := addTestClient(t, db, "ali", 921111111, 100000, 1001)
+	err = OpenSavingsAccount(clientId, productId, db)
+	if err != nil {
+		t.Fatalf("can't open savings: %v", err)
+	}
+
+	clock := &testClock{now: opened.Add(time.Hour)}
+	job := NewInterestJob(db, clock)
+	days, err := job.RunDue()
+	if err != nil || days != 0 {
+		t.Fatalf("accrued on opening day: %d %v", days, err)
+	}
+
+	// 100000 * 10% / 365 = 27.397... дирамов в день: 11 дней января дают 301.37, на баланс - 301
+	clock.now = time.Date(2021, 2, 1, 3, 0, 0, 0, time.Local)
+	days, err = job.RunDue()
+	if err != nil || days != 11 {
+		t.Fatalf("unexpected accrual: %d %v", days, err)
+	}
+	if balance := clientBalance(t, db, clientId); balance != 100301 {
+		t.Errorf("unexpected balance after capitalization: %d", balance)
+	}
+	days, _ = job.RunDue()
+	if days != 0 {
+		t.Errorf("same day accrued twice: %d", days)
+	}
+
+	history, err := GetInterestHistory(clientId, db)
+	if err != nil {
+		t.Fatalf("can't get history: %v", err)
+	}
+	if len(history) != 12 {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+	first, last := history[0], history[11]
+	if first.Kind != InterestAccrued || first.Date.Day() != 21 || first.Numerator != 100000*1000 || first.Denominator != 3650000 {
+		t.Errorf("unexpected accrual: %+v", first)
+	}
+	if last.Kind != InterestCapitalized || last.Amount != 301 || last.OperationId == 0 || last.Date.Day() != 31 {
+		t.Errorf("unexpected capitalization: %+v", last)
+	}
+	operation, err := GetOperation(last.OperationId, db)
+	if err != nil || !operation.CreatedAt.Equal(time.Date(2021, 1, 31, 23, 59, 59, 0, time.Local)) {
+		t.Errorf("capitalization not dated at period end: %+v %v", operation, err)
+	}
+
+	// остаток 0.37 дирама переходит в февраль: 28 дней по 27.48 = 769.43 + 0.37 = 769.80
+	clock.now = time.Date(2021, 3, 1, 3, 0, 0, 0, time.Local)
+	days, err = job.RunDue()
+	if err != nil || days != 28 {
+		t.Fatalf("unexpected accrual: %d %v", days, err)
+	}
+	if balance := clientBalance(t, db, clientId); balance != 100301+769 {
+		t.Errorf("remainder not carried over: %d", balance)
+	}
+
+	statement, err := GetStatement(clientId, opened, clock.now, db)
+	if err != nil {
+		t.Fatalf("can't get statement: %v", err)
+	}
+	credited := int64(0)
+	for _, entry := range statement {
+		if entry.Type == OperationInterest {
+			credited += entry.Change
+		}
+	}
+	if credited != 301+769 {
+		t.Errorf("unexpected interest in statement: %d", credited)
+	}
+}
@@ -0,0 +1,295 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	KycPending  = "pending"
+	KycVerified = "verified"
+	KycRejected = "rejected"
+)
+
+const (
+	SexMale   = "male"
+	SexFemale = "female"
+)
+
+const birthDateLayout = "2006-01-02"
+const minClientAge = 18
+const maxClientAge = 120
+
+// UnverifiedTransferThreshold - наибольший перевод за одну операцию для клиента без подтверждённого KYC
+var UnverifiedTransferThreshold int64 = 100000
+
+var ErrInvalidProfile = errors.New("invalid client profile")
+var ErrProfileIncomplete = errors.New("client profile incomplete")
+var ErrInvalidKycStatus = errors.New("invalid kyc status")
+var ErrKycReasonRequired = errors.New("kyc rejection reason required")
+var ErrKycRequired = errors.New("client verification required")
+
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s.]+$`)
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+var passportSeriesPattern = regexp.MustCompile(`^[A-Z]{1,2}[0-9]{7}$`)
+
+// homeCountryCode - код страны, номера которой хранятся в базе в местном формате (921234567):
+// по нему ищут клиента переводы по номеру телефона
+const homeCountryCode = "992"
+
+// ClientProfile - анкетные данные клиента для KYC. Phone - в формате E.164 (+992921234567),
+// в базе местные номера хранятся без кода страны, остальные - без '+' (см. localPhone);
+// PassportSeries - одна-две латинские буквы и 7 цифр (A1234567).
+type ClientProfile struct {
+	Surname        string
+	Name           string
+	MiddleName     string
+	Sex            string
+	Email          string
+	Phone          string
+	Address        string
+	PassportSeries string
+	BirthDate      time.Time
+}
+
+type ClientKyc struct {
+	Status    string
+	ManagerId int64
+	Reason    string
+	UpdatedAt time.Time
+}
+
+// ProfileFieldError - поле анкеты, не прошедшее проверку
+type ProfileFieldError struct {
+	Field string
+}
+
+func (receiver *ProfileFieldError) Error() string {
+	return fmt.Sprintf("invalid client profile field: %s", receiver.Field)
+}
+
+func (receiver *ProfileFieldError) Is(target error) bool {
+	return target == ErrInvalidProfile
+}
+
+// Validate проверяет анкету на дату now; отчество необязательно, остальные поля - да
+func (receiver ClientProfile) Validate(now time.Time) error {
+	required := [][2]string{
+		{"surname", receiver.Surname},
+		{"name", receiver.Name},
+		{"address", receiver.Address},
+	}
+	for _, field := range required {
+		if strings.TrimSpace(field[1]) == "" {
+			return &ProfileFieldError{Field: field[0]}
+		}
+	}
+	if receiver.Sex != SexMale && receiver.Sex != SexFemale {
+		return &ProfileFieldError{Field: "sex"}
+	}
+	if !emailPattern.MatchString(receiver.Email) {
+		return &ProfileFieldError{Field: "email"}
+	}
+	if !e164Pattern.MatchString(receiver.Phone) {
+		return &ProfileFieldError{Field: "phone"}
+	}
+	if !passportSeriesPattern.MatchString(receiver.PassportSeries) {
+		return &ProfileFieldError{Field: "passport_series"}
+	}
+	birthDate := receiver.BirthDate
+	if birthDate.IsZero() || birthDate.AddDate(minClientAge, 0, 0).After(now) ||
+		birthDate.AddDate(maxClientAge, 0, 0).Before(now) {
+		return &ProfileFieldError{Field: "birth_date"}
+	}
+	return nil
+}
+
+// UpdateClientProfile сохраняет проверенную анкету и отправляет клиента на повторную проверку:
+// после изменения данных статус KYC снова pending
+func UpdateClientProfile(actor Actor, clientId int64, profile ClientProfile, db *sql.DB) (err error) {
+	now := timeNow()
+	profile.Email = strings.ToLower(strings.TrimSpace(profile.Email))
+	err = profile.Validate(now)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkActorScope(tx, actor, clientId)
+	if err != nil {
+		return err
+	}
+	before, err := getClientProfile(tx, clientId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		updateClientProfileSQL,
+		sql.Named("id", clientId),
+		sql.Named("surname", profile.Surname),
+		sql.Named("name", profile.Name),
+		sql.Named("middle_name", profile.MiddleName),
+		sql.Named("sex", profile.Sex),
+		sql.Named("email", profile.Email),
+		sql.Named("phone", localPhone(profile.Phone)),
+		sql.Named("address", profile.Address),
+		sql.Named("passport_series", profile.PassportSeries),
+		sql.Named("birth_date", profile.BirthDate.Format(birthDateLayout)),
+		sql.Named("updated_at", now.Unix()),
+	)
+	if err != nil {
+		return err
+	}
+
+	return writeAudit(tx, actor, AuditUpdateProfile, AuditEntityClient, clientId, before, profile)
+}
+
+// localPhone переводит номер E.164 в формат колонки client.phone
+func localPhone(phone string) string {
+	phone = strings.TrimPrefix(phone, "+")
+	if strings.HasPrefix(phone, homeCountryCode) {
+		return strings.TrimPrefix(phone, homeCountryCode)
+	}
+	return phone
+}
+
+// e164Phone - обратное преобразование localPhone
+func e164Phone(phone string) string {
+	if len(phone) == 9 {
+		return "+" + homeCountryCode + phone
+	}
+	return "+" + phone
+}
+
+func GetClientProfile(clientId int64, db *sql.DB) (ClientProfile, error) {
+	return getClientProfile(db, clientId)
+}
+
+func getClientProfile(q queryRower, clientId int64) (profile ClientProfile, err error) {
+	var birthDate string
+	err = q.QueryRow(getClientProfileSQL, clientId).Scan(&profile.Surname, &profile.Name, &profile.MiddleName,
+		&profile.Sex, &profile.Email, &profile.Phone, &profile.Address, &profile.PassportSeries, &birthDate)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ClientProfile{}, ErrClientNotFound
+		}
+		return ClientProfile{}, queryError(getClientProfileSQL, err)
+	}
+	profile.Phone = e164Phone(profile.Phone)
+	if birthDate != "" {
+		profile.BirthDate, err = time.Parse(birthDateLayout, birthDate)
+		if err != nil {
+			return ClientProfile{}, dbError(err)
+		}
+	}
+	return profile, nil
+}
+
+// SetKycStatus - решение менеджера по проверке клиента. Подтвердить можно только
+// заполненную анкету, отказ требует причины.
+func SetKycStatus(managerId int64, clientId int64, status string, reason string, db *sql.DB) (err error) {
+	if status != KycPending && status != KycVerified && status != KycRejected {
+		return ErrInvalidKycStatus
+	}
+	reason = strings.TrimSpace(reason)
+	if status == KycRejected && reason == "" {
+		return ErrKycReasonRequired
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkClientScope(tx, managerId, clientId)
+	if err != nil {
+		return err
+	}
+	before, complete, err := getClientKyc(tx, clientId)
+	if err != nil {
+		return err
+	}
+	if status == KycVerified && !complete {
+		return ErrProfileIncomplete
+	}
+
+	after := ClientKyc{
+		Status:    status,
+		ManagerId: managerId,
+		Reason:    reason,
+		UpdatedAt: time.Unix(timeNow().Unix(), 0),
+	}
+	_, err = tx.Exec(
+		updateClientKycSQL,
+		sql.Named("id", clientId),
+		sql.Named("status", after.Status),
+		sql.Named("manager_id", after.ManagerId),
+		sql.Named("reason", after.Reason),
+		sql.Named("updated_at", after.UpdatedAt.Unix()),
+	)
+	if err != nil {
+		return err
+	}
+
+	return writeAudit(tx, ManagerActor(managerId), AuditKycStatus, AuditEntityClient, clientId, before, after)
+}
+
+func GetClientKyc(clientId int64, db *sql.DB) (ClientKyc, error) {
+	kyc, _, err := getClientKyc(db, clientId)
+	return kyc, err
+}
+
+// getClientKyc возвращает статус и признак заполненной анкеты
+func getClientKyc(q queryRower, clientId int64) (kyc ClientKyc, complete bool, err error) {
+	var managerId sql.NullInt64
+	var updatedAt int64
+	err = q.QueryRow(getClientKycSQL, clientId).Scan(&kyc.Status, &managerId, &kyc.Reason, &updatedAt, &complete)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ClientKyc{}, false, ErrClientNotFound
+		}
+		return ClientKyc{}, false, queryError(getClientKycSQL, err)
+	}
+	kyc.ManagerId = managerId.Int64
+	if updatedAt != 0 {
+		kyc.UpdatedAt = time.Unix(updatedAt, 0)
+	}
+	return kyc, complete, nil
+}
+
+// checkTransferKyc не пускает переводы больше UnverifiedTransferThreshold от неподтверждённых клиентов
+func checkTransferKyc(q queryRower, clientId int64, amount int64) error {
+	if amount <= UnverifiedTransferThreshold {
+		return nil
+	}
+	kyc, _, err := getClientKyc(q, clientId)
+	if err != nil {
+		return err
+	}
+	if kyc.Status != KycVerified {
+		return ErrKycRequired
+	}
+	return nil
+}
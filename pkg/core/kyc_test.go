@@ -0,0 +1,143 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func testProfile() ClientProfile {
+	return ClientProfile{
+		Surname:        "Aliev",
+		Name:           "Ali",
+		MiddleName:     "Valievich",
+		Sex:            SexMale,
+		Email:          "Ali@Example.tj",
+		Phone:          "+992921111111",
+		Address:        "Dushanbe, Rudaki 65",
+		PassportSeries: "A1234567",
+		BirthDate:      time.Date(1990, 5, 10, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestClientProfile_Validate(t *testing.T) {
+	now := time.Date(2020, 5, 10, 0, 0, 0, 0, time.UTC)
+	if err := testProfile().Validate(now); err != nil {
+		t.Fatalf("valid profile rejected: %v", err)
+	}
+
+	cases := map[string]func(profile *ClientProfile){
+		"surname":         func(profile *ClientProfile) { profile.Surname = " " },
+		"sex":             func(profile *ClientProfile) { profile.Sex = "m" },
+		"email":           func(profile *ClientProfile) { profile.Email = "ali@example" },
+		"phone":           func(profile *ClientProfile) { profile.Phone = "921111111" },
+		"passport_series": func(profile *ClientProfile) { profile.PassportSeries = "A123" },
+		"birth_date":      func(profile *ClientProfile) { profile.BirthDate = now.AddDate(-17, 0, 0) },
+	}
+	for field, spoil := range cases {
+		profile := testProfile()
+		spoil(&profile)
+		err := profile.Validate(now)
+		var fieldErr *ProfileFieldError
+		if !errors.As(err, &fieldErr) || fieldErr.Field != field || !errors.Is(err, ErrInvalidProfile) {
+			t.Errorf("invalid %s not rejected: %v", field, err)
+		}
+	}
+}
+
+func TestKycWorkflow(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	assignTestBranch(t, db, clientId, 1)
+
+	if err := SetKycStatus(1, clientId, KycVerified, "", db); !errors.Is(err, ErrProfileIncomplete) {
+		t.Errorf("incomplete profile verified: %v", err)
+	}
+
+	err := UpdateClientProfile(ClientActor(clientId), clientId, testProfile(), db)
+	if err != nil {
+		t.Fatalf("can't update profile: %v", err)
+	}
+	profile, err := GetClientProfile(clientId, db)
+	if err != nil {
+		t.Fatalf("can't get profile: %v", err)
+	}
+	if profile.Email != "ali@example.tj" || profile.Phone != "+992921111111" || !profile.BirthDate.Equal(testProfile().BirthDate) {
+		t.Errorf("unexpected profile: %+v", profile)
+	}
+	if err := CheckByPhoneNumber(921111111, db); err != nil {
+		t.Errorf("client not found by local phone after profile update: %v", err)
+	}
+	if err := TransactionPlus(921111111, 100, db); err != nil || clientBalance(t, db, clientId) != 100 {
+		t.Errorf("phone top-up after profile update failed: %v", err)
+	}
+	page, err := ListClients(1, ClientFilter{Phone: "+99292111"}, db)
+	if err != nil || len(page.Clients) != 1 {
+		t.Errorf("client not found by E.164 prefix: %+v %v", page.Clients, err)
+	}
+
+	if err := SetKycStatus(1, clientId, KycRejected, "", db); !errors.Is(err, ErrKycReasonRequired) {
+		t.Errorf("not ErrKycReasonRequired: %v", err)
+	}
+	if err := SetKycStatus(1, clientId, "approved", "", db); !errors.Is(err, ErrInvalidKycStatus) {
+		t.Errorf("not ErrInvalidKycStatus: %v", err)
+	}
+	err = SetKycStatus(2, clientId, KycVerified, "", db)
+	if err != nil {
+		t.Fatalf("can't verify client: %v", err)
+	}
+	kyc, err := GetClientKyc(clientId, db)
+	if err != nil {
+		t.Fatalf("can't get kyc: %v", err)
+	}
+	if kyc.Status != KycVerified || kyc.ManagerId != 2 {
+		t.Errorf("unexpected kyc: %+v", kyc)
+	}
+
+	profile = testProfile()
+	profile.Address = "Khujand, Lenina 1"
+	err = UpdateClientProfile(ClientActor(clientId), clientId, profile, db)
+	if err != nil {
+		t.Fatalf("can't update profile: %v", err)
+	}
+	kyc, _ = GetClientKyc(clientId, db)
+	if kyc.Status != KycPending {
+		t.Errorf("changed profile stays verified: %+v", kyc)
+	}
+}
+
+func TestTransfer_AboveThresholdRequiresKyc(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	aliCard := issueTestCard(t, db, aliId, UnverifiedTransferThreshold*3)
+	valiCard := issueTestCard(t, db, valiId, 0)
+
+	_, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, UnverifiedTransferThreshold, db)
+	if err != nil {
+		t.Fatalf("transfer up to threshold rejected: %v", err)
+	}
+	_, err = TransferCardToCard(aliId, aliCard.Id, valiCard.Id, UnverifiedTransferThreshold+1, db)
+	if !errors.Is(err, ErrKycRequired) {
+		t.Errorf("not ErrKycRequired for card transfer: %v", err)
+	}
+	err = TransactionMinus(Client{PhoneNumber: 921111111, Balance: uint64(UnverifiedTransferThreshold + 1)}, db)
+	if !errors.Is(err, ErrKycRequired) {
+		t.Errorf("not ErrKycRequired for phone transfer: %v", err)
+	}
+
+	err = UpdateClientProfile(ClientActor(aliId), aliId, testProfile(), db)
+	if err != nil {
+		t.Fatalf("can't update profile: %v", err)
+	}
+	err = SetKycStatus(1, aliId, KycVerified, "", db)
+	if err != nil {
+		t.Fatalf("can't verify client: %v", err)
+	}
+	_, err = TransferCardToCard(aliId, aliCard.Id, valiCard.Id, UnverifiedTransferThreshold+1, db)
+	if err != nil {
+		t.Errorf("verified client transfer rejected: %v", err)
+	}
+}
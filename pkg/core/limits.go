@@ -0,0 +1,266 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	LimitScopeCard   = "card"
+	LimitScopeClient = "client"
+)
+
+const (
+	LimitPeriodDaily   = "daily"
+	LimitPeriodMonthly = "monthly"
+)
+
+// LimitAnyOperation - лимит на сумму всех расходных операций
+const LimitAnyOperation = ""
+
+var ErrLimitExceeded = errors.New("spending limit exceeded")
+var ErrInvalidLimit = errors.New("invalid spending limit")
+var ErrLimitNotFound = errors.New("spending limit not found")
+
+type SpendingLimit struct {
+	Id            int64
+	Scope         string
+	SubjectId     int64
+	OperationType string
+	Period        string
+	Amount        int64
+}
+
+// LimitExceededError сравнивается с ErrLimitExceeded через errors.Is
+// и сообщает, сколько ещё можно потратить в текущем периоде
+type LimitExceededError struct {
+	Limit     SpendingLimit
+	Remaining int64
+}
+
+func (receiver *LimitExceededError) Error() string {
+	return fmt.Sprintf("%s %s limit for %s %d exceeded, remaining %d",
+		receiver.Limit.Period, receiver.Limit.OperationType, receiver.Limit.Scope,
+		receiver.Limit.SubjectId, receiver.Remaining)
+}
+
+func (receiver *LimitExceededError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// SetSpendingLimit создаёт лимит или меняет сумму существующего лимита
+// с теми же scope, subject, operation type и period. Менеджер подразделения задаёт
+// лимиты только своим клиентам и их картам; в журнал лимит пишется по карте
+// или клиенту, к которому он относится.
+func SetSpendingLimit(managerId int64, limit SpendingLimit, db *sql.DB) (err error) {
+	if limit.Scope != LimitScopeCard && limit.Scope != LimitScopeClient {
+		return ErrInvalidLimit
+	}
+	if !isLimitedOperation(limit.OperationType) {
+		return ErrInvalidLimit
+	}
+	if limit.Period != LimitPeriodDaily && limit.Period != LimitPeriodMonthly {
+		return ErrInvalidLimit
+	}
+	if limit.Amount < 0 {
+		return ErrInvalidLimit
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkLimitScope(tx, managerId, limit)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		upsertSpendingLimitSQL,
+		sql.Named("scope", limit.Scope),
+		sql.Named("subject_id", limit.SubjectId),
+		sql.Named("operation_type", limit.OperationType),
+		sql.Named("period", limit.Period),
+		sql.Named("amount", limit.Amount),
+	)
+	if err != nil {
+		return err
+	}
+	return writeAudit(tx, ManagerActor(managerId), AuditSpendingLimit, limit.Scope, limit.SubjectId, nil, limit)
+}
+
+func DeleteSpendingLimit(managerId int64, limitId int64, db *sql.DB) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	limit := SpendingLimit{}
+	err = tx.QueryRow(getSpendingLimitSQL, limitId).Scan(&limit.Id, &limit.Scope, &limit.SubjectId,
+		&limit.OperationType, &limit.Period, &limit.Amount)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrLimitNotFound
+		}
+		return queryError(getSpendingLimitSQL, err)
+	}
+	err = checkLimitScope(tx, managerId, limit)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(deleteSpendingLimitSQL, limitId)
+	if err != nil {
+		return err
+	}
+	return writeAudit(tx, ManagerActor(managerId), AuditSpendingLimit, limit.Scope, limit.SubjectId, limit, nil)
+}
+
+// isLimitedOperation - операции, расход по которым проверяет checkSpendingLimits
+func isLimitedOperation(operationType string) bool {
+	switch operationType {
+	case LimitAnyOperation, OperationTransfer, OperationServicePayment, OperationAtmWithdrawal:
+		return true
+	}
+	return false
+}
+
+// checkLimitScope - checkClientScope для клиента лимита или владельца карты
+func checkLimitScope(tx *sql.Tx, managerId int64, limit SpendingLimit) error {
+	clientId := limit.SubjectId
+	if limit.Scope == LimitScopeCard {
+		card, err := getCard(tx, limit.SubjectId)
+		if err != nil {
+			return err
+		}
+		clientId = card.UserId
+	}
+	return checkClientScope(tx, managerId, clientId)
+}
+
+func ListSpendingLimits(scope string, subjectId int64, db *sql.DB) (limits []SpendingLimit, err error) {
+	rows, err := db.Query(listSpendingLimitsSQL, scope, subjectId)
+	if err != nil {
+		return nil, queryError(listSpendingLimitsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			limits, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		limit := SpendingLimit{}
+		err = rows.Scan(&limit.Id, &limit.Scope, &limit.SubjectId, &limit.OperationType, &limit.Period, &limit.Amount)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		limits = append(limits, limit)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return limits, nil
+}
+
+// checkSpendingLimits проверяет все лимиты клиента и карты (cardId = 0 - операция без карты)
+// по истории операций; вызывается в той же транзакции, что и списание
+func checkSpendingLimits(tx *sql.Tx, clientId int64, cardId int64, operationType string, amount int64, now time.Time) error {
+	limits, err := applicableLimits(tx, clientId, cardId, operationType)
+	if err != nil {
+		return err
+	}
+
+	var exceeded *LimitExceededError
+	for _, limit := range limits {
+		spent, err := spentInPeriod(tx, limit, now)
+		if err != nil {
+			return err
+		}
+		remaining := limit.Amount - spent
+		if remaining < 0 {
+			remaining = 0
+		}
+		if amount > remaining && (exceeded == nil || remaining < exceeded.Remaining) {
+			exceeded = &LimitExceededError{Limit: limit, Remaining: remaining}
+		}
+	}
+	if exceeded != nil {
+		return exceeded
+	}
+
+	return nil
+}
+
+func applicableLimits(tx *sql.Tx, clientId int64, cardId int64, operationType string) (limits []SpendingLimit, err error) {
+	rows, err := tx.Query(
+		applicableSpendingLimitsSQL,
+		sql.Named("client_id", clientId),
+		sql.Named("card_id", cardId),
+		sql.Named("operation_type", operationType),
+	)
+	if err != nil {
+		return nil, queryError(applicableSpendingLimitsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			limits, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		limit := SpendingLimit{}
+		err = rows.Scan(&limit.Id, &limit.Scope, &limit.SubjectId, &limit.OperationType, &limit.Period, &limit.Amount)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		limits = append(limits, limit)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return limits, nil
+}
+
+func spentInPeriod(tx *sql.Tx, limit SpendingLimit, now time.Time) (int64, error) {
+	query := spentByClientSQL
+	if limit.Scope == LimitScopeCard {
+		query = spentByCardSQL
+	}
+
+	var spent int64
+	err := tx.QueryRow(
+		query,
+		sql.Named("subject_id", limit.SubjectId),
+		sql.Named("operation_type", limit.OperationType),
+		sql.Named("since", periodStart(limit.Period, now).Unix()),
+	).Scan(&spent)
+	if err != nil {
+		return 0, queryError(query, err)
+	}
+	return spent, nil
+}
+
+func periodStart(period string, now time.Time) time.Time {
+	year, month, day := now.Date()
+	if period == LimitPeriodMonthly {
+		return time.Date(year, month, 1, 0, 0, 0, 0, now.Location())
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+}
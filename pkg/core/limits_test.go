@@ -0,0 +1,147 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSpendingLimits_ClientDailyTransfer(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	addTestClient(t, db, "ali", 921111111, 1000, 1001)
+	clientId := addTestClient(t, db, "vali", 922222222, 1000, 1002)
+
+	now := time.Date(2020, 5, 10, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	err := SetSpendingLimit(1, SpendingLimit{
+		Scope:         LimitScopeClient,
+		SubjectId:     clientId,
+		OperationType: OperationTransfer,
+		Period:        LimitPeriodDaily,
+		Amount:        500,
+	}, db)
+	if err != nil {
+		t.Fatalf("can't set limit: %v", err)
+	}
+
+	err = TransactionMinus(Client{PhoneNumber: 922222222, Balance: 300}, db)
+	if err != nil {
+		t.Fatalf("can't transfer: %v", err)
+	}
+	err = TransactionBalanceNumberMinus(Client{BalanceNumber: 1002, Balance: 300}, db)
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("not ErrLimitExceeded: %v", err)
+	}
+	var limitErr *LimitExceededError
+	if !errors.As(err, &limitErr) || limitErr.Remaining != 200 {
+		t.Errorf("unexpected remaining: %v", err)
+	}
+	if balance := clientBalance(t, db, clientId); balance != 700 {
+		t.Errorf("balance changed by rejected transfer: %d", balance)
+	}
+
+	// лимит на переводы не ограничивает оплату услуг
+	if _, err := PayService(clientId, 1, "921234567", 300, db); err != nil {
+		t.Errorf("service payment rejected by transfer limit: %v", err)
+	}
+
+	now = now.AddDate(0, 0, 1)
+	if err := TransactionMinus(Client{PhoneNumber: 922222222, Balance: 300}, db); err != nil {
+		t.Errorf("daily limit not reset next day: %v", err)
+	}
+}
+
+func TestSpendingLimits_CardMonthlyAnyOperation(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	aliCard := issueTestCard(t, db, aliId, 1000)
+	valiCard := issueTestCard(t, db, valiId, 0)
+
+	err := SetSpendingLimit(1, SpendingLimit{
+		Scope:         LimitScopeCard,
+		SubjectId:     aliCard.Id,
+		OperationType: LimitAnyOperation,
+		Period:        LimitPeriodMonthly,
+		Amount:        100,
+	}, db)
+	if err != nil {
+		t.Fatalf("can't set limit: %v", err)
+	}
+
+	if _, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 60, db); err != nil {
+		t.Fatalf("can't transfer: %v", err)
+	}
+	_, err = TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 60, db)
+	var limitErr *LimitExceededError
+	if !errors.As(err, &limitErr) || limitErr.Remaining != 40 || limitErr.Limit.Scope != LimitScopeCard {
+		t.Errorf("unexpected limit error: %v", err)
+	}
+
+	limits, err := ListSpendingLimits(LimitScopeCard, aliCard.Id, db)
+	if err != nil || len(limits) != 1 {
+		t.Fatalf("unexpected limits: %v, %v", limits, err)
+	}
+	if err := DeleteSpendingLimit(1, limits[0].Id, db); err != nil {
+		t.Fatalf("can't delete limit: %v", err)
+	}
+	if _, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 60, db); err != nil {
+		t.Errorf("transfer rejected after limit removed: %v", err)
+	}
+}
+
+func TestSetSpendingLimit_Invalid(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+
+	err := SetSpendingLimit(1, SpendingLimit{Scope: "bank", Period: LimitPeriodDaily, Amount: 1}, db)
+	if !errors.Is(err, ErrInvalidLimit) {
+		t.Errorf("not ErrInvalidLimit: %v", err)
+	}
+	err = SetSpendingLimit(1, SpendingLimit{Scope: LimitScopeClient, Period: "weekly", Amount: 1}, db)
+	if !errors.Is(err, ErrInvalidLimit) {
+		t.Errorf("not ErrInvalidLimit: %v", err)
+	}
+	err = SetSpendingLimit(1, SpendingLimit{Scope: LimitScopeClient, OperationType: "tranfser", Period: LimitPeriodDaily, Amount: 1}, db)
+	if !errors.Is(err, ErrInvalidLimit) {
+		t.Errorf("unknown operation type accepted: %v", err)
+	}
+}
+
+func TestSetSpendingLimit_BranchScope(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 1000, 1001)
+	card := issueTestCard(t, db, clientId, 0)
+	assignTestBranch(t, db, clientId, 2)
+
+	limit := SpendingLimit{Scope: LimitScopeCard, SubjectId: card.Id, Period: LimitPeriodDaily, Amount: 100}
+	if err := SetSpendingLimit(2, limit, db); !errors.Is(err, ErrOutsideBranch) {
+		t.Errorf("not ErrOutsideBranch: %v", err)
+	}
+	if err := SetSpendingLimit(100, limit, db); !errors.Is(err, ErrManagerNotFound) {
+		t.Errorf("not ErrManagerNotFound: %v", err)
+	}
+	if err := SetSpendingLimit(4, limit, db); err != nil {
+		t.Fatalf("can't set limit: %v", err)
+	}
+	limits, err := ListSpendingLimits(LimitScopeCard, card.Id, db)
+	if err != nil || len(limits) != 1 {
+		t.Fatalf("unexpected limits: %+v %v", limits, err)
+	}
+	if err := DeleteSpendingLimit(2, limits[0].Id, db); !errors.Is(err, ErrOutsideBranch) {
+		t.Errorf("not ErrOutsideBranch: %v", err)
+	}
+	if err := DeleteSpendingLimit(4, limits[0].Id, db); err != nil {
+		t.Errorf("can't delete limit: %v", err)
+	}
+
+	entries, err := GetAuditLog(AuditFilter{ActorType: ActorManager, ActorId: 4}, db)
+	if err != nil || len(entries) != 2 || entries[0].Action != AuditSpendingLimit || entries[0].Entity != AuditEntityCard {
+		t.Errorf("limit changes not audited: %+v %v", entries, err)
+	}
+}
@@ -0,0 +1,879 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+// виды графика погашения
+const (
+	LoanAnnuity        = "annuity"
+	LoanDifferentiated = "differentiated"
+)
+
+// статусы кредита
+const (
+	LoanPending  = "pending"
+	LoanApproved = "approved"
+	LoanRejected = "rejected"
+	LoanActive   = "active"
+	LoanClosed   = "closed"
+)
+
+// статусы платежа по графику
+const (
+	InstallmentScheduled = "scheduled"
+	InstallmentPaid      = "paid"
+	InstallmentOverdue   = "overdue"
+)
+
+// виды погашения
+const (
+	LoanRepaymentScheduled = "scheduled"
+	LoanRepaymentEarly     = "early"
+)
+
+var ErrInvalidLoanProduct = errors.New("invalid loan product")
+var ErrLoanProductNotFound = errors.New("loan product not found")
+var ErrLoanOutOfProductRange = errors.New("loan amount or term out of product range")
+var ErrLoanNotFound = errors.New("loan not found")
+var ErrLoanNotPending = errors.New("loan is not pending")
+var ErrLoanNotApproved = errors.New("loan is not approved")
+var ErrLoanNotActive = errors.New("loan is not active")
+var ErrLoanReasonRequired = errors.New("loan rejection reason required")
+
+// LoanProduct - кредитный продукт: годовая ставка и дневная неустойка на просрочку
+// в базисных пунктах, границы суммы и срока в месяцах
+type LoanProduct struct {
+	Id        int64
+	Name      string
+	RateBp    int64
+	Schedule  string
+	PenaltyBp int64
+	MinAmount int64
+	MaxAmount int64
+	MinTerm   int
+	MaxTerm   int
+}
+
+func (receiver LoanProduct) Validate() error {
+	if strings.TrimSpace(receiver.Name) == "" || receiver.RateBp < 0 || receiver.PenaltyBp < 0 {
+		return ErrInvalidLoanProduct
+	}
+	if receiver.Schedule != LoanAnnuity && receiver.Schedule != LoanDifferentiated {
+		return ErrInvalidLoanProduct
+	}
+	if receiver.MinAmount <= 0 || receiver.MaxAmount < receiver.MinAmount ||
+		receiver.MinTerm <= 0 || receiver.MaxTerm < receiver.MinTerm {
+		return ErrInvalidLoanProduct
+	}
+	return nil
+}
+
+// Loan - кредит клиента. Условия продукта копируются в заявку, Principal - непогашенный
+// основной долг, Penalty - начисленная и не оплаченная неустойка по PenaltyThrough включительно.
+type Loan struct {
+	Id             int64
+	ClientId       int64
+	ProductId      int64
+	Amount         int64
+	Term           int
+	RateBp         int64
+	Schedule       string
+	PenaltyBp      int64
+	Status         string
+	Principal      int64
+	Penalty        int64
+	PenaltyThrough time.Time
+	ManagerId      int64
+	Reason         string
+	CreatedAt      time.Time
+	ReviewedAt     time.Time
+	DisbursedAt    time.Time
+}
+
+type LoanInstallment struct {
+	Id            int64
+	LoanId        int64
+	Number        int
+	DueOn         time.Time
+	Principal     int64
+	Interest      int64
+	PaidPrincipal int64
+	PaidInterest  int64
+	Status        string
+}
+
+// Unpaid - остаток платежа к оплате
+func (receiver LoanInstallment) Unpaid() int64 {
+	return receiver.Principal + receiver.Interest - receiver.PaidPrincipal - receiver.PaidInterest
+}
+
+// LoanPayment - списание в погашение кредита с разбивкой по неустойке, процентам и основному долгу
+type LoanPayment struct {
+	Id          int64
+	LoanId      int64
+	OperationId int64
+	Kind        string
+	Amount      int64
+	Penalty     int64
+	Interest    int64
+	Principal   int64
+	CreatedAt   time.Time
+}
+
+// BuildLoanSchedule строит помесячный график: проценты за месяц - остаток * ставка / 12
+// с округлением до дирама, последний платёж закрывает остаток основного долга
+func BuildLoanSchedule(amount int64, rateBp int64, term int, schedule string, start time.Time) []LoanInstallment {
+	dates := make([]time.Time, term)
+	for index := range dates {
+		dates[index] = addMonths(start, index+1)
+	}
+	return scheduleInstallments(amount, rateBp, schedule, dates)
+}
+
+func scheduleInstallments(principal int64, rateBp int64, schedule string, dates []time.Time) []LoanInstallment {
+	installments := make([]LoanInstallment, len(dates))
+	payment := annuityPayment(principal, rateBp, len(dates))
+	outstanding := principal
+	for index, dueOn := range dates {
+		installment := LoanInstallment{Number: index + 1, DueOn: dueOn, Status: InstallmentScheduled}
+		installment.Interest = (outstanding*rateBp + 60000) / 120000
+		if schedule == LoanAnnuity {
+			installment.Principal = payment - installment.Interest
+		} else {
+			installment.Principal = outstanding / int64(len(dates)-index)
+		}
+		if index == len(dates)-1 || installment.Principal > outstanding {
+			installment.Principal = outstanding
+		}
+		if installment.Principal < 0 {
+			installment.Principal = 0
+		}
+		outstanding -= installment.Principal
+		installments[index] = installment
+	}
+	return installments
+}
+
+// annuityPayment - ежемесячный аннуитетный платёж, округлённый до дирама
+func annuityPayment(principal int64, rateBp int64, term int) int64 {
+	if term == 0 {
+		return 0
+	}
+	rate := float64(rateBp) / 120000
+	if rate == 0 {
+		return (principal + int64(term) - 1) / int64(term)
+	}
+	return int64(math.Round(float64(principal) * rate / (1 - math.Pow(1+rate, -float64(term)))))
+}
+
+// addMonths сдвигает дату на months месяцев, прижимая день к концу короткого месяца (31.01 -> 28.02)
+func addMonths(day time.Time, months int) time.Time {
+	first := time.Date(day.Year(), day.Month()+time.Month(months), 1, 0, 0, 0, 0, day.Location())
+	last := first.AddDate(0, 1, -1).Day()
+	if day.Day() < last {
+		last = day.Day()
+	}
+	return time.Date(first.Year(), first.Month(), last, 0, 0, 0, 0, day.Location())
+}
+
+func AddLoanProduct(product LoanProduct, db *sql.DB) (int64, error) {
+	err := product.Validate()
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.Exec(
+		insertLoanProductSQL,
+		sql.Named("name", strings.TrimSpace(product.Name)),
+		sql.Named("rate_bp", product.RateBp),
+		sql.Named("schedule", product.Schedule),
+		sql.Named("penalty_bp", product.PenaltyBp),
+		sql.Named("min_amount", product.MinAmount),
+		sql.Named("max_amount", product.MaxAmount),
+		sql.Named("min_term", product.MinTerm),
+		sql.Named("max_term", product.MaxTerm),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func ListLoanProducts(db *sql.DB) (products []LoanProduct, err error) {
+	rows, err := db.Query(listLoanProductsSQL)
+	if err != nil {
+		return nil, queryError(listLoanProductsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			products, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		product, err := scanLoanProduct(rows)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		products = append(products, product)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return products, nil
+}
+
+func scanLoanProduct(row scanner) (product LoanProduct, err error) {
+	err = row.Scan(&product.Id, &product.Name, &product.RateBp, &product.Schedule, &product.PenaltyBp,
+		&product.MinAmount, &product.MaxAmount, &product.MinTerm, &product.MaxTerm)
+	return product, err
+}
+
+// ApplyForLoan создаёт заявку клиента на кредит, которую рассматривает менеджер
+func ApplyForLoan(clientId int64, productId int64, amount int64, term int, db *sql.DB) (loanId int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkExists(tx, getClientIdSQL, clientId, ErrClientNotFound)
+	if err != nil {
+		return 0, err
+	}
+	err = checkClientActive(tx, clientId)
+	if err != nil {
+		return 0, err
+	}
+	product, err := scanLoanProduct(tx.QueryRow(getLoanProductSQL, productId))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrLoanProductNotFound
+		}
+		return 0, queryError(getLoanProductSQL, err)
+	}
+	if amount < product.MinAmount || amount > product.MaxAmount || term < product.MinTerm || term > product.MaxTerm {
+		return 0, ErrLoanOutOfProductRange
+	}
+
+	loan := Loan{
+		ClientId:  clientId,
+		ProductId: productId,
+		Amount:    amount,
+		Term:      term,
+		RateBp:    product.RateBp,
+		Schedule:  product.Schedule,
+		PenaltyBp: product.PenaltyBp,
+		Status:    LoanPending,
+		CreatedAt: time.Unix(timeNow().Unix(), 0),
+	}
+	result, err := tx.Exec(
+		insertLoanSQL,
+		sql.Named("client_id", loan.ClientId),
+		sql.Named("product_id", loan.ProductId),
+		sql.Named("amount", loan.Amount),
+		sql.Named("term", loan.Term),
+		sql.Named("rate_bp", loan.RateBp),
+		sql.Named("schedule", loan.Schedule),
+		sql.Named("penalty_bp", loan.PenaltyBp),
+		sql.Named("created_at", loan.CreatedAt.Unix()),
+	)
+	if err != nil {
+		return 0, err
+	}
+	loan.Id, err = result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	err = writeAudit(tx, ClientActor(clientId), AuditCreate, AuditEntityLoan, loan.Id, nil, loan)
+	if err != nil {
+		return 0, err
+	}
+	return loan.Id, nil
+}
+
+func ApproveLoan(managerId int64, loanId int64, db *sql.DB) error {
+	return reviewLoan(managerId, loanId, LoanApproved, "", db)
+}
+
+func RejectLoan(managerId int64, loanId int64, reason string, db *sql.DB) error {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return ErrLoanReasonRequired
+	}
+	return reviewLoan(managerId, loanId, LoanRejected, reason, db)
+}
+
+func reviewLoan(managerId int64, loanId int64, status string, reason string, db *sql.DB) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkExists(tx, getManagerIdSQL, managerId, ErrManagerNotFound)
+	if err != nil {
+		return err
+	}
+	loan, err := getLoan(tx, loanId)
+	if err != nil {
+		return err
+	}
+	err = checkClientScope(tx, managerId, loan.ClientId)
+	if err != nil {
+		return err
+	}
+	if loan.Status != LoanPending {
+		return ErrLoanNotPending
+	}
+
+	before := loan
+	loan.Status = status
+	loan.ManagerId = managerId
+	loan.Reason = reason
+	loan.ReviewedAt = time.Unix(timeNow().Unix(), 0)
+	_, err = tx.Exec(
+		reviewLoanSQL,
+		sql.Named("id", loanId),
+		sql.Named("status", loan.Status),
+		sql.Named("manager_id", managerId),
+		sql.Named("reason", reason),
+		sql.Named("reviewed_at", loan.ReviewedAt.Unix()),
+	)
+	if err != nil {
+		return err
+	}
+
+	return writeAudit(tx, ManagerActor(managerId), AuditLoanReview, AuditEntityLoan, loanId, before, loan)
+}
+
+// DisburseLoan зачисляет одобренный кредит на баланс клиента и строит график погашения
+func DisburseLoan(managerId int64, loanId int64, db *sql.DB) (loan Loan, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Loan{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkExists(tx, getManagerIdSQL, managerId, ErrManagerNotFound)
+	if err != nil {
+		return Loan{}, err
+	}
+	loan, err = getLoan(tx, loanId)
+	if err != nil {
+		return Loan{}, err
+	}
+	err = checkClientScope(tx, managerId, loan.ClientId)
+	if err != nil {
+		return Loan{}, err
+	}
+	if loan.Status != LoanApproved {
+		return Loan{}, ErrLoanNotApproved
+	}
+
+	before, err := getClientBalance(tx, loan.ClientId)
+	if err != nil {
+		return Loan{}, err
+	}
+	_, err = registerCredit(tx, loan.ClientId, 0, OperationLoanDisbursement, loan.Amount)
+	if err != nil {
+		return Loan{}, err
+	}
+	err = changeClientBalance(tx, loan.ClientId, loan.Amount)
+	if err != nil {
+		return Loan{}, err
+	}
+
+	now := timeNow()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for _, installment := range BuildLoanSchedule(loan.Amount, loan.RateBp, loan.Term, loan.Schedule, today) {
+		installment.LoanId = loan.Id
+		err = insertLoanInstallment(tx, installment)
+		if err != nil {
+			return Loan{}, err
+		}
+	}
+
+	loan.Status = LoanActive
+	loan.Principal = loan.Amount
+	loan.PenaltyThrough = today
+	loan.DisbursedAt = time.Unix(now.Unix(), 0)
+	_, err = tx.Exec(
+		disburseLoanSQL,
+		sql.Named("id", loan.Id),
+		sql.Named("principal", loan.Principal),
+		sql.Named("penalty_through", today.Format(dateLayout)),
+		sql.Named("disbursed_at", loan.DisbursedAt.Unix()),
+	)
+	if err != nil {
+		return Loan{}, err
+	}
+
+	err = auditClientBalance(tx, ManagerActor(managerId), AuditLoanDisbursement, loan.ClientId, before)
+	if err != nil {
+		return Loan{}, err
+	}
+	return loan, nil
+}
+
+// RepayLoanEarly - досрочное погашение: сначала неустойка и наступившие платежи, остаток
+// уменьшает основной долг, и будущие платежи пересчитываются на тот же срок.
+// Сумма сверх полного долга не списывается; списание - в пределах баланса и овердрафта.
+func RepayLoanEarly(clientId int64, loanId int64, amount int64, db *sql.DB) (payment LoanPayment, err error) {
+	if amount <= 0 {
+		return LoanPayment{}, ErrInvalidAmount
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return LoanPayment{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	loan, err := getLoan(tx, loanId)
+	if err != nil {
+		return LoanPayment{}, err
+	}
+	if loan.ClientId != clientId {
+		return LoanPayment{}, ErrLoanNotFound
+	}
+	if loan.Status != LoanActive {
+		return LoanPayment{}, ErrLoanNotActive
+	}
+	err = checkClientActive(tx, clientId)
+	if err != nil {
+		return LoanPayment{}, err
+	}
+	return repayLoan(tx, ClientActor(clientId), loan, LoanRepaymentEarly, amount, timeNow())
+}
+
+// repayLoan начисляет неустойку по вчерашний день и распределяет amount: неустойка, наступившие
+// платежи по порядку (проценты, затем долг), при досрочном погашении - будущий основной долг
+func repayLoan(tx *sql.Tx, actor Actor, loan Loan, kind string, amount int64, now time.Time) (LoanPayment, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	installments, err := listLoanInstallments(tx, listUnpaidLoanInstallmentsSQL, loan.Id, now.Location())
+	if err != nil {
+		return LoanPayment{}, err
+	}
+	accrueLoanPenalty(&loan, installments, today.AddDate(0, 0, -1))
+
+	owed := loan.Penalty
+	var due, future []LoanInstallment
+	var futurePrincipal int64
+	for _, installment := range installments {
+		if installment.DueOn.After(today) {
+			future = append(future, installment)
+			futurePrincipal += installment.Principal
+			continue
+		}
+		due = append(due, installment)
+		owed += installment.Unpaid()
+	}
+	if kind == LoanRepaymentEarly {
+		owed += futurePrincipal
+	}
+	if amount > owed {
+		amount = owed
+	}
+
+	payment := LoanPayment{LoanId: loan.Id, Kind: kind, Amount: amount, CreatedAt: time.Unix(now.Unix(), 0)}
+	payment.Penalty = minInt64(amount, loan.Penalty)
+	loan.Penalty -= payment.Penalty
+	rest := amount - payment.Penalty
+	settled := true
+	for _, installment := range due {
+		interest := minInt64(rest, installment.Interest-installment.PaidInterest)
+		rest -= interest
+		principal := minInt64(rest, installment.Principal-installment.PaidPrincipal)
+		rest -= principal
+		installment.PaidInterest += interest
+		installment.PaidPrincipal += principal
+		payment.Interest += interest
+		payment.Principal += principal
+
+		installment.Status = InstallmentPaid
+		if installment.Unpaid() > 0 {
+			installment.Status, settled = InstallmentOverdue, false
+		}
+		err = updateLoanInstallment(tx, installment)
+		if err != nil {
+			return LoanPayment{}, err
+		}
+	}
+
+	if kind == LoanRepaymentEarly && rest > 0 {
+		payment.Principal += rest
+		err = rescheduleLoan(tx, loan, future, futurePrincipal-rest)
+		if err != nil {
+			return LoanPayment{}, err
+		}
+		if futurePrincipal == rest {
+			future = nil
+		}
+	}
+	loan.Principal -= payment.Principal
+	if settled && len(future) == 0 && loan.Penalty == 0 {
+		loan.Status = LoanClosed
+	}
+
+	if amount > 0 {
+		before, err := getClientBalance(tx, loan.ClientId)
+		if err != nil {
+			return LoanPayment{}, err
+		}
+		// досрочное погашение - списание по инициативе клиента, плановое не больше остатка
+		var overdraftFeeId int64
+		if kind == LoanRepaymentEarly {
+			overdraftFeeId, err = allowDebit(tx, loan.ClientId, amount)
+			if err != nil {
+				return LoanPayment{}, err
+			}
+		}
+		payment.OperationId, err = insertOperation(tx, Operation{
+			Type:      OperationLoanRepayment,
+			ClientId:  loan.ClientId,
+			Amount:    amount,
+			CreatedAt: now,
+		})
+		if err != nil {
+			return LoanPayment{}, err
+		}
+		err = linkOverdraftFee(tx, overdraftFeeId, OperationLoanRepayment, payment.OperationId)
+		if err != nil {
+			return LoanPayment{}, err
+		}
+		err = changeClientBalance(tx, loan.ClientId, -amount)
+		if err != nil {
+			return LoanPayment{}, err
+		}
+		payment.Id, err = insertLoanPayment(tx, payment)
+		if err != nil {
+			return LoanPayment{}, err
+		}
+		err = auditClientBalance(tx, actor, AuditLoanRepayment, loan.ClientId, before)
+		if err != nil {
+			return LoanPayment{}, err
+		}
+	}
+
+	_, err = tx.Exec(
+		updateLoanStateSQL,
+		sql.Named("id", loan.Id),
+		sql.Named("status", loan.Status),
+		sql.Named("principal", loan.Principal),
+		sql.Named("penalty", loan.Penalty),
+		sql.Named("penalty_through", loan.PenaltyThrough.Format(dateLayout)),
+	)
+	if err != nil {
+		return LoanPayment{}, err
+	}
+	return payment, nil
+}
+
+// accrueLoanPenalty начисляет за каждый день по through включительно PenaltyBp
+// от суммы платежей, срок которых наступил раньше этого дня и которые не оплачены
+func accrueLoanPenalty(loan *Loan, installments []LoanInstallment, through time.Time) {
+	for day := loan.PenaltyThrough.AddDate(0, 0, 1); !day.After(through); day = day.AddDate(0, 0, 1) {
+		var overdue int64
+		for _, installment := range installments {
+			if installment.DueOn.Before(day) {
+				overdue += installment.Unpaid()
+			}
+		}
+		loan.Penalty += overdue * loan.PenaltyBp / 10000
+	}
+	if through.After(loan.PenaltyThrough) {
+		loan.PenaltyThrough = through
+	}
+}
+
+// rescheduleLoan заменяет будущие платежи графиком на остаток principal с теми же датами
+func rescheduleLoan(tx *sql.Tx, loan Loan, future []LoanInstallment, principal int64) error {
+	dates := make([]time.Time, 0, len(future))
+	for _, installment := range future {
+		_, err := tx.Exec(deleteLoanInstallmentSQL, installment.Id)
+		if err != nil {
+			return err
+		}
+		dates = append(dates, installment.DueOn)
+	}
+	if principal == 0 {
+		return nil
+	}
+	for index, installment := range scheduleInstallments(principal, loan.RateBp, loan.Schedule, dates) {
+		installment.LoanId = loan.Id
+		installment.Number = future[index].Number
+		err := insertLoanInstallment(tx, installment)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoanRepaymentJob - ежедневное списание наступивших платежей по кредитам. Если денег
+// не хватает, списывается сколько есть, платёж становится просроченным и на него
+// начисляется неустойка.
+type LoanRepaymentJob struct {
+	db    *sql.DB
+	clock Clock
+}
+
+func NewLoanRepaymentJob(db *sql.DB, clock Clock) *LoanRepaymentJob {
+	return &LoanRepaymentJob{db: db, clock: clock}
+}
+
+// RunDue возвращает проведённые списания
+func (receiver *LoanRepaymentJob) RunDue() ([]LoanPayment, error) {
+	now := receiver.clock.Now()
+	loans, err := listLoans(receiver.db, listDueLoansSQL, now.Format(dateLayout), now.Location())
+	if err != nil {
+		return nil, err
+	}
+
+	payments := make([]LoanPayment, 0, len(loans))
+	for _, loan := range loans {
+		payment, err := receiver.collect(loan, now)
+		if err != nil {
+			return payments, err
+		}
+		if payment.Amount > 0 {
+			payments = append(payments, payment)
+		}
+	}
+	return payments, nil
+}
+
+func (receiver *LoanRepaymentJob) collect(loan Loan, now time.Time) (payment LoanPayment, err error) {
+	tx, err := receiver.db.Begin()
+	if err != nil {
+		return LoanPayment{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	balance, err := getClientBalance(tx, loan.ClientId)
+	if err != nil {
+		return LoanPayment{}, err
+	}
+	if balance < 0 {
+		balance = 0
+	}
+	return repayLoan(tx, SystemActor, loan, LoanRepaymentScheduled, balance, now)
+}
+
+func GetLoan(loanId int64, db *sql.DB) (Loan, error) {
+	return getLoan(db, loanId)
+}
+
+func getLoan(q queryRower, loanId int64) (Loan, error) {
+	loan, err := scanLoan(q.QueryRow(getLoanSQL, loanId), time.Local)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Loan{}, ErrLoanNotFound
+		}
+		return Loan{}, queryError(getLoanSQL, err)
+	}
+	return loan, nil
+}
+
+func ListClientLoans(clientId int64, db *sql.DB) ([]Loan, error) {
+	return listLoans(db, listClientLoansSQL, clientId, time.Local)
+}
+
+func listLoans(db *sql.DB, query string, arg interface{}, location *time.Location) (loans []Loan, err error) {
+	rows, err := db.Query(query, arg)
+	if err != nil {
+		return nil, queryError(query, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			loans, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		loan, err := scanLoan(rows, location)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		loans = append(loans, loan)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return loans, nil
+}
+
+func scanLoan(row scanner, location *time.Location) (loan Loan, err error) {
+	var managerId, reviewedAt, disbursedAt sql.NullInt64
+	var penaltyThrough sql.NullString
+	var createdAt int64
+	err = row.Scan(&loan.Id, &loan.ClientId, &loan.ProductId, &loan.Amount, &loan.Term, &loan.RateBp,
+		&loan.Schedule, &loan.PenaltyBp, &loan.Status, &loan.Principal, &loan.Penalty, &penaltyThrough,
+		&managerId, &loan.Reason, &createdAt, &reviewedAt, &disbursedAt)
+	if err != nil {
+		return Loan{}, err
+	}
+	loan.ManagerId = managerId.Int64
+	loan.CreatedAt = time.Unix(createdAt, 0)
+	if reviewedAt.Valid {
+		loan.ReviewedAt = time.Unix(reviewedAt.Int64, 0)
+	}
+	if disbursedAt.Valid {
+		loan.DisbursedAt = time.Unix(disbursedAt.Int64, 0)
+	}
+	if penaltyThrough.Valid {
+		loan.PenaltyThrough, err = time.ParseInLocation(dateLayout, penaltyThrough.String, location)
+	}
+	return loan, err
+}
+
+// GetLoanSchedule - график погашения кредита с отметками об оплате
+func GetLoanSchedule(loanId int64, db *sql.DB) ([]LoanInstallment, error) {
+	return listLoanInstallments(db, listLoanInstallmentsSQL, loanId, time.Local)
+}
+
+func listLoanInstallments(q queryer, query string, loanId int64, location *time.Location) (installments []LoanInstallment, err error) {
+	rows, err := q.Query(query, loanId)
+	if err != nil {
+		return nil, queryError(query, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			installments, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		installment := LoanInstallment{}
+		var dueOn string
+		err = rows.Scan(&installment.Id, &installment.LoanId, &installment.Number, &dueOn, &installment.Principal,
+			&installment.Interest, &installment.PaidPrincipal, &installment.PaidInterest, &installment.Status)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		installment.DueOn, err = time.ParseInLocation(dateLayout, dueOn, location)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		installments = append(installments, installment)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return installments, nil
+}
+
+func GetLoanPayments(loanId int64, db *sql.DB) (payments []LoanPayment, err error) {
+	rows, err := db.Query(listLoanPaymentsSQL, loanId)
+	if err != nil {
+		return nil, queryError(listLoanPaymentsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			payments, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		payment := LoanPayment{}
+		var createdAt int64
+		err = rows.Scan(&payment.Id, &payment.LoanId, &payment.OperationId, &payment.Kind, &payment.Amount,
+			&payment.Penalty, &payment.Interest, &payment.Principal, &createdAt)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		payment.CreatedAt = time.Unix(createdAt, 0)
+		payments = append(payments, payment)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return payments, nil
+}
+
+func insertLoanInstallment(tx *sql.Tx, installment LoanInstallment) error {
+	_, err := tx.Exec(
+		insertLoanInstallmentSQL,
+		sql.Named("loan_id", installment.LoanId),
+		sql.Named("number", installment.Number),
+		sql.Named("due_on", installment.DueOn.Format(dateLayout)),
+		sql.Named("principal", installment.Principal),
+		sql.Named("interest", installment.Interest),
+	)
+	return err
+}
+
+func updateLoanInstallment(tx *sql.Tx, installment LoanInstallment) error {
+	_, err := tx.Exec(
+		updateLoanInstallmentSQL,
+		sql.Named("id", installment.Id),
+		sql.Named("paid_principal", installment.PaidPrincipal),
+		sql.Named("paid_interest", installment.PaidInterest),
+		sql.Named("status", installment.Status),
+	)
+	return err
+}
+
+func insertLoanPayment(tx *sql.Tx, payment LoanPayment) (int64, error) {
+	result, err := tx.Exec(
+		insertLoanPaymentSQL,
+		sql.Named("loan_id", payment.LoanId),
+		sql.Named("operation_id", payment.OperationId),
+		sql.Named("kind", payment.Kind),
+		sql.Named("amount", payment.Amount),
+		sql.Named("penalty", payment.Penalty),
+		sql.Named("interest", payment.Interest),
+		sql.Named("principal", payment.Principal),
+		sql.Named("created_at", payment.CreatedAt.Unix()),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func minInt64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
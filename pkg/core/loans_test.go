@@ -0,0 +1,257 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func addTestLoan(t *testing.T, db *sql.DB, clientId int64, product LoanProduct, amount int64, term int) Loan {
+	productId, err := AddLoanProduct(product, db)
+	if err != nil {
+		t.Fatalf("can't add loan product: %v", err)
+	}
+	loanId, err := ApplyForLoan(clientId, productId, amount, term, db)
+	if err != nil {
+		t.Fatalf("can't apply for loan: %v", err)
+	}
+	err = ApproveLoan(1, loanId, db)
+	if err != nil {
+		t.Fatalf("can't approve loan: %v", err)
+	}
+	loan, err := DisburseLoan(1, loanId, db)
+	if err != nil {
+		t.Fatalf("can't disburse loan: %v", err)
+	}
+	return loan
+}
+
+func setTestClientBalance(t *testing.T, db *sql.DB, clientId int64, balance int64) {
+	_, err := db.Exec(`UPDATE client SET balance = ? WHERE id = ?;`, balance, clientId)
+	if err != nil {
+		t.Fatalf("can't set balance: %v", err)
+	}
+}
+
+func TestBuildLoanSchedule(t *testing.T) {
+	start := time.Date(2021, 1, 31, 0, 0, 0, 0, time.Local)
+
+	annuity := BuildLoanSchedule(120000, 1200, 12, LoanAnnuity, start)
+	if len(annuity) != 12 || annuity[0].Interest != 1200 || annuity[0].Principal != 9462 {
+		t.Fatalf("unexpected annuity schedule: %+v", annuity)
+	}
+	var principal int64
+	for _, installment := range annuity[:11] {
+		principal += installment.Principal
+		if payment := installment.Principal + installment.Interest; payment != 10662 {
+			t.Errorf("installment %d: unexpected payment %d", installment.Number, payment)
+		}
+	}
+	if principal+annuity[11].Principal != 120000 {
+		t.Errorf("principal not repaid: %d", principal+annuity[11].Principal)
+	}
+	if annuity[0].DueOn.Day() != 28 || annuity[1].DueOn.Day() != 31 || annuity[11].DueOn.Year() != 2022 {
+		t.Errorf("unexpected due dates: %v %v %v", annuity[0].DueOn, annuity[1].DueOn, annuity[11].DueOn)
+	}
+
+	differentiated := BuildLoanSchedule(120000, 1200, 12, LoanDifferentiated, start)
+	for _, installment := range differentiated {
+		if installment.Principal != 10000 {
+			t.Errorf("installment %d: unexpected principal %d", installment.Number, installment.Principal)
+		}
+	}
+	if differentiated[0].Interest != 1200 || differentiated[11].Interest != 100 {
+		t.Errorf("unexpected interest: %d %d", differentiated[0].Interest, differentiated[11].Interest)
+	}
+}
+
+func TestLoan_ApplyReviewDisburse(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 500, 1001)
+	assignTestBranch(t, db, clientId, 1)
+
+	if _, err := AddLoanProduct(LoanProduct{Name: "Consumer", Schedule: "bullet", MinAmount: 1, MaxAmount: 10, MinTerm: 1, MaxTerm: 1}, db); !errors.Is(err, ErrInvalidLoanProduct) {
+		t.Errorf("not ErrInvalidLoanProduct: %v", err)
+	}
+	productId, err := AddLoanProduct(LoanProduct{Name: "Consumer", RateBp: 2400, Schedule: LoanAnnuity, PenaltyBp: 10,
+		MinAmount: 1000, MaxAmount: 100000, MinTerm: 3, MaxTerm: 24}, db)
+	if err != nil {
+		t.Fatalf("can't add product: %v", err)
+	}
+	if _, err := ApplyForLoan(clientId, productId, 200000, 12, db); !errors.Is(err, ErrLoanOutOfProductRange) {
+		t.Errorf("not ErrLoanOutOfProductRange: %v", err)
+	}
+	if _, err := ApplyForLoan(clientId, productId+1, 10000, 12, db); !errors.Is(err, ErrLoanProductNotFound) {
+		t.Errorf("not ErrLoanProductNotFound: %v", err)
+	}
+
+	rejectedId, _ := ApplyForLoan(clientId, productId, 10000, 12, db)
+	if err := RejectLoan(2, rejectedId, " ", db); !errors.Is(err, ErrLoanReasonRequired) {
+		t.Errorf("not ErrLoanReasonRequired: %v", err)
+	}
+	if err := RejectLoan(2, rejectedId, "low income", db); err != nil {
+		t.Fatalf("can't reject loan: %v", err)
+	}
+	if _, err := DisburseLoan(2, rejectedId, db); !errors.Is(err, ErrLoanNotApproved) {
+		t.Errorf("rejected loan disbursed: %v", err)
+	}
+
+	loanId, err := ApplyForLoan(clientId, productId, 12000, 6, db)
+	if err != nil {
+		t.Fatalf("can't apply: %v", err)
+	}
+	if err := ApproveLoan(100, loanId, db); !errors.Is(err, ErrManagerNotFound) {
+		t.Errorf("not ErrManagerNotFound: %v", err)
+	}
+	if err := ApproveLoan(2, loanId, db); err != nil {
+		t.Fatalf("can't approve: %v", err)
+	}
+	if err := ApproveLoan(2, loanId, db); !errors.Is(err, ErrLoanNotPending) {
+		t.Errorf("not ErrLoanNotPending: %v", err)
+	}
+	loan, err := DisburseLoan(2, loanId, db)
+	if err != nil {
+		t.Fatalf("can't disburse: %v", err)
+	}
+	if loan.Status != LoanActive || loan.Principal != 12000 || clientBalance(t, db, clientId) != 12500 {
+		t.Errorf("unexpected disbursement: %+v", loan)
+	}
+	schedule, err := GetLoanSchedule(loanId, db)
+	if err != nil {
+		t.Fatalf("can't get schedule: %v", err)
+	}
+	if len(schedule) != 6 || schedule[0].Status != InstallmentScheduled || schedule[0].Interest != 240 {
+		t.Errorf("unexpected schedule: %+v", schedule)
+	}
+
+	loans, err := ListClientLoans(clientId, db)
+	if err != nil {
+		t.Fatalf("can't list loans: %v", err)
+	}
+	if len(loans) != 2 || loans[0].Status != LoanRejected || loans[0].Reason != "low income" || loans[1].ManagerId != 2 {
+		t.Errorf("unexpected loans: %+v", loans)
+	}
+}
+
+func TestLoanRepaymentJob_OverdueAndPenalty(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	defer func() { timeNow = time.Now }()
+	disbursed := time.Date(2021, 1, 10, 12, 0, 0, 0, time.Local)
+	timeNow = func() time.Time { return disbursed }
+
+	clientId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	loan := addTestLoan(t, db, clientId, LoanProduct{Name: "Interest free", Schedule: LoanDifferentiated, PenaltyBp: 10,
+		MinAmount: 1, MaxAmount: 100000, MinTerm: 1, MaxTerm: 12}, 12000, 3)
+	setTestClientBalance(t, db, clientId, 0)
+
+	clock := &testClock{now: time.Date(2021, 2, 9, 9, 0, 0, 0, time.Local)}
+	job := NewLoanRepaymentJob(db, clock)
+	payments, err := job.RunDue()
+	if err != nil || len(payments) != 0 {
+		t.Fatalf("collected before due date: %+v %v", payments, err)
+	}
+
+	clock.now = time.Date(2021, 2, 10, 9, 0, 0, 0, time.Local)
+	payments, err = job.RunDue()
+	if err != nil || len(payments) != 0 {
+		t.Fatalf("collected from empty balance: %+v %v", payments, err)
+	}
+	schedule, _ := GetLoanSchedule(loan.Id, db)
+	if schedule[0].Status != InstallmentOverdue {
+		t.Errorf("installment not overdue: %+v", schedule[0])
+	}
+
+	// неустойка за 11-14 февраля: 4 дня по 0.1% от 4000
+	setTestClientBalance(t, db, clientId, 5000)
+	clock.now = time.Date(2021, 2, 15, 9, 0, 0, 0, time.Local)
+	payments, err = job.RunDue()
+	if err != nil {
+		t.Fatalf("can't collect: %v", err)
+	}
+	if len(payments) != 1 || payments[0].Amount != 4016 || payments[0].Penalty != 16 || payments[0].Principal != 4000 {
+		t.Fatalf("unexpected payments: %+v", payments)
+	}
+	if balance := clientBalance(t, db, clientId); balance != 984 {
+		t.Errorf("unexpected balance: %d", balance)
+	}
+	loan, _ = GetLoan(loan.Id, db)
+	schedule, _ = GetLoanSchedule(loan.Id, db)
+	if loan.Principal != 8000 || loan.Penalty != 0 || schedule[0].Status != InstallmentPaid {
+		t.Errorf("unexpected loan state: %+v %+v", loan, schedule[0])
+	}
+
+	// остаток списывается частично, неустойка по второму платежу ещё не начислена
+	clock.now = time.Date(2021, 3, 10, 9, 0, 0, 0, time.Local)
+	payments, _ = job.RunDue()
+	if len(payments) != 1 || payments[0].Amount != 984 {
+		t.Errorf("unexpected partial payment: %+v", payments)
+	}
+	history, err := GetLoanPayments(loan.Id, db)
+	if err != nil || len(history) != 2 {
+		t.Errorf("unexpected payment history: %+v %v", history, err)
+	}
+}
+
+func TestRepayLoanEarly(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return time.Date(2021, 1, 10, 12, 0, 0, 0, time.Local) }
+
+	clientId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	otherId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	loan := addTestLoan(t, db, clientId, LoanProduct{Name: "Consumer", RateBp: 1200, Schedule: LoanAnnuity,
+		MinAmount: 1, MaxAmount: 1000000, MinTerm: 1, MaxTerm: 24}, 120000, 12)
+
+	if _, err := RepayLoanEarly(otherId, loan.Id, 1000, db); !errors.Is(err, ErrLoanNotFound) {
+		t.Errorf("other client repaid loan: %v", err)
+	}
+	if _, err := RepayLoanEarly(clientId, loan.Id, 0, db); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("not ErrInvalidAmount: %v", err)
+	}
+
+	timeNow = func() time.Time { return time.Date(2021, 1, 20, 12, 0, 0, 0, time.Local) }
+	setTestClientBalance(t, db, clientId, 50000)
+	if _, err := RepayLoanEarly(clientId, loan.Id, 60000, db); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("not ErrInsufficientFunds: %v", err)
+	}
+	if balance := clientBalance(t, db, clientId); balance != 50000 {
+		t.Errorf("balance changed by rejected repayment: %d", balance)
+	}
+	setTestClientBalance(t, db, clientId, 120000)
+
+	payment, err := RepayLoanEarly(clientId, loan.Id, 60000, db)
+	if err != nil {
+		t.Fatalf("can't repay: %v", err)
+	}
+	if payment.Principal != 60000 || payment.Kind != LoanRepaymentEarly || payment.OperationId == 0 {
+		t.Errorf("unexpected payment: %+v", payment)
+	}
+	schedule, _ := GetLoanSchedule(loan.Id, db)
+	var principal int64
+	for _, installment := range schedule {
+		principal += installment.Principal
+	}
+	if len(schedule) != 12 || principal != 60000 || schedule[0].Interest != 600 || schedule[0].Number != 1 ||
+		schedule[0].DueOn.Day() != 10 {
+		t.Errorf("schedule not recalculated: %+v", schedule)
+	}
+
+	payment, err = RepayLoanEarly(clientId, loan.Id, 100000, db)
+	if err != nil {
+		t.Fatalf("can't repay in full: %v", err)
+	}
+	loan, _ = GetLoan(loan.Id, db)
+	if payment.Amount != 60000 || loan.Status != LoanClosed || loan.Principal != 0 {
+		t.Errorf("loan not closed: %+v %+v", payment, loan)
+	}
+	if balance := clientBalance(t, db, clientId); balance != 0 {
+		t.Errorf("unexpected balance: %d", balance)
+	}
+	if _, err := RepayLoanEarly(clientId, loan.Id, 100, db); !errors.Is(err, ErrLoanNotActive) {
+		t.Errorf("not ErrLoanNotActive: %v", err)
+	}
+}
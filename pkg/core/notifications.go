@@ -0,0 +1,369 @@
+package core
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	ChannelSms   = "sms"
+	ChannelEmail = "email"
+)
+
+const (
+	LanguageRussian = "ru"
+	LanguageTajik   = "tg"
+	LanguageEnglish = "en"
+)
+
+var ErrUnsupportedLanguage = errors.New("unsupported notification language")
+
+// Message - сообщение клиенту; Subject нужен только для email
+type Message struct {
+	Channel string
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier отправляет сообщение по своему каналу, см. SmsNotifier, SmtpNotifier и MemoryNotifier
+type Notifier interface {
+	Notify(message Message) error
+}
+
+// NotificationPreferences - настройки уведомлений клиента. Events - события, о которых
+// сообщать; BalanceChanged по умолчанию выключен, чтобы перевод не приходил двумя SMS.
+type NotificationPreferences struct {
+	Language string
+	Sms      bool
+	Email    bool
+	Events   []string
+}
+
+func (receiver NotificationPreferences) wants(eventType string) bool {
+	for _, wanted := range receiver.Events {
+		if wanted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultNotificationPreferences() NotificationPreferences {
+	return NotificationPreferences{
+		Language: LanguageRussian,
+		Sms:      true,
+		Events:   []string{EventTransferCompleted, EventTopUpCompleted, EventServicePaid, EventNewDeviceLogin},
+	}
+}
+
+// notificationData - поля, доступные в шаблонах
+type notificationData struct {
+	Name          string
+	Amount        int64
+	Fee           int64
+	Balance       int64
+	Incoming      bool
+	Service       string
+	ReceiptNumber string
+	DeviceId      string
+	Time          string
+}
+
+type notificationTemplate struct {
+	subject string
+	body    *template.Template
+}
+
+func newNotificationTemplate(subject string, body string) notificationTemplate {
+	return notificationTemplate{subject: subject, body: template.Must(template.New(subject).Parse(body))}
+}
+
+// notificationTemplates - шаблоны по событию и языку
+var notificationTemplates = map[string]map[string]notificationTemplate{
+	EventTransferCompleted: {
+		LanguageRussian: newNotificationTemplate("Перевод",
+			"{{if .Incoming}}Зачислен перевод {{.Amount}}{{else}}Перевод {{.Amount}} выполнен{{end}}. Баланс: {{.Balance}}. Квитанция {{.ReceiptNumber}}"),
+		LanguageTajik: newNotificationTemplate("Интиқол",
+			"{{if .Incoming}}Ба ҳисоби шумо {{.Amount}} гузаронида шуд{{else}}Интиқоли {{.Amount}} иҷро шуд{{end}}. Бақия: {{.Balance}}. Квитансия {{.ReceiptNumber}}"),
+		LanguageEnglish: newNotificationTemplate("Transfer",
+			"{{if .Incoming}}Transfer of {{.Amount}} received{{else}}Transfer of {{.Amount}} completed{{end}}. Balance: {{.Balance}}. Receipt {{.ReceiptNumber}}"),
+	},
+	EventTopUpCompleted: {
+		LanguageRussian: newNotificationTemplate("Пополнение",
+			"Счёт пополнен на {{.Amount}}. Баланс: {{.Balance}}. Квитанция {{.ReceiptNumber}}"),
+		LanguageTajik: newNotificationTemplate("Пуркунии ҳисоб",
+			"Ҳисоби шумо ба {{.Amount}} пур карда шуд. Бақия: {{.Balance}}. Квитансия {{.ReceiptNumber}}"),
+		LanguageEnglish: newNotificationTemplate("Top-up",
+			"Account topped up by {{.Amount}}. Balance: {{.Balance}}. Receipt {{.ReceiptNumber}}"),
+	},
+	EventServicePaid: {
+		LanguageRussian: newNotificationTemplate("Оплата услуги",
+			"Оплата {{.Service}}: {{.Amount}}, комиссия {{.Fee}}. Баланс: {{.Balance}}. Квитанция {{.ReceiptNumber}}"),
+		LanguageTajik: newNotificationTemplate("Пардохти хизмат",
+			"Пардохти {{.Service}}: {{.Amount}}, комиссия {{.Fee}}. Бақия: {{.Balance}}. Квитансия {{.ReceiptNumber}}"),
+		LanguageEnglish: newNotificationTemplate("Service payment",
+			"Payment for {{.Service}}: {{.Amount}}, fee {{.Fee}}. Balance: {{.Balance}}. Receipt {{.ReceiptNumber}}"),
+	},
+	EventBalanceChanged: {
+		LanguageRussian: newNotificationTemplate("Изменение баланса", "Баланс изменился на {{.Amount}}: {{.Balance}}"),
+		LanguageTajik:   newNotificationTemplate("Тағйири бақия", "Бақияи ҳисоб ба {{.Amount}} тағйир ёфт: {{.Balance}}"),
+		LanguageEnglish: newNotificationTemplate("Balance change", "Balance changed by {{.Amount}}: {{.Balance}}"),
+	},
+	EventNewDeviceLogin: {
+		LanguageRussian: newNotificationTemplate("Вход с нового устройства",
+			"Вход в аккаунт с нового устройства {{.DeviceId}} в {{.Time}}. Если это не вы, позвоните в банк."),
+		LanguageTajik: newNotificationTemplate("Ворид аз дастгоҳи нав",
+			"Ворид ба ҳисоб аз дастгоҳи нав {{.DeviceId}} соати {{.Time}}. Агар ин шумо набошед, ба бонк занг занед."),
+		LanguageEnglish: newNotificationTemplate("New device sign-in",
+			"Sign-in from new device {{.DeviceId}} at {{.Time}}. If this wasn't you, call the bank."),
+	},
+}
+
+func renderNotification(eventType string, language string, data notificationData) (subject string, body string, err error) {
+	templates, ok := notificationTemplates[eventType]
+	if !ok {
+		return "", "", fmt.Errorf("%w: %s", ErrUnknownEventType, eventType)
+	}
+	notification, ok := templates[language]
+	if !ok {
+		return "", "", ErrUnsupportedLanguage
+	}
+	buffer := bytes.Buffer{}
+	err = notification.body.Execute(&buffer, data)
+	if err != nil {
+		return "", "", err
+	}
+	return notification.subject, buffer.String(), nil
+}
+
+// SetNotificationPreferences сохраняет настройки; пустой Events - сообщать о событиях по умолчанию
+func SetNotificationPreferences(clientId int64, preferences NotificationPreferences, db *sql.DB) error {
+	if _, ok := notificationTemplates[EventTransferCompleted][preferences.Language]; !ok {
+		return ErrUnsupportedLanguage
+	}
+	if len(preferences.Events) == 0 {
+		preferences.Events = defaultNotificationPreferences().Events
+	}
+	for _, eventType := range preferences.Events {
+		if _, ok := notificationTemplates[eventType]; !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownEventType, eventType)
+		}
+	}
+	err := checkExists(db, getClientIdSQL, clientId, ErrClientNotFound)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		upsertNotificationPreferencesSQL,
+		sql.Named("client_id", clientId),
+		sql.Named("language", preferences.Language),
+		sql.Named("sms", preferences.Sms),
+		sql.Named("email", preferences.Email),
+		sql.Named("events", strings.Join(preferences.Events, ",")),
+	)
+	return err
+}
+
+// GetNotificationPreferences - настройки клиента или настройки по умолчанию, если клиент их не менял
+func GetNotificationPreferences(clientId int64, db *sql.DB) (NotificationPreferences, error) {
+	err := checkExists(db, getClientIdSQL, clientId, ErrClientNotFound)
+	if err != nil {
+		return NotificationPreferences{}, err
+	}
+	return getNotificationPreferences(db, clientId)
+}
+
+func getNotificationPreferences(q queryRower, clientId int64) (preferences NotificationPreferences, err error) {
+	var events string
+	err = q.QueryRow(getNotificationPreferencesSQL, clientId).Scan(&preferences.Language, &preferences.Sms,
+		&preferences.Email, &events)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return defaultNotificationPreferences(), nil
+		}
+		return NotificationPreferences{}, queryError(getNotificationPreferencesSQL, err)
+	}
+	preferences.Events = strings.Split(events, ",")
+	return preferences, nil
+}
+
+// NotificationHandler - подписчик EventDispatcher, который сообщает клиентам о переводах,
+// пополнениях, оплатах услуг, изменениях баланса и входах с новых устройств. sms или email
+// может быть nil - тогда канал не используется. При ошибке отправки событие повторяется целиком, поэтому
+// второй участник перевода может получить сообщение повторно.
+func NotificationHandler(db *sql.DB, sms Notifier, email Notifier) EventHandler {
+	return func(event Event) error {
+		recipients, err := notificationRecipients(db, event)
+		if err != nil {
+			return err
+		}
+		for clientId, data := range recipients {
+			err = notifyClient(db, sms, email, clientId, event.Type, data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// notificationRecipients - кому и с какими данными сообщить о событии
+func notificationRecipients(db *sql.DB, event Event) (map[int64]notificationData, error) {
+	recipients := make(map[int64]notificationData)
+	switch event.Type {
+	case EventTransferCompleted:
+		transfer := TransferCompleted{}
+		err := event.Decode(&transfer)
+		if err != nil {
+			return nil, err
+		}
+		data := notificationData{Amount: transfer.Amount, ReceiptNumber: transfer.ReceiptNumber}
+		if transfer.ClientId != 0 {
+			recipients[transfer.ClientId] = data
+		}
+		data.Incoming = true
+		if transfer.TargetClientId != 0 {
+			recipients[transfer.TargetClientId] = data
+		}
+	case EventTopUpCompleted:
+		topUp := TopUpCompleted{}
+		err := event.Decode(&topUp)
+		if err != nil {
+			return nil, err
+		}
+		recipients[topUp.ClientId] = notificationData{Amount: topUp.Amount, ReceiptNumber: topUp.ReceiptNumber}
+	case EventServicePaid:
+		payment := ServicePaid{}
+		err := event.Decode(&payment)
+		if err != nil {
+			return nil, err
+		}
+		service, err := getCatalogService(db, payment.ServiceId)
+		if err != nil {
+			return nil, err
+		}
+		recipients[payment.ClientId] = notificationData{Amount: payment.Amount, Fee: payment.Fee,
+			Service: service.Name, ReceiptNumber: payment.ReceiptNumber}
+	case EventBalanceChanged:
+		changed := BalanceChanged{}
+		err := event.Decode(&changed)
+		if err != nil {
+			return nil, err
+		}
+		recipients[changed.ClientId] = notificationData{Amount: changed.After - changed.Before, Balance: changed.After}
+	case EventNewDeviceLogin:
+		login := NewDeviceLogin{}
+		err := event.Decode(&login)
+		if err != nil {
+			return nil, err
+		}
+		recipients[login.ClientId] = notificationData{DeviceId: login.DeviceId, Time: login.LoggedInAt.Format("02.01.2006 15:04")}
+	}
+	return recipients, nil
+}
+
+func notifyClient(db *sql.DB, sms Notifier, email Notifier, clientId int64, eventType string, data notificationData) error {
+	preferences, err := getNotificationPreferences(db, clientId)
+	if err != nil {
+		return err
+	}
+	if !preferences.wants(eventType) {
+		return nil
+	}
+
+	var phone, address string
+	var balance int64
+	err = db.QueryRow(getClientContactsSQL, clientId).Scan(&data.Name, &phone, &address, &balance)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrClientNotFound
+		}
+		return queryError(getClientContactsSQL, err)
+	}
+	if eventType != EventBalanceChanged {
+		data.Balance = balance
+	}
+	subject, body, err := renderNotification(eventType, preferences.Language, data)
+	if err != nil {
+		return err
+	}
+
+	if sms != nil && preferences.Sms && phone != "" {
+		err = sms.Notify(Message{Channel: ChannelSms, To: phone, Body: body})
+		if err != nil {
+			return err
+		}
+	}
+	if email != nil && preferences.Email && address != "" {
+		err = email.Notify(Message{Channel: ChannelEmail, To: address, Subject: subject, Body: body})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoginUserFromDevice - LoginUser с запоминанием устройства клиента: вход с устройства,
+// которого ещё не было, публикует EventNewDeviceLogin. Пустой deviceId - как LoginUser.
+func LoginUserFromDevice(login string, password string, deviceId string, db *sql.DB) (int64, bool, error) {
+	clientId, ok, err := LoginUser(login, password, db)
+	if err != nil || !ok || deviceId == "" {
+		return clientId, ok, err
+	}
+	err = rememberClientDevice(clientId, deviceId, db)
+	if err != nil {
+		return -1, false, err
+	}
+	return clientId, true, nil
+}
+
+func rememberClientDevice(clientId int64, deviceId string, db *sql.DB) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	now := time.Unix(timeNow().Unix(), 0)
+	result, err := tx.Exec(
+		insertClientDeviceSQL,
+		sql.Named("client_id", clientId),
+		sql.Named("device_id", deviceId),
+		sql.Named("now", now.Unix()),
+	)
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		_, err = tx.Exec(
+			touchClientDeviceSQL,
+			sql.Named("client_id", clientId),
+			sql.Named("device_id", deviceId),
+			sql.Named("now", now.Unix()),
+		)
+		return err
+	}
+
+	return publishEvent(tx, EventNewDeviceLogin, AuditEntityClient, clientId, NewDeviceLogin{
+		ClientId:   clientId,
+		DeviceId:   deviceId,
+		LoggedInAt: now,
+	})
+}
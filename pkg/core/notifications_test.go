@@ -0,0 +1,185 @@
+package core
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSetNotificationPreferences(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+
+	preferences, err := GetNotificationPreferences(clientId, db)
+	if err != nil {
+		t.Fatalf("can't get preferences: %v", err)
+	}
+	if preferences.Language != LanguageRussian || !preferences.Sms || preferences.Email || preferences.wants(EventBalanceChanged) {
+		t.Errorf("unexpected default preferences: %+v", preferences)
+	}
+
+	if err := SetNotificationPreferences(clientId, NotificationPreferences{Language: "de"}, db); !errors.Is(err, ErrUnsupportedLanguage) {
+		t.Errorf("not ErrUnsupportedLanguage: %v", err)
+	}
+	err = SetNotificationPreferences(clientId, NotificationPreferences{Language: LanguageTajik, Events: []string{EventAtmAdded}}, db)
+	if !errors.Is(err, ErrUnknownEventType) {
+		t.Errorf("not ErrUnknownEventType: %v", err)
+	}
+	if err := SetNotificationPreferences(clientId+1, NotificationPreferences{Language: LanguageTajik}, db); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("not ErrClientNotFound: %v", err)
+	}
+
+	err = SetNotificationPreferences(clientId, NotificationPreferences{Language: LanguageTajik, Email: true,
+		Events: []string{EventBalanceChanged}}, db)
+	if err != nil {
+		t.Fatalf("can't set preferences: %v", err)
+	}
+	preferences, _ = GetNotificationPreferences(clientId, db)
+	if preferences.Language != LanguageTajik || preferences.Sms || !preferences.Email || !preferences.wants(EventBalanceChanged) ||
+		preferences.wants(EventTransferCompleted) {
+		t.Errorf("unexpected preferences: %+v", preferences)
+	}
+}
+
+func TestNotificationHandler_TransferAndPayment(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	aliCard := issueTestCard(t, db, aliId, 1000)
+	valiCard := issueTestCard(t, db, valiId, 0)
+
+	err := UpdateClientProfile(ClientActor(aliId), aliId, testProfile(), db)
+	if err != nil {
+		t.Fatalf("can't update profile: %v", err)
+	}
+	err = SetNotificationPreferences(aliId, NotificationPreferences{Language: LanguageEnglish, Sms: true, Email: true}, db)
+	if err != nil {
+		t.Fatalf("can't set preferences: %v", err)
+	}
+	_, err = TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 100, db)
+	if err != nil {
+		t.Fatalf("can't transfer: %v", err)
+	}
+	_, err = PayService(aliId, 1, "921234567", 10, db)
+	if err != nil {
+		t.Fatalf("can't pay service: %v", err)
+	}
+
+	sms, email := &MemoryNotifier{}, &MemoryNotifier{}
+	dispatcher := NewEventDispatcher(db, SystemClock{})
+	dispatcher.Subscribe("notifications", NotificationHandler(db, sms, email))
+	_, err = dispatcher.Dispatch()
+	if err != nil {
+		t.Fatalf("can't dispatch: %v", err)
+	}
+
+	messages := sms.Messages()
+	if len(messages) != 3 {
+		t.Fatalf("unexpected sms: %+v", messages)
+	}
+	texts := make(map[string]string)
+	for _, message := range messages {
+		texts[message.To] = texts[message.To] + message.Body + "\n"
+	}
+	if !strings.Contains(texts["921111111"], "Transfer of 100 completed. Balance: 890") ||
+		!strings.Contains(texts["921111111"], "Payment for Tcell: 10, fee 0. Balance: 890") {
+		t.Errorf("unexpected sender sms: %q", texts["921111111"])
+	}
+	if !strings.HasPrefix(texts["922222222"], "Зачислен перевод 100. Баланс: 100.") {
+		t.Errorf("unexpected recipient sms: %q", texts["922222222"])
+	}
+
+	letters := email.Messages()
+	if len(letters) != 2 || letters[0].To != "ali@example.tj" || letters[0].Subject != "Transfer" ||
+		letters[1].Subject != "Service payment" {
+		t.Errorf("unexpected email: %+v", letters)
+	}
+}
+
+func TestNotificationHandler_PhoneTransferAndTopUp(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	_ = addTestClient(t, db, "ali", 921111111, 1000, 1001)
+
+	transfer, err := TransactionMinusWithReceipt(Client{PhoneNumber: 921111111, Balance: 300}, db)
+	if err != nil {
+		t.Fatalf("can't transfer: %v", err)
+	}
+	topUp, err := TransactionBalanceNumberPlusWithReceipt(1001, 50, db)
+	if err != nil {
+		t.Fatalf("can't top up: %v", err)
+	}
+
+	sms := &MemoryNotifier{}
+	dispatcher := NewEventDispatcher(db, SystemClock{})
+	dispatcher.Subscribe("notifications", NotificationHandler(db, sms, nil))
+	_, err = dispatcher.Dispatch()
+	if err != nil {
+		t.Fatalf("can't dispatch: %v", err)
+	}
+
+	// настройки по умолчанию: по сообщению на перевод и пополнение, без отдельного об остатке
+	messages := sms.Messages()
+	if len(messages) != 2 || messages[0].To != "921111111" ||
+		messages[0].Body != "Перевод 300 выполнен. Баланс: 750. Квитанция "+transfer.Number ||
+		messages[1].Body != "Счёт пополнен на 50. Баланс: 750. Квитанция "+topUp.Number {
+		t.Errorf("unexpected sms: %+v", messages)
+	}
+}
+
+func TestNotificationHandler_FailedSendRetried(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	_ = addTestClient(t, db, "ali", 921111111, 0, 1001)
+
+	_, ok, err := LoginUserFromDevice("ali", "secret", "iphone-1", db)
+	if !ok || err != nil {
+		t.Fatalf("can't login: %v", err)
+	}
+	sms := &MemoryNotifier{Err: errors.New("gateway down")}
+	dispatcher := NewEventDispatcher(db, SystemClock{})
+	dispatcher.Subscribe("notifications", NotificationHandler(db, sms, nil))
+	_, err = dispatcher.Dispatch()
+	if err != nil {
+		t.Fatalf("can't dispatch: %v", err)
+	}
+	pending, _ := ListPendingEvents(db)
+	if len(pending) != 1 || pending[0].Type != EventNewDeviceLogin || !strings.Contains(pending[0].LastError, "gateway down") {
+		t.Errorf("failed notification not retried: %+v", pending)
+	}
+}
+
+func TestLoginUserFromDevice_NewDevice(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	err := SetNotificationPreferences(clientId, NotificationPreferences{Language: LanguageTajik, Sms: true}, db)
+	if err != nil {
+		t.Fatalf("can't set preferences: %v", err)
+	}
+
+	for _, device := range []string{"iphone-1", "iphone-1", "android-7", ""} {
+		_, ok, err := LoginUserFromDevice("ali", "secret", device, db)
+		if !ok || err != nil {
+			t.Fatalf("can't login from %s: %v", device, err)
+		}
+	}
+	if _, ok, err := LoginUserFromDevice("ali", "wrong", "laptop", db); ok || !errors.Is(err, ErrInvalidPass) {
+		t.Errorf("wrong password accepted: %v", err)
+	}
+
+	sms := &MemoryNotifier{}
+	dispatcher := NewEventDispatcher(db, SystemClock{})
+	dispatcher.Subscribe("notifications", NotificationHandler(db, sms, nil), EventNewDeviceLogin)
+	_, err = dispatcher.Dispatch()
+	if err != nil {
+		t.Fatalf("can't dispatch: %v", err)
+	}
+	messages := sms.Messages()
+	if len(messages) != 2 || !strings.HasPrefix(messages[0].Body, "Ворид ба ҳисоб аз дастгоҳи нав iphone-1") ||
+		!strings.Contains(messages[1].Body, "android-7") || messages[1].To != "921111111" {
+		t.Errorf("unexpected messages: %+v", messages)
+	}
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"sync"
+)
+
+const defaultSmsTimeout = defaultWebhookTimeout
+
+// SmsNotifier отправляет SMS через HTTP-шлюз: POST JSON {"from", "to", "text"}
+// с заголовком Authorization: Bearer Token. Client nil - клиент с таймаутом 10 секунд.
+type SmsNotifier struct {
+	Url    string
+	Sender string
+	Token  string
+	Client *http.Client
+}
+
+type smsRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Text string `json:"text"`
+}
+
+func (receiver SmsNotifier) Notify(message Message) error {
+	body, err := json.Marshal(smsRequest{From: receiver.Sender, To: message.To, Text: message.Body})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, receiver.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+receiver.Token)
+
+	client := receiver.Client
+	if client == nil {
+		client = &http.Client{Timeout: defaultSmsTimeout}
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("sms gateway: unexpected status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// SmtpNotifier отправляет письма через SMTP-сервер Addr (host:port); Auth nil - без авторизации
+type SmtpNotifier struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func (receiver SmtpNotifier) Notify(message Message) error {
+	return smtp.SendMail(receiver.Addr, receiver.Auth, receiver.From, []string{message.To}, emailMessage(receiver.From, message))
+}
+
+// emailMessage собирает письмо в UTF-8: тема кодируется по RFC 2047, тело - base64
+func emailMessage(from string, message Message) []byte {
+	buffer := bytes.Buffer{}
+	_, _ = fmt.Fprintf(&buffer, "From: %s\r\n", from)
+	_, _ = fmt.Fprintf(&buffer, "To: %s\r\n", message.To)
+	_, _ = fmt.Fprintf(&buffer, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	buffer.WriteString("MIME-Version: 1.0\r\n")
+	buffer.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buffer.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString([]byte(message.Body))
+	for len(encoded) > 76 {
+		buffer.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buffer.WriteString(encoded + "\r\n")
+	return buffer.Bytes()
+}
+
+// MemoryNotifier запоминает сообщения вместо отправки - для тестов и локального запуска.
+// Если задан Err, Notify возвращает его и ничего не запоминает.
+type MemoryNotifier struct {
+	mutex    sync.Mutex
+	messages []Message
+	Err      error
+}
+
+func (receiver *MemoryNotifier) Notify(message Message) error {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if receiver.Err != nil {
+		return receiver.Err
+	}
+	receiver.messages = append(receiver.messages, message)
+	return nil
+}
+
+func (receiver *MemoryNotifier) Messages() []Message {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return append([]Message(nil), receiver.messages...)
+}
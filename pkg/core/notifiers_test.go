@@ -0,0 +1,55 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSmsNotifier_Notify(t *testing.T) {
+	var received smsRequest
+	var authorization string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		authorization = request.Header.Get("Authorization")
+		_ = json.NewDecoder(request.Body).Decode(&received)
+		writer.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	notifier := SmsNotifier{Url: server.URL, Sender: "Bank", Token: "token", Client: server.Client()}
+	err := notifier.Notify(Message{Channel: ChannelSms, To: "921111111", Body: "Баланс: 100"})
+	if err != nil {
+		t.Fatalf("can't send sms: %v", err)
+	}
+	if authorization != "Bearer token" || received != (smsRequest{From: "Bank", To: "921111111", Text: "Баланс: 100"}) {
+		t.Errorf("unexpected request: %q %+v", authorization, received)
+	}
+
+	status = http.StatusBadGateway
+	if err := notifier.Notify(Message{Channel: ChannelSms, To: "921111111", Body: "test"}); err == nil {
+		t.Errorf("gateway error not reported")
+	}
+}
+
+func TestEmailMessage(t *testing.T) {
+	body := strings.Repeat("Перевод выполнен. ", 10)
+	data := string(emailMessage("bank@example.tj", Message{To: "ali@example.tj", Subject: "Перевод", Body: body}))
+
+	parts := strings.SplitN(data, "\r\n\r\n", 2)
+	if len(parts) != 2 || !strings.Contains(parts[0], "Subject: =?utf-8?q?") || !strings.Contains(parts[0], "To: ali@example.tj") {
+		t.Fatalf("unexpected headers: %q", data)
+	}
+	for _, line := range strings.Split(parts[1], "\r\n") {
+		if len(line) > 76 {
+			t.Errorf("line too long: %d", len(line))
+		}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.Replace(parts[1], "\r\n", "", -1))
+	if err != nil || string(decoded) != body {
+		t.Errorf("unexpected body: %q %v", decoded, err)
+	}
+}
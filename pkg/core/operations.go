@@ -0,0 +1,175 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrClientNotFound = errors.New("client not found")
+
+// типы операций в истории
+const (
+	OperationTransfer          = "transfer"
+	OperationServicePayment    = "service_payment"
+	OperationAtmWithdrawal     = "atm_withdrawal"
+	OperationAtmDeposit        = "atm_deposit"
+	OperationTopUp             = "top_up"
+	OperationReversal          = "reversal"
+	OperationInterest          = "interest"
+	OperationLoanDisbursement  = "loan_disbursement"
+	OperationLoanRepayment     = "loan_repayment"
+	OperationDepositOpen       = "deposit_open"
+	OperationDepositPayout     = "deposit_payout"
+	OperationOverdraftFee      = "overdraft_fee"
+	OperationOverdraftInterest = "overdraft_interest"
+	OperationFee               = "fee"
+)
+
+// timeNow подменяется в тестах
+var timeNow = time.Now
+
+type Operation struct {
+	Id             int64
+	Type           string
+	ClientId       int64
+	CardId         int64
+	TargetClientId int64
+	TargetCardId   int64
+	AtmId          int64
+	Amount         int64
+	CreatedAt      time.Time
+	// только для сторно: отменённая операция, менеджер и причина
+	ReversalOf int64
+	ManagerId  int64
+	Reason     string
+}
+
+func insertOperation(tx *sql.Tx, operation Operation) (int64, error) {
+	result, err := tx.Exec(
+		insertOperationSQL,
+		sql.Named("type", operation.Type),
+		sql.Named("client_id", operation.ClientId),
+		sql.Named("card_id", nullableId(operation.CardId)),
+		sql.Named("target_client_id", nullableId(operation.TargetClientId)),
+		sql.Named("target_card_id", nullableId(operation.TargetCardId)),
+		sql.Named("atm_id", nullableId(operation.AtmId)),
+		sql.Named("amount", operation.Amount),
+		sql.Named("created_at", operation.CreatedAt.Unix()),
+		sql.Named("reversal_of", nullableId(operation.ReversalOf)),
+		sql.Named("manager_id", nullableId(operation.ManagerId)),
+		sql.Named("reason", operation.Reason),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// nullableId превращает нулевой id в NULL для необязательных внешних ключей
+func nullableId(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
+
+// registerDebit проверяет ограничения клиента, лимиты, KYC для переводов и лимит овердрафта
+// и записывает расходную операцию в историю
+func registerDebit(tx *sql.Tx, clientId int64, cardId int64, operationType string, amount int64) (int64, error) {
+	return registerDebitAt(tx, clientId, cardId, operationType, amount, timeNow())
+}
+
+// registerDebitAt - registerDebit на момент now: по нему считаются лимиты и время операции
+func registerDebitAt(tx *sql.Tx, clientId int64, cardId int64, operationType string, amount int64, now time.Time) (int64, error) {
+	err := checkClientActive(tx, clientId)
+	if err != nil {
+		return 0, err
+	}
+	if operationType == OperationTransfer {
+		err = checkTransferKyc(tx, clientId, amount)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = checkSpendingLimits(tx, clientId, cardId, operationType, amount, now)
+	if err != nil {
+		return 0, err
+	}
+	overdraftFeeId, err := allowDebit(tx, clientId, amount)
+	if err != nil {
+		return 0, err
+	}
+
+	operationId, err := insertOperation(tx, Operation{
+		Type:      operationType,
+		ClientId:  clientId,
+		CardId:    cardId,
+		Amount:    amount,
+		CreatedAt: now,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return operationId, linkOverdraftFee(tx, overdraftFeeId, operationType, operationId)
+}
+
+// registerCredit записывает приходную операцию в историю, чтобы её можно было найти в выписке и отменить
+func registerCredit(tx *sql.Tx, clientId int64, cardId int64, operationType string, amount int64) (int64, error) {
+	err := checkClientActive(tx, clientId)
+	if err != nil {
+		return 0, err
+	}
+	return insertOperation(tx, Operation{
+		Type:      operationType,
+		ClientId:  clientId,
+		CardId:    cardId,
+		Amount:    amount,
+		CreatedAt: timeNow(),
+	})
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanOperation читает колонки operationColumns, extra - дополнительные колонки запроса
+func scanOperation(row scanner, operation *Operation, extra ...interface{}) error {
+	var cardId, targetClientId, targetCardId, atmId, reversalOf, managerId sql.NullInt64
+	var createdAt int64
+	dest := []interface{}{&operation.Id, &operation.Type, &operation.ClientId, &cardId, &targetClientId,
+		&targetCardId, &atmId, &operation.Amount, &createdAt, &reversalOf, &managerId, &operation.Reason}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return err
+	}
+	operation.CardId = cardId.Int64
+	operation.TargetClientId = targetClientId.Int64
+	operation.TargetCardId = targetCardId.Int64
+	operation.AtmId = atmId.Int64
+	operation.ReversalOf = reversalOf.Int64
+	operation.ManagerId = managerId.Int64
+	operation.CreatedAt = time.Unix(createdAt, 0)
+	return nil
+}
+
+func getClientId(q queryRower, query string, key interface{}) (int64, error) {
+	var id int64
+	err := q.QueryRow(query, key).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrClientNotFound
+		}
+		return 0, queryError(query, err)
+	}
+	return id, nil
+}
+
+func getClientBalance(q queryRower, clientId int64) (int64, error) {
+	var balance int64
+	err := q.QueryRow(getClientBalanceSQL, clientId).Scan(&balance)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrClientNotFound
+		}
+		return 0, queryError(getClientBalanceSQL, err)
+	}
+	return balance, nil
+}
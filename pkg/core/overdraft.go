@@ -0,0 +1,320 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidOverdraft = errors.New("invalid overdraft terms")
+var ErrOverdraftExceeded = errors.New("overdraft limit exceeded")
+
+// Overdraft - условия овердрафта клиента: до какой суммы Limit баланс может уйти в минус,
+// годовая ставка на отрицательный баланс в базисных пунктах и комиссия Fee за каждый
+// уход баланса в минус. Клиент без условий работает с нулевым лимитом.
+type Overdraft struct {
+	ClientId int64
+	Limit    int64
+	RateBp   int64
+	Fee      int64
+}
+
+func (receiver Overdraft) Validate() error {
+	if receiver.Limit < 0 || receiver.RateBp < 0 || receiver.RateBp > 10000 || receiver.Fee < 0 {
+		return ErrInvalidOverdraft
+	}
+	return nil
+}
+
+// OverdraftExceededError сравнивается с ErrOverdraftExceeded и ErrInsufficientFunds через errors.Is;
+// Required - сумма списания вместе с комиссией за овердрафт
+type OverdraftExceededError struct {
+	ClientId int64
+	Balance  int64
+	Limit    int64
+	Required int64
+}
+
+func (receiver *OverdraftExceededError) Error() string {
+	return fmt.Sprintf("debit %d exceeds balance %d and overdraft limit %d of client %d",
+		receiver.Required, receiver.Balance, receiver.Limit, receiver.ClientId)
+}
+
+func (receiver *OverdraftExceededError) Is(target error) bool {
+	return target == ErrOverdraftExceeded || target == ErrInsufficientFunds
+}
+
+// SetOverdraft устанавливает или меняет условия овердрафта; уменьшение лимита ниже
+// текущего долга не списывает деньги, а только запрещает новые списания
+func SetOverdraft(managerId int64, overdraft Overdraft, db *sql.DB) (err error) {
+	err = overdraft.Validate()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkClientScope(tx, managerId, overdraft.ClientId)
+	if err != nil {
+		return err
+	}
+	before, err := getOverdraft(tx, overdraft.ClientId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		upsertOverdraftSQL,
+		sql.Named("client_id", overdraft.ClientId),
+		sql.Named("credit_limit", overdraft.Limit),
+		sql.Named("rate_bp", overdraft.RateBp),
+		sql.Named("fee", overdraft.Fee),
+		sql.Named("today", timeNow().Format(dateLayout)),
+	)
+	if err != nil {
+		return err
+	}
+	return writeAudit(tx, ManagerActor(managerId), AuditOverdraft, AuditEntityClient, overdraft.ClientId, before, overdraft)
+}
+
+func GetOverdraft(clientId int64, db *sql.DB) (Overdraft, error) {
+	err := checkExists(db, getClientIdSQL, clientId, ErrClientNotFound)
+	if err != nil {
+		return Overdraft{}, err
+	}
+	return getOverdraft(db, clientId)
+}
+
+func getOverdraft(q queryRower, clientId int64) (Overdraft, error) {
+	overdraft := Overdraft{ClientId: clientId}
+	err := q.QueryRow(getOverdraftSQL, clientId).Scan(&overdraft.Limit, &overdraft.RateBp, &overdraft.Fee)
+	if err != nil && err != sql.ErrNoRows {
+		return Overdraft{}, queryError(getOverdraftSQL, err)
+	}
+	return overdraft, nil
+}
+
+// checkOverdraft проверяет, что списание amount укладывается в баланс клиента и лимит
+// овердрафта, и возвращает комиссию за овердрафт, если списание уводит баланс в минус;
+// комиссия тоже должна уложиться в лимит. Сама ничего не списывает.
+func checkOverdraft(tx *sql.Tx, clientId int64, amount int64) (fee int64, err error) {
+	balance, err := getClientBalance(tx, clientId)
+	if err != nil {
+		return 0, err
+	}
+	overdraft, err := getOverdraft(tx, clientId)
+	if err != nil {
+		return 0, err
+	}
+	if balance >= 0 && balance < amount {
+		fee = overdraft.Fee
+	}
+	if balance-amount-fee < -overdraft.Limit {
+		return 0, &OverdraftExceededError{ClientId: clientId, Balance: balance, Limit: overdraft.Limit, Required: amount + fee}
+	}
+	return fee, nil
+}
+
+// checkCardFunds - с карты можно списать только её собственный остаток и лимит овердрафта
+// владельца: средства других карт клиента не позволяют увести карту в минус
+func checkCardFunds(tx *sql.Tx, card Card, amount int64) error {
+	overdraft, err := getOverdraft(tx, card.UserId)
+	if err != nil {
+		return err
+	}
+	if card.Balance-amount < -overdraft.Limit {
+		return &OverdraftExceededError{ClientId: card.UserId, Balance: card.Balance, Limit: overdraft.Limit, Required: amount}
+	}
+	return nil
+}
+
+// allowDebit - проверка лимита для списаний по инициативе клиента: при уходе баланса
+// в минус сразу списывается комиссия за овердрафт. Вызывается до изменения баланса и
+// возвращает операцию комиссии (0 - комиссии нет), которую после записи самого списания
+// нужно передать в linkOverdraftFee.
+func allowDebit(tx *sql.Tx, clientId int64, amount int64) (int64, error) {
+	fee, err := checkOverdraft(tx, clientId, amount)
+	if err != nil || fee == 0 {
+		return 0, err
+	}
+	return chargeClient(tx, clientId, OperationOverdraftFee, fee)
+}
+
+// allowCardDebit - allowDebit для списания с карты с проверкой остатка самой карты
+func allowCardDebit(tx *sql.Tx, card Card, amount int64) (int64, error) {
+	err := checkCardFunds(tx, card, amount)
+	if err != nil {
+		return 0, err
+	}
+	return allowDebit(tx, card.UserId, amount)
+}
+
+// linkOverdraftFee привязывает комиссию за овердрафт feeOperationId к операции operationId,
+// которая её вызвала: комиссия зачисляется в доходы банка и возвращается при сторно операции
+func linkOverdraftFee(tx *sql.Tx, feeOperationId int64, operationType string, operationId int64) error {
+	if feeOperationId == 0 {
+		return nil
+	}
+	fee, err := getOperation(tx, feeOperationId)
+	if err != nil {
+		return err
+	}
+	return postFeeRevenue(tx, fee.ClientId, operationType, operationId, feeOperationId, fee.Amount)
+}
+
+// chargeClient списывает с клиента сбор банка без проверки лимита овердрафта
+func chargeClient(tx *sql.Tx, clientId int64, operationType string, amount int64) (int64, error) {
+	operationId, err := insertOperation(tx, Operation{
+		Type:      operationType,
+		ClientId:  clientId,
+		Amount:    amount,
+		CreatedAt: timeNow(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(
+		updateClientBalanceMinusByIdSQL,
+		sql.Named("id", clientId),
+		sql.Named("balance", amount),
+	)
+	if err != nil {
+		return 0, err
+	}
+	err = settleClientCards(tx, clientId)
+	if err != nil {
+		return 0, err
+	}
+	return operationId, publishBalanceChanged(tx, clientId, -amount)
+}
+
+// OverdraftInterestJob - ежедневное начисление процентов на отрицательный баланс (act/365)
+// с точным накоплением долей дирама; накопленное списывается в последний день месяца.
+// Списание процентов может вывести баланс за лимит - новые списания тогда запрещены.
+type OverdraftInterestJob struct {
+	db    *sql.DB
+	clock Clock
+}
+
+func NewOverdraftInterestJob(db *sql.DB, clock Clock) *OverdraftInterestJob {
+	return &OverdraftInterestJob{db: db, clock: clock}
+}
+
+type overdraftAccrual struct {
+	clientId        int64
+	rateBp          int64
+	interestThrough time.Time
+	numerator       int64
+}
+
+// RunDue возвращает число начисленных клиенто-дней
+func (receiver *OverdraftInterestJob) RunDue() (int, error) {
+	now := receiver.clock.Now()
+	yesterday := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, now.Location())
+	accruals, err := listOverdraftAccruals(receiver.db, yesterday.Format(dateLayout), now.Location())
+	if err != nil {
+		return 0, err
+	}
+
+	accrued := 0
+	for _, accrual := range accruals {
+		days, err := receiver.accrue(accrual, yesterday)
+		if err != nil {
+			return accrued, err
+		}
+		accrued += days
+	}
+	return accrued, nil
+}
+
+func (receiver *OverdraftInterestJob) accrue(accrual overdraftAccrual, through time.Time) (days int, err error) {
+	tx, err := receiver.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	const denominator = 10000 * 365
+	for day := accrual.interestThrough.AddDate(0, 0, 1); !day.After(through); day = day.AddDate(0, 0, 1) {
+		balance, err := getClientBalance(tx, accrual.clientId)
+		if err != nil {
+			return 0, err
+		}
+		if balance < 0 {
+			accrual.numerator += -balance * accrual.rateBp
+		}
+		days++
+
+		monthEnd := day.AddDate(0, 0, 1).Month() != day.Month()
+		if monthEnd && accrual.numerator >= denominator {
+			amount := accrual.numerator / denominator
+			before := balance
+			_, err = chargeClient(tx, accrual.clientId, OperationOverdraftInterest, amount)
+			if err != nil {
+				return 0, err
+			}
+			err = auditClientBalance(tx, SystemActor, AuditOverdraft, accrual.clientId, before)
+			if err != nil {
+				return 0, err
+			}
+			accrual.numerator %= denominator
+		}
+	}
+
+	_, err = tx.Exec(
+		updateOverdraftInterestSQL,
+		sql.Named("client_id", accrual.clientId),
+		sql.Named("interest_through", through.Format(dateLayout)),
+		sql.Named("numerator", accrual.numerator),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return days, nil
+}
+
+func listOverdraftAccruals(db *sql.DB, through string, location *time.Location) (accruals []overdraftAccrual, err error) {
+	rows, err := db.Query(listDueOverdraftsSQL, through)
+	if err != nil {
+		return nil, queryError(listDueOverdraftsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			accruals, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		accrual := overdraftAccrual{}
+		var interestThrough string
+		err = rows.Scan(&accrual.clientId, &accrual.rateBp, &interestThrough, &accrual.numerator)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		accrual.interestThrough, err = time.ParseInLocation(dateLayout, interestThrough, location)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		accruals = append(accruals, accrual)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return accruals, nil
+}
@@ -0,0 +1,177 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSetOverdraft(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+
+	if err := SetOverdraft(1, Overdraft{ClientId: clientId, Limit: -1}, db); !errors.Is(err, ErrInvalidOverdraft) {
+		t.Errorf("not ErrInvalidOverdraft: %v", err)
+	}
+	if err := SetOverdraft(100, Overdraft{ClientId: clientId, Limit: 1000}, db); !errors.Is(err, ErrManagerNotFound) {
+		t.Errorf("not ErrManagerNotFound: %v", err)
+	}
+	if err := SetOverdraft(1, Overdraft{ClientId: clientId + 1, Limit: 1000}, db); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("not ErrClientNotFound: %v", err)
+	}
+
+	overdraft, err := GetOverdraft(clientId, db)
+	if err != nil || overdraft != (Overdraft{ClientId: clientId}) {
+		t.Errorf("unexpected default overdraft: %+v %v", overdraft, err)
+	}
+	for _, limit := range []int64{1000, 2000} {
+		err = SetOverdraft(1, Overdraft{ClientId: clientId, Limit: limit, RateBp: 2400, Fee: 50}, db)
+		if err != nil {
+			t.Fatalf("can't set overdraft: %v", err)
+		}
+	}
+	overdraft, _ = GetOverdraft(clientId, db)
+	if overdraft != (Overdraft{ClientId: clientId, Limit: 2000, RateBp: 2400, Fee: 50}) {
+		t.Errorf("unexpected overdraft: %+v", overdraft)
+	}
+}
+
+func TestCheckOverdraft_DebitPaths(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 1000, 1001)
+	transfer := Client{PhoneNumber: 921111111, Balance: 1500}
+
+	err := TransactionMinus(transfer, db)
+	var exceeded *OverdraftExceededError
+	if !errors.As(err, &exceeded) || !errors.Is(err, ErrInsufficientFunds) || exceeded.Limit != 0 || exceeded.Balance != 1000 {
+		t.Fatalf("debit beyond balance allowed: %v", err)
+	}
+
+	err = SetOverdraft(1, Overdraft{ClientId: clientId, Limit: 1000, Fee: 50}, db)
+	if err != nil {
+		t.Fatalf("can't set overdraft: %v", err)
+	}
+	err = TransactionMinus(transfer, db)
+	if err != nil {
+		t.Fatalf("debit within overdraft rejected: %v", err)
+	}
+	if balance := clientBalance(t, db, clientId); balance != -550 {
+		t.Errorf("overdraft fee not charged: %d", balance)
+	}
+	err = TransactionMinus(Client{PhoneNumber: 921111111, Balance: 400}, db)
+	if err != nil {
+		t.Fatalf("debit within overdraft rejected: %v", err)
+	}
+	if balance := clientBalance(t, db, clientId); balance != -950 {
+		t.Errorf("fee charged twice: %d", balance)
+	}
+
+	if _, err := PayService(clientId, 1, "921234567", 100, db); !errors.Is(err, ErrOverdraftExceeded) {
+		t.Errorf("service payment beyond limit: %v", err)
+	}
+	payment, err := PayService(clientId, 1, "921234567", 50, db)
+	if err != nil {
+		t.Fatalf("can't pay within limit: %v", err)
+	}
+	receipt, _ := GetReceipt(payment.ReceiptNumber, db)
+	if receipt.BalanceAfter == nil || *receipt.BalanceAfter != -1000 {
+		t.Errorf("unexpected receipt balance: %+v", receipt.BalanceAfter)
+	}
+}
+
+func TestCheckOverdraft_CardTransfer(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	aliCard := issueTestCard(t, db, aliId, 100)
+	valiCard := issueTestCard(t, db, valiId, 0)
+
+	issueTestCard(t, db, aliId, 1000)
+
+	// средства второй карты не позволяют увести первую в минус
+	if _, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 300, db); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("card transfer beyond card balance: %v", err)
+	}
+	err := SetOverdraft(1, Overdraft{ClientId: aliId, Limit: 500}, db)
+	if err != nil {
+		t.Fatalf("can't set overdraft: %v", err)
+	}
+	_, err = TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 300, db)
+	if err != nil {
+		t.Fatalf("card transfer within overdraft rejected: %v", err)
+	}
+	if card, _ := GetCard(aliCard.Id, db); card.Balance != -200 || clientBalance(t, db, aliId) != 800 {
+		t.Errorf("unexpected balance: card %d, client %d", card.Balance, clientBalance(t, db, aliId))
+	}
+	if _, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 400, db); !errors.Is(err, ErrOverdraftExceeded) {
+		t.Errorf("card overdraft beyond limit: %v", err)
+	}
+}
+
+func TestCheckOverdraft_ReversalChargesNoFee(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 100, 1001)
+	err := SetOverdraft(1, Overdraft{ClientId: clientId, Limit: 1000, Fee: 50}, db)
+	if err != nil {
+		t.Fatalf("can't set overdraft: %v", err)
+	}
+	err = UpdateBalanceClient(clientId, 500, db)
+	if err != nil {
+		t.Fatalf("can't credit client: %v", err)
+	}
+	err = TransactionMinus(Client{PhoneNumber: 921111111, Balance: 500}, db)
+	if err != nil {
+		t.Fatalf("can't debit client: %v", err)
+	}
+
+	var creditId int64
+	err = db.QueryRow(`SELECT id FROM operation WHERE type = ?`, OperationTopUp).Scan(&creditId)
+	if err != nil {
+		t.Fatalf("can't find credit: %v", err)
+	}
+	_, err = ReverseTransaction(1, creditId, "wrong client", db)
+	if err != nil {
+		t.Fatalf("can't reverse credit: %v", err)
+	}
+	if balance := clientBalance(t, db, clientId); balance != -400 {
+		t.Errorf("overdraft fee charged on reversal: %d", balance)
+	}
+}
+
+func TestOverdraftInterestJob(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return time.Date(2021, 1, 20, 12, 0, 0, 0, time.Local) }
+
+	clientId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	saverId := addTestClient(t, db, "vali", 922222222, 1000, 1002)
+	for _, id := range []int64{clientId, saverId} {
+		err := SetOverdraft(1, Overdraft{ClientId: id, Limit: 50000, RateBp: 1000}, db)
+		if err != nil {
+			t.Fatalf("can't set overdraft: %v", err)
+		}
+	}
+	setTestClientBalance(t, db, clientId, -36500)
+
+	// 11 дней по 10% годовых на 36500: ровно 110
+	clock := &testClock{now: time.Date(2021, 2, 1, 3, 0, 0, 0, time.Local)}
+	job := NewOverdraftInterestJob(db, clock)
+	days, err := job.RunDue()
+	if err != nil || days != 22 {
+		t.Fatalf("unexpected accrual: %d %v", days, err)
+	}
+	if balance := clientBalance(t, db, clientId); balance != -36610 {
+		t.Errorf("interest not charged: %d", balance)
+	}
+	if balance := clientBalance(t, db, saverId); balance != 1000 {
+		t.Errorf("interest charged on positive balance: %d", balance)
+	}
+	if days, _ := job.RunDue(); days != 0 {
+		t.Errorf("same day accrued twice: %d", days)
+	}
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// размеры страницы A6 в пунктах
+const pdfPageWidth = 298
+const pdfPageHeight = 420
+const pdfFontSize = 9
+const pdfLineHeight = 13
+const pdfMargin = 24
+
+// renderPDF собирает минимальный PDF 1.4: одна страница, моноширинный Courier.
+// Стандартные шрифты PDF не содержат кириллицы, поэтому не-ASCII символы заменяются на '?'.
+func renderPDF(lines []string) []byte {
+	content := bytes.Buffer{}
+	content.WriteString(fmt.Sprintf("BT\n/F1 %d Tf\n%d TL\n%d %d Td\n", pdfFontSize, pdfLineHeight,
+		pdfMargin, pdfPageHeight-pdfMargin-pdfFontSize))
+	for _, line := range lines {
+		content.WriteString("(" + pdfEscape(line) + ") Tj T*\n")
+	}
+	content.WriteString("ET\n")
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+			pdfPageWidth, pdfPageHeight),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+	}
+
+	document := bytes.Buffer{}
+	document.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = document.Len()
+		document.WriteString(fmt.Sprintf("%d 0 obj\n%s\nendobj\n", i+1, object))
+	}
+
+	xref := document.Len()
+	document.WriteString(fmt.Sprintf("xref\n0 %d\n0000000000 65535 f \n", len(objects)+1))
+	for _, offset := range offsets {
+		document.WriteString(fmt.Sprintf("%010d 00000 n \n", offset))
+	}
+	document.WriteString(fmt.Sprintf("trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(objects)+1, xref))
+
+	return document.Bytes()
+}
+
+func pdfEscape(text string) string {
+	builder := strings.Builder{}
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			builder.WriteRune('\\')
+			builder.WriteRune(r)
+		case r < 32 || r > 126:
+			builder.WriteRune('?')
+		default:
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,164 @@
+package core
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	ReceiptServicePayment = "service_payment"
+	ReceiptTransfer       = "transfer"
+	ReceiptSale           = "sale"
+	ReceiptTopUp          = "top_up"
+	ReceiptCashWithdrawal = "cash_withdrawal"
+)
+
+var ErrReceiptNotFound = errors.New("receipt not found")
+
+// Receipt - квитанция по завершённой операции; сохраняется в той же транзакции,
+// что и операция, и потом выдаётся по номеру. BalanceAfter = nil - остаток не показывается.
+type Receipt struct {
+	Number       string
+	Kind         string
+	OperationId  int64
+	CreatedAt    time.Time
+	Payer        string
+	Payee        string
+	Description  string
+	Amount       int64
+	Fee          int64
+	BalanceAfter *int64
+}
+
+func (receiver Receipt) Total() int64 {
+	return receiver.Amount + receiver.Fee
+}
+
+func GetReceipt(number string, db *sql.DB) (receipt Receipt, err error) {
+	var operationId sql.NullInt64
+	var createdAt int64
+	err = db.QueryRow(getReceiptSQL, number).Scan(&receipt.Number, &receipt.Kind, &operationId,
+		&createdAt, &receipt.Payer, &receipt.Payee, &receipt.Description, &receipt.Amount,
+		&receipt.Fee, &receipt.BalanceAfter)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Receipt{}, ErrReceiptNotFound
+		}
+		return Receipt{}, queryError(getReceiptSQL, err)
+	}
+	receipt.OperationId = operationId.Int64
+	receipt.CreatedAt = time.Unix(createdAt, 0)
+	return receipt, nil
+}
+
+func insertReceipt(tx *sql.Tx, receipt Receipt) error {
+	_, err := tx.Exec(
+		insertReceiptSQL,
+		sql.Named("number", receipt.Number),
+		sql.Named("kind", receipt.Kind),
+		sql.Named("operation_id", nullableId(receipt.OperationId)),
+		sql.Named("created_at", receipt.CreatedAt.Unix()),
+		sql.Named("payer", receipt.Payer),
+		sql.Named("payee", receipt.Payee),
+		sql.Named("description", receipt.Description),
+		sql.Named("amount", receipt.Amount),
+		sql.Named("fee", receipt.Fee),
+		sql.Named("balance_after", receipt.BalanceAfter),
+	)
+	return err
+}
+
+// insertAccountReceipt сохраняет квитанцию по операции со счётом клиента без карты;
+// остаток берётся после всех движений операции, включая комиссию
+func insertAccountReceipt(tx *sql.Tx, clientId int64, receipt Receipt) (Receipt, error) {
+	balanceAfter, err := getClientBalance(tx, clientId)
+	if err != nil {
+		return Receipt{}, err
+	}
+	receipt.BalanceAfter = &balanceAfter
+	err = insertReceipt(tx, receipt)
+	if err != nil {
+		return Receipt{}, err
+	}
+	return receipt, nil
+}
+
+// Text - квитанция для вывода на экран или чековый принтер
+func (receiver Receipt) Text() string {
+	lines := receiver.lines()
+	width := 0
+	for _, line := range lines {
+		if len(line[0]) > width {
+			width = len(line[0])
+		}
+	}
+
+	builder := strings.Builder{}
+	builder.WriteString("RECEIPT " + receiver.Number + "\n")
+	for _, line := range lines {
+		builder.WriteString(fmt.Sprintf("%-*s  %s\n", width+1, line[0]+":", line[1]))
+	}
+	return builder.String()
+}
+
+func (receiver Receipt) JSON() ([]byte, error) {
+	return json.MarshalIndent(receiver, "", "  ")
+}
+
+// PDF - квитанция одной страницей A6
+func (receiver Receipt) PDF() []byte {
+	text := []string{"RECEIPT " + receiver.Number, ""}
+	for _, line := range receiver.lines() {
+		text = append(text, fmt.Sprintf("%-12s %s", line[0]+":", line[1]))
+	}
+	return renderPDF(text)
+}
+
+func (receiver Receipt) lines() [][2]string {
+	lines := [][2]string{
+		{"Date", receiver.CreatedAt.Format("2006-01-02 15:04:05")},
+		{"Operation", receiptKindTitle(receiver.Kind)},
+		{"Payer", receiver.Payer},
+		{"Payee", receiver.Payee},
+		{"Details", receiver.Description},
+		{"Amount", fmt.Sprint(receiver.Amount)},
+		{"Fee", fmt.Sprint(receiver.Fee)},
+		{"Total", fmt.Sprint(receiver.Total())},
+	}
+	if receiver.BalanceAfter != nil {
+		lines = append(lines, [2]string{"Balance", fmt.Sprint(*receiver.BalanceAfter)})
+	}
+	return lines
+}
+
+func receiptKindTitle(kind string) string {
+	switch kind {
+	case ReceiptServicePayment:
+		return "Service payment"
+	case ReceiptTransfer:
+		return "Transfer"
+	case ReceiptSale:
+		return "Sale"
+	case ReceiptTopUp:
+		return "Top-up"
+	case ReceiptCashWithdrawal:
+		return "Cash withdrawal"
+	}
+	return kind
+}
+
+func getClientName(q queryRower, clientId int64) (string, error) {
+	var name string
+	err := q.QueryRow(getClientNameSQL, clientId).Scan(&name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrClientNotFound
+		}
+		return "", queryError(getClientNameSQL, err)
+	}
+	return name, nil
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReceipt_ServicePayment(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 1000, 1001)
+
+	payment, err := PayService(clientId, 3, "123456", 500, db)
+	if err != nil {
+		t.Fatalf("can't pay service: %v", err)
+	}
+
+	receipt, err := GetReceipt(payment.ReceiptNumber, db)
+	if err != nil {
+		t.Fatalf("can't get receipt: %v", err)
+	}
+	if receipt.Payer != "ali" || receipt.Payee != "Babilon-M" || receipt.Total() != 505 ||
+		receipt.BalanceAfter == nil || *receipt.BalanceAfter != 495 {
+		t.Errorf("unexpected receipt: %+v", receipt)
+	}
+
+	text := receipt.Text()
+	for _, expected := range []string{payment.ReceiptNumber, "Service payment", "account 123456", "Total:", "505", "Balance:"} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("receipt text has no %q:\n%s", expected, text)
+		}
+	}
+
+	data, err := receipt.JSON()
+	if err != nil {
+		t.Fatalf("can't marshal receipt: %v", err)
+	}
+	decoded := Receipt{}
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded.Number != receipt.Number || decoded.Fee != 5 {
+		t.Errorf("unexpected json receipt: %s, %v", data, err)
+	}
+
+	pdf := receipt.PDF()
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) ||
+		!bytes.Contains(pdf, []byte(payment.ReceiptNumber)) {
+		t.Errorf("unexpected pdf:\n%s", pdf)
+	}
+}
+
+func TestReceipt_TransferAndSale(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	aliCard := issueTestCard(t, db, aliId, 1000)
+	valiCard := issueTestCard(t, db, valiId, 0)
+
+	transfer, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 300, db)
+	if err != nil {
+		t.Fatalf("can't transfer: %v", err)
+	}
+	saved, err := GetReceipt(transfer.Number, db)
+	if err != nil {
+		t.Fatalf("can't get receipt: %v", err)
+	}
+	if saved.Kind != ReceiptTransfer || *saved.BalanceAfter != 700 || strings.Contains(saved.Payee, valiCard.PAN) {
+		t.Errorf("unexpected transfer receipt: %+v", saved)
+	}
+
+	sale, err := SaleWithReceipt(1, 2, db)
+	if err != nil {
+		t.Fatalf("can't sell: %v", err)
+	}
+	saved, err = GetReceipt(sale.Number, db)
+	if err != nil || saved.Amount != 400 || saved.Description != "Big Mac x 2" || saved.BalanceAfter != nil {
+		t.Errorf("unexpected sale receipt: %+v, %v", saved, err)
+	}
+	if strings.Contains(saved.Text(), "Balance:") {
+		t.Errorf("sale receipt shows balance:\n%s", saved.Text())
+	}
+
+	if _, err := GetReceipt("none", db); !errors.Is(err, ErrReceiptNotFound) {
+		t.Errorf("not ErrReceiptNotFound: %v", err)
+	}
+}
+
+func TestReceipt_AccountTransfersAndCash(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 1000, 1001)
+	card := issueTestCard(t, db, aliId, 100000)
+	atmId := addTestAtm(t, db)
+	err := ReplenishAtm(1, atmId, Notes{10000: 5}, db)
+	if err != nil {
+		t.Fatalf("can't replenish atm: %v", err)
+	}
+
+	transfer, err := TransactionMinusWithReceipt(Client{PhoneNumber: 921111111, Balance: 300}, db)
+	if err != nil {
+		t.Fatalf("can't transfer: %v", err)
+	}
+	if transfer.Kind != ReceiptTransfer || transfer.Payer != "ali" || transfer.Amount != 300 ||
+		*transfer.BalanceAfter != 100700 || transfer.Description != "transfer by phone 921111111" {
+		t.Errorf("unexpected phone transfer receipt: %+v", transfer)
+	}
+	transfer, err = TransactionBalanceNumberMinusWithReceipt(Client{BalanceNumber: 1001, Balance: 200}, db)
+	if err != nil || *transfer.BalanceAfter != 100500 {
+		t.Errorf("unexpected account transfer receipt: %+v %v", transfer, err)
+	}
+
+	topUps := []func() (Receipt, error){
+		func() (Receipt, error) { return TransactionPlusWithReceipt(921111111, 100, db) },
+		func() (Receipt, error) { return TransactionBalanceNumberPlusWithReceipt(1001, 100, db) },
+		func() (Receipt, error) { return UpdateBalanceClientWithReceipt(ManagerActor(1), aliId, 100, db) },
+	}
+	for i, topUp := range topUps {
+		receipt, err := topUp()
+		if err != nil {
+			t.Fatalf("can't top up: %v", err)
+		}
+		saved, err := GetReceipt(receipt.Number, db)
+		if err != nil || saved.Kind != ReceiptTopUp || saved.Payee != "ali" || *saved.BalanceAfter != int64(100600+100*i) {
+			t.Errorf("unexpected top-up receipt: %+v %v", saved, err)
+		}
+	}
+
+	withdrawal, err := WithdrawWithReceipt(atmId, card.Id, 20000, db)
+	if err != nil {
+		t.Fatalf("can't withdraw: %v", err)
+	}
+	saved, err := GetReceipt(withdrawal.Receipt.Number, db)
+	if err != nil || saved.Kind != ReceiptCashWithdrawal || *saved.BalanceAfter != 80000 ||
+		strings.Contains(saved.Payer, card.PAN) || withdrawal.Notes.Total() != 20000 {
+		t.Errorf("unexpected withdrawal receipt: %+v %v", saved, err)
+	}
+	if !strings.Contains(saved.Text(), "Cash withdrawal") {
+		t.Errorf("receipt text has no title:\n%s", saved.Text())
+	}
+}
+
+func TestPdfEscape(t *testing.T) {
+	if escaped := pdfEscape(`a(b)\Ж`); escaped != `a\(b\)\\?` {
+		t.Errorf("unexpected escape: %s", escaped)
+	}
+}
@@ -0,0 +1,255 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	RestrictionFreeze = "freeze"
+	RestrictionBan    = "ban"
+)
+
+var ErrClientFrozen = errors.New("client account frozen")
+var ErrClientBanned = errors.New("client banned")
+var ErrClientNotRestricted = errors.New("client has no active restriction")
+var ErrRestrictionReasonRequired = errors.New("restriction reason required")
+var ErrInvalidRestrictionExpiry = errors.New("restriction expiry must be in the future")
+
+// ClientRestriction - заморозка или блокировка клиента. Действует, пока не снята
+// и не истекла; ExpiresAt нулевое - бессрочно.
+type ClientRestriction struct {
+	Id        int64
+	ClientId  int64
+	Kind      string
+	Reason    string
+	Actor     Actor
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	LiftedAt  time.Time
+	LiftedBy  Actor
+}
+
+func (receiver ClientRestriction) ActiveAt(moment time.Time) bool {
+	return receiver.LiftedAt.IsZero() && (receiver.ExpiresAt.IsZero() || receiver.ExpiresAt.After(moment))
+}
+
+// ClientFrozenError возвращают вход и денежные операции замороженного клиента
+type ClientFrozenError struct {
+	ClientId  int64
+	Reason    string
+	ExpiresAt time.Time
+}
+
+func (receiver *ClientFrozenError) Error() string {
+	return fmt.Sprintf("client %d account frozen: %s", receiver.ClientId, receiver.Reason)
+}
+
+func (receiver *ClientFrozenError) Is(target error) bool {
+	return target == ErrClientFrozen
+}
+
+// ClientBannedError возвращают вход и денежные операции заблокированного клиента
+type ClientBannedError struct {
+	ClientId  int64
+	Reason    string
+	ExpiresAt time.Time
+}
+
+func (receiver *ClientBannedError) Error() string {
+	return fmt.Sprintf("client %d banned: %s", receiver.ClientId, receiver.Reason)
+}
+
+func (receiver *ClientBannedError) Is(target error) bool {
+	return target == ErrClientBanned
+}
+
+// FreezeClient временно останавливает вход и движение денег по счёту клиента
+func FreezeClient(actor Actor, clientId int64, reason string, expiresAt time.Time, db *sql.DB) (int64, error) {
+	return restrictClient(actor, clientId, RestrictionFreeze, AuditFreeze, reason, expiresAt, db)
+}
+
+func UnfreezeClient(actor Actor, clientId int64, db *sql.DB) error {
+	return liftClientRestrictions(actor, clientId, RestrictionFreeze, AuditUnfreeze, db)
+}
+
+// BanClient блокирует клиента; при одновременных заморозке и блокировке операции получают ClientBannedError
+func BanClient(actor Actor, clientId int64, reason string, expiresAt time.Time, db *sql.DB) (int64, error) {
+	return restrictClient(actor, clientId, RestrictionBan, AuditBan, reason, expiresAt, db)
+}
+
+func UnbanClient(actor Actor, clientId int64, db *sql.DB) error {
+	return liftClientRestrictions(actor, clientId, RestrictionBan, AuditUnban, db)
+}
+
+func restrictClient(actor Actor, clientId int64, kind string, action string, reason string, expiresAt time.Time, db *sql.DB) (id int64, err error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return 0, ErrRestrictionReasonRequired
+	}
+	now := time.Unix(timeNow().Unix(), 0)
+	if !expiresAt.IsZero() && !expiresAt.After(now) {
+		return 0, ErrInvalidRestrictionExpiry
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkExists(tx, getClientIdSQL, clientId, ErrClientNotFound)
+	if err != nil {
+		return 0, err
+	}
+	err = checkActorScope(tx, actor, clientId)
+	if err != nil {
+		return 0, err
+	}
+
+	restriction := ClientRestriction{
+		ClientId:  clientId,
+		Kind:      kind,
+		Reason:    reason,
+		Actor:     actor,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}
+	result, err := tx.Exec(
+		insertClientRestrictionSQL,
+		sql.Named("client_id", clientId),
+		sql.Named("kind", kind),
+		sql.Named("reason", reason),
+		sql.Named("actor_type", actor.Type),
+		sql.Named("actor_id", actor.Id),
+		sql.Named("created_at", now.Unix()),
+		sql.Named("expires_at", nullableUnix(expiresAt)),
+	)
+	if err != nil {
+		return 0, err
+	}
+	restriction.Id, err = result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	err = writeAudit(tx, actor, action, AuditEntityClient, clientId, nil, restriction)
+	if err != nil {
+		return 0, err
+	}
+	return restriction.Id, nil
+}
+
+func liftClientRestrictions(actor Actor, clientId int64, kind string, action string, db *sql.DB) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkActorScope(tx, actor, clientId)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(
+		liftClientRestrictionsSQL,
+		sql.Named("client_id", clientId),
+		sql.Named("kind", kind),
+		sql.Named("actor_type", actor.Type),
+		sql.Named("actor_id", actor.Id),
+		sql.Named("now", timeNow().Unix()),
+	)
+	if err != nil {
+		return err
+	}
+	lifted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if lifted == 0 {
+		return ErrClientNotRestricted
+	}
+
+	return writeAudit(tx, actor, action, AuditEntityClient, clientId, nil, nil)
+}
+
+// GetClientRestrictions - вся история заморозок и блокировок клиента, включая снятые
+func GetClientRestrictions(clientId int64, db *sql.DB) (restrictions []ClientRestriction, err error) {
+	rows, err := db.Query(listClientRestrictionsSQL, clientId)
+	if err != nil {
+		return nil, queryError(listClientRestrictionsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			restrictions, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		restriction, err := scanClientRestriction(rows)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		restrictions = append(restrictions, restriction)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return restrictions, nil
+}
+
+// checkClientActive возвращает ClientBannedError или ClientFrozenError, если у клиента есть
+// действующее ограничение; блокировка важнее заморозки
+func checkClientActive(q queryRower, clientId int64) error {
+	row := q.QueryRow(getActiveClientRestrictionSQL, sql.Named("client_id", clientId), sql.Named("now", timeNow().Unix()))
+	restriction, err := scanClientRestriction(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return queryError(getActiveClientRestrictionSQL, err)
+	}
+	if restriction.Kind == RestrictionBan {
+		return &ClientBannedError{ClientId: clientId, Reason: restriction.Reason, ExpiresAt: restriction.ExpiresAt}
+	}
+	return &ClientFrozenError{ClientId: clientId, Reason: restriction.Reason, ExpiresAt: restriction.ExpiresAt}
+}
+
+func scanClientRestriction(row scanner) (restriction ClientRestriction, err error) {
+	var createdAt int64
+	var expiresAt, liftedAt sql.NullInt64
+	err = row.Scan(&restriction.Id, &restriction.ClientId, &restriction.Kind, &restriction.Reason,
+		&restriction.Actor.Type, &restriction.Actor.Id, &createdAt, &expiresAt, &liftedAt,
+		&restriction.LiftedBy.Type, &restriction.LiftedBy.Id)
+	if err != nil {
+		return ClientRestriction{}, err
+	}
+	restriction.CreatedAt = time.Unix(createdAt, 0)
+	if expiresAt.Valid {
+		restriction.ExpiresAt = time.Unix(expiresAt.Int64, 0)
+	}
+	if liftedAt.Valid {
+		restriction.LiftedAt = time.Unix(liftedAt.Int64, 0)
+	}
+	return restriction, nil
+}
+
+func nullableUnix(moment time.Time) sql.NullInt64 {
+	return sql.NullInt64{Int64: moment.Unix(), Valid: !moment.IsZero()}
+}
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFreezeClient_BlocksLoginAndMoney(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	assignTestBranch(t, db, aliId, 1)
+	aliCard := issueTestCard(t, db, aliId, 1000)
+	valiCard := issueTestCard(t, db, valiId, 1000)
+
+	if _, err := FreezeClient(ManagerActor(1), aliId, "", time.Time{}, db); !errors.Is(err, ErrRestrictionReasonRequired) {
+		t.Errorf("not ErrRestrictionReasonRequired: %v", err)
+	}
+	_, err := FreezeClient(ManagerActor(1), aliId, "lost phone", time.Time{}, db)
+	if err != nil {
+		t.Fatalf("can't freeze client: %v", err)
+	}
+
+	_, ok, err := LoginUser("ali", "secret", db)
+	var frozen *ClientFrozenError
+	if ok || !errors.As(err, &frozen) || frozen.Reason != "lost phone" {
+		t.Errorf("frozen client logged in: %v", err)
+	}
+	if err := TransactionMinus(Client{PhoneNumber: 921111111, Balance: 10}, db); !errors.Is(err, ErrClientFrozen) {
+		t.Errorf("frozen client transfer by phone: %v", err)
+	}
+	if err := TransactionPlus(921111111, 10, db); !errors.Is(err, ErrClientFrozen) {
+		t.Errorf("frozen client topped up: %v", err)
+	}
+	if _, err := TransferCardToCard(valiId, valiCard.Id, aliCard.Id, 10, db); !errors.Is(err, ErrClientFrozen) {
+		t.Errorf("transfer to frozen client: %v", err)
+	}
+	if _, err := PayService(aliId, 1, "921234567", 10, db); !errors.Is(err, ErrClientFrozen) {
+		t.Errorf("frozen client paid service: %v", err)
+	}
+
+	_, err = BanClient(ManagerActor(1), aliId, "fraud", time.Time{}, db)
+	if err != nil {
+		t.Fatalf("can't ban client: %v", err)
+	}
+	if _, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 10, db); !errors.Is(err, ErrClientBanned) {
+		t.Errorf("ban not reported over freeze: %v", err)
+	}
+
+	if err := UnbanClient(ManagerActor(2), aliId, db); err != nil {
+		t.Fatalf("can't unban client: %v", err)
+	}
+	if err := UnfreezeClient(ManagerActor(2), aliId, db); err != nil {
+		t.Fatalf("can't unfreeze client: %v", err)
+	}
+	if err := UnfreezeClient(ManagerActor(2), aliId, db); !errors.Is(err, ErrClientNotRestricted) {
+		t.Errorf("not ErrClientNotRestricted: %v", err)
+	}
+	if _, ok, err := LoginUser("ali", "secret", db); !ok || err != nil {
+		t.Errorf("unfrozen client can't login: %v", err)
+	}
+
+	restrictions, err := GetClientRestrictions(aliId, db)
+	if err != nil {
+		t.Fatalf("can't get restrictions: %v", err)
+	}
+	if len(restrictions) != 2 || restrictions[0].Actor != ManagerActor(1) || restrictions[0].LiftedBy != ManagerActor(2) ||
+		restrictions[0].ActiveAt(time.Now()) {
+		t.Errorf("unexpected restriction history: %+v", restrictions)
+	}
+}
+
+func TestBanClient_Expires(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 100, 1001)
+	now := time.Date(2020, 5, 10, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	if _, err := BanClient(ManagerActor(1), clientId, "spam", now, db); !errors.Is(err, ErrInvalidRestrictionExpiry) {
+		t.Errorf("not ErrInvalidRestrictionExpiry: %v", err)
+	}
+	_, err := BanClient(ManagerActor(1), clientId, "spam", now.Add(24*time.Hour), db)
+	if err != nil {
+		t.Fatalf("can't ban client: %v", err)
+	}
+	if err := TransactionMinus(Client{PhoneNumber: 921111111, Balance: 10}, db); !errors.Is(err, ErrClientBanned) {
+		t.Errorf("banned client transfer: %v", err)
+	}
+
+	now = now.Add(25 * time.Hour)
+	if err := TransactionMinus(Client{PhoneNumber: 921111111, Balance: 10}, db); err != nil {
+		t.Errorf("expired ban still applied: %v", err)
+	}
+}
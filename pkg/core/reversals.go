@@ -0,0 +1,254 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrOperationNotFound = errors.New("operation not found")
+var ErrAlreadyReversed = errors.New("operation already reversed")
+var ErrOperationNotReversible = errors.New("operation can't be reversed")
+var ErrReversalReasonRequired = errors.New("reversal reason required")
+
+// ReverseTransaction отменяет проведённую операцию компенсирующими проводками и записывает
+// операцию-сторно со ссылкой на исходную. Сторно делает только менеджер, с указанием причины;
+// одну операцию можно отменить один раз, само сторно не отменяется. Комиссия за операцию,
+// в том числе за уход в овердрафт, возвращается клиенту вместе с ней. Наличные операции банкомата не сторнируются - они сверяются по кассетам.
+func ReverseTransaction(managerId int64, operationId int64, reason string, db *sql.DB) (reversal Operation, err error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return Operation{}, ErrReversalReasonRequired
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return Operation{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = checkExists(tx, getManagerIdSQL, managerId, ErrManagerNotFound)
+	if err != nil {
+		return Operation{}, err
+	}
+	original, err := getOperation(tx, operationId)
+	if err != nil {
+		return Operation{}, err
+	}
+	err = checkClientScope(tx, managerId, original.ClientId)
+	if err != nil {
+		return Operation{}, err
+	}
+	var reversalId int64
+	err = tx.QueryRow(getReversalIdSQL, operationId).Scan(&reversalId)
+	switch {
+	case err == nil:
+		return Operation{}, ErrAlreadyReversed
+	case err != sql.ErrNoRows:
+		return Operation{}, queryError(getReversalIdSQL, err)
+	}
+
+	reversal, err = reverseOperation(tx, managerId, original, reason)
+	if err != nil {
+		return Operation{}, err
+	}
+	err = reverseFees(tx, managerId, original.Id, reason)
+	if err != nil {
+		return Operation{}, err
+	}
+	return reversal, nil
+}
+
+// reverseFees возвращает своими сторно отдельно списанные комиссии за операцию, а вместе
+// с ними и комиссию за овердрафт, в который ушёл клиент при списании самой комиссии
+func reverseFees(tx *sql.Tx, managerId int64, operationId int64, reason string) error {
+	feeOperationIds, err := listUnrefundedFeeOperations(tx, operationId)
+	if err != nil {
+		return err
+	}
+	for _, feeOperationId := range feeOperationIds {
+		feeOperation, err := getOperation(tx, feeOperationId)
+		if err != nil {
+			return err
+		}
+		_, err = reverseOperation(tx, managerId, feeOperation, reason)
+		if err != nil {
+			return err
+		}
+		err = reverseFees(tx, managerId, feeOperationId, reason)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reverseOperation проводит компенсацию и записывает сторно операции
+func reverseOperation(tx *sql.Tx, managerId int64, original Operation, reason string) (reversal Operation, err error) {
+	err = compensate(tx, original)
+	if err != nil {
+		return Operation{}, err
+	}
+
+	reversal = Operation{
+		Type:           OperationReversal,
+		ClientId:       original.ClientId,
+		CardId:         original.CardId,
+		TargetClientId: original.TargetClientId,
+		TargetCardId:   original.TargetCardId,
+		Amount:         original.Amount,
+		CreatedAt:      time.Unix(timeNow().Unix(), 0),
+		ReversalOf:     original.Id,
+		ManagerId:      managerId,
+		Reason:         reason,
+	}
+	reversal.Id, err = insertOperation(tx, reversal)
+	if err != nil {
+		return Operation{}, err
+	}
+	err = writeAudit(tx, ManagerActor(managerId), AuditReverse, AuditEntityOperation, original.Id, original, reversal)
+	if err != nil {
+		return Operation{}, err
+	}
+	return reversal, nil
+}
+
+// compensate возвращает деньги туда, откуда их взяла операция; сумма должна уложиться
+// в баланс и овердрафт получателя (для карты - в остаток карты), иначе сторно отклоняется
+// с OverdraftExceededError. Комиссия за овердрафт при сторно не берётся.
+func compensate(tx *sql.Tx, operation Operation) error {
+	switch operation.Type {
+	case OperationTransfer:
+		if operation.TargetCardId == 0 {
+			return changeClientBalance(tx, operation.ClientId, operation.Amount)
+		}
+		from, err := getCard(tx, operation.CardId)
+		if err != nil {
+			return err
+		}
+		to, err := getCard(tx, operation.TargetCardId)
+		if err != nil {
+			return err
+		}
+		err = checkCardFunds(tx, to, operation.Amount)
+		if err != nil {
+			return err
+		}
+		_, err = checkOverdraft(tx, to.UserId, operation.Amount)
+		if err != nil {
+			return err
+		}
+		err = moveCardBalance(tx, to, -operation.Amount)
+		if err != nil {
+			return err
+		}
+		return moveCardBalance(tx, from, operation.Amount)
+
+	case OperationTopUp:
+		if operation.CardId == 0 {
+			return changeClientBalance(tx, operation.ClientId, -operation.Amount)
+		}
+		// начальный баланс выпущенной карты списывается с той же карты
+		card, err := getCard(tx, operation.CardId)
+		if err != nil {
+			return err
+		}
+		err = checkCardFunds(tx, card, operation.Amount)
+		if err != nil {
+			return err
+		}
+		_, err = checkOverdraft(tx, card.UserId, operation.Amount)
+		if err != nil {
+			return err
+		}
+		return moveCardBalance(tx, card, -operation.Amount)
+
+	case OperationServicePayment:
+		var providerId, amount int64
+		err := tx.QueryRow(getServicePaymentByOperationSQL, operation.Id).Scan(&providerId, &amount)
+		if err != nil {
+			return queryError(getServicePaymentByOperationSQL, err)
+		}
+		// клиенту возвращается всё списанное вместе с комиссией
+		err = changeClientBalance(tx, operation.ClientId, operation.Amount)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			updateProviderBalancePlusSQL,
+			sql.Named("id", providerId),
+			sql.Named("amount", -amount),
+		)
+		if err != nil {
+			return err
+		}
+		return refundFeeRevenue(tx, operation.Id)
+
+	case OperationFee, OperationOverdraftFee:
+		if operation.CardId == 0 {
+			err := changeClientBalance(tx, operation.ClientId, operation.Amount)
+			if err != nil {
+				return err
+			}
+		} else {
+			card, err := getCard(tx, operation.CardId)
+			if err != nil {
+				return err
+			}
+			err = moveCardBalance(tx, card, operation.Amount)
+			if err != nil {
+				return err
+			}
+		}
+		return refundFeeRevenue(tx, operation.Id)
+	}
+	return ErrOperationNotReversible
+}
+
+// changeClientBalance - изменение баланса по инициативе банка (сторно, кредиты, вклады):
+// списание проверяется по лимиту овердрафта, но комиссия за овердрафт не берётся
+func changeClientBalance(tx *sql.Tx, clientId int64, delta int64) error {
+	if delta < 0 {
+		_, err := checkOverdraft(tx, clientId, -delta)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(
+		updateClientBalancePlusSQL,
+		sql.Named("id", clientId),
+		sql.Named("balance", delta),
+	)
+	if err != nil {
+		return err
+	}
+	if delta < 0 {
+		err = settleClientCards(tx, clientId)
+		if err != nil {
+			return err
+		}
+	}
+	return publishBalanceChanged(tx, clientId, delta)
+}
+
+func GetOperation(operationId int64, db *sql.DB) (Operation, error) {
+	return getOperation(db, operationId)
+}
+
+func getOperation(q queryRower, operationId int64) (operation Operation, err error) {
+	err = scanOperation(q.QueryRow(getOperationSQL, operationId), &operation)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Operation{}, ErrOperationNotFound
+		}
+		return Operation{}, queryError(getOperationSQL, err)
+	}
+	return operation, nil
+}
@@ -0,0 +1,223 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReverseTransaction_MistakenCredit(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 100, 1001)
+
+	err := UpdateBalanceClient(clientId, 500, db)
+	if err != nil {
+		t.Fatalf("can't credit client: %v", err)
+	}
+	from, to := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	statement, err := GetStatement(clientId, from, to, db)
+	if err != nil {
+		t.Fatalf("can't get statement: %v", err)
+	}
+	if len(statement) != 1 || statement[0].Type != OperationTopUp || statement[0].Change != 500 {
+		t.Fatalf("credit not in statement: %+v", statement)
+	}
+	creditId := statement[0].Id
+
+	if _, err := ReverseTransaction(1, creditId, " ", db); !errors.Is(err, ErrReversalReasonRequired) {
+		t.Errorf("not ErrReversalReasonRequired: %v", err)
+	}
+	if _, err := ReverseTransaction(100, creditId, "wrong client", db); !errors.Is(err, ErrManagerNotFound) {
+		t.Errorf("not ErrManagerNotFound: %v", err)
+	}
+	if _, err := ReverseTransaction(1, 100, "wrong client", db); !errors.Is(err, ErrOperationNotFound) {
+		t.Errorf("not ErrOperationNotFound: %v", err)
+	}
+
+	reversal, err := ReverseTransaction(1, creditId, "wrong client", db)
+	if err != nil {
+		t.Fatalf("can't reverse credit: %v", err)
+	}
+	if reversal.ReversalOf != creditId || reversal.ManagerId != 1 || reversal.Reason != "wrong client" {
+		t.Errorf("reversal not linked to original: %+v", reversal)
+	}
+	if balance := clientBalance(t, db, clientId); balance != 100 {
+		t.Errorf("credit not reversed: %d", balance)
+	}
+	if _, err := ReverseTransaction(1, creditId, "again", db); !errors.Is(err, ErrAlreadyReversed) {
+		t.Errorf("not ErrAlreadyReversed: %v", err)
+	}
+	if _, err := ReverseTransaction(1, reversal.Id, "undo", db); !errors.Is(err, ErrOperationNotReversible) {
+		t.Errorf("reversal reversed: %v", err)
+	}
+
+	statement, err = GetStatement(clientId, from, to, db)
+	if err != nil {
+		t.Fatalf("can't get statement: %v", err)
+	}
+	if len(statement) != 2 {
+		t.Fatalf("reversal not in statement: %+v", statement)
+	}
+	if statement[0].ReversedBy != reversal.Id {
+		t.Errorf("original not marked reversed: %+v", statement[0])
+	}
+	if statement[1].Type != OperationReversal || statement[1].Change != -500 {
+		t.Errorf("unexpected reversal entry: %+v", statement[1])
+	}
+}
+
+func TestReverseTransaction_CardTransfer(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	aliCard := issueTestCard(t, db, aliId, 1000)
+	valiCard := issueTestCard(t, db, valiId, 0)
+
+	receipt, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 300, db)
+	if err != nil {
+		t.Fatalf("can't transfer: %v", err)
+	}
+	_, err = ReverseTransaction(1, receipt.OperationId, "wrong card", db)
+	if err != nil {
+		t.Fatalf("can't reverse transfer: %v", err)
+	}
+
+	from, _ := GetCard(aliCard.Id, db)
+	to, _ := GetCard(valiCard.Id, db)
+	if from.Balance != 1000 || to.Balance != 0 {
+		t.Errorf("card balances not restored: %d, %d", from.Balance, to.Balance)
+	}
+	if balance := clientBalance(t, db, valiId); balance != 0 {
+		t.Errorf("target client balance not restored: %d", balance)
+	}
+
+	statement, err := GetStatement(valiId, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), db)
+	if err != nil {
+		t.Fatalf("can't get statement: %v", err)
+	}
+	if len(statement) != 2 || statement[0].Change != 300 || statement[1].Change != -300 {
+		t.Errorf("unexpected target statement: %+v", statement)
+	}
+}
+
+func TestReverseTransaction_ServicePayment(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 1000, 1001)
+
+	payment, err := PayService(clientId, 3, "123456", 500, db)
+	if err != nil {
+		t.Fatalf("can't pay: %v", err)
+	}
+	_, err = ReverseTransaction(1, payment.OperationId, "chargeback", db)
+	if err != nil {
+		t.Fatalf("can't reverse payment: %v", err)
+	}
+
+	if balance := clientBalance(t, db, clientId); balance != 1000 {
+		t.Errorf("amount and fee not refunded: %d", balance)
+	}
+	providerBalance, err := GetProviderBalance(payment.ProviderId, db)
+	if err != nil {
+		t.Fatalf("can't get provider balance: %v", err)
+	}
+	if providerBalance != 0 {
+		t.Errorf("provider not charged back: %d", providerBalance)
+	}
+	if revenue, _ := GetBankAccountBalance(BankAccountFeeRevenue, db); revenue != 0 {
+		t.Errorf("catalog fee not taken back from revenue: %d", revenue)
+	}
+}
+
+func TestReverseTransaction_RefundsSeparateFee(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 1000, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	aliCard := issueTestCard(t, db, aliId, 1000)
+	valiCard := issueTestCard(t, db, valiId, 0)
+	_, err := SetFeeSchedule(1, FeeSchedule{OperationType: OperationTransfer, Fixed: 20}, db)
+	if err != nil {
+		t.Fatalf("can't set fee schedule: %v", err)
+	}
+
+	phone, err := TransactionMinusWithReceipt(Client{PhoneNumber: 921111111, Balance: 300}, db)
+	if err != nil || phone.Fee != 20 {
+		t.Fatalf("can't transfer: %+v %v", phone, err)
+	}
+	card, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 100, db)
+	if err != nil || card.Fee != 20 {
+		t.Fatalf("can't transfer: %+v %v", card, err)
+	}
+	if revenue, _ := GetBankAccountBalance(BankAccountFeeRevenue, db); revenue != 40 {
+		t.Fatalf("fees not posted: %d", revenue)
+	}
+
+	for _, operationId := range []int64{phone.OperationId, card.OperationId} {
+		if _, err := ReverseTransaction(1, operationId, "disputed", db); err != nil {
+			t.Fatalf("can't reverse: %v", err)
+		}
+	}
+	if balance := clientBalance(t, db, aliId); balance != 2000 {
+		t.Errorf("fee not refunded to client: %d", balance)
+	}
+	cards, err := ListClientCards(aliId, db)
+	if err != nil || cards[0].Balance != 1000 {
+		t.Errorf("fee not refunded to card: %+v %v", cards, err)
+	}
+	if revenue, _ := GetBankAccountBalance(BankAccountFeeRevenue, db); revenue != 0 {
+		t.Errorf("fees not taken back from revenue: %d", revenue)
+	}
+
+	entries, err := GetStatement(aliId, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), db)
+	if err != nil {
+		t.Fatalf("can't get statement: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.Type == OperationFee && entry.ReversedBy == 0 {
+			t.Errorf("fee operation not reversed: %+v", entry)
+		}
+	}
+}
+
+func TestReverseTransaction_RefundsOverdraftFee(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 100, 1001)
+	err := SetOverdraft(1, Overdraft{ClientId: aliId, Limit: 1000, Fee: 50}, db)
+	if err != nil {
+		t.Fatalf("can't set overdraft: %v", err)
+	}
+
+	transfer, err := TransactionMinusWithReceipt(Client{PhoneNumber: 921111111, Balance: 300}, db)
+	if err != nil {
+		t.Fatalf("can't transfer: %v", err)
+	}
+	if balance := clientBalance(t, db, aliId); balance != -250 {
+		t.Fatalf("overdraft fee not charged: %d", balance)
+	}
+	if revenue, _ := GetBankAccountBalance(BankAccountFeeRevenue, db); revenue != 50 {
+		t.Fatalf("overdraft fee not posted: %d", revenue)
+	}
+
+	if _, err := ReverseTransaction(1, transfer.OperationId, "disputed", db); err != nil {
+		t.Fatalf("can't reverse: %v", err)
+	}
+	if balance := clientBalance(t, db, aliId); balance != 100 {
+		t.Errorf("overdraft fee not refunded: %d", balance)
+	}
+	if revenue, _ := GetBankAccountBalance(BankAccountFeeRevenue, db); revenue != 0 {
+		t.Errorf("overdraft fee not taken back from revenue: %d", revenue)
+	}
+	entries, err := GetStatement(aliId, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), db)
+	if err != nil {
+		t.Fatalf("can't get statement: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.Type == OperationOverdraftFee && entry.ReversedBy == 0 {
+			t.Errorf("overdraft fee not reversed: %+v", entry)
+		}
+	}
+}
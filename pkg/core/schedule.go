@@ -0,0 +1,174 @@
+package core
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+// Schedule вычисляет следующий момент запуска строго после after
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// ParseSchedule разбирает расписание платежа:
+//
+//	"monthly:15"   - 15-го числа каждого месяца в 00:00 (в коротких месяцах - в последний день);
+//	"0 9 1,15 * *" - cron: минута, час, день месяца, месяц, день недели (0 - воскресенье),
+//	                 поддерживаются *, списки, диапазоны и шаг (*/2, 1-5).
+func ParseSchedule(spec string) (Schedule, error) {
+	if strings.HasPrefix(spec, "monthly:") {
+		day, err := strconv.Atoi(strings.TrimPrefix(spec, "monthly:"))
+		if err != nil || day < 1 || day > 31 {
+			return nil, ErrInvalidSchedule
+		}
+		return monthlySchedule{day: day}, nil
+	}
+	return parseCron(spec)
+}
+
+type monthlySchedule struct {
+	day int
+}
+
+func (receiver monthlySchedule) Next(after time.Time) time.Time {
+	year, month, _ := after.Date()
+	for {
+		candidate := receiver.inMonth(year, month, after.Location())
+		if candidate.After(after) {
+			return candidate
+		}
+		month++
+		if month > time.December {
+			month, year = time.January, year+1
+		}
+	}
+}
+
+func (receiver monthlySchedule) inMonth(year int, month time.Month, location *time.Location) time.Time {
+	lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, location).Day()
+	day := receiver.day
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, location)
+}
+
+type cronSchedule struct {
+	minutes     map[int]bool
+	hours       map[int]bool
+	daysOfMonth map[int]bool
+	months      map[int]bool
+	daysOfWeek  map[int]bool
+	anyDom      bool
+	anyDow      bool
+}
+
+func parseCron(spec string) (Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, ErrInvalidSchedule
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	sets := make([]map[int]bool, 5)
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+	return cronSchedule{
+		minutes:     sets[0],
+		hours:       sets[1],
+		daysOfMonth: sets[2],
+		months:      sets[3],
+		daysOfWeek:  sets[4],
+		anyDom:      fields[2] == "*",
+		anyDow:      fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			parsed, err := strconv.Atoi(part[slash+1:])
+			if err != nil || parsed <= 0 {
+				return nil, ErrInvalidSchedule
+			}
+			step = parsed
+			part = part[:slash]
+		}
+
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			from, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, ErrInvalidSchedule
+			}
+			to = from
+			if len(bounds) == 2 {
+				to, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, ErrInvalidSchedule
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, ErrInvalidSchedule
+		}
+		for value := from; value <= to; value += step {
+			set[value] = true
+		}
+	}
+	return set, nil
+}
+
+// Next перебирает время, пропуская целиком неподходящие месяцы, дни и часы;
+// если за 5 лет совпадения нет (например, 31 февраля), возвращает нулевое время
+func (receiver cronSchedule) Next(after time.Time) time.Time {
+	moment := after.Truncate(time.Minute).Add(time.Minute)
+	limit := moment.AddDate(5, 0, 0)
+	for moment.Before(limit) {
+		if !receiver.months[int(moment.Month())] {
+			moment = time.Date(moment.Year(), moment.Month()+1, 1, 0, 0, 0, 0, moment.Location())
+			continue
+		}
+		if !receiver.dayMatches(moment) {
+			moment = time.Date(moment.Year(), moment.Month(), moment.Day()+1, 0, 0, 0, 0, moment.Location())
+			continue
+		}
+		if !receiver.hours[moment.Hour()] {
+			moment = time.Date(moment.Year(), moment.Month(), moment.Day(), moment.Hour()+1, 0, 0, 0, moment.Location())
+			continue
+		}
+		if !receiver.minutes[moment.Minute()] {
+			moment = moment.Add(time.Minute)
+			continue
+		}
+		return moment
+	}
+	return time.Time{}
+}
+
+// dayMatches - как в cron: если заданы и день месяца, и день недели, достаточно одного совпадения
+func (receiver cronSchedule) dayMatches(moment time.Time) bool {
+	dom := receiver.daysOfMonth[moment.Day()]
+	dow := receiver.daysOfWeek[int(moment.Weekday())]
+	switch {
+	case receiver.anyDom && receiver.anyDow:
+		return true
+	case receiver.anyDom:
+		return dow
+	case receiver.anyDow:
+		return dom
+	}
+	return dom || dow
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule_Monthly(t *testing.T) {
+	schedule, err := ParseSchedule("monthly:31")
+	if err != nil {
+		t.Fatalf("can't parse schedule: %v", err)
+	}
+	next := schedule.Next(time.Date(2020, 1, 31, 0, 0, 0, 0, time.UTC))
+	if !next.Equal(time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected next: %v", next)
+	}
+	next = schedule.Next(next)
+	if !next.Equal(time.Date(2020, 3, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected next: %v", next)
+	}
+}
+
+func TestParseSchedule_Cron(t *testing.T) {
+	after := time.Date(2020, 5, 10, 12, 0, 0, 0, time.UTC) // воскресенье
+	cases := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"0 9 1,15 * *", time.Date(2020, 5, 15, 9, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, 5, 10, 12, 15, 0, 0, time.UTC)},
+		{"30 8 * * 1-5", time.Date(2020, 5, 11, 8, 30, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, testCase := range cases {
+		schedule, err := ParseSchedule(testCase.spec)
+		if err != nil {
+			t.Errorf("can't parse %q: %v", testCase.spec, err)
+			continue
+		}
+		if next := schedule.Next(after); !next.Equal(testCase.expected) {
+			t.Errorf("%q: expected %v, got %v", testCase.spec, testCase.expected, next)
+		}
+	}
+
+	for _, spec := range []string{"", "monthly:0", "* * *", "60 * * * *", "5-1 * * * *", "*/0 * * * *"} {
+		if _, err := ParseSchedule(spec); !errors.Is(err, ErrInvalidSchedule) {
+			t.Errorf("%q: not ErrInvalidSchedule: %v", spec, err)
+		}
+	}
+}
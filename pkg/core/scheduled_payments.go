@@ -0,0 +1,303 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	ScheduledRunSuccess = "success"
+	ScheduledRunRetry   = "retry"
+	ScheduledRunFailed  = "failed"
+)
+
+const defaultScheduledMaxRetries = 3
+const defaultScheduledRetryBackoff = time.Hour
+
+var ErrScheduledPaymentNotFound = errors.New("scheduled payment not found")
+
+// Clock - источник текущего времени для планировщика; в тестах подменяется
+type Clock interface {
+	Now() time.Time
+}
+
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ScheduledPayment - регулярный платёж за услугу по расписанию (см. ParseSchedule).
+// DueAt - очередной плановый срок, NextRunAt - ближайшая попытка (позже DueAt при повторах).
+type ScheduledPayment struct {
+	Id           int64
+	ClientId     int64
+	ServiceId    int64
+	PayerAccount string
+	Amount       int64
+	Schedule     string
+	DueAt        time.Time
+	NextRunAt    time.Time
+	Attempts     int
+	Active       bool
+}
+
+type ScheduledPaymentRun struct {
+	Id                 int64
+	ScheduledPaymentId int64
+	RunAt              time.Time
+	DueAt              time.Time
+	Attempt            int
+	Status             string
+	ReceiptNumber      string
+	Error              string
+}
+
+// PaymentScheduler исполняет наступившие регулярные платежи через PayService.
+// При нехватке средств или превышении лимита платёж повторяется через RetryBackoff,
+// 2*RetryBackoff, 4*RetryBackoff ... до MaxRetries раз, потом переносится на следующий срок.
+type PaymentScheduler struct {
+	db           *sql.DB
+	clock        Clock
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+func NewPaymentScheduler(db *sql.DB, clock Clock) *PaymentScheduler {
+	return &PaymentScheduler{
+		db:           db,
+		clock:        clock,
+		MaxRetries:   defaultScheduledMaxRetries,
+		RetryBackoff: defaultScheduledRetryBackoff,
+	}
+}
+
+// Schedule проверяет услугу, счёт и сумму и создаёт регулярный платёж
+func (receiver *PaymentScheduler) Schedule(payment ScheduledPayment) (int64, error) {
+	schedule, err := ParseSchedule(payment.Schedule)
+	if err != nil {
+		return 0, err
+	}
+	service, err := getCatalogService(receiver.db, payment.ServiceId)
+	if err != nil {
+		return 0, err
+	}
+	err = service.ValidatePayment(payment.PayerAccount, payment.Amount)
+	if err != nil {
+		return 0, err
+	}
+	err = checkExists(receiver.db, getClientIdSQL, payment.ClientId, ErrClientNotFound)
+	if err != nil {
+		return 0, err
+	}
+
+	dueAt := schedule.Next(receiver.clock.Now())
+	if dueAt.IsZero() {
+		return 0, ErrInvalidSchedule
+	}
+	result, err := receiver.db.Exec(
+		insertScheduledPaymentSQL,
+		sql.Named("client_id", payment.ClientId),
+		sql.Named("service_id", payment.ServiceId),
+		sql.Named("payer_account", payment.PayerAccount),
+		sql.Named("amount", payment.Amount),
+		sql.Named("schedule", payment.Schedule),
+		sql.Named("due_at", dueAt.Unix()),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (receiver *PaymentScheduler) Cancel(scheduledPaymentId int64) error {
+	result, err := receiver.db.Exec(cancelScheduledPaymentSQL, scheduledPaymentId)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrScheduledPaymentNotFound
+	}
+	return nil
+}
+
+// RunDue исполняет все платежи, срок которых наступил, и возвращает записи о запусках.
+// Ошибка одного платежа не останавливает остальные - она попадает в историю запусков.
+func (receiver *PaymentScheduler) RunDue() ([]ScheduledPaymentRun, error) {
+	now := receiver.clock.Now()
+	due, err := listScheduledPayments(receiver.db, listDueScheduledPaymentsSQL, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]ScheduledPaymentRun, 0, len(due))
+	for _, payment := range due {
+		run, err := receiver.run(payment, now)
+		if err != nil {
+			return runs, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+func (receiver *PaymentScheduler) run(payment ScheduledPayment, now time.Time) (ScheduledPaymentRun, error) {
+	run := ScheduledPaymentRun{
+		ScheduledPaymentId: payment.Id,
+		RunAt:              now,
+		DueAt:              payment.DueAt,
+		Attempt:            payment.Attempts + 1,
+		Status:             ScheduledRunSuccess,
+	}
+
+	// ключ не даёт провести платёж второй раз, если запуск не успел сохраниться после оплаты
+	key := fmt.Sprintf("scheduled:%d:%d:%d", payment.Id, payment.DueAt.Unix(), run.Attempt)
+	paid, payErr := payServiceWithKey(key, payment.ClientId, payment.ServiceId, payment.PayerAccount, payment.Amount,
+		now, receiver.db)
+	retryable := errors.Is(payErr, ErrInsufficientFunds) || errors.Is(payErr, ErrLimitExceeded)
+	switch {
+	case payErr == nil:
+		run.ReceiptNumber = paid.ReceiptNumber
+	case retryable && payment.Attempts < receiver.MaxRetries:
+		run.Status, run.Error = ScheduledRunRetry, payErr.Error()
+	default:
+		run.Status, run.Error = ScheduledRunFailed, payErr.Error()
+	}
+
+	if run.Status == ScheduledRunRetry {
+		payment.Attempts++
+		payment.NextRunAt = now.Add(receiver.RetryBackoff << uint(payment.Attempts-1))
+	} else {
+		schedule, err := ParseSchedule(payment.Schedule)
+		if err != nil {
+			return ScheduledPaymentRun{}, err
+		}
+		// пропущенные за время простоя сроки не догоняются - только ближайший будущий
+		payment.DueAt = schedule.Next(maxTime(payment.DueAt, now))
+		payment.NextRunAt = payment.DueAt
+		payment.Attempts = 0
+		payment.Active = !payment.DueAt.IsZero()
+	}
+
+	err := receiver.saveRun(payment, run)
+	if err != nil {
+		return ScheduledPaymentRun{}, err
+	}
+	return run, nil
+}
+
+func (receiver *PaymentScheduler) saveRun(payment ScheduledPayment, run ScheduledPaymentRun) (err error) {
+	tx, err := receiver.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	_, err = tx.Exec(
+		updateScheduledPaymentStateSQL,
+		sql.Named("id", payment.Id),
+		sql.Named("due_at", payment.DueAt.Unix()),
+		sql.Named("next_run_at", payment.NextRunAt.Unix()),
+		sql.Named("attempts", payment.Attempts),
+		sql.Named("active", payment.Active),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		insertScheduledPaymentRunSQL,
+		sql.Named("scheduled_payment_id", run.ScheduledPaymentId),
+		sql.Named("run_at", run.RunAt.Unix()),
+		sql.Named("due_at", run.DueAt.Unix()),
+		sql.Named("attempt", run.Attempt),
+		sql.Named("status", run.Status),
+		sql.Named("receipt_number", run.ReceiptNumber),
+		sql.Named("error", run.Error),
+	)
+	return err
+}
+
+func ListClientScheduledPayments(clientId int64, db *sql.DB) ([]ScheduledPayment, error) {
+	return listScheduledPayments(db, listClientScheduledPaymentsSQL, clientId)
+}
+
+func listScheduledPayments(db *sql.DB, query string, arg interface{}) (payments []ScheduledPayment, err error) {
+	rows, err := db.Query(query, arg)
+	if err != nil {
+		return nil, queryError(query, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			payments, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		payment := ScheduledPayment{}
+		var dueAt, nextRunAt int64
+		err = rows.Scan(&payment.Id, &payment.ClientId, &payment.ServiceId, &payment.PayerAccount,
+			&payment.Amount, &payment.Schedule, &dueAt, &nextRunAt, &payment.Attempts, &payment.Active)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		payment.DueAt = time.Unix(dueAt, 0)
+		payment.NextRunAt = time.Unix(nextRunAt, 0)
+		payments = append(payments, payment)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return payments, nil
+}
+
+// GetScheduledPaymentRuns - история исполнений и ошибок регулярного платежа
+func GetScheduledPaymentRuns(scheduledPaymentId int64, db *sql.DB) (runs []ScheduledPaymentRun, err error) {
+	rows, err := db.Query(listScheduledPaymentRunsSQL, scheduledPaymentId)
+	if err != nil {
+		return nil, queryError(listScheduledPaymentRunsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			runs, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		run := ScheduledPaymentRun{}
+		var runAt, dueAt int64
+		err = rows.Scan(&run.Id, &run.ScheduledPaymentId, &runAt, &dueAt, &run.Attempt,
+			&run.Status, &run.ReceiptNumber, &run.Error)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		run.RunAt = time.Unix(runAt, 0)
+		run.DueAt = time.Unix(dueAt, 0)
+		runs = append(runs, run)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return runs, nil
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
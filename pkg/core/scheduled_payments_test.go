@@ -0,0 +1,153 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (receiver *testClock) Now() time.Time {
+	return receiver.now
+}
+
+func TestPaymentScheduler_RunDue(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 150, 1001)
+
+	clock := &testClock{now: time.Date(2020, 5, 10, 12, 0, 0, 0, time.Local)}
+	scheduler := NewPaymentScheduler(db, clock)
+	scheduler.MaxRetries = 1
+
+	id, err := scheduler.Schedule(ScheduledPayment{
+		ClientId:     clientId,
+		ServiceId:    1,
+		PayerAccount: "921234567",
+		Amount:       100,
+		Schedule:     "monthly:15",
+	})
+	if err != nil {
+		t.Fatalf("can't schedule payment: %v", err)
+	}
+
+	runs, err := scheduler.RunDue()
+	if err != nil || len(runs) != 0 {
+		t.Errorf("payment run before due: %+v, %v", runs, err)
+	}
+
+	clock.now = time.Date(2020, 5, 15, 0, 0, 0, 0, time.Local)
+	runs, err = scheduler.RunDue()
+	if err != nil || len(runs) != 1 || runs[0].Status != ScheduledRunSuccess || runs[0].ReceiptNumber == "" {
+		t.Fatalf("unexpected runs: %+v, %v", runs, err)
+	}
+	if balance := clientBalance(t, db, clientId); balance != 50 {
+		t.Errorf("unexpected balance: %d", balance)
+	}
+
+	// в июне денег не хватает: один повтор через час, потом перенос на июль
+	clock.now = time.Date(2020, 6, 15, 0, 0, 0, 0, time.Local)
+	runs, _ = scheduler.RunDue()
+	if len(runs) != 1 || runs[0].Status != ScheduledRunRetry {
+		t.Fatalf("unexpected runs: %+v", runs)
+	}
+	clock.now = clock.now.Add(30 * time.Minute)
+	if runs, _ = scheduler.RunDue(); len(runs) != 0 {
+		t.Errorf("retry before backoff: %+v", runs)
+	}
+	clock.now = clock.now.Add(30 * time.Minute)
+	runs, _ = scheduler.RunDue()
+	if len(runs) != 1 || runs[0].Status != ScheduledRunFailed {
+		t.Fatalf("unexpected runs: %+v", runs)
+	}
+
+	payments, err := ListClientScheduledPayments(clientId, db)
+	if err != nil || len(payments) != 1 {
+		t.Fatalf("unexpected payments: %+v, %v", payments, err)
+	}
+	if !payments[0].DueAt.Equal(time.Date(2020, 7, 15, 0, 0, 0, 0, time.Local)) || payments[0].Attempts != 0 {
+		t.Errorf("unexpected next due: %+v", payments[0])
+	}
+
+	history, err := GetScheduledPaymentRuns(id, db)
+	if err != nil || len(history) != 3 {
+		t.Errorf("unexpected history: %+v, %v", history, err)
+	}
+
+	if err := scheduler.Cancel(id); err != nil {
+		t.Fatalf("can't cancel: %v", err)
+	}
+	clock.now = time.Date(2020, 7, 15, 0, 0, 0, 0, time.Local)
+	if runs, _ = scheduler.RunDue(); len(runs) != 0 {
+		t.Errorf("cancelled payment run: %+v", runs)
+	}
+	if err := scheduler.Cancel(id); !errors.Is(err, ErrScheduledPaymentNotFound) {
+		t.Errorf("not ErrScheduledPaymentNotFound: %v", err)
+	}
+}
+
+func TestPaymentScheduler_ScheduleInvalid(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 150, 1001)
+	scheduler := NewPaymentScheduler(db, SystemClock{})
+
+	payment := ScheduledPayment{ClientId: clientId, ServiceId: 1, PayerAccount: "921234567", Amount: 100, Schedule: "weekly"}
+	if _, err := scheduler.Schedule(payment); !errors.Is(err, ErrInvalidSchedule) {
+		t.Errorf("not ErrInvalidSchedule: %v", err)
+	}
+	payment.Schedule, payment.PayerAccount = "monthly:1", "1"
+	if _, err := scheduler.Schedule(payment); !errors.Is(err, ErrInvalidPayerAccount) {
+		t.Errorf("not ErrInvalidPayerAccount: %v", err)
+	}
+	payment.PayerAccount, payment.ClientId = "921234567", 100
+	if _, err := scheduler.Schedule(payment); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("not ErrClientNotFound: %v", err)
+	}
+}
+
+func TestPaymentScheduler_RunNotSavedPaysOnce(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 1000, 1001)
+
+	clock := &testClock{now: time.Date(2020, 5, 10, 9, 0, 0, 0, time.Local)}
+	scheduler := NewPaymentScheduler(db, clock)
+	id, err := scheduler.Schedule(ScheduledPayment{
+		ClientId:     clientId,
+		ServiceId:    1,
+		PayerAccount: "921234567",
+		Amount:       100,
+		Schedule:     "monthly:15",
+	})
+	if err != nil {
+		t.Fatalf("can't schedule payment: %v", err)
+	}
+	clock.now = time.Date(2020, 5, 15, 9, 0, 0, 0, time.Local)
+	first, err := scheduler.RunDue()
+	if err != nil || len(first) != 1 {
+		t.Fatalf("unexpected runs: %+v, %v", first, err)
+	}
+
+	// платёж проведён, а состояние расписания не сохранилось
+	_, err = db.Exec(`UPDATE scheduled_payment SET due_at = ?, next_run_at = ? WHERE id = ?`,
+		first[0].DueAt.Unix(), first[0].DueAt.Unix(), id)
+	if err != nil {
+		t.Fatalf("can't reset schedule: %v", err)
+	}
+	second, err := scheduler.RunDue()
+	if err != nil || len(second) != 1 || second[0].ReceiptNumber != first[0].ReceiptNumber {
+		t.Fatalf("payment repeated: %+v, %v", second, err)
+	}
+	if balance := clientBalance(t, db, clientId); balance != 900 {
+		t.Errorf("client charged twice: %d", balance)
+	}
+
+	payment, err := GetServicePayment(first[0].ReceiptNumber, db)
+	if err != nil || !payment.CreatedAt.Equal(clock.now) {
+		t.Errorf("payment not at scheduler time: %+v, %v", payment, err)
+	}
+}
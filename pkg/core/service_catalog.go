@@ -0,0 +1,218 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+var ErrServiceNotFound = errors.New("service not found")
+var ErrInvalidAccountPattern = errors.New("invalid payer account pattern")
+var ErrInvalidPayerAccount = errors.New("invalid payer account")
+var ErrInvalidServiceAmounts = errors.New("invalid service amounts")
+
+type AmountOutOfRangeError struct {
+	Amount    int64
+	MinAmount int64
+	MaxAmount int64
+}
+
+func (receiver *AmountOutOfRangeError) Error() string {
+	if receiver.MaxAmount == 0 {
+		return fmt.Sprintf("amount %d is less than %d", receiver.Amount, receiver.MinAmount)
+	}
+	return fmt.Sprintf("amount %d is out of range %d-%d", receiver.Amount, receiver.MinAmount, receiver.MaxAmount)
+}
+
+type Provider struct {
+	Id   int64
+	Name string
+}
+
+type ServiceCategory struct {
+	Id   int64
+	Name string
+}
+
+// CatalogService - услуга провайдера, которую клиент оплачивает на свой лицевой счёт
+// (номер телефона, договора и т.п.) на произвольную сумму в пределах MinAmount-MaxAmount.
+// MaxAmount = 0 - без ограничения сверху, комиссия = FeeFixed + FeePercentBp сотых процента.
+type CatalogService struct {
+	Id             int64
+	Name           string
+	ProviderId     int64
+	ProviderName   string
+	CategoryId     int64
+	CategoryName   string
+	AccountPattern string
+	AccountHint    string
+	MinAmount      int64
+	MaxAmount      int64
+	FeeFixed       int64
+	FeePercentBp   int64
+}
+
+func AddProvider(name string, db *sql.DB) (int64, error) {
+	return insertNamed(db, insertProviderSQL, name)
+}
+
+func AddServiceCategory(name string, db *sql.DB) (int64, error) {
+	return insertNamed(db, insertServiceCategorySQL, name)
+}
+
+func insertNamed(db *sql.DB, query string, name string) (int64, error) {
+	result, err := db.Exec(query, name)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func AddCatalogService(service CatalogService, db *sql.DB) (int64, error) {
+	if _, err := compileAccountPattern(service.AccountPattern); err != nil {
+		return 0, err
+	}
+	if service.MinAmount <= 0 || service.MaxAmount != 0 && service.MaxAmount < service.MinAmount {
+		return 0, ErrInvalidServiceAmounts
+	}
+	if service.FeeFixed < 0 || service.FeePercentBp < 0 {
+		return 0, ErrInvalidServiceAmounts
+	}
+
+	result, err := db.Exec(
+		insertCatalogServiceSQL,
+		sql.Named("name", service.Name),
+		sql.Named("provider_id", service.ProviderId),
+		sql.Named("category_id", service.CategoryId),
+		sql.Named("account_pattern", service.AccountPattern),
+		sql.Named("account_hint", service.AccountHint),
+		sql.Named("min_amount", service.MinAmount),
+		sql.Named("max_amount", service.MaxAmount),
+		sql.Named("fee_fixed", service.FeeFixed),
+		sql.Named("fee_percent_bp", service.FeePercentBp),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// GetServiceCatalog возвращает услуги категории; categoryId = 0 - все категории
+func GetServiceCatalog(categoryId int64, db *sql.DB) (services []CatalogService, err error) {
+	rows, err := db.Query(listServiceCatalogSQL, sql.Named("category_id", categoryId))
+	if err != nil {
+		return nil, queryError(listServiceCatalogSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			services, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		service := CatalogService{}
+		err = rows.Scan(&service.Id, &service.Name, &service.ProviderId, &service.ProviderName,
+			&service.CategoryId, &service.CategoryName, &service.AccountPattern, &service.AccountHint,
+			&service.MinAmount, &service.MaxAmount, &service.FeeFixed, &service.FeePercentBp)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		services = append(services, service)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return services, nil
+}
+
+func GetCatalogService(serviceId int64, db *sql.DB) (CatalogService, error) {
+	return getCatalogService(db, serviceId)
+}
+
+func getCatalogService(q queryRower, serviceId int64) (service CatalogService, err error) {
+	err = q.QueryRow(getCatalogServiceSQL, serviceId).Scan(&service.Id, &service.Name,
+		&service.ProviderId, &service.ProviderName, &service.CategoryId, &service.CategoryName,
+		&service.AccountPattern, &service.AccountHint, &service.MinAmount, &service.MaxAmount,
+		&service.FeeFixed, &service.FeePercentBp)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return CatalogService{}, ErrServiceNotFound
+		}
+		return CatalogService{}, queryError(getCatalogServiceSQL, err)
+	}
+	return service, nil
+}
+
+func GetServiceCategories(db *sql.DB) ([]ServiceCategory, error) {
+	var categories []ServiceCategory
+	err := listIdNames(db, listServiceCategoriesSQL, func(id int64, name string) {
+		categories = append(categories, ServiceCategory{Id: id, Name: name})
+	})
+	return categories, err
+}
+
+func GetProviders(db *sql.DB) ([]Provider, error) {
+	var providers []Provider
+	err := listIdNames(db, listProvidersSQL, func(id int64, name string) {
+		providers = append(providers, Provider{Id: id, Name: name})
+	})
+	return providers, err
+}
+
+func listIdNames(db *sql.DB, query string, add func(id int64, name string)) (err error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return queryError(query, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			err = dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		var id int64
+		var name string
+		err = rows.Scan(&id, &name)
+		if err != nil {
+			return dbError(err)
+		}
+		add(id, name)
+	}
+	if rows.Err() != nil {
+		return dbError(rows.Err())
+	}
+
+	return nil
+}
+
+// ValidatePayment проверяет лицевой счёт плательщика и сумму платежа
+func (receiver CatalogService) ValidatePayment(payerAccount string, amount int64) error {
+	pattern, err := compileAccountPattern(receiver.AccountPattern)
+	if err != nil {
+		return err
+	}
+	if !pattern.MatchString(payerAccount) {
+		return ErrInvalidPayerAccount
+	}
+	if amount < receiver.MinAmount || receiver.MaxAmount != 0 && amount > receiver.MaxAmount {
+		return &AmountOutOfRangeError{Amount: amount, MinAmount: receiver.MinAmount, MaxAmount: receiver.MaxAmount}
+	}
+	return nil
+}
+
+// Fee - комиссия за платёж, процентная часть округляется вверх
+func (receiver CatalogService) Fee(amount int64) int64 {
+	return receiver.FeeFixed + (amount*receiver.FeePercentBp+9999)/10000
+}
+
+// compileAccountPattern - шаблон должен совпадать со всем счётом целиком
+func compileAccountPattern(pattern string) (*regexp.Regexp, error) {
+	compiled, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, ErrInvalidAccountPattern
+	}
+	return compiled, nil
+}
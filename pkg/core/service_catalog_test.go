@@ -0,0 +1,105 @@
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestServiceCatalog_Seeded(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+
+	services, err := GetServiceCatalog(0, db)
+	if err != nil {
+		t.Fatalf("can't get catalog: %v", err)
+	}
+	if len(services) != 4 {
+		t.Errorf("unexpected catalog: %+v", services)
+	}
+
+	mobile, err := GetServiceCatalog(1, db)
+	if err != nil || len(mobile) != 2 {
+		t.Errorf("unexpected mobile services: %+v, %v", mobile, err)
+	}
+
+	tcell, err := GetCatalogService(1, db)
+	if err != nil {
+		t.Fatalf("can't get service: %v", err)
+	}
+	if tcell.ProviderName != "Tcell" || tcell.CategoryName != "Mobile" {
+		t.Errorf("unexpected service: %+v", tcell)
+	}
+	if err := tcell.ValidatePayment("921234567", 50); err != nil {
+		t.Errorf("valid payment rejected: %v", err)
+	}
+	if err := tcell.ValidatePayment("901234567", 50); !errors.Is(err, ErrInvalidPayerAccount) {
+		t.Errorf("not ErrInvalidPayerAccount: %v", err)
+	}
+	if err := tcell.ValidatePayment("9212345678", 50); !errors.Is(err, ErrInvalidPayerAccount) {
+		t.Errorf("pattern not anchored: %v", err)
+	}
+	var rangeErr *AmountOutOfRangeError
+	if err := tcell.ValidatePayment("921234567", 6000); !errors.As(err, &rangeErr) || rangeErr.MaxAmount != 5000 {
+		t.Errorf("not AmountOutOfRangeError: %v", err)
+	}
+
+	if _, err := GetCatalogService(100, db); !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("not ErrServiceNotFound: %v", err)
+	}
+}
+
+func TestAddCatalogService(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+
+	providerId, err := AddProvider("Tojiktelecom", db)
+	if err != nil {
+		t.Fatalf("can't add provider: %v", err)
+	}
+	categoryId, err := AddServiceCategory("Landline", db)
+	if err != nil {
+		t.Fatalf("can't add category: %v", err)
+	}
+
+	service := CatalogService{
+		Name:           "Home phone",
+		ProviderId:     providerId,
+		CategoryId:     categoryId,
+		AccountPattern: "[0-9]{6}",
+		MinAmount:      5,
+		FeeFixed:       1,
+		FeePercentBp:   150,
+	}
+	id, err := AddCatalogService(service, db)
+	if err != nil {
+		t.Fatalf("can't add service: %v", err)
+	}
+	saved, err := GetCatalogService(id, db)
+	if err != nil || saved.ProviderName != "Tojiktelecom" || saved.CategoryName != "Landline" {
+		t.Errorf("unexpected service: %+v, %v", saved, err)
+	}
+	if fee := saved.Fee(1000); fee != 16 {
+		t.Errorf("unexpected fee: %d", fee)
+	}
+	if fee := saved.Fee(1); fee != 2 {
+		t.Errorf("percent fee not rounded up: %d", fee)
+	}
+
+	service.AccountPattern = "[0-9"
+	if _, err := AddCatalogService(service, db); !errors.Is(err, ErrInvalidAccountPattern) {
+		t.Errorf("not ErrInvalidAccountPattern: %v", err)
+	}
+	service.AccountPattern, service.MinAmount, service.MaxAmount = "[0-9]{6}", 10, 5
+	if _, err := AddCatalogService(service, db); !errors.Is(err, ErrInvalidServiceAmounts) {
+		t.Errorf("not ErrInvalidServiceAmounts: %v", err)
+	}
+
+	categories, err := GetServiceCategories(db)
+	if err != nil || len(categories) != 4 {
+		t.Errorf("unexpected categories: %+v, %v", categories, err)
+	}
+	providers, err := GetProviders(db)
+	if err != nil || len(providers) != 5 {
+		t.Errorf("unexpected providers: %+v, %v", providers, err)
+	}
+}
@@ -0,0 +1,239 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrPaymentNotFound = errors.New("payment not found")
+var ErrProviderNotFound = errors.New("provider not found")
+
+// ServicePayment - проведённый платёж за услугу; клиент списывает Amount + Fee,
+// провайдер получает Amount на свой расчётный счёт
+type ServicePayment struct {
+	Id            int64
+	ReceiptNumber string
+	OperationId   int64
+	ClientId      int64
+	ServiceId     int64
+	ProviderId    int64
+	PayerAccount  string
+	Amount        int64
+	Fee           int64
+	CreatedAt     time.Time
+}
+
+// PayService оплачивает услугу из каталога со счёта клиента одной транзакцией:
+// списание с клиента, зачисление провайдеру, комиссия и запись платежа с номером квитанции
+func PayService(clientId int64, serviceId int64, payerAccount string, amount int64, db *sql.DB) (ServicePayment, error) {
+	return PayServiceWithKey("", clientId, serviceId, payerAccount, amount, db)
+}
+
+// PayServiceWithKey - PayService с ключом идемпотентности: повтор с тем же ключом
+// возвращает первый платёж и повторно не списывает
+func PayServiceWithKey(idempotencyKey string, clientId int64, serviceId int64, payerAccount string, amount int64, db *sql.DB) (ServicePayment, error) {
+	return payServiceWithKey(idempotencyKey, clientId, serviceId, payerAccount, amount, timeNow(), db)
+}
+
+// payServiceWithKey проводит платёж на момент now - планировщик передаёт время своих часов
+func payServiceWithKey(idempotencyKey string, clientId int64, serviceId int64, payerAccount string, amount int64, now time.Time, db *sql.DB) (payment ServicePayment, err error) {
+	defer func() {
+		err = holdForReview(err, db)
+	}()
+	tx, err := db.Begin()
+	if err != nil {
+		return ServicePayment{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	request := []interface{}{clientId, serviceId, payerAccount, amount}
+	err = idempotent(tx, idempotencyKey, clientId, idempotentServicePayment, request, &payment, func() error {
+		err := screenFraudAt(tx, fraudRequest{
+			Operation:    idempotentServicePayment,
+			ClientId:     clientId,
+			Amount:       amount,
+			Recipient:    serviceRecipient(serviceId, payerAccount),
+			ServiceId:    serviceId,
+			PayerAccount: payerAccount,
+		}, now)
+		if err != nil {
+			return err
+		}
+		payment, err = payService(tx, clientId, serviceId, payerAccount, amount, now)
+		return err
+	})
+	if err != nil {
+		return ServicePayment{}, err
+	}
+	return payment, nil
+}
+
+func payService(tx *sql.Tx, clientId int64, serviceId int64, payerAccount string, amount int64, now time.Time) (ServicePayment, error) {
+	service, err := getCatalogService(tx, serviceId)
+	if err != nil {
+		return ServicePayment{}, err
+	}
+	err = service.ValidatePayment(payerAccount, amount)
+	if err != nil {
+		return ServicePayment{}, err
+	}
+	fee := service.Fee(amount)
+	total := amount + fee
+	before, err := getClientBalance(tx, clientId)
+	if err != nil {
+		return ServicePayment{}, err
+	}
+
+	operationId, err := registerDebitAt(tx, clientId, 0, OperationServicePayment, total, now)
+	if err != nil {
+		return ServicePayment{}, err
+	}
+
+	_, err = tx.Exec(
+		updateClientBalanceMinusByIdSQL,
+		sql.Named("id", clientId),
+		sql.Named("balance", total),
+	)
+	if err != nil {
+		return ServicePayment{}, err
+	}
+	err = settleClientCards(tx, clientId)
+	if err != nil {
+		return ServicePayment{}, err
+	}
+	err = publishBalanceChanged(tx, clientId, -total)
+	if err != nil {
+		return ServicePayment{}, err
+	}
+	_, err = tx.Exec(
+		updateProviderBalancePlusSQL,
+		sql.Named("id", service.ProviderId),
+		sql.Named("amount", amount),
+	)
+	if err != nil {
+		return ServicePayment{}, err
+	}
+	// комиссия каталога входит в сумму операции и зачисляется в доходы банка
+	err = postFeeRevenue(tx, clientId, OperationServicePayment, operationId, operationId, fee)
+	if err != nil {
+		return ServicePayment{}, err
+	}
+	bankFee, err := applyFee(tx, clientId, 0, OperationServicePayment, operationId, amount, now)
+	if err != nil {
+		return ServicePayment{}, err
+	}
+	fee += bankFee
+
+	payment := ServicePayment{
+		ReceiptNumber: receiptNumber("SP", now, operationId),
+		OperationId:   operationId,
+		ClientId:      clientId,
+		ServiceId:     service.Id,
+		ProviderId:    service.ProviderId,
+		PayerAccount:  payerAccount,
+		Amount:        amount,
+		Fee:           fee,
+		CreatedAt:     time.Unix(now.Unix(), 0),
+	}
+	result, err := tx.Exec(
+		insertServicePaymentSQL,
+		sql.Named("receipt_number", payment.ReceiptNumber),
+		sql.Named("operation_id", payment.OperationId),
+		sql.Named("client_id", payment.ClientId),
+		sql.Named("service_id", payment.ServiceId),
+		sql.Named("provider_id", payment.ProviderId),
+		sql.Named("payer_account", payment.PayerAccount),
+		sql.Named("amount", payment.Amount),
+		sql.Named("fee", payment.Fee),
+		sql.Named("created_at", now.Unix()),
+	)
+	if err != nil {
+		return ServicePayment{}, err
+	}
+	payment.Id, err = result.LastInsertId()
+	if err != nil {
+		return ServicePayment{}, err
+	}
+
+	clientName, err := getClientName(tx, clientId)
+	if err != nil {
+		return ServicePayment{}, err
+	}
+	balanceAfter, err := getClientBalance(tx, clientId)
+	if err != nil {
+		return ServicePayment{}, err
+	}
+	err = insertReceipt(tx, Receipt{
+		Number:       payment.ReceiptNumber,
+		Kind:         ReceiptServicePayment,
+		OperationId:  operationId,
+		CreatedAt:    now,
+		Payer:        clientName,
+		Payee:        service.ProviderName,
+		Description:  service.Name + ", account " + payerAccount,
+		Amount:       amount,
+		Fee:          fee,
+		BalanceAfter: &balanceAfter,
+	})
+	if err != nil {
+		return ServicePayment{}, err
+	}
+	err = publishEvent(tx, EventServicePaid, AuditEntityClient, clientId, ServicePaid{
+		PaymentId:     payment.Id,
+		ClientId:      clientId,
+		ServiceId:     payment.ServiceId,
+		ProviderId:    payment.ProviderId,
+		Amount:        amount,
+		Fee:           fee,
+		ReceiptNumber: payment.ReceiptNumber,
+	})
+	if err != nil {
+		return ServicePayment{}, err
+	}
+	err = auditClientBalance(tx, ClientActor(clientId), AuditServicePayment, clientId, before)
+	if err != nil {
+		return ServicePayment{}, err
+	}
+
+	return payment, nil
+}
+
+func GetServicePayment(receiptNumber string, db *sql.DB) (payment ServicePayment, err error) {
+	var createdAt int64
+	err = db.QueryRow(getServicePaymentByReceiptSQL, receiptNumber).Scan(&payment.Id,
+		&payment.ReceiptNumber, &payment.OperationId, &payment.ClientId, &payment.ServiceId,
+		&payment.ProviderId, &payment.PayerAccount, &payment.Amount, &payment.Fee, &createdAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ServicePayment{}, ErrPaymentNotFound
+		}
+		return ServicePayment{}, queryError(getServicePaymentByReceiptSQL, err)
+	}
+	payment.CreatedAt = time.Unix(createdAt, 0)
+	return payment, nil
+}
+
+func GetProviderBalance(providerId int64, db *sql.DB) (int64, error) {
+	var balance int64
+	err := db.QueryRow(getProviderBalanceSQL, providerId).Scan(&balance)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrProviderNotFound
+		}
+		return 0, queryError(getProviderBalanceSQL, err)
+	}
+	return balance, nil
+}
+
+// receiptNumber - номер квитанции вида SP20200510-00000042, уникален за счёт id операции
+func receiptNumber(prefix string, moment time.Time, operationId int64) string {
+	return fmt.Sprintf("%s%s-%08d", prefix, moment.Format("20060102"), operationId)
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPayService_Ok(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 1000, 1001)
+
+	// Babilon-M Internet: комиссия 1%
+	payment, err := PayService(clientId, 3, "123456", 500, db)
+	if err != nil {
+		t.Fatalf("can't pay service: %v", err)
+	}
+	if payment.Fee != 5 || payment.ProviderId != 3 || !strings.HasPrefix(payment.ReceiptNumber, "SP") {
+		t.Errorf("unexpected payment: %+v", payment)
+	}
+	if balance := clientBalance(t, db, clientId); balance != 495 {
+		t.Errorf("unexpected client balance: %d", balance)
+	}
+	providerBalance, err := GetProviderBalance(3, db)
+	if err != nil || providerBalance != 500 {
+		t.Errorf("unexpected provider balance: %d, %v", providerBalance, err)
+	}
+	revenue, err := GetBankAccountBalance(BankAccountFeeRevenue, db)
+	if err != nil || revenue != 5 {
+		t.Errorf("catalog fee not posted to revenue: %d, %v", revenue, err)
+	}
+
+	saved, err := GetServicePayment(payment.ReceiptNumber, db)
+	if err != nil {
+		t.Fatalf("can't get payment: %v", err)
+	}
+	if saved != payment {
+		t.Errorf("saved payment differs: %+v != %+v", saved, payment)
+	}
+}
+
+func TestPayService_Rejected(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 100, 1001)
+
+	if _, err := PayService(clientId, 1, "921234567", 101, db); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("not ErrInsufficientFunds: %v", err)
+	}
+	if _, err := PayService(clientId, 1, "12", 10, db); !errors.Is(err, ErrInvalidPayerAccount) {
+		t.Errorf("not ErrInvalidPayerAccount: %v", err)
+	}
+	if _, err := PayService(clientId, 100, "921234567", 10, db); !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("not ErrServiceNotFound: %v", err)
+	}
+	if _, err := PayService(100, 1, "921234567", 10, db); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("not ErrClientNotFound: %v", err)
+	}
+	if _, err := GetServicePayment("SP-none", db); !errors.Is(err, ErrPaymentNotFound) {
+		t.Errorf("not ErrPaymentNotFound: %v", err)
+	}
+
+	if balance := clientBalance(t, db, clientId); balance != 100 {
+		t.Errorf("balance changed by rejected payments: %d", balance)
+	}
+	if balance, _ := GetProviderBalance(1, db); balance != 0 {
+		t.Errorf("provider credited by rejected payments: %d", balance)
+	}
+}
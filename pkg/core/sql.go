@@ -9,7 +9,7 @@ CREATE TABLE IF NOT EXISTS managers
     password TEXT NOT NULL,
     salary  INTEGER NOT NULL CHECK ( salary > 0 ),
     plan    INTEGER NOT NULL CHECK ( plan >= 0 ),
-    unit 	TEXT,
+    branch_id INTEGER REFERENCES branch,
     boss_id INTEGER REFERENCES managers
 );`
 
@@ -31,13 +31,13 @@ CREATE TABLE IF NOT EXISTS sales (
     price INTEGER NOT NULL CHECK ( price > 0 )
 );`
 
-const managersInitialData = `INSERT INTO managers
+const managersInitialData = `INSERT INTO managers(id, name, login, password, salary, plan, branch_id, boss_id)
 VALUES (1, 'Vasya', 'vasya', 'secret', 100000, 0, NULL, NULL),
-       (2, 'Petya', 'petya', 'secret', 90000, 90000, 'boys', 1),
-       (3, 'Vanya', 'vanya', 'secret', 80000, 80000, 'boys', 2),
-       (4, 'Masha', 'masha', 'secret', 80000, 80000, 'girls', 1),
-       (5, 'Dasha', 'dasha', 'secret', 60000, 60000, 'girls', 4),
-       (6, 'Sasha', 'sasha', 'secret', 40000, 40000, 'girls', 5)
+       (2, 'Petya', 'petya', 'secret', 90000, 90000, 1, 1),
+       (3, 'Vanya', 'vanya', 'secret', 80000, 80000, 1, 2),
+       (4, 'Masha', 'masha', 'secret', 80000, 80000, 2, 1),
+       (5, 'Dasha', 'dasha', 'secret', 60000, 60000, 2, 4),
+       (6, 'Sasha', 'sasha', 'secret', 40000, 40000, 2, 5)
        ON CONFLICT DO NOTHING;`
 
 const productsInitialData = `INSERT INTO products(id, name, price, qty)
@@ -58,28 +58,39 @@ const getProductPriceAndQtyByIdSQL = `SELECT price, qty FROM products WHERE id =
 const insertSaleSQL = `INSERT INTO sales(manager_id, product_id, price, qty) VALUES (:manager_id, :product_id, :price, :qty);`
 
 const loginManagersSQL  = `SELECT login, password FROM managers WHERE login = ?;`
-const listAtmsSQL = `SELECT name, address FROM atm;`
+const listAtmsSQL = `SELECT a.id, a.name, a.address, a.latitude, a.longitude, a.opens_at, a.closes_at,
+       CASE WHEN EXISTS(SELECT 1 FROM atm_maintenance m WHERE m.atm_id = a.id AND m.starts_at <= :now AND m.ends_at > :now)
+            THEN 'maintenance' ELSE a.status END
+FROM atm a
+WHERE :branch_id = 0 OR a.branch_id = :branch_id
+ORDER BY a.id;`
 const listServicesSQL  = `SELECT id, name, price FROM service;`
-const listCards = ` SELECT id, name, balance, user_id FROM card;`
-const lisUsers = `SELECT id, name, surname, middle_name, sex, email, login, password, phone, address, ban FROM client;`
+const listCards = `SELECT id, name, pan, expiry_month, expiry_year, status, balance, user_id FROM card;`
+const lisUsers = `SELECT c.id, c.name, c.balance_number, c.balance, ` + clientDepositsSQL + ` FROM client c WHERE c.id = ?;`
 
 
 
 const clients = `CREATE TABLE IF NOT EXISTS client(
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	name TEXT NOT NULL,
-	-- surname TEXT NOT NULL,
-	-- middle_name TEXT NOT NULL,
-	-- sex TEXT NOT NULL,
-	-- email TEXT NOT NULL UNIQUE,
+	surname TEXT NOT NULL DEFAULT '',
+	middle_name TEXT NOT NULL DEFAULT '',
+	sex TEXT NOT NULL DEFAULT '' CHECK(sex IN ('', 'male', 'female')),
+	email TEXT UNIQUE,
 	login TEXT NOT NULL UNIQUE,
 	password TEXT NOT NULL,
 	passport_series TEXT NOT NULL UNIQUE,
 	phone TEXT NOT NULL UNIQUE,
 	balance INTEGER NOT NULL,
-	balance_number INTEGER NOT NULL UNIQUE
-	-- address TEXT NOT NULL,
-	-- ban BOOLEAN NOT NULL,
+	balance_number INTEGER NOT NULL UNIQUE,
+	address TEXT NOT NULL DEFAULT '',
+	birth_date TEXT NOT NULL DEFAULT '',
+	kyc_status TEXT NOT NULL DEFAULT 'pending' CHECK(kyc_status IN ('pending', 'verified', 'rejected')),
+	kyc_manager_id INTEGER REFERENCES managers,
+	kyc_reason TEXT NOT NULL DEFAULT '',
+	kyc_updated_at INTEGER NOT NULL DEFAULT 0,
+	segment TEXT NOT NULL DEFAULT 'standard' CHECK(segment IN ('standard', 'premium', 'business')),
+	branch_id INTEGER REFERENCES branch
 );`
 
 const managers = `CREATE TABLE IF NOT EXISTS manager(
@@ -94,40 +105,895 @@ const managers = `CREATE TABLE IF NOT EXISTS manager(
 const atm  = `CREATE TABLE IF NOT EXISTS atm(
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	name TEXT NOT NULL,
-	address TEXT NOT NULL
+	address TEXT NOT NULL,
+	latitude REAL CHECK(latitude BETWEEN -90 AND 90),
+	longitude REAL CHECK(longitude BETWEEN -180 AND 180),
+	opens_at TEXT NOT NULL DEFAULT '',
+	closes_at TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL DEFAULT 'online' CHECK(status IN ('online', 'offline', 'maintenance', 'out_of_cash')),
+	branch_id INTEGER REFERENCES branch
 );`
 
 const services  = `CREATE TABLE IF NOT EXISTS service(
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	name TEXT NOT NULL,
-	price INTEGER NOT NULL CHECK(price > 0)
+	price INTEGER NOT NULL DEFAULT 0 CHECK(price >= 0),
+	provider_id INTEGER REFERENCES provider,
+	category_id INTEGER REFERENCES service_category,
+	account_pattern TEXT NOT NULL DEFAULT '',
+	account_hint TEXT NOT NULL DEFAULT '',
+	min_amount INTEGER NOT NULL DEFAULT 1 CHECK(min_amount > 0),
+	max_amount INTEGER NOT NULL DEFAULT 0 CHECK(max_amount >= 0),
+	fee_fixed INTEGER NOT NULL DEFAULT 0 CHECK(fee_fixed >= 0),
+	fee_percent_bp INTEGER NOT NULL DEFAULT 0 CHECK(fee_percent_bp >= 0)
 );`
 
 
 const cards = `CREATE TABLE IF NOT EXISTS card(
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	pan TEXT NOT NULL UNIQUE,
+	expiry_month INTEGER NOT NULL CHECK(expiry_month BETWEEN 1 AND 12),
+	expiry_year INTEGER NOT NULL,
+	cvv_hash TEXT NOT NULL,
+	pin_hash TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'active' CHECK(status IN ('active', 'blocked', 'expired', 'closed')),
 	balance INTEGER NOT NULL,
-	user_id TEXT NOT NULL REFERENCES client
+	user_id INTEGER NOT NULL REFERENCES client
 );`
 // -- Insertes
 const insertAtmSQL = `INSERT INTO atm( name, address)VALUES( :name,:address);`
 const insertServiceSQL = `INSERT INTO service( name, price)VALUES( :name, :price);`
-const insertCardsSQL = `INSERT INTO card(name, balance, user_id)VALUES( :name, :balance);`
+const insertCardsSQL = `INSERT INTO card(name, pan, expiry_month, expiry_year, cvv_hash, pin_hash, status, balance, user_id)VALUES( :name, :pan, :expiry_month, :expiry_year, :cvv_hash, :pin_hash, 'active', :balance, :user_id);`
 const insertUserSQL = `INSERT INTO client(name, login, password, passport_series, phone, balance, balance_number)VALUES( :name, :login, :password, :passport_series, :phone, :balance, :balance_number )`
-const getAllAtmDataSQL = `SELECT * FROM atm;`
-const getAllClientsDataSQL = `SELECT * FROM client`
+const getAllAtmDataSQL = `SELECT id, name, address, latitude, longitude, opens_at, closes_at, status FROM atm
+WHERE :branch_id = 0 OR branch_id = :branch_id;`
+const getAllClientsDataSQL = `SELECT c.id, c.login, c.password, c.name, c.phone, c.balance, c.balance_number, c.passport_series,
+	` + clientDepositsSQL + ` FROM client c
+WHERE :branch_id = 0 OR c.branch_id = :branch_id`
 // -- Updates
 const updateCardBalanceSQL = `UPDATE client SET balance=balance + :balance WHERE id = :id;`
-const updateClientBalanceMinusSQL = `UPDATE client SET balance = balance - :balance WHERE login=:login;`
 const updateClientBalancePlusSQL =	`UPDATE client SET balance = balance + :balance WHERE id = :id;`
 
-const priceOfService = `SELECT price FROM service WHERE id= :id;`
-const payForServices = `UPDATE service SET price = price + :price WHERE id =:id;`
-const updateTransactionWithPhoneNumberMinus = `UPDATE client SET balance = balance - :balance WHERE phone_number = :phone_number;`
-const updateTransactionWithPhoneNumberPlus = `UPDATE client SET balance = balance + :balance where phone_number = :phone_number;`
+const updateTransactionWithPhoneNumberMinus = `UPDATE client SET balance = balance - :balance WHERE phone = :phone_number;`
+const updateTransactionWithPhoneNumberPlus = `UPDATE client SET balance = balance + :balance where phone = :phone_number;`
 const updateTransactionWithBalanceNumberMinus = `UPDATE client SET balance = balance - :balance WHERE balance_number = :balance_number;`
 const updateTransactionWithBalanceNumberPlus = `UPDATE client SET balance = balance + :balance where balance_number = :balance_number;`
 const LoginForClient = `select id, login,password from client where login = ?;`
 const getAllAtmSql = `select id,name,street from atm;`
 
-const insertClientSQL  = `insert into client(id,name,login,password,passport_series,phone) values(:id, :name, :login, :password,:passport_series,:phone) ON CONFLICT DO NOTHING;`
\ No newline at end of file
+const insertClientSQL  = `insert into client(id,name,login,password,passport_series,phone) values(:id, :name, :login, :password,:passport_series,:phone) ON CONFLICT DO NOTHING;`
+
+// -- Cards
+const listClientCardsSQL = `SELECT id, name, pan, expiry_month, expiry_year, status, balance, user_id FROM card WHERE user_id = ? ORDER BY id;`
+const getCardByIdSQL = `SELECT id, name, pan, expiry_month, expiry_year, status, balance, user_id FROM card WHERE id = ?;`
+const getCardPinHashSQL = `SELECT pin_hash FROM card WHERE id = ?;`
+const updateCardStatusSQL = `UPDATE card SET status = :status WHERE id = :id;`
+const updateCardPinHashSQL = `UPDATE card SET pin_hash = :pin_hash WHERE id = :id;`
+const closeCardForReissueSQL = `UPDATE card SET status = 'closed', balance = 0 WHERE id = :id;`
+const expireCardsSQL = `UPDATE card SET status = 'expired'
+WHERE status IN ('active', 'blocked')
+  AND (expiry_year < :year OR (expiry_year = :year AND expiry_month < :month));`
+const getCardByPANSQL = `SELECT id, name, pan, expiry_month, expiry_year, status, balance, user_id FROM card WHERE pan = ?;`
+const updateCardBalancePlusSQL = `UPDATE card SET balance = balance + :amount WHERE id = :id;`
+const updateCardBalanceMinusSQL = `UPDATE card SET balance = balance - :amount WHERE id = :id;`
+const updateClientBalanceMinusByIdSQL = `UPDATE client SET balance = balance - :balance WHERE id = :id;`
+const listClientCardBalancesSQL = `SELECT id, balance FROM card WHERE user_id = ? AND status != 'closed' ORDER BY balance DESC, id;`
+
+// -- Operations
+const operations = `CREATE TABLE IF NOT EXISTS operation(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	type TEXT NOT NULL,
+	client_id INTEGER NOT NULL REFERENCES client,
+	card_id INTEGER REFERENCES card,
+	target_client_id INTEGER REFERENCES client,
+	target_card_id INTEGER REFERENCES card,
+	atm_id INTEGER REFERENCES atm,
+	amount INTEGER NOT NULL CHECK(amount > 0),
+	created_at INTEGER NOT NULL,
+	reversal_of INTEGER UNIQUE REFERENCES operation,
+	manager_id INTEGER REFERENCES managers,
+	reason TEXT NOT NULL DEFAULT ''
+);`
+const insertOperationSQL = `INSERT INTO operation(type, client_id, card_id, target_client_id, target_card_id, atm_id, amount, created_at,
+	reversal_of, manager_id, reason)
+VALUES (:type, :client_id, :card_id, :target_client_id, :target_card_id, :atm_id, :amount, :created_at,
+	:reversal_of, :manager_id, :reason);`
+const operationColumns = `o.id, o.type, o.client_id, o.card_id, o.target_client_id, o.target_card_id, o.atm_id, o.amount, o.created_at,
+	o.reversal_of, o.manager_id, o.reason`
+const getOperationSQL = `SELECT ` + operationColumns + ` FROM operation o WHERE o.id = ?;`
+const getReversalIdSQL = `SELECT id FROM operation WHERE reversal_of = ?;`
+const getServicePaymentByOperationSQL = `SELECT provider_id, amount FROM service_payment WHERE operation_id = ?;`
+const getStatementSQL = `SELECT ` + operationColumns + `, COALESCE(original.type, o.type), COALESCE(reversal.id, 0)
+FROM operation o
+LEFT JOIN operation original ON original.id = o.reversal_of
+LEFT JOIN operation reversal ON reversal.reversal_of = o.id
+WHERE (o.client_id = :client_id OR o.target_client_id = :client_id) AND o.created_at >= :from AND o.created_at < :to
+ORDER BY o.created_at, o.id;`
+
+// -- Limits
+const spendingLimits = `CREATE TABLE IF NOT EXISTS spending_limit(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	scope TEXT NOT NULL CHECK(scope IN ('card', 'client')),
+	subject_id INTEGER NOT NULL,
+	operation_type TEXT NOT NULL,
+	period TEXT NOT NULL CHECK(period IN ('daily', 'monthly')),
+	amount INTEGER NOT NULL CHECK(amount >= 0),
+	UNIQUE(scope, subject_id, operation_type, period)
+);`
+const upsertSpendingLimitSQL = `INSERT INTO spending_limit(scope, subject_id, operation_type, period, amount)
+VALUES (:scope, :subject_id, :operation_type, :period, :amount)
+ON CONFLICT(scope, subject_id, operation_type, period) DO UPDATE SET amount = excluded.amount;`
+const deleteSpendingLimitSQL = `DELETE FROM spending_limit WHERE id = ?;`
+const getSpendingLimitSQL = `SELECT id, scope, subject_id, operation_type, period, amount FROM spending_limit WHERE id = ?;`
+const listSpendingLimitsSQL = `SELECT id, scope, subject_id, operation_type, period, amount FROM spending_limit WHERE scope = ? AND subject_id = ? ORDER BY id;`
+const applicableSpendingLimitsSQL = `SELECT id, scope, subject_id, operation_type, period, amount FROM spending_limit
+WHERE ((scope = 'client' AND subject_id = :client_id) OR (scope = 'card' AND subject_id = :card_id))
+  AND operation_type IN ('', :operation_type);`
+const spentByClientSQL = `SELECT COALESCE(SUM(amount), 0) FROM operation
+WHERE client_id = :subject_id AND created_at >= :since
+  AND (:operation_type = '' AND type IN ('transfer', 'service_payment', 'atm_withdrawal') OR type = :operation_type)
+  AND NOT EXISTS (SELECT 1 FROM operation reversal WHERE reversal.reversal_of = operation.id);`
+const spentByCardSQL = `SELECT COALESCE(SUM(amount), 0) FROM operation
+WHERE card_id = :subject_id AND created_at >= :since
+  AND (:operation_type = '' AND type IN ('transfer', 'service_payment', 'atm_withdrawal') OR type = :operation_type)
+  AND NOT EXISTS (SELECT 1 FROM operation reversal WHERE reversal.reversal_of = operation.id);`
+const getClientIdByPhoneSQL = `SELECT id FROM client WHERE phone = ?;`
+const getClientIdByBalanceNumberSQL = `SELECT id FROM client WHERE balance_number = ?;`
+const getClientIdByLoginSQL = `SELECT id FROM client WHERE login = ?;`
+
+// -- ATM cash
+const atmCassettes = `CREATE TABLE IF NOT EXISTS atm_cassette(
+	atm_id INTEGER NOT NULL REFERENCES atm,
+	denomination INTEGER NOT NULL CHECK(denomination > 0),
+	count INTEGER NOT NULL CHECK(count >= 0),
+	PRIMARY KEY (atm_id, denomination)
+);`
+const atmReplenishments = `CREATE TABLE IF NOT EXISTS atm_replenishment(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	atm_id INTEGER NOT NULL REFERENCES atm,
+	manager_id INTEGER NOT NULL REFERENCES managers,
+	denomination INTEGER NOT NULL,
+	count INTEGER NOT NULL CHECK(count > 0),
+	created_at INTEGER NOT NULL
+);`
+const getManagerIdSQL = `SELECT id FROM managers WHERE id = ?;`
+const listAtmCassettesSQL = `SELECT atm_id, denomination, count FROM atm_cassette WHERE atm_id = ? ORDER BY denomination DESC;`
+const addAtmCassetteNotesSQL = `INSERT INTO atm_cassette(atm_id, denomination, count) VALUES (:atm_id, :denomination, :count)
+ON CONFLICT(atm_id, denomination) DO UPDATE SET count = count + excluded.count;`
+const takeAtmCassetteNotesSQL = `UPDATE atm_cassette SET count = count - :count WHERE atm_id = :atm_id AND denomination = :denomination;`
+const insertAtmReplenishmentSQL = `INSERT INTO atm_replenishment(atm_id, manager_id, denomination, count, created_at)
+VALUES (:atm_id, :manager_id, :denomination, :count, :created_at);`
+
+// -- ATM status and location
+const atmMaintenanceWindows = `CREATE TABLE IF NOT EXISTS atm_maintenance(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	atm_id INTEGER NOT NULL REFERENCES atm,
+	starts_at INTEGER NOT NULL,
+	ends_at INTEGER NOT NULL CHECK(ends_at > starts_at),
+	reason TEXT NOT NULL
+);`
+const insertAtmFullSQL = `INSERT INTO atm(id, name, address, latitude, longitude, opens_at, closes_at, status)
+VALUES (:id, :name, :address, :latitude, :longitude, :opens_at, :closes_at, :status);`
+const getAtmByIdSQL = `SELECT id, name, address, latitude, longitude, opens_at, closes_at, status FROM atm WHERE id = ?;`
+const updateAtmLocationSQL = `UPDATE atm SET latitude = :latitude, longitude = :longitude WHERE id = :id;`
+const updateAtmHoursSQL = `UPDATE atm SET opens_at = :opens_at, closes_at = :closes_at WHERE id = :id;`
+const updateAtmStatusSQL = `UPDATE atm SET status = :status WHERE id = :id;`
+const insertAtmMaintenanceSQL = `INSERT INTO atm_maintenance(atm_id, starts_at, ends_at, reason) VALUES (:atm_id, :starts_at, :ends_at, :reason);`
+const atmInMaintenanceSQL = `SELECT COUNT(*) FROM atm_maintenance WHERE atm_id = :atm_id AND starts_at <= :now AND ends_at > :now;`
+const listAtmsInBoxSQL = `SELECT a.id, a.name, a.address, a.latitude, a.longitude, a.opens_at, a.closes_at,
+       CASE WHEN EXISTS(SELECT 1 FROM atm_maintenance m WHERE m.atm_id = a.id AND m.starts_at <= :now AND m.ends_at > :now)
+            THEN 'maintenance' ELSE a.status END
+FROM atm a
+WHERE a.latitude BETWEEN :min_lat AND :max_lat
+  AND (a.longitude BETWEEN :min_lon AND :max_lon OR a.longitude BETWEEN :wrap_min_lon AND :wrap_max_lon);`
+const atmCashTotalSQL = `SELECT COALESCE(SUM(denomination * count), 0) FROM atm_cassette WHERE atm_id = ?;`
+const backOnlineAfterCashSQL = `UPDATE atm SET status = 'online' WHERE id = ? AND status = 'out_of_cash';`
+
+// -- Service catalog
+const providers = `CREATE TABLE IF NOT EXISTS provider(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	balance INTEGER NOT NULL DEFAULT 0
+);`
+const serviceCategories = `CREATE TABLE IF NOT EXISTS service_category(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE
+);`
+const serviceCatalogInitialData = `INSERT INTO service_category(id, name)
+VALUES (1, 'Mobile'),
+       (2, 'Utilities'),
+       (3, 'Internet')
+       ON CONFLICT DO NOTHING;
+INSERT INTO provider(id, name)
+VALUES (1, 'Tcell'),
+       (2, 'MegaFon'),
+       (3, 'Babilon-M'),
+       (4, 'Barqi Tojik')
+       ON CONFLICT DO NOTHING;
+INSERT INTO service(id, name, provider_id, category_id, account_pattern, account_hint, min_amount, max_amount, fee_fixed, fee_percent_bp)
+VALUES (1, 'Tcell', 1, 1, '9[23][0-9]{7}', 'phone 92xxxxxxx or 93xxxxxxx', 1, 5000, 0, 0),
+       (2, 'MegaFon', 2, 1, '(90|88)[0-9]{7}', 'phone 90xxxxxxx or 88xxxxxxx', 1, 5000, 0, 0),
+       (3, 'Babilon-M Internet', 3, 3, '[0-9]{6,8}', 'contract number, 6-8 digits', 10, 10000, 0, 100),
+       (4, 'Electricity', 4, 2, '[0-9]{10}', 'personal account, 10 digits', 1, 0, 1, 0)
+       ON CONFLICT DO NOTHING;`
+const insertProviderSQL = `INSERT INTO provider(name) VALUES (?);`
+const insertServiceCategorySQL = `INSERT INTO service_category(name) VALUES (?);`
+const insertCatalogServiceSQL = `INSERT INTO service(name, provider_id, category_id, account_pattern, account_hint, min_amount, max_amount, fee_fixed, fee_percent_bp)
+VALUES (:name, :provider_id, :category_id, :account_pattern, :account_hint, :min_amount, :max_amount, :fee_fixed, :fee_percent_bp);`
+const catalogServiceColumns = `s.id, s.name, s.provider_id, p.name, s.category_id, c.name,
+       s.account_pattern, s.account_hint, s.min_amount, s.max_amount, s.fee_fixed, s.fee_percent_bp
+FROM service s
+JOIN provider p ON p.id = s.provider_id
+JOIN service_category c ON c.id = s.category_id`
+const listServiceCatalogSQL = `SELECT ` + catalogServiceColumns + `
+WHERE :category_id = 0 OR s.category_id = :category_id
+ORDER BY c.name, s.name;`
+const getCatalogServiceSQL = `SELECT ` + catalogServiceColumns + `
+WHERE s.id = ?;`
+const listServiceCategoriesSQL = `SELECT id, name FROM service_category ORDER BY name;`
+const listProvidersSQL = `SELECT id, name FROM provider ORDER BY name;`
+
+// -- Service payments
+const servicePayments = `CREATE TABLE IF NOT EXISTS service_payment(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	receipt_number TEXT NOT NULL UNIQUE,
+	operation_id INTEGER NOT NULL REFERENCES operation,
+	client_id INTEGER NOT NULL REFERENCES client,
+	service_id INTEGER NOT NULL REFERENCES service,
+	provider_id INTEGER NOT NULL REFERENCES provider,
+	payer_account TEXT NOT NULL,
+	amount INTEGER NOT NULL CHECK(amount > 0),
+	fee INTEGER NOT NULL CHECK(fee >= 0),
+	created_at INTEGER NOT NULL
+);`
+const getClientBalanceSQL = `SELECT balance FROM client WHERE id = ?;`
+const updateProviderBalancePlusSQL = `UPDATE provider SET balance = balance + :amount WHERE id = :id;`
+const insertServicePaymentSQL = `INSERT INTO service_payment(receipt_number, operation_id, client_id, service_id, provider_id, payer_account, amount, fee, created_at)
+VALUES (:receipt_number, :operation_id, :client_id, :service_id, :provider_id, :payer_account, :amount, :fee, :created_at);`
+const getServicePaymentByReceiptSQL = `SELECT id, receipt_number, operation_id, client_id, service_id, provider_id, payer_account, amount, fee, created_at
+FROM service_payment WHERE receipt_number = ?;`
+const getProviderBalanceSQL = `SELECT balance FROM provider WHERE id = ?;`
+
+// -- Receipts
+const receipts = `CREATE TABLE IF NOT EXISTS receipt(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	number TEXT NOT NULL UNIQUE,
+	kind TEXT NOT NULL,
+	operation_id INTEGER REFERENCES operation,
+	created_at INTEGER NOT NULL,
+	payer TEXT NOT NULL,
+	payee TEXT NOT NULL,
+	description TEXT NOT NULL,
+	amount INTEGER NOT NULL,
+	fee INTEGER NOT NULL,
+	balance_after INTEGER
+);`
+const insertReceiptSQL = `INSERT INTO receipt(number, kind, operation_id, created_at, payer, payee, description, amount, fee, balance_after)
+VALUES (:number, :kind, :operation_id, :created_at, :payer, :payee, :description, :amount, :fee, :balance_after);`
+const getReceiptSQL = `SELECT number, kind, operation_id, created_at, payer, payee, description, amount, fee, balance_after
+FROM receipt WHERE number = ?;`
+const getClientNameSQL = `SELECT name FROM client WHERE id = ?;`
+const getProductNameSQL = `SELECT name FROM products WHERE id = ?;`
+
+// -- Scheduled payments
+const scheduledPayments = `CREATE TABLE IF NOT EXISTS scheduled_payment(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	client_id INTEGER NOT NULL REFERENCES client,
+	service_id INTEGER NOT NULL REFERENCES service,
+	payer_account TEXT NOT NULL,
+	amount INTEGER NOT NULL CHECK(amount > 0),
+	schedule TEXT NOT NULL,
+	due_at INTEGER NOT NULL,
+	next_run_at INTEGER NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	active INTEGER NOT NULL DEFAULT 1
+);`
+const scheduledPaymentRuns = `CREATE TABLE IF NOT EXISTS scheduled_payment_run(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	scheduled_payment_id INTEGER NOT NULL REFERENCES scheduled_payment,
+	run_at INTEGER NOT NULL,
+	due_at INTEGER NOT NULL,
+	attempt INTEGER NOT NULL,
+	status TEXT NOT NULL CHECK(status IN ('success', 'retry', 'failed')),
+	receipt_number TEXT NOT NULL DEFAULT '',
+	error TEXT NOT NULL DEFAULT ''
+);`
+const insertScheduledPaymentSQL = `INSERT INTO scheduled_payment(client_id, service_id, payer_account, amount, schedule, due_at, next_run_at)
+VALUES (:client_id, :service_id, :payer_account, :amount, :schedule, :due_at, :due_at);`
+const scheduledPaymentColumns = `id, client_id, service_id, payer_account, amount, schedule, due_at, next_run_at, attempts, active FROM scheduled_payment`
+const listDueScheduledPaymentsSQL = `SELECT ` + scheduledPaymentColumns + ` WHERE active = 1 AND next_run_at <= ? ORDER BY next_run_at, id;`
+const listClientScheduledPaymentsSQL = `SELECT ` + scheduledPaymentColumns + ` WHERE client_id = ? ORDER BY id;`
+const updateScheduledPaymentStateSQL = `UPDATE scheduled_payment SET due_at = :due_at, next_run_at = :next_run_at, attempts = :attempts, active = :active WHERE id = :id;`
+const cancelScheduledPaymentSQL = `UPDATE scheduled_payment SET active = 0 WHERE id = ? AND active = 1;`
+const insertScheduledPaymentRunSQL = `INSERT INTO scheduled_payment_run(scheduled_payment_id, run_at, due_at, attempt, status, receipt_number, error)
+VALUES (:scheduled_payment_id, :run_at, :due_at, :attempt, :status, :receipt_number, :error);`
+const listScheduledPaymentRunsSQL = `SELECT id, scheduled_payment_id, run_at, due_at, attempt, status, receipt_number, error
+FROM scheduled_payment_run WHERE scheduled_payment_id = ? ORDER BY id;`
+const getClientIdSQL = `SELECT id FROM client WHERE id = ?;`
+
+// ключи идемпотентности выбирает клиент, поэтому они уникальны только в пределах клиента
+// и операции; client_id 0 - операции без клиента (продажи)
+const idempotencyKeys = `CREATE TABLE IF NOT EXISTS idempotency_key(
+	client_id INTEGER NOT NULL,
+	operation TEXT NOT NULL,
+	key TEXT NOT NULL,
+	request_hash TEXT NOT NULL,
+	result TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	PRIMARY KEY(client_id, operation, key)
+);`
+const dropIdempotencyKeysSQL = `DROP TABLE idempotency_key;`
+const getIdempotencyKeySQL = `SELECT request_hash, result FROM idempotency_key
+WHERE client_id = :client_id AND operation = :operation AND key = :key;`
+const claimIdempotencyKeySQL = `INSERT INTO idempotency_key(client_id, operation, key, request_hash, result, created_at)
+VALUES (:client_id, :operation, :key, :request_hash, '', :created_at)
+ON CONFLICT(client_id, operation, key) DO NOTHING;`
+const updateIdempotencyResultSQL = `UPDATE idempotency_key SET result = :result
+WHERE client_id = :client_id AND operation = :operation AND key = :key;`
+
+// -- Audit
+const auditLog = `CREATE TABLE IF NOT EXISTS audit_log(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	actor_type TEXT NOT NULL,
+	actor_id INTEGER NOT NULL DEFAULT 0,
+	action TEXT NOT NULL,
+	entity TEXT NOT NULL,
+	entity_id INTEGER NOT NULL DEFAULT 0,
+	before TEXT NOT NULL DEFAULT '',
+	after TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL,
+	prev_hash TEXT NOT NULL UNIQUE,
+	hash TEXT NOT NULL
+);`
+const auditLogNoUpdate = `CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;`
+const auditLogNoDelete = `CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;`
+const getLastAuditHashSQL = `SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1;`
+const insertAuditEntrySQL = `INSERT INTO audit_log(actor_type, actor_id, action, entity, entity_id, before, after, created_at, prev_hash, hash)
+VALUES (:actor_type, :actor_id, :action, :entity, :entity_id, :before, :after, :created_at, :prev_hash, :hash);`
+const auditEntryColumns = `id, actor_type, actor_id, action, entity, entity_id, before, after, created_at, prev_hash, hash FROM audit_log`
+const listAuditEntriesSQL = `SELECT ` + auditEntryColumns + `
+WHERE (:actor_type = '' OR actor_type = :actor_type) AND (:actor_id = 0 OR actor_id = :actor_id)
+  AND (:entity = '' OR entity = :entity) AND (:entity_id = 0 OR entity_id = :entity_id)
+  AND (:from = 0 OR created_at >= :from) AND (:to = 0 OR created_at < :to)
+ORDER BY id;`
+const listAllAuditEntriesSQL = `SELECT ` + auditEntryColumns + ` ORDER BY id;`
+
+// -- KYC
+const getClientProfileSQL = `SELECT surname, name, middle_name, sex, COALESCE(email, ''), phone, address, passport_series, birth_date
+FROM client WHERE id = ?;`
+const updateClientProfileSQL = `UPDATE client SET surname = :surname, name = :name, middle_name = :middle_name, sex = :sex,
+	email = :email, phone = :phone, address = :address, passport_series = :passport_series, birth_date = :birth_date,
+	kyc_status = 'pending', kyc_manager_id = NULL, kyc_reason = '', kyc_updated_at = :updated_at
+WHERE id = :id;`
+const getClientKycSQL = `SELECT kyc_status, kyc_manager_id, kyc_reason, kyc_updated_at, birth_date != '' FROM client WHERE id = ?;`
+const updateClientKycSQL = `UPDATE client SET kyc_status = :status, kyc_manager_id = :manager_id, kyc_reason = :reason,
+	kyc_updated_at = :updated_at WHERE id = :id;`
+
+// -- Client restrictions
+const clientRestrictions = `CREATE TABLE IF NOT EXISTS client_restriction(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	client_id INTEGER NOT NULL REFERENCES client,
+	kind TEXT NOT NULL CHECK(kind IN ('freeze', 'ban')),
+	reason TEXT NOT NULL,
+	actor_type TEXT NOT NULL,
+	actor_id INTEGER NOT NULL DEFAULT 0,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER,
+	lifted_at INTEGER,
+	lifted_by_type TEXT NOT NULL DEFAULT '',
+	lifted_by_id INTEGER NOT NULL DEFAULT 0
+);`
+const insertClientRestrictionSQL = `INSERT INTO client_restriction(client_id, kind, reason, actor_type, actor_id, created_at, expires_at)
+VALUES (:client_id, :kind, :reason, :actor_type, :actor_id, :created_at, :expires_at);`
+const liftClientRestrictionsSQL = `UPDATE client_restriction SET lifted_at = :now, lifted_by_type = :actor_type, lifted_by_id = :actor_id
+WHERE client_id = :client_id AND kind = :kind AND lifted_at IS NULL AND (expires_at IS NULL OR expires_at > :now);`
+const clientRestrictionColumns = `id, client_id, kind, reason, actor_type, actor_id, created_at, expires_at, lifted_at,
+	lifted_by_type, lifted_by_id FROM client_restriction`
+const getActiveClientRestrictionSQL = `SELECT ` + clientRestrictionColumns + `
+WHERE client_id = :client_id AND lifted_at IS NULL AND (expires_at IS NULL OR expires_at > :now)
+ORDER BY kind = 'ban' DESC, id LIMIT 1;`
+const listClientRestrictionsSQL = `SELECT ` + clientRestrictionColumns + ` WHERE client_id = ? ORDER BY id;`
+
+// -- Client list
+const clientListFromSQL = `FROM (
+	SELECT c.id, c.name, c.surname, c.login, c.phone, c.balance, c.balance_number, c.kyc_status,
+		COALESCE(c.branch_id, 0) AS branch_id, ` + clientDepositsSQL + ` AS deposits, CASE
+		WHEN EXISTS(SELECT 1 FROM client_restriction r WHERE r.client_id = c.id AND r.kind = 'ban'
+			AND r.lifted_at IS NULL AND (r.expires_at IS NULL OR r.expires_at > :now)) THEN 'banned'
+		WHEN EXISTS(SELECT 1 FROM client_restriction r WHERE r.client_id = c.id AND r.kind = 'freeze'
+			AND r.lifted_at IS NULL AND (r.expires_at IS NULL OR r.expires_at > :now)) THEN 'frozen'
+		ELSE 'active' END AS status
+	FROM client c
+)
+WHERE (:name = '' OR name LIKE :name OR surname LIKE :name)
+  AND (:phone = '' OR phone LIKE :phone)
+  AND (:min_balance IS NULL OR balance >= :min_balance)
+  AND (:max_balance IS NULL OR balance <= :max_balance)
+  AND (:status = '' OR status = :status)
+  AND (:branch_id = 0 OR branch_id = :branch_id)
+  AND (:kyc_status = '' OR kyc_status = :kyc_status)`
+const listClientsSQL = `SELECT id, name, surname, login, phone, balance, balance_number, branch_id, deposits, kyc_status, status ` + clientListFromSQL
+const countClientsSQL = `SELECT count(*) ` + clientListFromSQL
+
+const outboxEvents = `CREATE TABLE IF NOT EXISTS outbox_event(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	type TEXT NOT NULL,
+	aggregate TEXT NOT NULL,
+	aggregate_id INTEGER NOT NULL,
+	payload TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	next_attempt_at INTEGER NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	delivered_at INTEGER
+);`
+const outboxDeliveries = `CREATE TABLE IF NOT EXISTS outbox_delivery(
+	event_id INTEGER NOT NULL REFERENCES outbox_event,
+	subscriber TEXT NOT NULL,
+	delivered_at INTEGER NOT NULL,
+	PRIMARY KEY (event_id, subscriber)
+);`
+const insertOutboxEventSQL = `INSERT INTO outbox_event(type, aggregate, aggregate_id, payload, created_at, next_attempt_at)
+VALUES (:type, :aggregate, :aggregate_id, :payload, :created_at, :created_at);`
+const outboxEventColumns = `id, type, aggregate, aggregate_id, payload, created_at, attempts, last_error FROM outbox_event`
+const listDueEventsSQL = `SELECT ` + outboxEventColumns + ` event
+WHERE delivered_at IS NULL AND next_attempt_at <= :now
+  AND NOT EXISTS (SELECT 1 FROM outbox_event earlier WHERE earlier.aggregate = event.aggregate
+    AND earlier.aggregate_id = event.aggregate_id AND earlier.delivered_at IS NULL AND earlier.id < event.id)
+ORDER BY id LIMIT :limit;`
+const listPendingEventsSQL = `SELECT ` + outboxEventColumns + ` WHERE delivered_at IS NULL ORDER BY id;`
+const listEventDeliveriesSQL = `SELECT subscriber FROM outbox_delivery WHERE event_id = ?;`
+const insertEventDeliverySQL = `INSERT OR IGNORE INTO outbox_delivery(event_id, subscriber, delivered_at)
+VALUES (:event_id, :subscriber, :delivered_at);`
+const retryEventSQL = `UPDATE outbox_event SET attempts = :attempts, next_attempt_at = :next_attempt_at, last_error = :last_error
+WHERE id = :id;`
+const markEventDeliveredSQL = `UPDATE outbox_event SET delivered_at = :delivered_at WHERE id = :id;`
+
+const webhookSubscriptions = `CREATE TABLE IF NOT EXISTS webhook_subscription(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	url TEXT NOT NULL,
+	event_types TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	active INTEGER NOT NULL DEFAULT 1,
+	created_at INTEGER NOT NULL
+);`
+const webhookDeliveries = `CREATE TABLE IF NOT EXISTS webhook_delivery(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	subscription_id INTEGER NOT NULL REFERENCES webhook_subscription,
+	event_id INTEGER NOT NULL REFERENCES outbox_event,
+	event_type TEXT NOT NULL,
+	body TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'delivered', 'dead')),
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	last_status INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	delivered_at INTEGER,
+	UNIQUE(subscription_id, event_id)
+);`
+const insertWebhookSubscriptionSQL = `INSERT INTO webhook_subscription(url, event_types, secret, created_at)
+VALUES (:url, :event_types, :secret, :created_at);`
+const disableWebhookSubscriptionSQL = `UPDATE webhook_subscription SET active = 0 WHERE id = ?;`
+const webhookSubscriptionColumns = `id, url, event_types, active, created_at FROM webhook_subscription`
+const listWebhookSubscriptionsSQL = `SELECT ` + webhookSubscriptionColumns + ` ORDER BY id;`
+const listActiveWebhookSubscriptionsSQL = `SELECT ` + webhookSubscriptionColumns + ` WHERE active = 1 ORDER BY id;`
+const insertWebhookDeliverySQL = `INSERT OR IGNORE INTO webhook_delivery(subscription_id, event_id, event_type, body, next_attempt_at, created_at)
+VALUES (:subscription_id, :event_id, :event_type, :body, :created_at, :created_at);`
+const webhookDeliveryColumns = `delivery.id, delivery.subscription_id, delivery.event_id, delivery.event_type, delivery.body,
+	delivery.status, delivery.attempts, delivery.last_error, delivery.last_status, delivery.next_attempt_at,
+	delivery.created_at, delivery.delivered_at`
+const listDueWebhookDeliveriesSQL = `SELECT ` + webhookDeliveryColumns + `, subscription.url, subscription.secret
+FROM webhook_delivery delivery JOIN webhook_subscription subscription ON subscription.id = delivery.subscription_id
+WHERE delivery.status = 'pending' AND delivery.next_attempt_at <= :now AND subscription.active = 1
+ORDER BY delivery.id LIMIT :limit;`
+const listWebhookDeliveriesByStatusSQL = `SELECT ` + webhookDeliveryColumns + ` FROM webhook_delivery delivery
+WHERE delivery.status = ? ORDER BY delivery.id;`
+const listWebhookDeliveriesSQL = `SELECT ` + webhookDeliveryColumns + ` FROM webhook_delivery delivery
+WHERE delivery.subscription_id = ? ORDER BY delivery.id;`
+const updateWebhookDeliverySQL = `UPDATE webhook_delivery SET status = :status, attempts = :attempts,
+	next_attempt_at = :next_attempt_at, last_error = :last_error, last_status = :last_status, delivered_at = :delivered_at
+WHERE id = :id;`
+const replayWebhookDeliverySQL = `UPDATE webhook_delivery SET status = 'pending', attempts = 0, next_attempt_at = :now,
+	last_error = '', delivered_at = NULL
+WHERE id = :id AND status IN ('dead', 'delivered');`
+const replayDeadWebhookDeliveriesSQL = `UPDATE webhook_delivery SET status = 'pending', attempts = 0, next_attempt_at = :now,
+	last_error = ''
+WHERE subscription_id = :subscription_id AND status = 'dead';`
+
+const notificationPreferences = `CREATE TABLE IF NOT EXISTS notification_preference(
+	client_id INTEGER PRIMARY KEY REFERENCES client,
+	language TEXT NOT NULL CHECK(language IN ('ru', 'tg', 'en')),
+	sms INTEGER NOT NULL,
+	email INTEGER NOT NULL,
+	events TEXT NOT NULL
+);`
+const clientDevices = `CREATE TABLE IF NOT EXISTS client_device(
+	client_id INTEGER NOT NULL REFERENCES client,
+	device_id TEXT NOT NULL,
+	first_seen_at INTEGER NOT NULL,
+	last_seen_at INTEGER NOT NULL,
+	PRIMARY KEY (client_id, device_id)
+);`
+const upsertNotificationPreferencesSQL = `INSERT INTO notification_preference(client_id, language, sms, email, events)
+VALUES (:client_id, :language, :sms, :email, :events)
+ON CONFLICT(client_id) DO UPDATE SET language = excluded.language, sms = excluded.sms, email = excluded.email,
+	events = excluded.events;`
+const getNotificationPreferencesSQL = `SELECT language, sms, email, events FROM notification_preference WHERE client_id = ?;`
+const getClientContactsSQL = `SELECT name, phone, COALESCE(email, ''), balance FROM client WHERE id = ?;`
+const insertClientDeviceSQL = `INSERT OR IGNORE INTO client_device(client_id, device_id, first_seen_at, last_seen_at)
+VALUES (:client_id, :device_id, :now, :now);`
+const touchClientDeviceSQL = `UPDATE client_device SET last_seen_at = :now WHERE client_id = :client_id AND device_id = :device_id;`
+
+const fraudHistory = `CREATE TABLE IF NOT EXISTS fraud_history(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	client_id INTEGER NOT NULL REFERENCES client,
+	operation TEXT NOT NULL,
+	amount INTEGER NOT NULL,
+	recipient TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL
+);`
+const fraudHolds = `CREATE TABLE IF NOT EXISTS fraud_hold(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	client_id INTEGER NOT NULL REFERENCES client,
+	operation TEXT NOT NULL,
+	amount INTEGER NOT NULL,
+	recipient TEXT NOT NULL DEFAULT '',
+	request TEXT NOT NULL,
+	request_hash TEXT NOT NULL,
+	rules TEXT NOT NULL,
+	status TEXT NOT NULL CHECK(status IN ('pending', 'approved', 'rejected', 'executed', 'blocked')),
+	manager_id INTEGER REFERENCES managers,
+	reason TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL,
+	reviewed_at INTEGER
+);`
+const insertFraudHistorySQL = `INSERT INTO fraud_history(client_id, operation, amount, recipient, created_at)
+VALUES (:client_id, :operation, :amount, :recipient, :created_at);`
+const countFraudHistorySQL = `SELECT COUNT(*) FROM fraud_history WHERE client_id = ? AND created_at >= ?;`
+const fraudAverageAmountSQL = `SELECT COUNT(*), COALESCE(AVG(amount), 0) FROM fraud_history WHERE client_id = ? AND created_at >= ?;`
+const countFraudRecipientSQL = `SELECT COUNT(*) FROM fraud_history WHERE client_id = ? AND recipient = ?;`
+const countNewFraudRecipientsSQL = `SELECT COUNT(*) FROM (
+	SELECT recipient FROM fraud_history WHERE client_id = ? AND recipient != ''
+	GROUP BY recipient HAVING MIN(created_at) >= ?
+);`
+const insertFraudHoldSQL = `INSERT INTO fraud_hold(client_id, operation, amount, recipient, request, request_hash, rules, status, created_at)
+VALUES (:client_id, :operation, :amount, :recipient, :request, :request_hash, :rules, :status, :created_at);`
+const fraudHoldColumns = `id, client_id, operation, amount, recipient, request, rules, status, manager_id, reason, created_at,
+	reviewed_at FROM fraud_hold`
+const getFraudHoldSQL = `SELECT ` + fraudHoldColumns + ` WHERE id = ?;`
+const listFraudHoldsSQL = `SELECT ` + fraudHoldColumns + `
+WHERE (:status = '' OR status = :status)
+  AND (:branch_id = 0 OR client_id IN (SELECT id FROM client WHERE branch_id = :branch_id))
+ORDER BY id DESC;`
+const getPendingFraudHoldSQL = `SELECT id FROM fraud_hold WHERE client_id = ? AND request_hash = ? AND status = 'pending';`
+const getApprovedFraudHoldSQL = `SELECT id FROM fraud_hold WHERE client_id = ? AND request_hash = ? AND status = 'approved'
+ORDER BY id LIMIT 1;`
+const executeFraudHoldSQL = `UPDATE fraud_hold SET status = 'executed' WHERE id = ?;`
+const reviewFraudHoldSQL = `UPDATE fraud_hold SET status = :status, manager_id = :manager_id, reason = :reason, reviewed_at = :reviewed_at
+WHERE id = :id;`
+
+const interestProducts = `CREATE TABLE IF NOT EXISTS interest_product(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	rate_bp INTEGER NOT NULL CHECK(rate_bp > 0),
+	day_count TEXT NOT NULL CHECK(day_count IN ('act/365', 'act/360', '30/360')),
+	compounding TEXT NOT NULL CHECK(compounding IN ('monthly', 'quarterly', 'yearly'))
+);`
+const savingsAccounts = `CREATE TABLE IF NOT EXISTS savings_account(
+	client_id INTEGER PRIMARY KEY REFERENCES client,
+	product_id INTEGER NOT NULL REFERENCES interest_product,
+	opened_on TEXT NOT NULL,
+	accrued_through TEXT NOT NULL,
+	accrued_numerator INTEGER NOT NULL DEFAULT 0
+);`
+const interestAccruals = `CREATE TABLE IF NOT EXISTS interest_accrual(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	client_id INTEGER NOT NULL REFERENCES client,
+	product_id INTEGER NOT NULL REFERENCES interest_product,
+	date TEXT NOT NULL,
+	kind TEXT NOT NULL CHECK(kind IN ('accrual', 'capitalization')),
+	balance INTEGER NOT NULL,
+	rate_bp INTEGER NOT NULL,
+	days INTEGER NOT NULL,
+	numerator INTEGER NOT NULL,
+	denominator INTEGER NOT NULL,
+	amount INTEGER NOT NULL DEFAULT 0,
+	operation_id INTEGER REFERENCES operation
+);`
+
+const insertInterestProductSQL = `INSERT INTO interest_product(name, rate_bp, day_count, compounding)
+VALUES (:name, :rate_bp, :day_count, :compounding);`
+const listInterestProductsSQL = `SELECT id, name, rate_bp, day_count, compounding FROM interest_product ORDER BY id;`
+const getInterestProductIdSQL = `SELECT id FROM interest_product WHERE id = ?;`
+const insertSavingsAccountSQL = `INSERT OR IGNORE INTO savings_account(client_id, product_id, opened_on, accrued_through)
+VALUES (:client_id, :product_id, :today, :today);`
+const listDueSavingsAccountsSQL = `SELECT s.client_id, s.accrued_through, s.accrued_numerator,
+	p.id, p.name, p.rate_bp, p.day_count, p.compounding
+FROM savings_account s JOIN interest_product p ON p.id = s.product_id
+WHERE s.accrued_through < ? ORDER BY s.client_id;`
+const updateSavingsAccountSQL = `UPDATE savings_account SET accrued_through = :accrued_through, accrued_numerator = :numerator
+WHERE client_id = :client_id;`
+const insertInterestAccrualSQL = `INSERT INTO interest_accrual(client_id, product_id, date, kind, balance, rate_bp, days,
+	numerator, denominator, amount, operation_id)
+VALUES (:client_id, :product_id, :date, :kind, :balance, :rate_bp, :days, :numerator, :denominator, :amount, :operation_id);`
+const listInterestAccrualsSQL = `SELECT id, client_id, product_id, date, kind, balance, rate_bp, days, numerator, denominator,
+	amount, operation_id
+FROM interest_accrual WHERE client_id = ? ORDER BY date, id;`
+
+const loanProducts = `CREATE TABLE IF NOT EXISTS loan_product(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	rate_bp INTEGER NOT NULL CHECK(rate_bp >= 0),
+	schedule TEXT NOT NULL CHECK(schedule IN ('annuity', 'differentiated')),
+	penalty_bp INTEGER NOT NULL DEFAULT 0,
+	min_amount INTEGER NOT NULL,
+	max_amount INTEGER NOT NULL,
+	min_term INTEGER NOT NULL,
+	max_term INTEGER NOT NULL
+);`
+const loans = `CREATE TABLE IF NOT EXISTS loan(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	client_id INTEGER NOT NULL REFERENCES client,
+	product_id INTEGER NOT NULL REFERENCES loan_product,
+	amount INTEGER NOT NULL CHECK(amount > 0),
+	term INTEGER NOT NULL CHECK(term > 0),
+	rate_bp INTEGER NOT NULL,
+	schedule TEXT NOT NULL,
+	penalty_bp INTEGER NOT NULL,
+	status TEXT NOT NULL CHECK(status IN ('pending', 'approved', 'rejected', 'active', 'closed')),
+	principal INTEGER NOT NULL DEFAULT 0,
+	penalty INTEGER NOT NULL DEFAULT 0,
+	penalty_through TEXT,
+	manager_id INTEGER REFERENCES managers,
+	reason TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL,
+	reviewed_at INTEGER,
+	disbursed_at INTEGER
+);`
+const loanInstallments = `CREATE TABLE IF NOT EXISTS loan_installment(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	loan_id INTEGER NOT NULL REFERENCES loan,
+	number INTEGER NOT NULL,
+	due_on TEXT NOT NULL,
+	principal INTEGER NOT NULL,
+	interest INTEGER NOT NULL,
+	paid_principal INTEGER NOT NULL DEFAULT 0,
+	paid_interest INTEGER NOT NULL DEFAULT 0,
+	status TEXT NOT NULL DEFAULT 'scheduled' CHECK(status IN ('scheduled', 'paid', 'overdue'))
+);`
+const loanPayments = `CREATE TABLE IF NOT EXISTS loan_payment(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	loan_id INTEGER NOT NULL REFERENCES loan,
+	operation_id INTEGER NOT NULL REFERENCES operation,
+	kind TEXT NOT NULL CHECK(kind IN ('scheduled', 'early')),
+	amount INTEGER NOT NULL,
+	penalty INTEGER NOT NULL,
+	interest INTEGER NOT NULL,
+	principal INTEGER NOT NULL,
+	created_at INTEGER NOT NULL
+);`
+
+const insertLoanProductSQL = `INSERT INTO loan_product(name, rate_bp, schedule, penalty_bp, min_amount, max_amount, min_term, max_term)
+VALUES (:name, :rate_bp, :schedule, :penalty_bp, :min_amount, :max_amount, :min_term, :max_term);`
+const loanProductColumns = `id, name, rate_bp, schedule, penalty_bp, min_amount, max_amount, min_term, max_term`
+const listLoanProductsSQL = `SELECT ` + loanProductColumns + ` FROM loan_product ORDER BY id;`
+const getLoanProductSQL = `SELECT ` + loanProductColumns + ` FROM loan_product WHERE id = ?;`
+const insertLoanSQL = `INSERT INTO loan(client_id, product_id, amount, term, rate_bp, schedule, penalty_bp, status, created_at)
+VALUES (:client_id, :product_id, :amount, :term, :rate_bp, :schedule, :penalty_bp, 'pending', :created_at);`
+const loanColumns = `l.id, l.client_id, l.product_id, l.amount, l.term, l.rate_bp, l.schedule, l.penalty_bp, l.status,
+	l.principal, l.penalty, l.penalty_through, l.manager_id, l.reason, l.created_at, l.reviewed_at, l.disbursed_at`
+const getLoanSQL = `SELECT ` + loanColumns + ` FROM loan l WHERE l.id = ?;`
+const listClientLoansSQL = `SELECT ` + loanColumns + ` FROM loan l WHERE l.client_id = ? ORDER BY l.id;`
+const listDueLoansSQL = `SELECT ` + loanColumns + ` FROM loan l WHERE l.status = 'active' AND EXISTS (
+	SELECT 1 FROM loan_installment i WHERE i.loan_id = l.id AND i.status != 'paid' AND i.due_on <= ?
+) ORDER BY l.id;`
+const reviewLoanSQL = `UPDATE loan SET status = :status, manager_id = :manager_id, reason = :reason, reviewed_at = :reviewed_at
+WHERE id = :id;`
+const disburseLoanSQL = `UPDATE loan SET status = 'active', principal = :principal, penalty_through = :penalty_through,
+	disbursed_at = :disbursed_at
+WHERE id = :id;`
+const updateLoanStateSQL = `UPDATE loan SET status = :status, principal = :principal, penalty = :penalty,
+	penalty_through = :penalty_through
+WHERE id = :id;`
+const insertLoanInstallmentSQL = `INSERT INTO loan_installment(loan_id, number, due_on, principal, interest)
+VALUES (:loan_id, :number, :due_on, :principal, :interest);`
+const loanInstallmentColumns = `id, loan_id, number, due_on, principal, interest, paid_principal, paid_interest, status`
+const listLoanInstallmentsSQL = `SELECT ` + loanInstallmentColumns + ` FROM loan_installment WHERE loan_id = ? ORDER BY number;`
+const listUnpaidLoanInstallmentsSQL = `SELECT ` + loanInstallmentColumns + ` FROM loan_installment
+WHERE loan_id = ? AND status != 'paid' ORDER BY number;`
+const updateLoanInstallmentSQL = `UPDATE loan_installment SET paid_principal = :paid_principal, paid_interest = :paid_interest,
+	status = :status
+WHERE id = :id;`
+const deleteLoanInstallmentSQL = `DELETE FROM loan_installment WHERE id = ?;`
+const insertLoanPaymentSQL = `INSERT INTO loan_payment(loan_id, operation_id, kind, amount, penalty, interest, principal, created_at)
+VALUES (:loan_id, :operation_id, :kind, :amount, :penalty, :interest, :principal, :created_at);`
+const listLoanPaymentsSQL = `SELECT id, loan_id, operation_id, kind, amount, penalty, interest, principal, created_at
+FROM loan_payment WHERE loan_id = ? ORDER BY id;`
+
+const depositProducts = `CREATE TABLE IF NOT EXISTS deposit_product(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	term_months INTEGER NOT NULL CHECK(term_months > 0),
+	rate_bp INTEGER NOT NULL CHECK(rate_bp > 0),
+	early_rate_bp INTEGER NOT NULL CHECK(early_rate_bp >= 0),
+	min_amount INTEGER NOT NULL CHECK(min_amount > 0)
+);`
+const termDeposits = `CREATE TABLE IF NOT EXISTS term_deposit(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	client_id INTEGER NOT NULL REFERENCES client,
+	product_id INTEGER NOT NULL REFERENCES deposit_product,
+	principal INTEGER NOT NULL CHECK(principal > 0),
+	term_months INTEGER NOT NULL,
+	rate_bp INTEGER NOT NULL,
+	early_rate_bp INTEGER NOT NULL,
+	rollover INTEGER NOT NULL DEFAULT 0,
+	status TEXT NOT NULL DEFAULT 'active' CHECK(status IN ('active', 'matured', 'withdrawn')),
+	opened_on TEXT NOT NULL,
+	matures_on TEXT NOT NULL,
+	payout INTEGER NOT NULL DEFAULT 0,
+	closed_at INTEGER
+);`
+
+// clientDepositsSQL - сумма действующих вкладов клиента c для списков и выгрузок
+const clientDepositsSQL = `(SELECT COALESCE(SUM(d.principal), 0) FROM term_deposit d WHERE d.client_id = c.id AND d.status = 'active')`
+
+const insertDepositProductSQL = `INSERT INTO deposit_product(name, term_months, rate_bp, early_rate_bp, min_amount)
+VALUES (:name, :term_months, :rate_bp, :early_rate_bp, :min_amount);`
+const depositProductColumns = `id, name, term_months, rate_bp, early_rate_bp, min_amount`
+const listDepositProductsSQL = `SELECT ` + depositProductColumns + ` FROM deposit_product ORDER BY id;`
+const getDepositProductSQL = `SELECT ` + depositProductColumns + ` FROM deposit_product WHERE id = ?;`
+const insertDepositSQL = `INSERT INTO term_deposit(client_id, product_id, principal, term_months, rate_bp, early_rate_bp, rollover,
+	opened_on, matures_on)
+VALUES (:client_id, :product_id, :principal, :term_months, :rate_bp, :early_rate_bp, :rollover, :opened_on, :matures_on);`
+const depositColumns = `id, client_id, product_id, principal, term_months, rate_bp, early_rate_bp, rollover, status,
+	opened_on, matures_on, payout, closed_at`
+const getDepositSQL = `SELECT ` + depositColumns + ` FROM term_deposit WHERE id = ?;`
+const listClientDepositsSQL = `SELECT ` + depositColumns + ` FROM term_deposit WHERE client_id = ? ORDER BY id;`
+const listMaturedDepositsSQL = `SELECT ` + depositColumns + ` FROM term_deposit
+WHERE status = 'active' AND matures_on <= ? ORDER BY id;`
+const rollOverDepositSQL = `UPDATE term_deposit SET principal = :principal, rate_bp = :rate_bp, early_rate_bp = :early_rate_bp,
+	opened_on = :opened_on, matures_on = :matures_on
+WHERE id = :id;`
+const closeDepositSQL = `UPDATE term_deposit SET status = :status, payout = :payout, closed_at = :closed_at WHERE id = :id;`
+
+const overdrafts = `CREATE TABLE IF NOT EXISTS client_overdraft(
+	client_id INTEGER PRIMARY KEY REFERENCES client,
+	credit_limit INTEGER NOT NULL CHECK(credit_limit >= 0),
+	rate_bp INTEGER NOT NULL CHECK(rate_bp >= 0),
+	fee INTEGER NOT NULL CHECK(fee >= 0),
+	interest_through TEXT NOT NULL,
+	accrued_numerator INTEGER NOT NULL DEFAULT 0
+);`
+
+const getOverdraftSQL = `SELECT credit_limit, rate_bp, fee FROM client_overdraft WHERE client_id = ?;`
+const upsertOverdraftSQL = `INSERT INTO client_overdraft(client_id, credit_limit, rate_bp, fee, interest_through)
+VALUES (:client_id, :credit_limit, :rate_bp, :fee, :today)
+ON CONFLICT(client_id) DO UPDATE SET credit_limit = excluded.credit_limit, rate_bp = excluded.rate_bp, fee = excluded.fee;`
+const listDueOverdraftsSQL = `SELECT client_id, rate_bp, interest_through, accrued_numerator FROM client_overdraft
+WHERE interest_through < ? ORDER BY client_id;`
+const updateOverdraftInterestSQL = `UPDATE client_overdraft SET interest_through = :interest_through, accrued_numerator = :numerator
+WHERE client_id = :client_id;`
+
+const feeSchedules = `CREATE TABLE IF NOT EXISTS fee_schedule(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	operation_type TEXT NOT NULL,
+	segment TEXT NOT NULL DEFAULT '',
+	fixed INTEGER NOT NULL CHECK(fixed >= 0),
+	percent_bp INTEGER NOT NULL CHECK(percent_bp >= 0),
+	min_fee INTEGER NOT NULL CHECK(min_fee >= 0),
+	max_fee INTEGER NOT NULL CHECK(max_fee >= 0),
+	free_per_month INTEGER NOT NULL CHECK(free_per_month >= 0),
+	UNIQUE(operation_type, segment)
+);`
+
+const feeTiers = `CREATE TABLE IF NOT EXISTS fee_tier(
+	schedule_id INTEGER NOT NULL REFERENCES fee_schedule,
+	from_amount INTEGER NOT NULL CHECK(from_amount >= 0),
+	fixed INTEGER NOT NULL CHECK(fixed >= 0),
+	percent_bp INTEGER NOT NULL CHECK(percent_bp >= 0),
+	PRIMARY KEY(schedule_id, from_amount)
+);`
+
+const bankAccounts = `CREATE TABLE IF NOT EXISTS bank_account(
+	code TEXT PRIMARY KEY,
+	balance INTEGER NOT NULL DEFAULT 0
+);`
+
+const feePostings = `CREATE TABLE IF NOT EXISTS fee_posting(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	account TEXT NOT NULL REFERENCES bank_account,
+	client_id INTEGER NOT NULL REFERENCES client,
+	operation_type TEXT NOT NULL,
+	operation_id INTEGER NOT NULL REFERENCES operation,
+	fee_operation_id INTEGER NOT NULL REFERENCES operation,
+	amount INTEGER NOT NULL CHECK(amount > 0),
+	created_at INTEGER NOT NULL,
+	refunded_at INTEGER
+);`
+
+const feeScheduleColumns = `id, operation_type, segment, fixed, percent_bp, min_fee, max_fee, free_per_month`
+const upsertFeeScheduleSQL = `INSERT INTO fee_schedule(operation_type, segment, fixed, percent_bp, min_fee, max_fee, free_per_month)
+VALUES (:operation_type, :segment, :fixed, :percent_bp, :min_fee, :max_fee, :free_per_month)
+ON CONFLICT(operation_type, segment) DO UPDATE SET fixed = excluded.fixed, percent_bp = excluded.percent_bp,
+	min_fee = excluded.min_fee, max_fee = excluded.max_fee, free_per_month = excluded.free_per_month;`
+const getFeeScheduleIdSQL = `SELECT id FROM fee_schedule WHERE operation_type = ? AND segment = ?;`
+const deleteFeeScheduleSQL = `DELETE FROM fee_schedule WHERE id = ?;`
+const listFeeSchedulesSQL = `SELECT ` + feeScheduleColumns + ` FROM fee_schedule ORDER BY operation_type, segment;`
+const getClientFeeScheduleSQL = `SELECT ` + feeScheduleColumns + ` FROM fee_schedule
+WHERE operation_type = :operation_type AND segment IN (:segment, '') ORDER BY segment = '' LIMIT 1;`
+const deleteFeeTiersSQL = `DELETE FROM fee_tier WHERE schedule_id = ?;`
+const insertFeeTierSQL = `INSERT INTO fee_tier(schedule_id, from_amount, fixed, percent_bp)
+VALUES (:schedule_id, :from_amount, :fixed, :percent_bp);`
+const listFeeTiersSQL = `SELECT from_amount, fixed, percent_bp FROM fee_tier WHERE schedule_id = ? ORDER BY from_amount;`
+const countMonthOperationsSQL = `SELECT count(*) FROM operation o
+WHERE o.client_id = :client_id AND o.type = :type AND o.created_at >= :from AND o.created_at < :to AND o.reversal_of IS NULL
+	AND NOT EXISTS (SELECT 1 FROM operation r WHERE r.reversal_of = o.id);`
+const getClientSegmentSQL = `SELECT segment FROM client WHERE id = ?;`
+const updateClientSegmentSQL = `UPDATE client SET segment = :segment WHERE id = :id;`
+const postBankAccountSQL = `INSERT INTO bank_account(code, balance) VALUES (:code, :amount)
+ON CONFLICT(code) DO UPDATE SET balance = balance + excluded.balance;`
+const getBankAccountBalanceSQL = `SELECT balance FROM bank_account WHERE code = ?;`
+const insertFeePostingSQL = `INSERT INTO fee_posting(account, client_id, operation_type, operation_id, fee_operation_id, amount, created_at)
+VALUES (:account, :client_id, :operation_type, :operation_id, :fee_operation_id, :amount, :created_at);`
+const listFeePostingsSQL = `SELECT id, account, client_id, operation_type, operation_id, fee_operation_id, amount, created_at
+FROM fee_posting WHERE created_at >= ? AND created_at < ? ORDER BY id;`
+
+const branches = `CREATE TABLE IF NOT EXISTS branch(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	address TEXT NOT NULL DEFAULT ''
+);`
+
+// подразделения, которые раньше хранились строкой managers.unit
+const branchesInitialData = `INSERT INTO branch(id, name)
+VALUES (1, 'boys'),
+       (2, 'girls')
+       ON CONFLICT DO NOTHING;`
+
+// миграция баз, созданных до подразделений: branch_id добавляется в конец таблиц,
+// подразделение менеджера переносится из прежней строки managers.unit
+const columnExistsSQL = `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?;`
+const addManagersBranchIdSQL = `ALTER TABLE managers ADD COLUMN branch_id INTEGER REFERENCES branch;`
+const addClientBranchIdSQL = `ALTER TABLE client ADD COLUMN branch_id INTEGER REFERENCES branch;`
+const addAtmBranchIdSQL = `ALTER TABLE atm ADD COLUMN branch_id INTEGER REFERENCES branch;`
+const insertUnitBranchesSQL = `INSERT INTO branch(name)
+SELECT DISTINCT unit FROM managers WHERE TRIM(COALESCE(unit, '')) <> '' ORDER BY unit
+ON CONFLICT DO NOTHING;`
+const backfillManagersBranchSQL = `UPDATE managers SET branch_id = (SELECT b.id FROM branch b WHERE b.name = managers.unit)
+WHERE branch_id IS NULL;`
+
+const insertBranchSQL = `INSERT INTO branch(name, address) VALUES (:name, :address);`
+const listBranchesSQL = `SELECT id, name, address FROM branch ORDER BY id;`
+const getBranchIdSQL = `SELECT id FROM branch WHERE id = ?;`
+const getManagerBranchSQL = `SELECT COALESCE(branch_id, 0) FROM managers WHERE id = ?;`
+const getClientBranchSQL = `SELECT COALESCE(branch_id, 0) FROM client WHERE id = ?;`
+const getAtmBranchSQL = `SELECT COALESCE(branch_id, 0) FROM atm WHERE id = ?;`
+const updateManagerBranchSQL = `UPDATE managers SET branch_id = :branch_id WHERE id = :id;`
+const updateClientBranchSQL = `UPDATE client SET branch_id = :branch_id WHERE id = :id;`
+const updateAtmBranchSQL = `UPDATE atm SET branch_id = :branch_id WHERE id = :id;`
+
+// branchReportSQL - показатели по подразделениям; строка с id 0 - клиенты, банкоматы
+// и менеджеры без подразделения, видна только головному офису
+const branchReportSQL = `SELECT COALESCE(b.id, 0), b.name,
+	(SELECT count(*) FROM managers m WHERE m.branch_id IS b.id),
+	(SELECT count(*) FROM client c WHERE c.branch_id IS b.id),
+	(SELECT COALESCE(SUM(c.balance), 0) FROM client c WHERE c.branch_id IS b.id),
+	(SELECT COALESCE(SUM(d.principal), 0) FROM term_deposit d JOIN client c ON c.id = d.client_id
+		WHERE c.branch_id IS b.id AND d.status = 'active'),
+	(SELECT count(*) FROM atm a WHERE a.branch_id IS b.id),
+	(SELECT COALESCE(SUM(k.denomination * k.count), 0) FROM atm_cassette k JOIN atm a ON a.id = k.atm_id
+		WHERE a.branch_id IS b.id)
+FROM (SELECT id, name FROM branch UNION ALL SELECT NULL, '') b
+WHERE :branch_id = 0 OR b.id = :branch_id
+ORDER BY b.id IS NULL, b.id;`
+const refundFeeRevenueSQL = `UPDATE bank_account SET balance = balance - COALESCE((SELECT SUM(amount) FROM fee_posting
+	WHERE fee_operation_id = :fee_operation_id AND refunded_at IS NULL), 0)
+WHERE code = 'fee_revenue';`
+const markFeesRefundedSQL = `UPDATE fee_posting SET refunded_at = :refunded_at
+WHERE fee_operation_id = :fee_operation_id AND refunded_at IS NULL;`
+const listUnrefundedFeeOperationsSQL = `SELECT DISTINCT fee_operation_id FROM fee_posting
+WHERE operation_id = ? AND fee_operation_id <> operation_id AND refunded_at IS NULL ORDER BY fee_operation_id;`
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"database/sql"
+	"time"
+)
+
+// StatementEntry - строка выписки клиента. Change - изменение его баланса:
+// плюс - зачисление, минус - списание. ReversedBy - id сторно, если операция отменена.
+type StatementEntry struct {
+	Operation
+	Change     int64
+	ReversedBy int64
+}
+
+// GetStatement - выписка клиента за период [from, to) вместе со сторно
+func GetStatement(clientId int64, from time.Time, to time.Time, db *sql.DB) (entries []StatementEntry, err error) {
+	rows, err := db.Query(
+		getStatementSQL,
+		sql.Named("client_id", clientId),
+		sql.Named("from", from.Unix()),
+		sql.Named("to", to.Unix()),
+	)
+	if err != nil {
+		return nil, queryError(getStatementSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			entries, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		entry := StatementEntry{}
+		var originalType string
+		err = scanOperation(rows, &entry.Operation, &originalType, &entry.ReversedBy)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		entry.Change = balanceChange(entry.Operation, originalType, clientId)
+		entries = append(entries, entry)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return entries, nil
+}
+
+// creditOperations - операции, зачисляющие деньги клиенту ClientId; остальные списывают
+var creditOperations = map[string]bool{
+	OperationTopUp:            true,
+	OperationAtmDeposit:       true,
+	OperationInterest:         true,
+	OperationLoanDisbursement: true,
+	OperationDepositPayout:    true,
+}
+
+// balanceChange считает влияние операции на баланс клиента; сторно действует
+// противоположно исходной операции типа originalType
+func balanceChange(operation Operation, originalType string, clientId int64) int64 {
+	var change int64
+	if operation.ClientId == clientId {
+		if creditOperations[originalType] {
+			change += operation.Amount
+		} else {
+			change -= operation.Amount
+		}
+	}
+	if operation.TargetClientId == clientId {
+		change += operation.Amount
+	}
+	if operation.Type == OperationReversal {
+		return -change
+	}
+	return change
+}
@@ -0,0 +1,360 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrInvalidAmount = errors.New("amount must be positive")
+var ErrInsufficientFunds = errors.New("insufficient funds")
+var ErrCardNotOwned = errors.New("card does not belong to client")
+var ErrSameCard = errors.New("source and target card are the same")
+
+// TransferCardToCard переводит amount с карты клиента clientId на любую другую активную карту.
+// Балансы карт и клиентов меняются в одной транзакции.
+func TransferCardToCard(clientId int64, fromCardId int64, toCardId int64, amount int64, db *sql.DB) (Receipt, error) {
+	return TransferCardToCardWithKey("", clientId, fromCardId, toCardId, amount, db)
+}
+
+// TransferCardToCardWithKey - TransferCardToCard с ключом идемпотентности:
+// повтор с тем же ключом возвращает квитанцию первого перевода и деньги не переводит
+func TransferCardToCardWithKey(idempotencyKey string, clientId int64, fromCardId int64, toCardId int64, amount int64, db *sql.DB) (receipt Receipt, err error) {
+	defer func() {
+		err = holdForReview(err, db)
+	}()
+	tx, err := db.Begin()
+	if err != nil {
+		return Receipt{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	request := []int64{clientId, fromCardId, toCardId, amount}
+	err = idempotent(tx, idempotencyKey, clientId, idempotentTransferCard, request, &receipt, func() error {
+		from, err := getCard(tx, fromCardId)
+		if err != nil {
+			return err
+		}
+		to, err := getCard(tx, toCardId)
+		if err != nil {
+			return err
+		}
+		err = screenFraud(tx, fraudRequest{
+			Operation:  idempotentTransferCard,
+			ClientId:   clientId,
+			Amount:     amount,
+			Recipient:  cardRecipient(to),
+			FromCardId: fromCardId,
+			ToCardId:   toCardId,
+		})
+		if err != nil {
+			return err
+		}
+		receipt, err = transferCardToCard(tx, clientId, from, to, amount)
+		return err
+	})
+	if err != nil {
+		return Receipt{}, err
+	}
+	return receipt, nil
+}
+
+// TransferCardToCardByPAN - то же, что TransferCardToCard, но карты задаются номерами
+func TransferCardToCardByPAN(clientId int64, fromPAN string, toPAN string, amount int64, db *sql.DB) (Receipt, error) {
+	return TransferCardToCardByPANWithKey("", clientId, fromPAN, toPAN, amount, db)
+}
+
+func TransferCardToCardByPANWithKey(idempotencyKey string, clientId int64, fromPAN string, toPAN string, amount int64, db *sql.DB) (receipt Receipt, err error) {
+	defer func() {
+		err = holdForReview(err, db)
+	}()
+	tx, err := db.Begin()
+	if err != nil {
+		return Receipt{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	request := []interface{}{clientId, fromPAN, toPAN, amount}
+	err = idempotent(tx, idempotencyKey, clientId, idempotentTransferCardByPAN, request, &receipt, func() error {
+		from, err := getCardByPAN(tx, fromPAN)
+		if err != nil {
+			return err
+		}
+		to, err := getCardByPAN(tx, toPAN)
+		if err != nil {
+			return err
+		}
+		err = screenFraud(tx, fraudRequest{
+			Operation: idempotentTransferCardByPAN,
+			ClientId:  clientId,
+			Amount:    amount,
+			Recipient: cardRecipient(to),
+			FromPAN:   fromPAN,
+			ToPAN:     toPAN,
+		})
+		if err != nil {
+			return err
+		}
+		receipt, err = transferCardToCard(tx, clientId, from, to, amount)
+		return err
+	})
+	if err != nil {
+		return Receipt{}, err
+	}
+	return receipt, nil
+}
+
+func transferCardToCard(tx *sql.Tx, clientId int64, from Card, to Card, amount int64) (Receipt, error) {
+	if amount <= 0 {
+		return Receipt{}, ErrInvalidAmount
+	}
+	if from.Id == to.Id {
+		return Receipt{}, ErrSameCard
+	}
+	if from.UserId != clientId {
+		return Receipt{}, ErrCardNotOwned
+	}
+	now := timeNow()
+	err := checkCardActive(from, now)
+	if err != nil {
+		return Receipt{}, err
+	}
+	err = checkCardActive(to, now)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	err = checkClientActive(tx, from.UserId)
+	if err != nil {
+		return Receipt{}, err
+	}
+	err = checkClientActive(tx, to.UserId)
+	if err != nil {
+		return Receipt{}, err
+	}
+	err = checkTransferKyc(tx, from.UserId, amount)
+	if err != nil {
+		return Receipt{}, err
+	}
+	err = checkSpendingLimits(tx, from.UserId, from.Id, OperationTransfer, amount, now)
+	if err != nil {
+		return Receipt{}, err
+	}
+	payerBefore, err := getClientBalance(tx, from.UserId)
+	if err != nil {
+		return Receipt{}, err
+	}
+	payeeBefore, err := getClientBalance(tx, to.UserId)
+	if err != nil {
+		return Receipt{}, err
+	}
+	overdraftFeeId, err := allowCardDebit(tx, from, amount)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	err = moveCardBalance(tx, from, -amount)
+	if err != nil {
+		return Receipt{}, err
+	}
+	err = moveCardBalance(tx, to, amount)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	operationId, err := insertOperation(tx, Operation{
+		Type:           OperationTransfer,
+		ClientId:       from.UserId,
+		CardId:         from.Id,
+		TargetClientId: to.UserId,
+		TargetCardId:   to.Id,
+		Amount:         amount,
+		CreatedAt:      now,
+	})
+	if err != nil {
+		return Receipt{}, err
+	}
+	err = linkOverdraftFee(tx, overdraftFeeId, OperationTransfer, operationId)
+	if err != nil {
+		return Receipt{}, err
+	}
+	fee, err := applyFee(tx, from.UserId, from.Id, OperationTransfer, operationId, amount, now)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	payer, err := getClientName(tx, from.UserId)
+	if err != nil {
+		return Receipt{}, err
+	}
+	payee, err := getClientName(tx, to.UserId)
+	if err != nil {
+		return Receipt{}, err
+	}
+	balanceAfter := from.Balance - amount - fee
+	receipt := Receipt{
+		Number:       receiptNumber("TR", now, operationId),
+		Kind:         ReceiptTransfer,
+		OperationId:  operationId,
+		CreatedAt:    time.Unix(now.Unix(), 0),
+		Payer:        payer + ", " + from.MaskedPAN(),
+		Payee:        payee + ", " + to.MaskedPAN(),
+		Description:  "card to card transfer",
+		Amount:       amount,
+		Fee:          fee,
+		BalanceAfter: &balanceAfter,
+	}
+	err = insertReceipt(tx, receipt)
+	if err != nil {
+		return Receipt{}, err
+	}
+	err = publishEvent(tx, EventTransferCompleted, AuditEntityClient, from.UserId, TransferCompleted{
+		OperationId:    operationId,
+		ClientId:       from.UserId,
+		TargetClientId: to.UserId,
+		Amount:         amount,
+		ReceiptNumber:  receipt.Number,
+	})
+	if err != nil {
+		return Receipt{}, err
+	}
+	err = auditClientBalance(tx, ClientActor(clientId), AuditTransfer, from.UserId, payerBefore)
+	if err != nil {
+		return Receipt{}, err
+	}
+	if to.UserId != from.UserId {
+		err = auditClientBalance(tx, ClientActor(clientId), AuditTransfer, to.UserId, payeeBefore)
+		if err != nil {
+			return Receipt{}, err
+		}
+	}
+
+	return receipt, nil
+}
+
+// moveCardBalance меняет баланс карты и её владельца на delta
+func moveCardBalance(tx *sql.Tx, card Card, delta int64) error {
+	cardSQL, clientSQL, amount := updateCardBalancePlusSQL, updateClientBalancePlusSQL, delta
+	if delta < 0 {
+		cardSQL, clientSQL, amount = updateCardBalanceMinusSQL, updateClientBalanceMinusByIdSQL, -delta
+	}
+
+	_, err := tx.Exec(
+		cardSQL,
+		sql.Named("id", card.Id),
+		sql.Named("amount", amount),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		clientSQL,
+		sql.Named("id", card.UserId),
+		sql.Named("balance", amount),
+	)
+	if err != nil {
+		return err
+	}
+	return publishBalanceChanged(tx, card.UserId, delta)
+}
+
+// settleClientCards вызывается после списания со счёта клиента в обход карт: остатки карт
+// уменьшаются так, чтобы их сумма не превышала баланс клиента. Сначала списывается
+// с карт с наибольшим остатком, уход в овердрафт ложится на первую из них.
+func settleClientCards(tx *sql.Tx, clientId int64) error {
+	balance, err := getClientBalance(tx, clientId)
+	if err != nil {
+		return err
+	}
+	cards, err := listClientCardBalances(tx, clientId)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, card := range cards {
+		total += card.Balance
+	}
+	shortfall := total - balance
+	if len(cards) == 0 || shortfall <= 0 {
+		return nil
+	}
+
+	take := make([]int64, len(cards))
+	for i, card := range cards {
+		if card.Balance > 0 {
+			take[i] = card.Balance
+			if take[i] > shortfall {
+				take[i] = shortfall
+			}
+			shortfall -= take[i]
+		}
+	}
+	take[0] += shortfall
+	for i, card := range cards {
+		if take[i] == 0 {
+			continue
+		}
+		_, err = tx.Exec(
+			updateCardBalanceMinusSQL,
+			sql.Named("id", card.Id),
+			sql.Named("amount", take[i]),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listClientCardBalances - карты клиента, начиная с наибольшего остатка
+func listClientCardBalances(q queryer, clientId int64) (cards []Card, err error) {
+	rows, err := q.Query(listClientCardBalancesSQL, clientId)
+	if err != nil {
+		return nil, queryError(listClientCardBalancesSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			cards, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		card := Card{UserId: clientId}
+		err = rows.Scan(&card.Id, &card.Balance)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		cards = append(cards, card)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return cards, nil
+}
+
+func getCardByPAN(q queryRower, pan string) (card Card, err error) {
+	err = q.QueryRow(getCardByPANSQL, pan).Scan(
+		&card.Id, &card.Name, &card.PAN, &card.ExpiryMonth, &card.ExpiryYear,
+		&card.Status, &card.Balance, &card.UserId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Card{}, ErrCardNotFound
+		}
+		return Card{}, queryError(getCardByPANSQL, err)
+	}
+	return card, nil
+}
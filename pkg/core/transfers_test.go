@@ -0,0 +1,142 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func clientBalance(t *testing.T, db *sql.DB, clientId int64) int64 {
+	var balance int64
+	err := db.QueryRow(`SELECT balance FROM client WHERE id = ?`, clientId).Scan(&balance)
+	if err != nil {
+		t.Fatalf("can't get client balance: %v", err)
+	}
+	return balance
+}
+
+func issueTestCard(t *testing.T, db *sql.DB, clientId int64, balance int64) IssuedCard {
+	issued, err := IssueCard(clientId, "Alif Mobi", "1234", balance, db)
+	if err != nil {
+		t.Fatalf("can't issue card: %v", err)
+	}
+	return issued
+}
+
+func TestTransferCardToCard_Ok(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	aliCard := issueTestCard(t, db, aliId, 1000)
+	valiCard := issueTestCard(t, db, valiId, 100)
+
+	_, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 300, db)
+	if err != nil {
+		t.Fatalf("can't transfer: %v", err)
+	}
+	_, err = TransferCardToCardByPAN(valiId, valiCard.PAN, aliCard.PAN, 50, db)
+	if err != nil {
+		t.Fatalf("can't transfer by pan: %v", err)
+	}
+
+	from, _ := GetCard(aliCard.Id, db)
+	to, _ := GetCard(valiCard.Id, db)
+	if from.Balance != 750 || to.Balance != 350 {
+		t.Errorf("unexpected card balances: %d, %d", from.Balance, to.Balance)
+	}
+	if balance := clientBalance(t, db, aliId); balance != 750 {
+		t.Errorf("client balance not equal to cards total: %d", balance)
+	}
+	if balance := clientBalance(t, db, valiId); balance != 350 {
+		t.Errorf("client balance not equal to cards total: %d", balance)
+	}
+}
+
+func TestTransferCardToCard_Rejected(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	aliCard := issueTestCard(t, db, aliId, 1000)
+	valiCard := issueTestCard(t, db, valiId, 100)
+
+	if _, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 0, db); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("not ErrInvalidAmount: %v", err)
+	}
+	if _, err := TransferCardToCard(aliId, aliCard.Id, aliCard.Id, 10, db); !errors.Is(err, ErrSameCard) {
+		t.Errorf("not ErrSameCard: %v", err)
+	}
+	if _, err := TransferCardToCard(aliId, valiCard.Id, aliCard.Id, 10, db); !errors.Is(err, ErrCardNotOwned) {
+		t.Errorf("not ErrCardNotOwned: %v", err)
+	}
+	if _, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 1001, db); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("not ErrInsufficientFunds: %v", err)
+	}
+	if _, err := TransferCardToCardByPAN(aliId, aliCard.PAN, "0000", 10, db); !errors.Is(err, ErrCardNotFound) {
+		t.Errorf("not ErrCardNotFound: %v", err)
+	}
+
+	if err := BlockCard(ManagerActor(1), valiCard.Id, db); err != nil {
+		t.Fatalf("can't block card: %v", err)
+	}
+	_, err := TransferCardToCard(aliId, aliCard.Id, valiCard.Id, 10, db)
+	var statusErr *CardStatusError
+	if !errors.As(err, &statusErr) || statusErr.CardId != valiCard.Id {
+		t.Errorf("not CardStatusError for blocked target: %v", err)
+	}
+
+	if balance := clientBalance(t, db, aliId); balance != 1000 {
+		t.Errorf("balance changed by rejected transfers: %d", balance)
+	}
+}
+
+// cardsTotal - сумма остатков карт клиента; не должна превышать баланс клиента
+func cardsTotal(t *testing.T, db *sql.DB, clientId int64) int64 {
+	var total int64
+	err := db.QueryRow(`SELECT COALESCE(SUM(balance), 0) FROM card WHERE user_id = ?`, clientId).Scan(&total)
+	if err != nil {
+		t.Fatalf("can't get cards total: %v", err)
+	}
+	return total
+}
+
+func TestAccountTransfers_KeepCardsWithinClientBalance(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	aliId := addTestClient(t, db, "ali", 921111111, 0, 1001)
+	valiId := addTestClient(t, db, "vali", 922222222, 0, 1002)
+	first := issueTestCard(t, db, aliId, 1000)
+	second := issueTestCard(t, db, aliId, 500)
+	valiCard := issueTestCard(t, db, valiId, 0)
+
+	err := TransactionMinus(Client{PhoneNumber: 921111111, Balance: 1200}, db)
+	if err != nil {
+		t.Fatalf("can't transfer by phone: %v", err)
+	}
+	if total, balance := cardsTotal(t, db, aliId), clientBalance(t, db, aliId); total != 300 || balance != 300 {
+		t.Errorf("cards total %d not within client balance %d", total, balance)
+	}
+	// остаток первой карты ушёл на перевод по телефону
+	if _, err := TransferCardToCard(aliId, first.Id, valiCard.Id, 100, db); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("not ErrInsufficientFunds for spent card: %v", err)
+	}
+	if _, err := TransferCardToCard(aliId, second.Id, valiCard.Id, 100, db); err != nil {
+		t.Fatalf("can't transfer from card: %v", err)
+	}
+
+	err = SetOverdraft(1, Overdraft{ClientId: aliId, Limit: 500}, db)
+	if err != nil {
+		t.Fatalf("can't set overdraft: %v", err)
+	}
+	err = TransactionBalanceNumberMinus(Client{BalanceNumber: 1001, Balance: 400}, db)
+	if err != nil {
+		t.Fatalf("can't transfer by account: %v", err)
+	}
+	if total, balance := cardsTotal(t, db, aliId), clientBalance(t, db, aliId); total != -200 || balance != -200 {
+		t.Errorf("cards total %d not within client balance %d", total, balance)
+	}
+	if _, err := TransferCardToCard(aliId, second.Id, valiCard.Id, 400, db); !errors.Is(err, ErrOverdraftExceeded) {
+		t.Errorf("card spent beyond client overdraft: %v", err)
+	}
+}
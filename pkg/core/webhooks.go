@@ -0,0 +1,447 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookDead      = "dead"
+)
+
+// заголовки запроса вебхука; подпись - "sha256=" + hex HMAC-SHA256 от "<timestamp>.<тело>"
+const (
+	WebhookIdHeader        = "X-Webhook-Id"
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+const minWebhookSecretLength = 16
+const defaultWebhookBatchSize = 100
+const defaultWebhookMaxAttempts = 8
+const defaultWebhookRetryBackoff = time.Minute
+const defaultWebhookMaxBackoff = 6 * time.Hour
+const defaultWebhookTimeout = 10 * time.Second
+
+var ErrInvalidWebhookUrl = errors.New("invalid webhook url")
+var ErrWebhookSecretTooShort = errors.New("webhook secret too short")
+var ErrUnknownEventType = errors.New("unknown event type")
+var ErrWebhookNotFound = errors.New("webhook subscription not found")
+var ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+
+// webhookEventTypes - события, которые отправляются партнёрам
+var webhookEventTypes = []string{EventBalanceChanged, EventServicePaid, EventTransferCompleted, EventTopUpCompleted}
+
+// WebhookSubscription - подписка партнёра; секрет после создания не выдаётся
+type WebhookSubscription struct {
+	Id         int64
+	Url        string
+	EventTypes []string
+	Active     bool
+	CreatedAt  time.Time
+}
+
+func (receiver WebhookSubscription) accepts(eventType string) bool {
+	for _, subscribed := range receiver.EventTypes {
+		if subscribed == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery - отправка одного события одной подписке. После MaxAttempts
+// неудачных попыток попадает в dead-letter (Status = WebhookDead), см. ReplayWebhookDelivery.
+type WebhookDelivery struct {
+	Id             int64
+	SubscriptionId int64
+	EventId        int64
+	EventType      string
+	Body           string
+	Status         string
+	Attempts       int
+	LastError      string
+	LastStatusCode int
+	NextAttemptAt  time.Time
+	CreatedAt      time.Time
+	DeliveredAt    time.Time
+}
+
+type webhookPayload struct {
+	Id        int64           `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt int64           `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// AddWebhookSubscription подписывает url на события eventTypes (пустой список - все
+// события вебхуков); secret нужен партнёру для проверки подписи
+func AddWebhookSubscription(webhookUrl string, eventTypes []string, secret string, db *sql.DB) (int64, error) {
+	parsed, err := url.Parse(webhookUrl)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return 0, ErrInvalidWebhookUrl
+	}
+	if len(secret) < minWebhookSecretLength {
+		return 0, ErrWebhookSecretTooShort
+	}
+	if len(eventTypes) == 0 {
+		eventTypes = webhookEventTypes
+	}
+	for _, eventType := range eventTypes {
+		if !(WebhookSubscription{EventTypes: webhookEventTypes}).accepts(eventType) {
+			return 0, fmt.Errorf("%w: %s", ErrUnknownEventType, eventType)
+		}
+	}
+
+	result, err := db.Exec(
+		insertWebhookSubscriptionSQL,
+		sql.Named("url", webhookUrl),
+		sql.Named("event_types", strings.Join(eventTypes, ",")),
+		sql.Named("secret", secret),
+		sql.Named("created_at", timeNow().Unix()),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// DisableWebhookSubscription отключает подписку: новые события не ставятся в очередь,
+// недоставленные не отправляются
+func DisableWebhookSubscription(subscriptionId int64, db *sql.DB) error {
+	result, err := db.Exec(disableWebhookSubscriptionSQL, subscriptionId)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func ListWebhookSubscriptions(db *sql.DB) ([]WebhookSubscription, error) {
+	return listWebhookSubscriptions(db, listWebhookSubscriptionsSQL)
+}
+
+// WebhookEventHandler - подписчик EventDispatcher, который ставит событие в очередь
+// отправки каждой активной подписке. Повторная доставка события дублей не создаёт.
+func WebhookEventHandler(db *sql.DB) EventHandler {
+	return func(event Event) error {
+		subscriptions, err := listWebhookSubscriptions(db, listActiveWebhookSubscriptionsSQL)
+		if err != nil {
+			return err
+		}
+		body, err := json.Marshal(webhookPayload{
+			Id:        event.Id,
+			Type:      event.Type,
+			CreatedAt: event.CreatedAt.Unix(),
+			Data:      json.RawMessage(event.Payload),
+		})
+		if err != nil {
+			return err
+		}
+
+		now := timeNow().Unix()
+		for _, subscription := range subscriptions {
+			if !subscription.accepts(event.Type) {
+				continue
+			}
+			_, err = db.Exec(
+				insertWebhookDeliverySQL,
+				sql.Named("subscription_id", subscription.Id),
+				sql.Named("event_id", event.Id),
+				sql.Named("event_type", event.Type),
+				sql.Named("body", string(body)),
+				sql.Named("created_at", now),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// WebhookWorker отправляет вебхуки POST-запросом с подписью. Ответ 2xx - доставлено,
+// иначе повтор через RetryBackoff, 2*RetryBackoff ... (не больше MaxBackoff);
+// после MaxAttempts попыток доставка уходит в dead-letter.
+type WebhookWorker struct {
+	db           *sql.DB
+	clock        Clock
+	client       *http.Client
+	BatchSize    int
+	MaxAttempts  int
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+}
+
+// NewWebhookWorker создаёт отправщик; client nil - http.Client с таймаутом 10 секунд
+func NewWebhookWorker(db *sql.DB, clock Clock, client *http.Client) *WebhookWorker {
+	if client == nil {
+		client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	return &WebhookWorker{
+		db:           db,
+		clock:        clock,
+		client:       client,
+		BatchSize:    defaultWebhookBatchSize,
+		MaxAttempts:  defaultWebhookMaxAttempts,
+		RetryBackoff: defaultWebhookRetryBackoff,
+		MaxBackoff:   defaultWebhookMaxBackoff,
+	}
+}
+
+// DeliverDue отправляет все доставки, срок которых наступил, и возвращает их с результатом попытки
+func (receiver *WebhookWorker) DeliverDue() (attempted []WebhookDelivery, err error) {
+	now := receiver.clock.Now()
+	for {
+		jobs, err := listWebhookJobs(receiver.db, now, receiver.BatchSize)
+		if err != nil {
+			return attempted, err
+		}
+		if len(jobs) == 0 {
+			return attempted, nil
+		}
+		for _, job := range jobs {
+			delivery, err := receiver.deliver(job, now)
+			if err != nil {
+				return attempted, err
+			}
+			attempted = append(attempted, delivery)
+		}
+	}
+}
+
+type webhookJob struct {
+	WebhookDelivery
+	url    string
+	secret string
+}
+
+func (receiver *WebhookWorker) deliver(job webhookJob, now time.Time) (WebhookDelivery, error) {
+	delivery := job.WebhookDelivery
+	delivery.Attempts++
+	delivery.LastStatusCode, delivery.LastError = receiver.post(job, now)
+
+	if delivery.LastError == "" {
+		delivery.Status = WebhookDelivered
+		delivery.DeliveredAt = now
+	} else if delivery.Attempts >= receiver.MaxAttempts {
+		delivery.Status = WebhookDead
+	} else {
+		delivery.NextAttemptAt = now.Add(exponentialBackoff(receiver.RetryBackoff, receiver.MaxBackoff, delivery.Attempts))
+	}
+
+	_, err := receiver.db.Exec(
+		updateWebhookDeliverySQL,
+		sql.Named("id", delivery.Id),
+		sql.Named("status", delivery.Status),
+		sql.Named("attempts", delivery.Attempts),
+		sql.Named("next_attempt_at", delivery.NextAttemptAt.Unix()),
+		sql.Named("last_error", delivery.LastError),
+		sql.Named("last_status", delivery.LastStatusCode),
+		sql.Named("delivered_at", nullableUnix(delivery.DeliveredAt)),
+	)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	return delivery, nil
+}
+
+// post отправляет запрос и возвращает код ответа и ошибку попытки (пустая - доставлено)
+func (receiver *WebhookWorker) post(job webhookJob, now time.Time) (int, string) {
+	body := []byte(job.Body)
+	request, err := http.NewRequest(http.MethodPost, job.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	timestamp := now.Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookIdHeader, strconv.FormatInt(job.EventId, 10))
+	request.Header.Set(WebhookEventHeader, job.EventType)
+	request.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(WebhookSignatureHeader, SignWebhookPayload(job.secret, timestamp, body))
+
+	response, err := receiver.client.Do(request)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Sprintf("unexpected status %d", response.StatusCode)
+	}
+	return response.StatusCode, ""
+}
+
+// SignWebhookPayload - значение заголовка X-Webhook-Signature для тела body
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%d.", timestamp)
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature проверяет подпись на стороне получателя
+func VerifyWebhookSignature(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhookPayload(secret, timestamp, body)), []byte(signature))
+}
+
+// ListDeadWebhookDeliveries - dead-letter: доставки, исчерпавшие попытки
+func ListDeadWebhookDeliveries(db *sql.DB) ([]WebhookDelivery, error) {
+	return listWebhookDeliveries(db, listWebhookDeliveriesByStatusSQL, WebhookDead)
+}
+
+func ListWebhookDeliveries(subscriptionId int64, db *sql.DB) ([]WebhookDelivery, error) {
+	return listWebhookDeliveries(db, listWebhookDeliveriesSQL, subscriptionId)
+}
+
+// ReplayWebhookDelivery ставит доставку из dead-letter (или уже доставленную) в очередь
+// заново со сброшенным счётчиком попыток
+func ReplayWebhookDelivery(deliveryId int64, db *sql.DB) error {
+	result, err := db.Exec(replayWebhookDeliverySQL, sql.Named("id", deliveryId), sql.Named("now", timeNow().Unix()))
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrWebhookDeliveryNotFound
+	}
+	return nil
+}
+
+// ReplayDeadWebhookDeliveries заново ставит в очередь весь dead-letter подписки и возвращает число доставок
+func ReplayDeadWebhookDeliveries(subscriptionId int64, db *sql.DB) (int64, error) {
+	result, err := db.Exec(
+		replayDeadWebhookDeliveriesSQL,
+		sql.Named("subscription_id", subscriptionId),
+		sql.Named("now", timeNow().Unix()),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func listWebhookSubscriptions(db *sql.DB, query string) (subscriptions []WebhookSubscription, err error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, queryError(query, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			subscriptions, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		subscription := WebhookSubscription{}
+		var eventTypes string
+		var createdAt int64
+		err = rows.Scan(&subscription.Id, &subscription.Url, &eventTypes, &subscription.Active, &createdAt)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		subscription.EventTypes = strings.Split(eventTypes, ",")
+		subscription.CreatedAt = time.Unix(createdAt, 0)
+		subscriptions = append(subscriptions, subscription)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return subscriptions, nil
+}
+
+func listWebhookJobs(db *sql.DB, now time.Time, limit int) (jobs []webhookJob, err error) {
+	rows, err := db.Query(listDueWebhookDeliveriesSQL, sql.Named("now", now.Unix()), sql.Named("limit", limit))
+	if err != nil {
+		return nil, queryError(listDueWebhookDeliveriesSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			jobs, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		job := webhookJob{}
+		job.WebhookDelivery, err = scanWebhookDelivery(rows, &job.url, &job.secret)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		jobs = append(jobs, job)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return jobs, nil
+}
+
+func listWebhookDeliveries(db *sql.DB, query string, arg interface{}) (deliveries []WebhookDelivery, err error) {
+	rows, err := db.Query(query, arg)
+	if err != nil {
+		return nil, queryError(query, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			deliveries, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+
+	return deliveries, nil
+}
+
+func scanWebhookDelivery(row scanner, extra ...interface{}) (delivery WebhookDelivery, err error) {
+	var nextAttemptAt, createdAt int64
+	var deliveredAt sql.NullInt64
+	dest := []interface{}{&delivery.Id, &delivery.SubscriptionId, &delivery.EventId, &delivery.EventType,
+		&delivery.Body, &delivery.Status, &delivery.Attempts, &delivery.LastError, &delivery.LastStatusCode,
+		&nextAttemptAt, &createdAt, &deliveredAt}
+	err = row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	delivery.NextAttemptAt = time.Unix(nextAttemptAt, 0)
+	delivery.CreatedAt = time.Unix(createdAt, 0)
+	if deliveredAt.Valid {
+		delivery.DeliveredAt = time.Unix(deliveredAt.Int64, 0)
+	}
+	return delivery, nil
+}
@@ -0,0 +1,195 @@
+package core
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testWebhookSecret = "0123456789abcdef"
+
+// dispatchTestWebhooks ставит в очередь вебхуков все события из outbox
+func dispatchTestWebhooks(t *testing.T, db *sql.DB) {
+	dispatcher := NewEventDispatcher(db, SystemClock{})
+	dispatcher.Subscribe("webhooks", WebhookEventHandler(db), webhookEventTypes...)
+	_, err := dispatcher.Dispatch()
+	if err != nil {
+		t.Fatalf("can't dispatch events: %v", err)
+	}
+}
+
+func TestAddWebhookSubscription_Validation(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+
+	if _, err := AddWebhookSubscription("ftp://partner.tj/hook", nil, testWebhookSecret, db); !errors.Is(err, ErrInvalidWebhookUrl) {
+		t.Errorf("not ErrInvalidWebhookUrl: %v", err)
+	}
+	if _, err := AddWebhookSubscription("https://partner.tj/hook", nil, "secret", db); !errors.Is(err, ErrWebhookSecretTooShort) {
+		t.Errorf("not ErrWebhookSecretTooShort: %v", err)
+	}
+	_, err := AddWebhookSubscription("https://partner.tj/hook", []string{EventAtmAdded}, testWebhookSecret, db)
+	if !errors.Is(err, ErrUnknownEventType) {
+		t.Errorf("not ErrUnknownEventType: %v", err)
+	}
+
+	id, err := AddWebhookSubscription("https://partner.tj/hook", nil, testWebhookSecret, db)
+	if err != nil {
+		t.Fatalf("can't add subscription: %v", err)
+	}
+	err = DisableWebhookSubscription(id, db)
+	if err != nil {
+		t.Fatalf("can't disable subscription: %v", err)
+	}
+	subscriptions, err := ListWebhookSubscriptions(db)
+	if err != nil {
+		t.Fatalf("can't list subscriptions: %v", err)
+	}
+	if len(subscriptions) != 1 || subscriptions[0].Active || len(subscriptions[0].EventTypes) != len(webhookEventTypes) {
+		t.Errorf("unexpected subscriptions: %+v", subscriptions)
+	}
+	if err := DisableWebhookSubscription(id+1, db); !errors.Is(err, ErrWebhookNotFound) {
+		t.Errorf("not ErrWebhookNotFound: %v", err)
+	}
+}
+
+func TestWebhookWorker_SignedDeliveryWithRetry(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	clientId := addTestClient(t, db, "ali", 921111111, 100, 1001)
+
+	failures := 1
+	var received webhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if failures > 0 {
+			failures--
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(request.Body)
+		timestamp, _ := strconv.ParseInt(request.Header.Get(WebhookTimestampHeader), 10, 64)
+		if !VerifyWebhookSignature(testWebhookSecret, timestamp, body, request.Header.Get(WebhookSignatureHeader)) {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.Unmarshal(body, &received)
+	}))
+	defer server.Close()
+
+	_, err := AddWebhookSubscription(server.URL, []string{EventBalanceChanged}, testWebhookSecret, db)
+	if err != nil {
+		t.Fatalf("can't add subscription: %v", err)
+	}
+	err = TransactionPlus(921111111, 50, db)
+	if err != nil {
+		t.Fatalf("can't top up: %v", err)
+	}
+	dispatchTestWebhooks(t, db)
+
+	// повторная доставка события из outbox не создаёт второй вебхук
+	events, _ := listEvents(db, `SELECT `+outboxEventColumns+` WHERE type = 'balance_changed';`)
+	if len(events) != 1 {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	err = WebhookEventHandler(db)(events[0])
+	if err != nil {
+		t.Fatalf("can't enqueue webhook: %v", err)
+	}
+
+	clock := &testClock{now: time.Now()}
+	worker := NewWebhookWorker(db, clock, server.Client())
+	attempted, err := worker.DeliverDue()
+	if err != nil {
+		t.Fatalf("can't deliver webhooks: %v", err)
+	}
+	if len(attempted) != 1 || attempted[0].Status != WebhookPending || attempted[0].LastStatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected first attempt: %+v", attempted)
+	}
+	attempted, _ = worker.DeliverDue()
+	if len(attempted) != 0 {
+		t.Errorf("retried before backoff: %+v", attempted)
+	}
+
+	clock.now = clock.now.Add(worker.RetryBackoff)
+	attempted, err = worker.DeliverDue()
+	if err != nil {
+		t.Fatalf("can't deliver webhooks: %v", err)
+	}
+	if len(attempted) != 1 || attempted[0].Status != WebhookDelivered || attempted[0].Attempts != 2 {
+		t.Errorf("unexpected retry: %+v", attempted)
+	}
+	changed := BalanceChanged{}
+	_ = json.Unmarshal(received.Data, &changed)
+	if received.Type != EventBalanceChanged || received.Id != events[0].Id || changed.ClientId != clientId || changed.After != 150 {
+		t.Errorf("unexpected payload: %+v %+v", received, changed)
+	}
+}
+
+func TestWebhookWorker_DeadLetterAndReplay(t *testing.T) {
+	db := openTestDb(t)
+	defer closeTestDb(t, db)
+	_ = addTestClient(t, db, "ali", 921111111, 100, 1001)
+
+	down := true
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if down {
+			writer.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	subscriptionId, err := AddWebhookSubscription(server.URL, []string{EventBalanceChanged}, testWebhookSecret, db)
+	if err != nil {
+		t.Fatalf("can't add subscription: %v", err)
+	}
+	err = TransactionPlus(921111111, 50, db)
+	if err != nil {
+		t.Fatalf("can't top up: %v", err)
+	}
+	dispatchTestWebhooks(t, db)
+
+	clock := &testClock{now: time.Now()}
+	worker := NewWebhookWorker(db, clock, server.Client())
+	worker.MaxAttempts = 2
+	for attempt := 0; attempt < worker.MaxAttempts; attempt++ {
+		_, err = worker.DeliverDue()
+		if err != nil {
+			t.Fatalf("can't deliver webhooks: %v", err)
+		}
+		clock.now = clock.now.Add(worker.MaxBackoff)
+	}
+
+	dead, err := ListDeadWebhookDeliveries(db)
+	if err != nil {
+		t.Fatalf("can't list dead letters: %v", err)
+	}
+	if len(dead) != 1 || dead[0].Attempts != 2 || dead[0].LastError != "unexpected status 500" {
+		t.Fatalf("unexpected dead letters: %+v", dead)
+	}
+	attempted, _ := worker.DeliverDue()
+	if len(attempted) != 0 {
+		t.Errorf("dead letter retried: %+v", attempted)
+	}
+
+	down = false
+	replayed, err := ReplayDeadWebhookDeliveries(subscriptionId, db)
+	if err != nil || replayed != 1 {
+		t.Fatalf("can't replay dead letters: %d %v", replayed, err)
+	}
+	if err := ReplayWebhookDelivery(dead[0].Id, db); !errors.Is(err, ErrWebhookDeliveryNotFound) {
+		t.Errorf("pending delivery replayed: %v", err)
+	}
+	attempted, err = worker.DeliverDue()
+	if err != nil {
+		t.Fatalf("can't deliver webhooks: %v", err)
+	}
+	if len(attempted) != 1 || attempted[0].Status != WebhookDelivered || attempted[0].Attempts != 1 {
+		t.Errorf("unexpected replay: %+v", attempted)
+	}
+}